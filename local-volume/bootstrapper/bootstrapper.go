@@ -73,10 +73,11 @@ func setupClient() *kubernetes.Clientset {
 }
 
 // generateMountName generates a volumeMount.name for pod spec, based on volume configuration.
+// Only the roots of glob dirs are mounted, so classes with the same roots share the name.
 func generateMountName(mount *common.MountConfig) string {
 	h := fnv.New32a()
-	h.Write([]byte(mount.HostDir))
-	h.Write([]byte(mount.MountDir))
+	h.Write([]byte(mount.HostRoot()))
+	h.Write([]byte(mount.MountRoot()))
 	return fmt.Sprintf("mount-%x", h.Sum32())
 }
 
@@ -84,8 +85,11 @@ func generateMountName(mount *common.MountConfig) string {
 // and change "/" to "~" (based on kubernetes convention), then concatenate with root path, e.g,
 // if mountRoot == /mnt/local-storage, then:
 //   "/mnt/ssds" -> "/mnt/local-storage/mnt~ssds"
+// The glob elements of the host dir are kept as is:
+//   "/mnt/ssd-*" -> "/mnt/local-storage/mnt/ssd-*"
 func generateMountDir(mount *common.MountConfig) string {
-	return path.Join(*mountRoot, strings.Replace(strings.TrimPrefix(mount.HostDir, "/"), "/", "~", -1))
+	hostRoot, pattern := common.SplitGlob(mount.HostDir)
+	return path.Join(*mountRoot, strings.Replace(strings.TrimPrefix(hostRoot, "/"), "/", "~", -1), pattern)
 }
 
 // ensureVolumeConfig reads volume configurations from given configmap, and create a default one
@@ -235,19 +239,24 @@ func createClusterRoleBinding(client *kubernetes.Clientset, namespace string) er
 func createDaemonSet(client *kubernetes.Clientset, namespace string, config map[string]common.MountConfig) error {
 	volumes := []v1.Volume{}
 	volumeMounts := []v1.VolumeMount{}
+	mounted := map[string]bool{}
 	for _, mount := range config {
 		name := generateMountName(&mount)
+		if mounted[name] {
+			continue
+		}
+		mounted[name] = true
 		volumes = append(volumes, v1.Volume{
 			Name: name,
 			VolumeSource: v1.VolumeSource{
 				HostPath: &v1.HostPathVolumeSource{
-					Path: mount.HostDir,
+					Path: mount.HostRoot(),
 				},
 			},
 		})
 		volumeMounts = append(volumeMounts, v1.VolumeMount{
 			Name:      name,
-			MountPath: mount.MountDir,
+			MountPath: mount.MountRoot(),
 		})
 	}
 
@@ -17,12 +17,19 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/controller"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -30,6 +37,54 @@ import (
 	"k8s.io/client-go/rest"
 )
 
+var (
+	maxDiscoveryConcurrency = flag.Int("max-discovery-concurrency", 0, "Maximum number of storage classes to discover concurrently, 0 means one per storage class")
+	maxVolumeConcurrency    = flag.Int("max-volume-concurrency", 1, "Maximum number of new volumes of a storage class whose capacity is probed and PV created concurrently, and of PVs of missing volumes deleted concurrently")
+	pvNamePrefix            = flag.String("pv-name-prefix", common.DefaultPVNamePrefix, "Prefix of the names of the PVs created by the provisioner")
+	pvNamingStrategy        = flag.String("pv-naming-strategy", string(common.PVNamingHash), "How the PV names are generated from the volume names, \"Hash\" or \"Readable\"")
+	pvNameHashBits          = flag.Int("pv-name-hash-bits", 32, "Size in bits of the hashes in the PV names, 32 or 64. Changing it renames all new PVs")
+	wipeBlockOnDelete       = flag.Bool("wipe-block-on-delete", false, "Overwrite block devices with zeros before deleting their released PVs")
+	blockWipeTimeout        = flag.Duration("block-wipe-timeout", common.DefaultBlockWipeTimeout, "Timeout for wiping a block device")
+	removeEmptyDirsOnDelete = flag.Bool("remove-empty-dirs-on-delete", false, "Remove the empty directories of file volumes after deleting their released PVs")
+	preDeleteHook           = flag.String("pre-delete-hook", "", "Command run with the PV name and host path before a released PV is deleted, a failure keeps the PV")
+	preDeleteHookTimeout    = flag.Duration("pre-delete-hook-timeout", common.DefaultPreDeleteHookTimeout, "Timeout for running the pre-delete hook")
+	cleanupGracePeriod      = flag.Duration("cleanup-grace-period", 0, "Delete the unbound PVs whose volumes have been missing for longer than this, 0 never deletes them")
+	resolveDuplicates       = flag.Bool("resolve-duplicate-host-paths", false, "Delete the unbound PVs whose host path is also the host path of another PV")
+	adoptExisting           = flag.Bool("adopt-existing", false, "Adopt the local PVs of the node that were not created by a provisioner instead of creating PVs for their volumes, can't be used with -scope-pv-informer")
+	healthCheck             = flag.Bool("health-check", false, "Probe that new volumes can be read before creating their PVs, and skip the volumes that fail")
+	healthCheckTimeout      = flag.Duration("health-check-timeout", common.DefaultHealthCheckTimeout, "Timeout for the health probe of a volume")
+	fsOperationTimeout      = flag.Duration("fs-operation-timeout", 0, "Timeout for the filesystem stat and listing calls, the paths that time out are skipped, 0 means no timeout")
+	apiRetryAttempts        = flag.Int("api-retry-attempts", common.DefaultAPIRetryAttempts, "Maximum number of attempts for a failed API call")
+	apiRetryInterval        = flag.Duration("api-retry-interval", common.DefaultAPIRetryInterval, "Initial backoff interval between API call attempts")
+	apiQPS                  = flag.Float64("api-qps", 0, "Maximum rate of PV create and delete API calls, 0 means unlimited")
+	apiBurst                = flag.Int("api-burst", common.DefaultAPIBurst, "Maximum burst of PV create and delete API calls")
+	nodeAffinityLabelKeys   = flag.String("node-affinity-label-keys", common.NodeLabelKey, "Comma separated list of node label keys used for PV node affinity")
+	ignorePatterns          = flag.String("ignore-patterns", common.DefaultIgnorePatterns, "Comma separated list of patterns of directory entries that are not discovered")
+	skipZeroCapacity        = flag.Bool("skip-zero-capacity", true, "Don't create PVs for volumes with zero capacity, they are retried in the next discovery")
+	maxPVsPerNode           = flag.Int("max-pvs-per-node", 0, "Maximum number of PVs of the node, no more PVs are created once reached, 0 means unlimited")
+	pauseOnCordon           = flag.Bool("pause-on-cordon", false, "Don't create PVs while the node is unschedulable or has the cordon taint")
+	cordonTaintKey          = flag.String("cordon-taint-key", "", "Key of a taint that also marks the node as cordoned for -pause-on-cordon")
+	pauseCleanupOnCordon    = flag.Bool("pause-cleanup-on-cordon", false, "With -pause-on-cordon, also don't clean up released PVs while the node is cordoned")
+	dryRun                  = flag.Bool("dry-run", false, "Log the PVs that would be created and deleted without calling the API server")
+	httpAddress             = flag.String("http-address", "", "Address of the HTTP server for /metrics and /healthz, empty disables the server")
+	scopePVInformer         = flag.Bool("scope-pv-informer", false, "Only watch the PVs labeled with the node name instead of all the PVs of the cluster")
+	healthzStaleness        = flag.Duration("healthz-staleness", common.DefaultHealthzStaleness, "Maximum age of the last successful discovery before /healthz reports unhealthy")
+	hostRootfs              = flag.String("host-rootfs", "", "Path where the root fs of the host is mounted, to check at startup that the host dir of each storage class is the host path of its mount dir")
+	nodeAffinityStrict      = flag.Bool("node-affinity-strict", false, "Fail if any of the node affinity label keys is not present on the node")
+	nodeAffinityFirstKey    = flag.Bool("node-affinity-first-key", false, "Only use the first of the node affinity label keys present on the node")
+	nodeAffinityZone        = flag.Bool("node-affinity-zone", false, "Also add the zone label of the node to the PV node affinity, if the node has one")
+	setNodeOwnerRef         = flag.Bool("set-node-owner-ref", false, "Set an owner reference to the node on the created PVs, so that they are deleted with the node")
+	extraAnnotations        = flag.String("extra-annotations", "", "Comma separated list of key=value annotations added to the created PVs")
+	extraLabels             = flag.String("extra-labels", "", "Comma separated list of key=value labels added to the created PVs")
+	lastSeenInterval        = flag.Duration("last-seen-interval", 0, "Minimum interval between updates of the last seen annotation of a PV, 0 disables the annotation")
+	discoveryPeriod         = flag.Duration("discovery-period", common.DefaultDiscoveryPeriod, "Period of the discovery of new volumes and the cleanup of released PVs")
+	discoveryJitterFactor   = flag.Float64("discovery-jitter-factor", common.DefaultDiscoveryJitterFactor, "Maximum fraction of the discovery period that is randomly added to it, negative disables the jitter")
+	reconcilePeriod         = flag.Duration("reconcile-period", 0, "Minimum period between the checks of the existing PVs against their volumes, 0 means every discovery")
+	logFormat               = flag.String("log-format", util.LogFormatText, "Format of the logged volume lifecycle events, \"text\" or \"json\"")
+	eventComponent          = flag.String("event-component", "", "Component of the source of the recorded events, empty means the provisioner name")
+	eventMode               = flag.String("event-mode", string(common.EventModePerVolume), "Which events are recorded, \"per-volume\", \"summary\" or \"none\"")
+)
+
 func setupClient() *kubernetes.Clientset {
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -52,14 +107,113 @@ func main() {
 		glog.Fatalf("MY_NODE_NAME environment variable not set\n")
 	}
 
+	var mux *http.ServeMux
+	if *httpAddress != "" {
+		mux = http.NewServeMux()
+		go serveHTTP(*httpAddress, mux)
+	}
+
 	client := setupClient()
 	node := getNode(client, nodeName)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigCh
+		glog.Infof("Received %v, stopping controller after the cleanups in progress", sig)
+		cancel()
+		sig = <-sigCh
+		glog.Exitf("Received %v again, exiting without waiting for the cleanups", sig)
+	}()
+	rescanner := controller.NewRescanner()
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			rescanner.Trigger("SIGHUP")
+		}
+	}()
+
 	glog.Info("Starting controller\n")
-	controller.StartLocalController(client, &common.UserConfig{
+	controller.StartLocalController(ctx, client, &common.UserConfig{
 		Node:         node,
 		DiscoveryMap: createDiscoveryMap(client),
-	})
+
+		MaxDiscoveryConcurrency:   *maxDiscoveryConcurrency,
+		MaxVolumeConcurrency:      *maxVolumeConcurrency,
+		PVNamePrefix:              *pvNamePrefix,
+		PVNamingStrategy:          common.PVNamingStrategy(*pvNamingStrategy),
+		PVNameHashBits:            *pvNameHashBits,
+		WipeBlockOnDelete:         *wipeBlockOnDelete,
+		BlockWipeTimeout:          *blockWipeTimeout,
+		RemoveEmptyDirsOnDelete:   *removeEmptyDirsOnDelete,
+		PreDeleteHook:             *preDeleteHook,
+		PreDeleteHookTimeout:      *preDeleteHookTimeout,
+		CleanupGracePeriod:        *cleanupGracePeriod,
+		ResolveDuplicateHostPaths: *resolveDuplicates,
+		AdoptExisting:             *adoptExisting,
+		HealthCheck:               *healthCheck,
+		HealthCheckTimeout:        *healthCheckTimeout,
+		FsOperationTimeout:        *fsOperationTimeout,
+		APIRetryAttempts:          *apiRetryAttempts,
+		APIRetryInterval:          *apiRetryInterval,
+		APIQPS:                    *apiQPS,
+		APIBurst:                  *apiBurst,
+		NodeAffinityLabelKeys:     splitList(*nodeAffinityLabelKeys),
+		NodeAffinityStrict:        *nodeAffinityStrict,
+		NodeAffinityFirstKey:      *nodeAffinityFirstKey,
+		NodeAffinityZone:          *nodeAffinityZone,
+		IgnorePatterns:            splitList(*ignorePatterns),
+		DryRun:                    *dryRun,
+		MaxPVsPerNode:             *maxPVsPerNode,
+		SkipZeroCapacity:          *skipZeroCapacity,
+		PauseOnCordon:             *pauseOnCordon,
+		CordonTaintKey:            *cordonTaintKey,
+		PauseCleanupOnCordon:      *pauseCleanupOnCordon,
+		LogFormat:                 *logFormat,
+		EventMode:                 common.EventMode(*eventMode),
+		EventComponent:            *eventComponent,
+		SetNodeOwnerRef:           *setNodeOwnerRef,
+		ExtraAnnotations:          parseKeyValues(*extraAnnotations),
+		ExtraLabels:               parseKeyValues(*extraLabels),
+		LastSeenInterval:          *lastSeenInterval,
+		DiscoveryPeriod:           *discoveryPeriod,
+		DiscoveryJitterFactor:     *discoveryJitterFactor,
+		ReconcilePeriod:           *reconcilePeriod,
+		HealthzStaleness:          *healthzStaleness,
+		HostRootfs:                *hostRootfs,
+		ScopePVInformer:           *scopePVInformer,
+	}, mux, rescanner)
+}
+
+// serveHTTP serves the metrics and the handlers registered later on mux
+func serveHTTP(address string, mux *http.ServeMux) {
+	mux.Handle("/metrics", metrics.Handler())
+	glog.Infof("Serving HTTP on %s", address)
+	glog.Fatalf("HTTP server failed: %v", http.ListenAndServe(address, mux))
+}
+
+// splitList splits a comma separated list, returning an empty list for an empty string
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+// parseKeyValues parses a comma separated list of key=value pairs, e.g. labels
+func parseKeyValues(list string) map[string]string {
+	values := map[string]string{}
+	for _, pair := range splitList(list) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			glog.Fatalf("Invalid pair %q, expected key=value", pair)
+		}
+		values[kv[0]] = kv[1]
+	}
+	return values
 }
 
 func getNode(client *kubernetes.Clientset, name string) *v1.Node {
@@ -17,6 +17,8 @@ limitations under the License.
 package cache
 
 import (
+	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/golang/glog"
@@ -30,11 +32,23 @@ import (
 type VolumeCache struct {
 	mutex sync.Mutex
 	pvs   map[string]*v1.PersistentVolume
+	// Index of the PVs by storage class, key = storage class, value = PVs by name
+	classPVs map[string]map[string]*v1.PersistentVolume
+	// Index of the local PVs by cleaned host path, key = host path, value = PVs by name
+	hostPathPVs map[string]map[string]*v1.PersistentVolume
+	// Local PVs of the node that were not created by a provisioner, which the Discoverer
+	// adopts with AdoptExisting, key = PV name
+	adoptable map[string]*v1.PersistentVolume
 }
 
 // NewVolumeCache creates a new PV cache object for storing PVs created by this provisioner.
 func NewVolumeCache() *VolumeCache {
-	return &VolumeCache{pvs: map[string]*v1.PersistentVolume{}}
+	return &VolumeCache{
+		pvs:         map[string]*v1.PersistentVolume{},
+		classPVs:    map[string]map[string]*v1.PersistentVolume{},
+		hostPathPVs: map[string]map[string]*v1.PersistentVolume{},
+		adoptable:   map[string]*v1.PersistentVolume{},
+	}
 }
 
 // GetPV returns the PV object given the PV name
@@ -51,7 +65,7 @@ func (cache *VolumeCache) AddPV(pv *v1.PersistentVolume) {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
 
-	cache.pvs[pv.Name] = pv
+	cache.setPV(pv)
 	glog.Infof("Added pv %q to cache", pv.Name)
 }
 
@@ -60,7 +74,7 @@ func (cache *VolumeCache) UpdatePV(pv *v1.PersistentVolume) {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
 
-	cache.pvs[pv.Name] = pv
+	cache.setPV(pv)
 	glog.Infof("Updated pv %q to cache", pv.Name)
 }
 
@@ -69,10 +83,117 @@ func (cache *VolumeCache) DeletePV(pvName string) {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
 
-	delete(cache.pvs, pvName)
+	cache.removePV(pvName)
 	glog.Infof("Deleted pv %q from cache", pvName)
 }
 
+// setPV adds or replaces the PV, the caller must hold the mutex
+func (cache *VolumeCache) setPV(pv *v1.PersistentVolume) {
+	cache.removePV(pv.Name)
+	delete(cache.adoptable, pv.Name)
+	cache.pvs[pv.Name] = pv
+	class := pv.Spec.StorageClassName
+	if cache.classPVs[class] == nil {
+		cache.classPVs[class] = map[string]*v1.PersistentVolume{}
+	}
+	cache.classPVs[class][pv.Name] = pv
+	if pv.Spec.Local != nil {
+		path := filepath.Clean(pv.Spec.Local.Path)
+		if cache.hostPathPVs[path] == nil {
+			cache.hostPathPVs[path] = map[string]*v1.PersistentVolume{}
+		}
+		cache.hostPathPVs[path][pv.Name] = pv
+	}
+}
+
+// removePV removes the PV if it exists, the caller must hold the mutex
+func (cache *VolumeCache) removePV(pvName string) {
+	pv, exists := cache.pvs[pvName]
+	if !exists {
+		return
+	}
+	delete(cache.pvs, pvName)
+	class := pv.Spec.StorageClassName
+	delete(cache.classPVs[class], pvName)
+	if len(cache.classPVs[class]) == 0 {
+		delete(cache.classPVs, class)
+	}
+	if pv.Spec.Local != nil {
+		path := filepath.Clean(pv.Spec.Local.Path)
+		delete(cache.hostPathPVs[path], pvName)
+		if len(cache.hostPathPVs[path]) == 0 {
+			delete(cache.hostPathPVs, path)
+		}
+	}
+}
+
+// GetPVByHostPath returns a local PV with the given host path, the first by name if more
+// than one PV has it
+func (cache *VolumeCache) GetPVByHostPath(hostPath string) (*v1.PersistentVolume, bool) {
+	pvs := cache.GetPVsByHostPath(hostPath)
+	if len(pvs) == 0 {
+		return nil, false
+	}
+	return pvs[0], true
+}
+
+// GetPVsByHostPath returns the local PVs with the given host path, sorted by name
+func (cache *VolumeCache) GetPVsByHostPath(hostPath string) []*v1.PersistentVolume {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	pvs := []*v1.PersistentVolume{}
+	for _, pv := range cache.hostPathPVs[filepath.Clean(hostPath)] {
+		pvs = append(pvs, pv)
+	}
+	sort.Slice(pvs, func(i, j int) bool { return pvs[i].Name < pvs[j].Name })
+	return pvs
+}
+
+// AddAdoptablePV adds or replaces a PV that the provisioner can adopt, unless it is
+// already in the cache
+func (cache *VolumeCache) AddAdoptablePV(pv *v1.PersistentVolume) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if _, exists := cache.pvs[pv.Name]; exists {
+		return
+	}
+	if _, exists := cache.adoptable[pv.Name]; !exists {
+		glog.Infof("Added adoptable pv %q to cache", pv.Name)
+	}
+	cache.adoptable[pv.Name] = pv
+}
+
+// DeleteAdoptablePV deletes the adoptable PV from the cache, if it exists
+func (cache *VolumeCache) DeleteAdoptablePV(pvName string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.adoptable, pvName)
+}
+
+// GetAdoptablePV returns the adoptable PV object given the PV name
+func (cache *VolumeCache) GetAdoptablePV(pvName string) (*v1.PersistentVolume, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	pv, exists := cache.adoptable[pvName]
+	return pv, exists
+}
+
+// ListAdoptablePVs returns a list of the adoptable PVs in the cache
+func (cache *VolumeCache) ListAdoptablePVs() []*v1.PersistentVolume {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	pvs := []*v1.PersistentVolume{}
+	for _, pv := range cache.adoptable {
+		pvs = append(pvs, pv)
+	}
+	return pvs
+}
+
 // ListPVs returns a list of all the PVs in the cache
 func (cache *VolumeCache) ListPVs() []*v1.PersistentVolume {
 	cache.mutex.Lock()
@@ -84,3 +205,24 @@ func (cache *VolumeCache) ListPVs() []*v1.PersistentVolume {
 	}
 	return pvs
 }
+
+// ListPVsForClass returns a list of the PVs of the storage class in the cache.
+// All the PVs in the cache are on this provisioner's node.
+func (cache *VolumeCache) ListPVsForClass(class string) []*v1.PersistentVolume {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	pvs := []*v1.PersistentVolume{}
+	for _, pv := range cache.classPVs[class] {
+		pvs = append(pvs, pv)
+	}
+	return pvs
+}
+
+// Size returns the number of PVs in the cache
+func (cache *VolumeCache) Size() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return len(cache.pvs)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestPV(name, class string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.PersistentVolumeSpec{StorageClassName: class},
+	}
+}
+
+func verifyClassPVs(t *testing.T, cache *VolumeCache, class string, expectedNames ...string) {
+	pvs := cache.ListPVsForClass(class)
+	if len(pvs) != len(expectedNames) {
+		t.Errorf("Expected %v PVs of class %q, got %v", len(expectedNames), class, len(pvs))
+	}
+	for _, name := range expectedNames {
+		found := false
+		for _, pv := range pvs {
+			found = found || pv.Name == name
+		}
+		if !found {
+			t.Errorf("Expected PV %q in class %q", name, class)
+		}
+	}
+}
+
+func TestListPVsForClass(t *testing.T) {
+	cache := NewVolumeCache()
+	cache.AddPV(newTestPV("pv1", "sc1"))
+	cache.AddPV(newTestPV("pv2", "sc1"))
+	cache.AddPV(newTestPV("pv3", "sc2"))
+	verifyClassPVs(t, cache, "sc1", "pv1", "pv2")
+	verifyClassPVs(t, cache, "sc2", "pv3")
+	verifyClassPVs(t, cache, "sc3")
+
+	cache.UpdatePV(newTestPV("pv2", "sc2"))
+	verifyClassPVs(t, cache, "sc1", "pv1")
+	verifyClassPVs(t, cache, "sc2", "pv2", "pv3")
+
+	cache.DeletePV("pv1")
+	cache.DeletePV("pv4")
+	verifyClassPVs(t, cache, "sc1")
+	if size := cache.Size(); size != 2 {
+		t.Errorf("Expected 2 PVs in cache, got %v", size)
+	}
+}
+
+func TestAdoptablePVs(t *testing.T) {
+	cache := NewVolumeCache()
+	cache.AddPV(newTestPV("pv1", "sc1"))
+	cache.AddAdoptablePV(newTestPV("pv1", "sc1"))
+	cache.AddAdoptablePV(newTestPV("pv2", "sc1"))
+	if _, exists := cache.GetAdoptablePV("pv1"); exists {
+		t.Errorf("Expected cached PV %q not to be adoptable", "pv1")
+	}
+	if pvs := cache.ListAdoptablePVs(); len(pvs) != 1 || pvs[0].Name != "pv2" {
+		t.Errorf("Expected only PV %q to be adoptable, got %v", "pv2", pvs)
+	}
+
+	// Adopted PVs are no longer adoptable
+	cache.AddPV(newTestPV("pv2", "sc1"))
+	if _, exists := cache.GetAdoptablePV("pv2"); exists {
+		t.Errorf("Expected adopted PV %q not to be adoptable", "pv2")
+	}
+	verifyClassPVs(t, cache, "sc1", "pv1", "pv2")
+
+	cache.AddAdoptablePV(newTestPV("pv3", "sc1"))
+	cache.DeleteAdoptablePV("pv3")
+	if pvs := cache.ListAdoptablePVs(); len(pvs) != 0 {
+		t.Errorf("Expected no adoptable PVs, got %v", pvs)
+	}
+}
+
+func newTestLocalPV(name, class, hostPath string) *v1.PersistentVolume {
+	pv := newTestPV(name, class)
+	pv.Spec.Local = &v1.LocalVolumeSource{Path: hostPath}
+	return pv
+}
+
+func TestGetPVByHostPath(t *testing.T) {
+	cache := NewVolumeCache()
+	cache.AddPV(newTestLocalPV("pv2", "sc1", "/mnt/disks/vol1"))
+	cache.AddPV(newTestLocalPV("pv1", "sc2", "/mnt/disks/vol1/"))
+	cache.AddPV(newTestPV("pv3", "sc1"))
+
+	// The first PV by name, with the host path cleaned
+	pv, found := cache.GetPVByHostPath("/mnt/disks/vol1")
+	if !found || pv.Name != "pv1" {
+		t.Errorf("Expected PV %q for the host path, got %v", "pv1", pv)
+	}
+
+	pvs := cache.GetPVsByHostPath("/mnt/disks/vol1/")
+	if len(pvs) != 2 || pvs[0].Name != "pv1" || pvs[1].Name != "pv2" {
+		t.Errorf("Expected PVs %q and %q for the host path, got %v", "pv1", "pv2", pvs)
+	}
+
+	// The index follows the updates and deletions
+	cache.UpdatePV(newTestLocalPV("pv1", "sc2", "/mnt/disks/vol2"))
+	if pv, found := cache.GetPVByHostPath("/mnt/disks/vol1"); !found || pv.Name != "pv2" {
+		t.Errorf("Expected PV %q for the host path, got %v", "pv2", pv)
+	}
+	cache.DeletePV("pv2")
+	if pv, found := cache.GetPVByHostPath("/mnt/disks/vol1"); found {
+		t.Errorf("Expected no PV for the host path, got %v", pv)
+	}
+	if pv, found := cache.GetPVByHostPath("/mnt/disks/vol2"); !found || pv.Name != "pv1" {
+		t.Errorf("Expected PV %q for the new host path, got %v", "pv1", pv)
+	}
+}
@@ -17,17 +17,33 @@ limitations under the License.
 package common
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/cache"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/api/v1/helper"
 	"k8s.io/kubernetes/pkg/kubelet/apis"
 )
 
@@ -37,26 +53,274 @@ const (
 	// NodeLabelKey is the label key that this provisioner uses for PV node affinity
 	// hostname is not the best choice, but it's what pod and node affinity also use
 	NodeLabelKey = apis.LabelHostname
+	// ZoneLabelKey is the node label key of the zone added to the PV node affinity with
+	// NodeAffinityZone
+	ZoneLabelKey = "topology.kubernetes.io/zone"
+	// AnnDiscoveryPaused is the node annotation that pauses the creation and deletion of
+	// the node's PVs while it is "true"
+	AnnDiscoveryPaused = "local-volume.kubernetes.io/discovery-paused"
+	// AnnDeviceID is the PV annotation for the hardware identifier of block type volumes
+	AnnDeviceID = "local-volume.kubernetes.io/device-id"
+	// AnnLastSeen is the PV annotation for the last time the provisioner found the volume
+	// of the PV, in RFC3339 format
+	AnnLastSeen = "local-volume.kubernetes.io/last-seen"
+	// AnnMissingSince is the PV annotation for the time the volume of an unbound PV was
+	// first found missing, in RFC3339 format, set while CleanupGracePeriod is running
+	AnnMissingSince = "local-volume.kubernetes.io/missing-since"
+	// AnnVolatile is the PV annotation warning that the volume is on tmpfs, set with
+	// LabelVolatile
+	AnnVolatile = "local-volume.kubernetes.io/volatile-warning"
+	// AnnVolumePath is the PV annotation for the path of the volume relative to the mount
+	// dir of its class, set if the host path of the PV comes from a HostPathTemplate
+	AnnVolumePath = "local-volume.kubernetes.io/volume-path"
+	// LabelFsType is the PV label key for the filesystem type of file type volumes
+	LabelFsType = "local-volume.kubernetes.io/fs-type"
+	// LabelReadOnly is the PV label of file type volumes on read-only mounts, set to "true"
+	LabelReadOnly = "local-volume.kubernetes.io/read-only"
+	// LabelLoopback is the PV label of file type volumes on loop devices, set to "true"
+	LabelLoopback = "local-volume.kubernetes.io/loopback"
+	// LabelVolatile is the PV label of file type volumes on tmpfs, set to "true", with
+	// DetectTmpfs
+	LabelVolatile = "local-volume.kubernetes.io/volatile"
+	// LabelNode is the PV label for the name of the node of the volume, which the PV
+	// informer can select on
+	LabelNode = "local-volume.kubernetes.io/node"
+	// LabelProvisionedBy is the PV label for the name of the provisioner that created
+	// the PV, see ProvisionerLabelValue
+	LabelProvisionedBy = "local-volume.kubernetes.io/provisioned-by"
 	// VolumeTypeFile represents file type volumes
 	VolumeTypeFile = "file"
 	// VolumeTypeBlock represents block type volumes
 	VolumeTypeBlock = "block"
 
+	// HostDirProbeFile is the file created in the mount dirs to check that it is seen
+	// under their host dirs, with HostRootfs
+	HostDirProbeFile = ".local-volume-provisioner-probe"
 	// DefaultHostDir is the default host dir to discover local volumes.
 	DefaultHostDir = "/mnt/disks"
 	// DefaultMountDir is the container mount point for the default host dir.
 	DefaultMountDir = "/local-disks"
+	// DefaultPVNamePrefix is the default prefix of the generated PV names.
+	DefaultPVNamePrefix = "local-pv-"
+	// DefaultIgnorePatterns is the default comma separated list of patterns of
+	// directory entries that are not discovered.
+	DefaultIgnorePatterns = ".*,lost+found"
+
+	// DefaultDiscoveryPeriod is the default period of the discovery of new volumes.
+	DefaultDiscoveryPeriod = 10 * time.Second
+	// DefaultDiscoveryJitterFactor is the default maximum fraction of the discovery period
+	// that is randomly added to it.
+	DefaultDiscoveryJitterFactor = 0.1
+	// DefaultHealthzStaleness is the default maximum age of the last successful discovery
+	// of a healthy provisioner.
+	DefaultHealthzStaleness = 5 * time.Minute
+	// DefaultBlockWipeTimeout is the default timeout for wiping a block device.
+	DefaultBlockWipeTimeout = 2 * time.Hour
+	// DefaultPreDeleteHookTimeout is the default timeout for running the pre-delete hook.
+	DefaultPreDeleteHookTimeout = time.Minute
+	// DefaultHealthCheckTimeout is the default timeout for the health probe of a volume.
+	DefaultHealthCheckTimeout = 10 * time.Second
+	// DefaultAPIRetryAttempts is the default number of attempts for a failed API call.
+	DefaultAPIRetryAttempts = 5
+	// DefaultAPIRetryInterval is the default initial backoff interval between API call attempts.
+	DefaultAPIRetryInterval = time.Second
+	// DefaultAPIBurst is the default burst of PV create and delete API calls.
+	DefaultAPIBurst = 10
 
 	// EventVolumeFailedDelete copied from k8s.io/kubernetes/pkg/controller/volume/events
 	EventVolumeFailedDelete = "VolumeFailedDelete"
+	// EventVolumeCreated is the event reason when a PV has been created for a new volume
+	EventVolumeCreated = "VolumeCreated"
+	// EventVolumeDeleted is the event reason when a released PV has been cleaned up and deleted
+	EventVolumeDeleted = "VolumeDeleted"
+	// EventMissingBackingMedia is the event reason when the volume of a bound PV, or of a
+	// released PV that would be recycled, is missing
+	EventMissingBackingMedia = "MissingBackingMedia"
+	// EventMaxPVsReached is the event reason when no more PVs are created because the
+	// node has reached the maximum number of PVs
+	EventMaxPVsReached = "MaxPVsReached"
+	// EventCapacityShrunk is the event reason when the volume of a PV has less capacity
+	// than the PV advertises
+	EventCapacityShrunk = "VolumeCapacityShrunk"
+	// EventVolumeResized is the event reason when an unbound PV has been recreated with
+	// the grown capacity of its volume
+	EventVolumeResized = "VolumeResized"
+	// EventPVNameCollision is the event reason when the generated name of a volume's PV
+	// is taken by the PV of another volume
+	EventPVNameCollision = "PVNameCollision"
+	// EventVolumeWiped is the event reason when a block device has been wiped
+	EventVolumeWiped = "VolumeWiped"
+	// EventVolumeFailedWipe is the event reason when wiping a block device failed
+	EventVolumeFailedWipe = "VolumeFailedWipe"
+	// EventVolumeRecycled is the event reason when a released PV with reclaim policy
+	// Retain has been cleaned up and deleted, to be recreated by discovery
+	EventVolumeRecycled = "VolumeRecycled"
+	// EventVolumeDirRemoved is the event reason when the empty directory of a deleted
+	// file PV has been removed
+	EventVolumeDirRemoved = "VolumeDirRemoved"
+	// EventPreDeleteHookFailed is the event reason when the pre-delete hook failed, so
+	// the released PV is not deleted
+	EventPreDeleteHookFailed = "PreDeleteHookFailed"
+	// EventVolumeUnhealthy is the event reason when a new volume fails the health probe,
+	// so no PV is created for it
+	EventVolumeUnhealthy = "VolumeUnhealthy"
+	// EventDuplicateHostPath is the event reason when more than one PV has the same host
+	// path, e.g. because it was discovered under two storage classes
+	EventDuplicateHostPath = "DuplicateHostPath"
+	// EventHostPathInUse is the event reason when no PV is created for a volume because
+	// a PV with another name already has its host path
+	EventHostPathInUse = "HostPathInUse"
+	// EventDiscoverySummary is the event reason of the summary of a discovery cycle on
+	// the node, with EventModeSummary
+	EventDiscoverySummary = "DiscoverySummary"
+)
+
+// EventMode is which events the provisioner records
+type EventMode string
+
+const (
+	// EventModePerVolume records the events of each PV
+	EventModePerVolume EventMode = "per-volume"
+	// EventModeSummary records a summary event on the node for each discovery cycle
+	// that changed anything, instead of the events of each PV
+	EventModeSummary EventMode = "summary"
+	// EventModeNone records no events
+	EventModeNone EventMode = "none"
+)
+
+// PVNamingStrategy is how the names of the PVs are generated from the volumes
+type PVNamingStrategy string
+
+const (
+	// PVNamingHash names PVs with a hash of the volume name, node and storage class
+	PVNamingHash PVNamingStrategy = "Hash"
+	// PVNamingReadable names PVs after the volume name, with a hash of the node and
+	// storage class as suffix
+	PVNamingReadable PVNamingStrategy = "Readable"
 )
 
 // UserConfig stores all the user-defined parameters to the provisioner
 type UserConfig struct {
-	// Node object for this node
+	// Node object for this node. Once the provisioner runs, read it with
+	// RuntimeConfig.GetNode, since RefreshNode replaces it.
 	Node *v1.Node
 	// key = storageclass, value = mount configuration for the storageclass
 	DiscoveryMap map[string]MountConfig
+	// Maximum number of storage classes to discover concurrently.
+	// Zero or less means one worker per storage class.
+	MaxDiscoveryConcurrency int
+	// Maximum number of new volumes of a storage class that are probed and get their PVs
+	// created concurrently, and of PVs of missing volumes that are deleted concurrently.
+	// Zero or less means one at a time.
+	MaxVolumeConcurrency int
+	// Prefix of the generated PV names, defaults to DefaultPVNamePrefix
+	PVNamePrefix string
+	// How the PV names are generated, defaults to PVNamingHash
+	PVNamingStrategy PVNamingStrategy
+	// Size in bits of the FNV-1a hashes in the PV names, 32 or 64, defaults to 32.
+	// Changing it changes the names of all the PVs.
+	PVNameHashBits int
+	// Wipe block devices of released PVs before deleting the PVs
+	WipeBlockOnDelete bool
+	// Timeout for wiping a block device, defaults to DefaultBlockWipeTimeout
+	BlockWipeTimeout time.Duration
+	// Remove the empty directories of file volumes after deleting their released PVs,
+	// so that no PV is created for them again
+	RemoveEmptyDirsOnDelete bool
+	// Command run with the PV name and host path as arguments after a released PV has
+	// been cleaned up and before it is deleted, a failure keeps the PV. Empty disables it.
+	PreDeleteHook string
+	// Timeout for running the pre-delete hook, defaults to DefaultPreDeleteHookTimeout
+	PreDeleteHookTimeout time.Duration
+	// Delete the unbound PVs whose volumes have been missing for longer than this, across
+	// discoveries. Zero or less means the PVs of missing volumes are never deleted.
+	CleanupGracePeriod time.Duration
+	// Delete the unbound PVs whose host path is also the host path of another PV, keeping
+	// the bound PVs, or the oldest PV if none is bound. Bound PVs are never deleted.
+	ResolveDuplicateHostPaths bool
+	// Adopt the local PVs of the node that were not created by a provisioner, e.g. before
+	// migrating to the provisioner, when their host path is a discovered volume of their
+	// storage class, instead of creating another PV for the volume
+	AdoptExisting bool
+	// Probe that volumes can be read before creating their PVs, volumes that fail are
+	// skipped. The volumes of existing PVs are not probed.
+	HealthCheck bool
+	// Timeout for the health probe of a volume, defaults to DefaultHealthCheckTimeout
+	HealthCheckTimeout time.Duration
+	// Timeout for the filesystem stat and listing calls, e.g. on hung mounts, the volumes
+	// of paths that time out are skipped. Zero or less means no timeout.
+	FsOperationTimeout time.Duration
+	// Maximum number of attempts for a failed API call, one or less means no retries
+	APIRetryAttempts int
+	// Initial backoff interval between API call attempts, doubled after every retry
+	APIRetryInterval time.Duration
+	// Maximum rate of PV create and delete API calls, zero or less means unlimited
+	APIQPS float64
+	// Maximum burst of PV create and delete API calls
+	APIBurst int
+	// Node label keys used for PV node affinity, defaults to NodeLabelKey.
+	// Keys that are not present on the node are skipped, unless NodeAffinityStrict is set.
+	NodeAffinityLabelKeys []string
+	// Fail if any of NodeAffinityLabelKeys is not present on the node
+	NodeAffinityStrict bool
+	// Only use the first of NodeAffinityLabelKeys present on the node, the keys are
+	// candidates in priority order. Can't be set with NodeAffinityStrict.
+	NodeAffinityFirstKey bool
+	// Also add a requirement for the zone label of the node to the PV node affinity, the
+	// zone is skipped if the node has no zone label
+	NodeAffinityZone bool
+	// Patterns of directory entries that are not discovered, as used by filepath.Match.
+	// Nil means DefaultIgnorePatterns.
+	IgnorePatterns []string
+	// Log the PVs that would be created and deleted instead of calling the API
+	DryRun bool
+	// Maximum number of PVs of the node, no more PVs are discovered once it is reached.
+	// Zero or less means unlimited.
+	MaxPVsPerNode int
+	// Skip volumes whose capacity is zero, e.g. because the device is not ready yet,
+	// instead of creating PVs that can't be bound. They are retried in the next discovery.
+	SkipZeroCapacity bool
+	// Don't create PVs while the node is cordoned, i.e. unschedulable or tainted with
+	// CordonTaintKey. The existing PVs are still reconciled.
+	PauseOnCordon bool
+	// Key of a taint that also marks the node as cordoned, empty means only unschedulable
+	CordonTaintKey string
+	// With PauseOnCordon, also don't clean up released PVs while the node is cordoned
+	PauseCleanupOnCordon bool
+	// Format of the logged volume lifecycle events, "text" or "json"
+	LogFormat string
+	// Which events are recorded, defaults to EventModePerVolume
+	EventMode EventMode
+	// Component of the source of the recorded events, defaults to the provisioner name
+	EventComponent string
+	// Set an owner reference to the node on the created PVs, so that they are garbage
+	// collected when the node is deleted
+	SetNodeOwnerRef bool
+	// Annotations added to the created PVs, the annotations of the storage class take precedence
+	ExtraAnnotations map[string]string
+	// Labels added to the created PVs, the labels of the storage class take precedence
+	ExtraLabels map[string]string
+	// Minimum interval between updates of the last seen annotation of a PV, zero or
+	// less disables the annotation
+	LastSeenInterval time.Duration
+	// Period of the discovery of new volumes, defaults to DefaultDiscoveryPeriod
+	DiscoveryPeriod time.Duration
+	// Maximum fraction of the discovery period that is randomly added to it, so that the
+	// discoveries of the nodes don't align. Defaults to DefaultDiscoveryJitterFactor,
+	// negative disables the jitter
+	DiscoveryJitterFactor float64
+	// Minimum period between the reconciliations of the existing PVs with their volumes,
+	// zero or less reconciles them in every discovery
+	ReconcilePeriod time.Duration
+	// Only watch the PVs with the LabelNode label of the node, instead of all the PVs
+	ScopePVInformer bool
+	// Maximum age of the last successful discovery before /healthz reports the provisioner
+	// as unhealthy, defaults to DefaultHealthzStaleness
+	HealthzStaleness time.Duration
+	// Path in the container where the root fs of the host is mounted, to check at startup
+	// that the HostDir of each storage class is the host path of its MountDir. Empty
+	// disables the check.
+	HostRootfs string
 }
 
 // MountConfig stores a configuration for discoverying a specific storageclass
@@ -65,6 +329,175 @@ type MountConfig struct {
 	HostDir string `json:"hostDir"`
 	// The mount point of the hostpath volume
 	MountDir string `json:"mountDir"`
+	// Volumes with capacity below this threshold are not discovered, zero disables the filter
+	MinCapacityBytes int64 `json:"minCapacityBytes,omitempty"`
+	// File volumes with fewer free inodes than this are not discovered, zero disables
+	// the check
+	MinFreeInodes int64 `json:"minFreeInodes,omitempty"`
+	// Resolve symlinks under the mount point before checking the volume type
+	ResolveSymlinks bool `json:"resolveSymlinks,omitempty"`
+	// Reclaim policy of the created PVs, "Delete" (default) or "Retain"
+	ReclaimPolicy v1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+	// Name of a file in file volumes whose content, "Delete" or "Retain", overrides the
+	// reclaim policy of the class for the PV of the volume. Empty disables it.
+	ReclaimPolicyFile string `json:"reclaimPolicyFile,omitempty"`
+	// Regular expression matched against volume names, named capture groups become PV labels
+	LabelPattern string `json:"labelPattern,omitempty"`
+	// Percentage of the filesystem capacity of file volumes that is not advertised in the PV
+	ReservedCapacityPercent int `json:"reservedCapacityPercent,omitempty"`
+	// Bytes of the filesystem capacity of file volumes that are not advertised in the PV
+	ReservedCapacityBytes int64 `json:"reservedCapacityBytes,omitempty"`
+	// File volumes must be mount points, released PVs whose path is not one are not cleaned up
+	RequireMountPoint bool `json:"requireMountPoint,omitempty"`
+	// PV capacities are rounded down to a multiple of this, zero disables rounding
+	CapacityRoundingBytes int64 `json:"capacityRoundingBytes,omitempty"`
+	// Filesystem types of file volumes that are discovered, empty allows all types
+	AllowedFsTypes []string `json:"allowedFsTypes,omitempty"`
+	// Number of directory levels below the mount dir of the volumes, defaults to 1
+	NestedDepth int `json:"nestedDepth,omitempty"`
+	// Provisioner name of the created PVs, defaults to the name of the node's provisioner
+	ProvisionerName string `json:"provisionerName,omitempty"`
+	// Warn when the capacity of the volume of an existing PV is less than advertised
+	DetectCapacityShrink bool `json:"detectCapacityShrink,omitempty"`
+	// Percentage of the advertised capacity that the volume may shrink by without a warning
+	CapacityShrinkTolerancePercent int `json:"capacityShrinkTolerancePercent,omitempty"`
+	// Recreate unbound PVs with the new capacity when their volume has grown
+	UpdateUnboundCapacity bool `json:"updateUnboundCapacity,omitempty"`
+	// Annotations added to the created PVs, overriding the global ones with the same keys
+	ExtraAnnotations map[string]string `json:"extraAnnotations,omitempty"`
+	// Labels added to the created PVs, overriding the global ones with the same keys
+	ExtraLabels map[string]string `json:"extraLabels,omitempty"`
+	// Minimum number of volumes in the mount dir before the class is discovered
+	ReadyMinEntries int `json:"readyMinEntries,omitempty"`
+	// File in the mount dir that must exist before the class is discovered
+	ReadySentinel string `json:"readySentinel,omitempty"`
+	// Patterns of volumes that are never discovered, as used by filepath.Match, matched
+	// against the volume name and path, and the resolved path with ResolveSymlinks
+	ExcludePaths []string `json:"excludePaths,omitempty"`
+	// Set the access mode of the PVs of read-only volumes to ReadOnlyMany instead of ReadWriteOnce
+	ReadOnlyManyAccessMode bool `json:"readOnlyManyAccessMode,omitempty"`
+	// Mount options of the PVs of file volumes, block volumes ignore them
+	MountOptions []string `json:"mountOptions,omitempty"`
+	// Discover and clean up the volumes of the class, defaults to true
+	Enabled *bool `json:"enabled,omitempty"`
+	// Source of the capacity of file volumes, "statfs" (default) or "quota"
+	CapacitySource string `json:"capacitySource,omitempty"`
+	// Reporter that shapes the advertised capacity of all volumes, "exact", "roundDownGiB"
+	// or "reservePercent", applied after the reserved capacity and rounding options
+	CapacityReporter string `json:"capacityReporter,omitempty"`
+	// Percentage of the capacity that is not advertised, with the "reservePercent" reporter
+	CapacityReporterPercent int `json:"capacityReporterPercent,omitempty"`
+	// Factor that the capacity of all volumes is multiplied by, after the reserved
+	// capacity and before rounding, e.g. 0.8 for thin-provisioned media. Zero disables it.
+	CapacityScaleFactor float64 `json:"capacityScaleFactor,omitempty"`
+	// Allow a CapacityScaleFactor greater than 1, to overcommit the media on purpose
+	AllowCapacityOvercommit bool `json:"allowCapacityOvercommit,omitempty"`
+	// Access modes of the PVs, defaults to ReadWriteOnce
+	AccessModes []string `json:"accessModes,omitempty"`
+	// Clean up and recreate released PVs with reclaim policy Retain, so that their
+	// volumes become available again
+	AutoRecycleReleased bool `json:"autoRecycleReleased,omitempty"`
+	// Go template of the host paths of the PVs, see HostPathTemplateData, defaults to
+	// the volume path under HostDir
+	HostPathTemplate string `json:"hostPathTemplate,omitempty"`
+	// Detect file volumes mounted from loop devices, whose capacity is then the allocated
+	// size of the backing file
+	DetectLoopback bool `json:"detectLoopback,omitempty"`
+	// Detect file volumes on tmpfs, whose PVs are then labeled volatile and get a warning
+	// annotation, since their data is lost when the node reboots
+	DetectTmpfs bool `json:"detectTmpfs,omitempty"`
+	// Discover whole disks that have partitions too, by default they are skipped so that
+	// their partitions aren't overwritten through the PV of the disk
+	AllowPartitionedDisks bool `json:"allowPartitionedDisks,omitempty"`
+	// Minimum time since the last modification of the directories of file volumes before
+	// they are discovered, as a Go duration, e.g. "10m". Newer directories are deferred
+	// to a later discovery. Empty or zero disables the check.
+	MinDirAge string `json:"minDirAge,omitempty"`
+	// Period of the discovery of the class as a Go duration, e.g. "1m", overriding the
+	// global discovery period. Empty uses the global period.
+	DiscoveryPeriod string `json:"discoveryPeriod,omitempty"`
+	// Maximum number of new volumes of the class that are probed concurrently, overriding
+	// the global MaxVolumeConcurrency. Zero uses the global value.
+	MaxVolumeConcurrency int `json:"maxVolumeConcurrency,omitempty"`
+}
+
+const (
+	// CapacitySourceStatfs uses the capacity of the filesystem of file volumes
+	CapacitySourceStatfs = "statfs"
+	// CapacitySourceQuota uses the project quota limit of the directory of file volumes
+	CapacitySourceQuota = "quota"
+)
+
+const (
+	// CapacityReporterExact advertises the capacity as is
+	CapacityReporterExact = "exact"
+	// CapacityReporterRoundDownGiB rounds the capacity down to a multiple of GiB
+	CapacityReporterRoundDownGiB = "roundDownGiB"
+	// CapacityReporterReservePercent subtracts CapacityReporterPercent of the capacity
+	CapacityReporterReservePercent = "reservePercent"
+)
+
+// CapacityReporter returns the capacity advertised in the PV of a volume
+type CapacityReporter interface {
+	// ReportCapacity returns the advertised capacity of a volume with capacityByte bytes
+	ReportCapacity(capacityByte int64) int64
+}
+
+type exactCapacityReporter struct{}
+
+func (exactCapacityReporter) ReportCapacity(capacityByte int64) int64 {
+	return capacityByte
+}
+
+type roundDownGiBCapacityReporter struct{}
+
+func (roundDownGiBCapacityReporter) ReportCapacity(capacityByte int64) int64 {
+	const gib = 1024 * 1024 * 1024
+	return capacityByte - capacityByte%gib
+}
+
+type reservePercentCapacityReporter struct {
+	percent int
+}
+
+func (r reservePercentCapacityReporter) ReportCapacity(capacityByte int64) int64 {
+	return capacityByte - capacityByte*int64(r.percent)/100
+}
+
+// NewCapacityReporter returns the capacity reporter of the class, nil if it has none
+func NewCapacityReporter(config MountConfig) (CapacityReporter, error) {
+	switch config.CapacityReporter {
+	case "":
+		return nil, nil
+	case CapacityReporterExact:
+		return exactCapacityReporter{}, nil
+	case CapacityReporterRoundDownGiB:
+		return roundDownGiBCapacityReporter{}, nil
+	case CapacityReporterReservePercent:
+		if config.CapacityReporterPercent < 0 || config.CapacityReporterPercent > 100 {
+			return nil, fmt.Errorf("capacity reporter percent %d is not between 0 and 100", config.CapacityReporterPercent)
+		}
+		return reservePercentCapacityReporter{percent: config.CapacityReporterPercent}, nil
+	}
+	return nil, fmt.Errorf("unsupported capacity reporter %q", config.CapacityReporter)
+}
+
+// IsEnabled returns true unless the discovery and cleanup of the class are disabled
+func (config MountConfig) IsEnabled() bool {
+	return config.Enabled == nil || *config.Enabled
+}
+
+// MountRoot returns the directory that the paths of the volumes of the class are relative
+// to, see SplitGlob
+func (config MountConfig) MountRoot() string {
+	root, _ := SplitGlob(config.MountDir)
+	return root
+}
+
+// HostRoot returns the directory on the host that the mount root is mounted from
+func (config MountConfig) HostRoot() string {
+	root, _ := SplitGlob(config.HostDir)
+	return root
 }
 
 // RuntimeConfig stores all the objects that the provisioner needs to run
@@ -82,6 +515,196 @@ type RuntimeConfig struct {
 	VolUtil util.VolumeUtil
 	// Recorder is used to record events in the API server
 	Recorder record.EventRecorder
+	// RateLimiter is shared by all the PV create and delete API calls
+	RateLimiter util.RateLimiter
+	// VolumeLogger logs the lifecycle events of the volumes
+	VolumeLogger util.VolumeLogger
+	// HookRunner runs the pre-delete hook
+	HookRunner util.HookRunner
+
+	// nodeMutex guards Node, which RefreshNode replaces while the populator and the
+	// background cleanups and retries read it
+	nodeMutex sync.RWMutex
+}
+
+// GetNode returns the latest version of Node
+func (c *RuntimeConfig) GetNode() *v1.Node {
+	c.nodeMutex.RLock()
+	defer c.nodeMutex.RUnlock()
+	return c.Node
+}
+
+// RefreshNode replaces Node with the latest version from the API server. The
+// current Node is kept if it can't be fetched.
+func (c *RuntimeConfig) RefreshNode() {
+	current := c.GetNode()
+	if current == nil {
+		return
+	}
+	node, err := c.APIUtil.GetNode(current.Name)
+	if err != nil {
+		glog.Errorf("Error refreshing node %q: %v", current.Name, err)
+		return
+	}
+	c.nodeMutex.Lock()
+	c.Node = node
+	c.nodeMutex.Unlock()
+}
+
+// APIRetryBackoff returns the exponential backoff of the attempts of a failed API call,
+// APIRetryAttempts steps in total starting at APIRetryInterval
+func (c *UserConfig) APIRetryBackoff() wait.Backoff {
+	interval := c.APIRetryInterval
+	if interval <= 0 {
+		interval = DefaultAPIRetryInterval
+	}
+	steps := c.APIRetryAttempts
+	if steps < 1 {
+		steps = 1
+	}
+	return wait.Backoff{
+		Duration: interval,
+		Factor:   2,
+		Steps:    steps,
+	}
+}
+
+// IsPaused returns true if the node is annotated to pause the creation and deletion of PVs
+func IsPaused(node *v1.Node) bool {
+	return node != nil && node.Annotations[AnnDiscoveryPaused] == "true"
+}
+
+// IsCordoned returns true if the node is unschedulable, or has a taint with taintKey.
+// An empty taintKey only checks if the node is unschedulable.
+func IsCordoned(node *v1.Node, taintKey string) bool {
+	if node == nil {
+		return false
+	}
+	if node.Spec.Unschedulable {
+		return true
+	}
+	if taintKey == "" {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == taintKey {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeOwnerReference returns an owner reference to the node for the PVs of the node
+func NodeOwnerReference(node *v1.Node) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       node.Name,
+		UID:        node.UID,
+	}
+}
+
+// NodeLabelValue returns the value of the LabelNode label of the PVs of the node, or
+// an empty string if the node name is not a valid label value, e.g. because it is
+// longer than 63 characters
+func NodeLabelValue(node *v1.Node) string {
+	if errs := validation.IsValidLabelValue(node.Name); len(errs) > 0 {
+		return ""
+	}
+	return node.Name
+}
+
+// ProvisionerLabelValue returns the value of the LabelProvisionedBy label of the PVs
+// created by the provisioner. Names that are not valid label values, like the default
+// names, which have the node name and UID, are truncated and get a hash of the full name
+// as suffix, e.g. local-volume-provisioner-node1-2f3a6b1c-0c2e-11e8-b7b1-42-5d1b8a3e.
+func ProvisionerLabelValue(provisioner string) string {
+	if errs := validation.IsValidLabelValue(provisioner); len(errs) == 0 {
+		return provisioner
+	}
+	h := fnv.New32a()
+	h.Write([]byte(provisioner))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	prefix := invalidLabelValueChars.ReplaceAllString(provisioner, "-")
+	if maxLen := validation.LabelValueMaxLength - len(suffix); len(prefix) > maxLen {
+		prefix = prefix[:maxLen]
+	}
+	prefix = strings.TrimLeft(strings.TrimRight(prefix, "-_."), "-_.")
+	if prefix == "" {
+		return suffix[1:]
+	}
+	return prefix + suffix
+}
+
+var invalidLabelValueChars = regexp.MustCompile("[^-_.A-Za-z0-9]+")
+
+// NewEventRecorder returns a recorder of the events of the provisioner whose source is
+// the component, recording the events of the mode, see NewEventModeRecorder
+func NewEventRecorder(broadcaster record.EventBroadcaster, component string, mode EventMode) record.EventRecorder {
+	return NewEventModeRecorder(broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component}), mode)
+}
+
+// NewEventModeRecorder returns a recorder that only records the events of the mode.
+// With EventModeSummary, the events of PVs are dropped, with EventModeNone all events.
+func NewEventModeRecorder(recorder record.EventRecorder, mode EventMode) record.EventRecorder {
+	switch mode {
+	case EventModeSummary:
+		return &eventModeRecorder{recorder: recorder}
+	case EventModeNone:
+		return &eventModeRecorder{recorder: recorder, dropAll: true}
+	}
+	return recorder
+}
+
+var _ record.EventRecorder = &eventModeRecorder{}
+
+type eventModeRecorder struct {
+	recorder record.EventRecorder
+	dropAll  bool
+}
+
+func (r *eventModeRecorder) isDropped(object runtime.Object) bool {
+	_, isPV := object.(*v1.PersistentVolume)
+	return r.dropAll || isPV
+}
+
+// Event records the event unless it is dropped
+func (r *eventModeRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if !r.isDropped(object) {
+		r.recorder.Event(object, eventtype, reason, message)
+	}
+}
+
+// Eventf records the event unless it is dropped
+func (r *eventModeRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if !r.isDropped(object) {
+		r.recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	}
+}
+
+// PastEventf records the event unless it is dropped
+func (r *eventModeRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	if !r.isDropped(object) {
+		r.recorder.PastEventf(object, timestamp, eventtype, reason, messageFmt, args...)
+	}
+}
+
+// IsLocalPVOnNode returns true if the node matches the node affinity annotation of the PV
+func IsLocalPVOnNode(pv *v1.PersistentVolume, node *v1.Node) bool {
+	affinity, err := helper.GetStorageNodeAffinityFromAnnotation(pv.Annotations)
+	if err != nil || affinity == nil || affinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return false
+	}
+	for _, term := range affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		selector, err := helper.NodeSelectorRequirementsAsSelector(term.MatchExpressions)
+		if err != nil {
+			continue
+		}
+		if selector.Matches(labels.Set(node.Labels)) {
+			return true
+		}
+	}
+	return false
 }
 
 // LocalPVConfig defines the parameters for creating a local PV
@@ -92,34 +715,66 @@ type LocalPVConfig struct {
 	StorageClass    string
 	ProvisionerName string
 	AffinityAnn     string
+	Labels          map[string]string
+	ReclaimPolicy   v1.PersistentVolumeReclaimPolicy
+	DeviceID        string
+	OwnerReferences []metav1.OwnerReference
+	// Annotations in addition to the ones set by the provisioner
+	Annotations map[string]string
+	// Access modes of the PV, defaults to ReadWriteOnce
+	AccessModes []v1.PersistentVolumeAccessMode
+	// Mount options of the PV
+	MountOptions []string
 }
 
 // CreateLocalPVSpec returns a PV spec that can be used for PV creation
 func CreateLocalPVSpec(config *LocalPVConfig) *v1.PersistentVolume {
-	return &v1.PersistentVolume{
+	reclaimPolicy := config.ReclaimPolicy
+	if reclaimPolicy == "" {
+		reclaimPolicy = v1.PersistentVolumeReclaimDelete
+	}
+	accessModes := config.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	}
+	annotations := map[string]string{}
+	for k, v := range config.Annotations {
+		annotations[k] = v
+	}
+	annotations[AnnProvisionedBy] = config.ProvisionerName
+	// TODO: Set spec.nodeAffinity instead once the vendored API supports it.
+	annotations[v1.AlphaStorageNodeAffinityAnnotation] = config.AffinityAnn
+	delete(annotations, AnnDeviceID)
+
+	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: config.Name,
-			Annotations: map[string]string{
-				AnnProvisionedBy:                      config.ProvisionerName,
-				v1.AlphaStorageNodeAffinityAnnotation: config.AffinityAnn,
-			},
+			Name:            config.Name,
+			Labels:          config.Labels,
+			OwnerReferences: config.OwnerReferences,
+			Annotations:     annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
-			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
 			Capacity: v1.ResourceList{
-				v1.ResourceName(v1.ResourceStorage): *resource.NewQuantity(int64(config.Capacity), resource.BinarySI),
+				v1.ResourceName(v1.ResourceStorage): *resource.NewQuantity(config.Capacity, resource.BinarySI),
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				Local: &v1.LocalVolumeSource{
 					Path: config.HostPath,
 				},
 			},
-			AccessModes: []v1.PersistentVolumeAccessMode{
-				v1.ReadWriteOnce,
-			},
+			AccessModes:      accessModes,
 			StorageClassName: config.StorageClass,
 		},
 	}
+	if config.DeviceID != "" {
+		pv.Annotations[AnnDeviceID] = config.DeviceID
+	}
+	if len(config.MountOptions) > 0 {
+		// TODO: Set spec.mountOptions instead once the vendored API supports it.
+		pv.Annotations[v1.MountOptionAnnotation] = strings.Join(config.MountOptions, ",")
+	}
+	return pv
 }
 
 // GetVolumeConfigFromConfigMap gets volume configuration from given configmap,
@@ -163,7 +818,344 @@ func ConfigMapDataToVolumeConfig(data map[string]string) (map[string]MountConfig
 		if err := json.Unmarshal([]byte(val), &config); err != nil {
 			return nil, fmt.Errorf("unable to unmarshal config for class %v: %v", class, err)
 		}
+		if err := validateMountConfig(&config); err != nil {
+			return nil, fmt.Errorf("invalid config for class %v: %v", class, err)
+		}
 		mountConfig[class] = config
 	}
 	return mountConfig, nil
 }
+
+// validateMountConfig checks the optional fields of a mount configuration
+func validateMountConfig(config *MountConfig) error {
+	if err := ValidateGlobDirs(config.HostDir, config.MountDir); err != nil {
+		return err
+	}
+	switch config.ReclaimPolicy {
+	case "", v1.PersistentVolumeReclaimDelete, v1.PersistentVolumeReclaimRetain:
+	default:
+		return fmt.Errorf("unsupported reclaim policy %q", config.ReclaimPolicy)
+	}
+	if err := ValidateReclaimPolicyFile(config.ReclaimPolicyFile); err != nil {
+		return err
+	}
+	if config.LabelPattern != "" {
+		if _, err := CompileLabelPattern(config.LabelPattern); err != nil {
+			return err
+		}
+	}
+	if config.HostPathTemplate != "" {
+		if _, err := ParseHostPathTemplate(config.HostPathTemplate); err != nil {
+			return err
+		}
+	}
+	if _, err := ParseMinDirAge(config.MinDirAge); err != nil {
+		return err
+	}
+	if _, err := ParseDiscoveryPeriod(config.DiscoveryPeriod); err != nil {
+		return err
+	}
+	if err := ValidateCapacityScaleFactor(*config); err != nil {
+		return err
+	}
+	if config.MaxVolumeConcurrency < 0 {
+		return fmt.Errorf("max volume concurrency %d is negative", config.MaxVolumeConcurrency)
+	}
+	if config.ReservedCapacityPercent < 0 || config.ReservedCapacityPercent > 100 {
+		return fmt.Errorf("reserved capacity percent %d is not between 0 and 100", config.ReservedCapacityPercent)
+	}
+	if config.ReservedCapacityBytes < 0 {
+		return fmt.Errorf("reserved capacity bytes %d is negative", config.ReservedCapacityBytes)
+	}
+	if config.NestedDepth < 0 {
+		return fmt.Errorf("nested depth %d is negative", config.NestedDepth)
+	}
+	if config.CapacityRoundingBytes < 0 {
+		return fmt.Errorf("capacity rounding bytes %d is negative", config.CapacityRoundingBytes)
+	}
+	if config.CapacityShrinkTolerancePercent < 0 || config.CapacityShrinkTolerancePercent > 100 {
+		return fmt.Errorf("capacity shrink tolerance percent %d is not between 0 and 100", config.CapacityShrinkTolerancePercent)
+	}
+	if config.ReadyMinEntries < 0 {
+		return fmt.Errorf("ready min entries %d is negative", config.ReadyMinEntries)
+	}
+	for _, pattern := range config.ExcludePaths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+	}
+	if err := ValidateMountOptions(config.MountOptions); err != nil {
+		return err
+	}
+	if err := ValidateCapacitySource(config.CapacitySource); err != nil {
+		return err
+	}
+	if _, err := NewCapacityReporter(*config); err != nil {
+		return err
+	}
+	if err := ValidateAccessModes(config.AccessModes); err != nil {
+		return err
+	}
+	if err := ValidateExtraAnnotations(config.ExtraAnnotations); err != nil {
+		return err
+	}
+	return ValidateExtraLabels(config.ExtraLabels)
+}
+
+// ValidateReclaimPolicyFile checks that the reclaim policy file is a file name, not a path
+func ValidateReclaimPolicyFile(name string) error {
+	if strings.Contains(name, string(filepath.Separator)) {
+		return fmt.Errorf("reclaim policy file %q is not a file name", name)
+	}
+	return nil
+}
+
+// ValidateCapacitySource checks that the capacity source is supported
+func ValidateCapacitySource(source string) error {
+	switch source {
+	case "", CapacitySourceStatfs, CapacitySourceQuota:
+		return nil
+	}
+	return fmt.Errorf("unsupported capacity source %q", source)
+}
+
+// ValidateAccessModes checks that the access modes are known PV access modes, without
+// duplicates
+func ValidateAccessModes(modes []string) error {
+	seen := map[string]bool{}
+	for _, mode := range modes {
+		switch v1.PersistentVolumeAccessMode(mode) {
+		case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany:
+		default:
+			return fmt.Errorf("unsupported access mode %q", mode)
+		}
+		if seen[mode] {
+			return fmt.Errorf("duplicate access mode %q", mode)
+		}
+		seen[mode] = true
+	}
+	return nil
+}
+
+// ValidateMountOptions checks that the mount options are not empty, and don't have
+// commas, which separate them in the mount options annotation
+func ValidateMountOptions(options []string) error {
+	for _, option := range options {
+		if strings.TrimSpace(option) == "" {
+			return fmt.Errorf("empty mount option in %q", options)
+		}
+		if strings.Contains(option, ",") {
+			return fmt.Errorf("mount option %q has a comma", option)
+		}
+	}
+	return nil
+}
+
+// reservedAnnotations are the PV annotations set by the provisioner, which can't be
+// set as extra annotations
+var reservedAnnotations = map[string]bool{
+	AnnProvisionedBy:                      true,
+	AnnDeviceID:                           true,
+	AnnLastSeen:                           true,
+	AnnMissingSince:                       true,
+	AnnVolatile:                           true,
+	AnnVolumePath:                         true,
+	v1.AlphaStorageNodeAffinityAnnotation: true,
+}
+
+// ValidateExtraAnnotations checks that the keys of the extra PV annotations are valid
+// and not reserved by the provisioner
+func ValidateExtraAnnotations(annotations map[string]string) error {
+	for key := range annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation key %q: %v", key, errs)
+		}
+		if reservedAnnotations[key] {
+			return fmt.Errorf("annotation %q is reserved by the provisioner", key)
+		}
+	}
+	return nil
+}
+
+// reservedLabels are the PV labels set by the provisioner, which can't be set as extra
+// labels
+var reservedLabels = map[string]bool{
+	LabelFsType:        true,
+	LabelReadOnly:      true,
+	LabelLoopback:      true,
+	LabelVolatile:      true,
+	LabelNode:          true,
+	LabelProvisionedBy: true,
+}
+
+// ValidateExtraLabels checks that the extra PV labels are valid and not set by the provisioner
+func ValidateExtraLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid label key %q: %v", key, errs)
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q of label %q: %v", value, key, errs)
+		}
+		if reservedLabels[key] {
+			return fmt.Errorf("label %q is reserved by the provisioner", key)
+		}
+	}
+	return nil
+}
+
+// ParseMinDirAge parses the minimum directory age of a storage class, empty means zero
+func ParseMinDirAge(text string) (time.Duration, error) {
+	if text == "" {
+		return 0, nil
+	}
+	age, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid min dir age %q: %v", text, err)
+	}
+	if age < 0 {
+		return 0, fmt.Errorf("min dir age %q is negative", text)
+	}
+	return age, nil
+}
+
+// ValidateCapacityScaleFactor checks that the capacity scale factor of a storage class is
+// in (0, 1], or greater than 1 with AllowCapacityOvercommit. Zero means no scaling.
+func ValidateCapacityScaleFactor(config MountConfig) error {
+	factor := config.CapacityScaleFactor
+	if math.IsNaN(factor) || math.IsInf(factor, 0) || factor < 0 {
+		return fmt.Errorf("capacity scale factor %v is not positive", factor)
+	}
+	if factor > 1 && !config.AllowCapacityOvercommit {
+		return fmt.Errorf("capacity scale factor %v overcommits the media, set allowCapacityOvercommit to allow it", factor)
+	}
+	return nil
+}
+
+// ParseDiscoveryPeriod parses the discovery period of a storage class, empty means zero,
+// i.e. the global period
+func ParseDiscoveryPeriod(text string) (time.Duration, error) {
+	if text == "" {
+		return 0, nil
+	}
+	period, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid discovery period %q: %v", text, err)
+	}
+	if period <= 0 {
+		return 0, fmt.Errorf("discovery period %q is not positive", text)
+	}
+	return period, nil
+}
+
+// HostPathTemplateData is the data of the host path templates
+type HostPathTemplateData struct {
+	// Path of the volume relative to the mount dir
+	Name string
+	// Storage class of the volume
+	Class string
+	// Name of the node
+	Node string
+}
+
+// ParseHostPathTemplate parses a host path template, checking that it executes to an
+// absolute path.
+func ParseHostPathTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("hostPath").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host path template %q: %v", text, err)
+	}
+	if _, err := ExecuteHostPathTemplate(tmpl, &HostPathTemplateData{Name: "volume", Class: "class", Node: "node"}); err != nil {
+		return nil, fmt.Errorf("invalid host path template %q: %v", text, err)
+	}
+	return tmpl, nil
+}
+
+// ExecuteHostPathTemplate returns the cleaned host path of a volume
+func ExecuteHostPathTemplate(tmpl *template.Template, data *HostPathTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(buf.String()) {
+		return "", fmt.Errorf("host path %q is not absolute", buf.String())
+	}
+	return filepath.Clean(buf.String()), nil
+}
+
+// VolumePath returns the path of the volume of the PV relative to the mount dir of its
+// class, whose host dir is hostDir
+func VolumePath(pv *v1.PersistentVolume, hostDir string) (string, error) {
+	if path, found := pv.Annotations[AnnVolumePath]; found {
+		return path, nil
+	}
+	if pv.Spec.Local == nil {
+		return "", fmt.Errorf("PV %q is not a local volume", pv.Name)
+	}
+	return filepath.Rel(hostDir, pv.Spec.Local.Path)
+}
+
+// SplitGlob splits dir into the directory above its first element with glob meta
+// characters, and the remaining elements, e.g. "/mnt/ssd-*" into "/mnt" and "ssd-*".
+// A dir without meta characters is its own root, with an empty pattern.
+func SplitGlob(dir string) (root, pattern string) {
+	dir = filepath.Clean(dir)
+	elements := strings.Split(dir, string(filepath.Separator))
+	for i, element := range elements {
+		if HasGlobMeta(element) {
+			root = strings.Join(elements[:i], string(filepath.Separator))
+			if root == "" {
+				root = string(filepath.Separator)
+			}
+			return root, strings.Join(elements[i:], string(filepath.Separator))
+		}
+	}
+	return dir, ""
+}
+
+// HasGlobMeta returns true if path has any of the meta characters of filepath.Match
+func HasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// ValidateGlobDirs checks that the host dir and mount dir have the same glob elements, so
+// that each matched base dir of the mount dir is mounted from the host dir with the same
+// elements. An empty mount dir is generated by the bootstrapper.
+func ValidateGlobDirs(hostDir, mountDir string) error {
+	if mountDir == "" {
+		return nil
+	}
+	_, hostPattern := SplitGlob(hostDir)
+	_, mountPattern := SplitGlob(mountDir)
+	if hostPattern != mountPattern {
+		return fmt.Errorf("host dir %q and mount dir %q don't end with the same glob elements", hostDir, mountDir)
+	}
+	if _, err := filepath.Match(mountPattern, ""); err != nil {
+		return fmt.Errorf("invalid mount dir pattern %q: %v", mountDir, err)
+	}
+	return nil
+}
+
+// CompileLabelPattern compiles a label pattern, checking that it has named capture groups
+// and that the group names are valid label keys.
+func CompileLabelPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label pattern %q: %v", pattern, err)
+	}
+
+	named := 0
+	for _, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label key %q in label pattern %q: %v", name, pattern, errs)
+		}
+		named++
+	}
+	if named == 0 {
+		return nil, fmt.Errorf("label pattern %q has no named capture groups", pattern)
+	}
+	return re, nil
+}
@@ -17,7 +17,10 @@ limitations under the License.
 package controller
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/golang/glog"
@@ -29,47 +32,137 @@ import (
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/populator"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 
-	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
 )
 
-// StartLocalController starts the sync loop for the local PV discovery and deleter
-func StartLocalController(client *kubernetes.Clientset, config *common.UserConfig) {
+// exitNodeMissingLabel is the exit code when the node doesn't have the labels of the node
+// affinity of its PVs
+const exitNodeMissingLabel = 2
+
+// StartLocalController starts the sync loop for the local PV discovery and deleter.
+// If mux is not nil, the health of the discovery is served at /healthz, and the
+// decisions of the last discovery at /debug/discovery. If rescanner is not nil, its
+// triggers run a cycle without waiting for the discovery period, and with mux, it is
+// served at /rescan. Once ctx is done, no more PVs are created, and it returns after the
+// cycle in progress and the background cleanups have finished.
+func StartLocalController(ctx context.Context, client *kubernetes.Clientset, config *common.UserConfig, mux *http.ServeMux, rescanner *Rescanner) {
 	glog.Info("Initializing volume cache\n")
 
 	provisionerName := fmt.Sprintf("local-volume-provisioner-%v-%v", config.Node.Name, config.Node.UID)
 
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(client.Core().RESTClient()).Events("")})
-	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: provisionerName})
+	component := config.EventComponent
+	if component == "" {
+		component = provisionerName
+	}
+	recorder := common.NewEventRecorder(broadcaster, component, config.EventMode)
+
+	volumeLogger, err := util.NewVolumeLogger(config.LogFormat, os.Stderr)
+	if err != nil {
+		glog.Fatalf("Error creating volume logger: %v", err)
+	}
+
+	volUtil := util.NewVolumeUtil()
+	if config.FsOperationTimeout > 0 {
+		volUtil = util.NewTimeoutVolumeUtil(volUtil, config.FsOperationTimeout)
+	}
 
 	runtimeConfig := &common.RuntimeConfig{
-		UserConfig: config,
-		Cache:      cache.NewVolumeCache(),
-		VolUtil:    util.NewVolumeUtil(),
-		APIUtil:    util.NewAPIUtil(client),
-		Client:     client,
-		Name:       provisionerName,
-		Recorder:   recorder,
+		UserConfig:   config,
+		Cache:        cache.NewVolumeCache(),
+		VolUtil:      volUtil,
+		APIUtil:      util.NewAPIUtil(client),
+		Client:       client,
+		Name:         provisionerName,
+		Recorder:     recorder,
+		RateLimiter:  util.NewRateLimiter(config.APIQPS, config.APIBurst),
+		VolumeLogger: volumeLogger,
+		HookRunner:   util.NewHookRunner(),
 	}
 
 	populator := populator.NewPopulator(runtimeConfig)
 	populator.Start()
 
 	discoverer, err := discovery.NewDiscoverer(runtimeConfig)
+	if discovery.IsNodeMissingLabel(err) {
+		// A misconfiguration, not a crash, so no stack traces
+		glog.Errorf("Error starting discoverer: %v. Label node %q or change -node-affinity-label-keys", err, config.Node.Name)
+		glog.Flush()
+		os.Exit(exitNodeMissingLabel)
+	}
 	if err != nil {
 		glog.Fatalf("Error starting discoverer: %v", err)
 	}
+	if config.HostRootfs != "" {
+		if err := discoverer.CheckHostDirs(); err != nil {
+			glog.Fatalf("Invalid storage class config: %v", err)
+		}
+	}
+	if mux != nil {
+		mux.Handle("/healthz", discoverer.HealthzHandler())
+		mux.Handle("/debug/discovery", discoverer.DebugHandler())
+		if rescanner != nil {
+			mux.Handle("/rescan", rescanner.Handler())
+		}
+	}
 
 	deleter := deleter.NewDeleter(runtimeConfig)
 
 	glog.Info("Controller started\n")
-	for {
-		deleter.DeletePVs()
-		discoverer.DiscoverLocalVolumes()
-		time.Sleep(10 * time.Second)
+	run(ctx, config, discoverer, deleter, rescanner)
+	glog.Info("Controller stopped\n")
+}
+
+// run runs the discovery and deleter cycles until ctx is done, then waits for the
+// background cleanups to finish
+func run(ctx context.Context, config *common.UserConfig, discoverer *discovery.Discoverer, deleter *deleter.Deleter, rescanner *Rescanner) {
+	// Classes with a longer discovery period are skipped until they are due
+	period := discoverer.Period()
+	jitterFactor := config.DiscoveryJitterFactor
+	if jitterFactor == 0 {
+		jitterFactor = common.DefaultDiscoveryJitterFactor
+	}
+
+	// The cleanups don't use ctx, so that the ones in progress when it is done still
+	// finish instead of leaving released PVs behind. The discovery does, so that a scan
+	// stuck on a slow volume doesn't hold up the shutdown.
+	cleanupCtx := context.Background()
+	go func() {
+		<-ctx.Done()
+		discoverer.Drain()
+	}()
+
+	runCycles(ctx, period, jitterFactor, rescanner.requested(), func() {
+		deleter.DeletePVs(cleanupCtx)
+		discoverer.DiscoverLocalVolumes(ctx)
+	})
+	rescanner.stop()
+	glog.Info("Controller stopping, waiting for the cleanups in progress\n")
+	deleter.Wait()
+}
+
+// runCycles runs cycle until ctx is done, waiting for the jittered period after each
+// cycle, like wait.JitterUntil, unless a rescan is requested in the meantime. A rescan
+// requested while a cycle runs starts the next cycle as soon as it returns.
+func runCycles(ctx context.Context, period time.Duration, jitterFactor float64, rescan <-chan struct{}, cycle func()) {
+	for ctx.Err() == nil {
+		cycle()
+
+		delay := period
+		if jitterFactor > 0 {
+			delay = wait.Jitter(period, jitterFactor)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		case <-rescan:
+			glog.Info("Running a discovery cycle for the requested rescan")
+		}
+		timer.Stop()
 	}
 }
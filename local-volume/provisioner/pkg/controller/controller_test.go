@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/cache"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/deleter"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/discovery"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRun_CancelSlowDiscovery(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "test-node",
+			Labels: map[string]string{common.NodeLabelKey: "test-node"},
+		},
+	}
+	volumeCache := cache.NewVolumeCache()
+
+	// Scanning all the volumes takes 10s
+	volUtil := util.NewFakeVolumeUtil(false)
+	volUtil.SetCapacityDelay(100 * time.Millisecond)
+	files := []*util.FakeDirEntry{}
+	for i := 0; i < 100; i++ {
+		files = append(files, &util.FakeDirEntry{Name: fmt.Sprintf("mount%d", i), VolumeType: util.FakeEntryFile, Capacity: 100})
+	}
+	volUtil.AddNewDirEntries("/discoveryPath", map[string][]*util.FakeDirEntry{"dir1": files})
+
+	apiUtil := util.NewFakeAPIUtil(false, volumeCache)
+	apiUtil.SetNode(node)
+	apiUtil.SetStorageClass(&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "sc1"}})
+
+	config := &common.UserConfig{
+		Node: node,
+		DiscoveryMap: map[string]common.MountConfig{
+			"sc1": {HostDir: "/mnt/disks/dir1", MountDir: "/discoveryPath/dir1"},
+		},
+		DiscoveryPeriod: time.Hour,
+	}
+	runConfig := &common.RuntimeConfig{
+		UserConfig: config,
+		Cache:      volumeCache,
+		VolUtil:    volUtil,
+		APIUtil:    apiUtil,
+		Name:       "test-provisioner",
+		Recorder:   record.NewFakeRecorder(100),
+	}
+	discoverer, err := discovery.NewDiscoverer(runConfig)
+	if err != nil {
+		t.Fatalf("Error setting up discoverer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		run(ctx, config, discoverer, deleter.NewDeleter(runConfig), nil)
+		close(done)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected the discovery in progress to be aborted once ctx is done")
+	}
+	if created := len(volumeCache.ListPVs()); created >= len(files) {
+		t.Errorf("Expected the discovery to stop before creating all the PVs, got %d", created)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// Rescanner triggers a discovery cycle before the next scheduled one, e.g. once an admin
+// has mounted a new disk. Triggers are debounced: while a rescan is pending, more
+// triggers are coalesced into it, and they never start a cycle while one is running.
+type Rescanner struct {
+	pending chan struct{}
+	// Set once the controller has stopped, no more rescans run after that
+	stopped int32
+}
+
+// NewRescanner returns a Rescanner to pass to StartLocalController
+func NewRescanner() *Rescanner {
+	return &Rescanner{pending: make(chan struct{}, 1)}
+}
+
+// Trigger requests a rescan. It returns false if a rescan was already pending, or if the
+// controller has stopped.
+func (r *Rescanner) Trigger(source string) bool {
+	if atomic.LoadInt32(&r.stopped) != 0 {
+		glog.Infof("Ignoring rescan requested by %s, the controller has stopped", source)
+		return false
+	}
+	select {
+	case r.pending <- struct{}{}:
+		glog.Infof("Rescan requested by %s", source)
+		return true
+	default:
+		glog.V(4).Infof("Rescan requested by %s is already pending", source)
+		return false
+	}
+}
+
+// Handler returns the handler of the /rescan endpoint, which triggers a rescan on POST
+func (r *Rescanner) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if atomic.LoadInt32(&r.stopped) != 0 {
+			http.Error(w, "controller has stopped", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		if r.Trigger(fmt.Sprintf("HTTP request from %s", req.RemoteAddr)) {
+			fmt.Fprintln(w, "rescan triggered")
+		} else {
+			fmt.Fprintln(w, "rescan already pending")
+		}
+	})
+}
+
+// requested returns the channel that receives the pending rescans, nil for a nil
+// Rescanner, which never triggers
+func (r *Rescanner) requested() <-chan struct{} {
+	if r == nil {
+		return nil
+	}
+	return r.pending
+}
+
+// stop makes the next triggers fail, once the controller loop has returned
+func (r *Rescanner) stop() {
+	if r != nil {
+		atomic.StoreInt32(&r.stopped, 1)
+	}
+}
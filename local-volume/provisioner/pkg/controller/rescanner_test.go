@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRescanner_Trigger(t *testing.T) {
+	r := NewRescanner()
+	if !r.Trigger("test") {
+		t.Errorf("Expected the first trigger to request a rescan")
+	}
+	// Coalesced into the pending rescan
+	if r.Trigger("test") {
+		t.Errorf("Expected the second trigger to be debounced")
+	}
+	<-r.requested()
+	if !r.Trigger("test") {
+		t.Errorf("Expected a trigger after the rescan started to request another one")
+	}
+
+	r.stop()
+	<-r.requested()
+	if r.Trigger("test") {
+		t.Errorf("Expected no rescan once stopped")
+	}
+}
+
+func TestRescanner_Handler(t *testing.T) {
+	r := NewRescanner()
+	tests := []struct {
+		name         string
+		method       string
+		stopped      bool
+		expectedCode int
+	}{
+		{name: "get", method: http.MethodGet, expectedCode: http.StatusMethodNotAllowed},
+		{name: "post", method: http.MethodPost, expectedCode: http.StatusAccepted},
+		{name: "post while pending", method: http.MethodPost, expectedCode: http.StatusAccepted},
+		{name: "post once stopped", method: http.MethodPost, stopped: true, expectedCode: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		if test.stopped {
+			r.stop()
+		}
+		rec := httptest.NewRecorder()
+		r.Handler().ServeHTTP(rec, httptest.NewRequest(test.method, "/rescan", nil))
+		if rec.Code != test.expectedCode {
+			t.Errorf("Expected status %v, got %v", test.expectedCode, rec.Code)
+		}
+	}
+	// Both POSTs were merged into one rescan
+	<-r.requested()
+	select {
+	case <-r.requested():
+		t.Errorf("Expected a single pending rescan")
+	default:
+	}
+}
+
+func TestRunCycles_Rescan(t *testing.T) {
+	r := NewRescanner()
+	ctx, cancel := context.WithCancel(context.Background())
+	cycles := make(chan int, 10)
+	done := make(chan struct{})
+	count := 0
+	go func() {
+		runCycles(ctx, time.Hour, 0, r.requested(), func() {
+			count++
+			cycles <- count
+		})
+		close(done)
+	}()
+
+	// The first cycle runs right away, the next one only when rescanned
+	if cycle := <-cycles; cycle != 1 {
+		t.Fatalf("Expected cycle 1, got %v", cycle)
+	}
+	r.Trigger("test")
+	select {
+	case cycle := <-cycles:
+		if cycle != 2 {
+			t.Errorf("Expected cycle 2, got %v", cycle)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected a cycle for the rescan")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the cycles to stop once ctx is done")
+	}
+	if len(cycles) != 0 {
+		t.Errorf("Expected no more cycles, got %v", len(cycles))
+	}
+}
@@ -17,89 +17,392 @@ limitations under the License.
 package deleter
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 // Deleter handles PV cleanup and object deletion
 // For file-based volumes, it deletes the contents of the directory
+// For block-based volumes, it optionally wipes the device in the background
 type Deleter struct {
 	*common.RuntimeConfig
+
+	mutex sync.Mutex
+	// PVs that are being cleaned up in the background
+	pendingPVs map[string]bool
+	// Used to wait for background cleanups to finish
+	pendingWg sync.WaitGroup
+	// True while the node is annotated to pause cleanup
+	paused bool
+	// True while cleanup is paused because the node is cordoned, with PauseCleanupOnCordon
+	cordoned bool
 }
 
 // NewDeleter creates a Deleter object to handle the cleanup and deletion of local PVs
 // allocated by this provisioner
 func NewDeleter(config *common.RuntimeConfig) *Deleter {
+	if config.RateLimiter == nil {
+		config.RateLimiter = util.NewRateLimiter(0, 0)
+	}
+	if config.VolumeLogger == nil {
+		config.VolumeLogger, _ = util.NewVolumeLogger(util.LogFormatText, nil)
+	}
+	if config.HookRunner == nil {
+		config.HookRunner = util.NewHookRunner()
+	}
 	return &Deleter{
 		RuntimeConfig: config,
+		pendingPVs:    map[string]bool{},
 	}
 }
 
 // DeletePVs will scan through all the existing PVs that are released, and cleanup and
-// delete them
-func (d *Deleter) DeletePVs() {
-	for _, pv := range d.Cache.ListPVs() {
-		if pv.Status.Phase == v1.VolumeReleased {
-			name := pv.Name
-			glog.Infof("Deleting PV %q", name)
-
-			// Cleanup volume
-			err := d.cleanupPV(pv)
-			if err != nil {
-				cleaningLocalPVErr := fmt.Errorf("Error cleaning PV %q: %v", name, err.Error())
-				d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventVolumeFailedDelete, cleaningLocalPVErr.Error())
-				continue
-			}
+// delete them. Once ctx is done, no more PVs are cleaned up and in progress wipes are aborted.
+func (d *Deleter) DeletePVs(ctx context.Context) {
+	d.RefreshNode()
+	node := d.GetNode()
+	if common.IsPaused(node) {
+		if !d.paused {
+			glog.Infof("Node %q has annotation %s=true, pausing cleanup", node.Name, common.AnnDiscoveryPaused)
+			d.paused = true
+		}
+		return
+	}
+	if d.paused {
+		glog.Infof("Resuming cleanup on node %q", node.Name)
+		d.paused = false
+	}
+	if d.PauseOnCordon && d.PauseCleanupOnCordon && common.IsCordoned(node, d.CordonTaintKey) {
+		if !d.cordoned {
+			glog.Infof("Node %q is cordoned, pausing cleanup", node.Name)
+			d.cordoned = true
+		}
+		return
+	}
+	if d.cordoned {
+		glog.Infof("Node %q is no longer cordoned, resuming cleanup", node.Name)
+		d.cordoned = false
+	}
 
-			// Remove API object
-			err = d.APIUtil.DeletePV(name)
-			if err != nil {
-				// TODO: Does delete return an error if object has already been deleted?
-				deletingLocalPVErr := fmt.Errorf("Error deleting PV %q: %v", name, err.Error())
-				d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventVolumeFailedDelete, deletingLocalPVErr.Error())
-				continue
+	// Only the PVs of the configured and enabled storage classes can be cleaned up
+	for class, config := range d.DiscoveryMap {
+		if !config.IsEnabled() {
+			continue
+		}
+		for _, pv := range d.Cache.ListPVsForClass(class) {
+			if ctx.Err() != nil {
+				return
+			}
+			if pv.Status.Phase == v1.VolumeReleased {
+				d.deleteReleasedPV(ctx, pv)
 			}
-			glog.Infof("Deleted PV %q", name)
 		}
 	}
 }
 
-func (d *Deleter) cleanupPV(pv *v1.PersistentVolume) error {
+func (d *Deleter) deleteReleasedPV(ctx context.Context, pv *v1.PersistentVolume) {
+	name := pv.Name
+	if pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain && !d.isRecycled(pv) {
+		glog.Warningf("PV %q is released but has reclaim policy %q, leaving it for manual cleanup", name, pv.Spec.PersistentVolumeReclaimPolicy)
+		return
+	}
+	if d.isPending(name) {
+		glog.V(4).Infof("PV %q is still being cleaned up", name)
+		return
+	}
+
+	if d.WipeBlockOnDelete && d.getVolumeType(pv) == common.VolumeTypeBlock {
+		// Wiping a device can take a long time, so don't block the sync loop on it
+		d.setPending(name, true)
+		d.pendingWg.Add(1)
+		go func() {
+			defer d.pendingWg.Done()
+			defer d.setPending(name, false)
+			d.deletePV(ctx, pv)
+		}()
+		return
+	}
+	d.deletePV(ctx, pv)
+}
+
+// isRecycled returns true if the PV is retained, but its class recycles released PVs
+func (d *Deleter) isRecycled(pv *v1.PersistentVolume) bool {
+	return pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain &&
+		d.DiscoveryMap[pv.Spec.StorageClassName].AutoRecycleReleased
+}
+
+// Wait waits for the cleanups running in the background, i.e. the wipes of block devices,
+// to finish
+func (d *Deleter) Wait() {
+	d.pendingWg.Wait()
+}
+
+func (d *Deleter) isPending(pvName string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.pendingPVs[pvName]
+}
+
+func (d *Deleter) setPending(pvName string, pending bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if pending {
+		d.pendingPVs[pvName] = true
+	} else {
+		delete(d.pendingPVs, pvName)
+	}
+}
+
+func (d *Deleter) deletePV(ctx context.Context, pv *v1.PersistentVolume) {
+	name := pv.Name
+	recycled := d.isRecycled(pv)
+	if d.DryRun {
+		// Cleanup destroys data, so it is skipped too
+		glog.Infof("Dry run: skipping cleanup and deletion of PV %q at hostpath %q", name, pv.Spec.Local.Path)
+		return
+	}
+	if recycled && !d.hasBackingMedia(pv) {
+		return
+	}
+	if recycled {
+		glog.Infof("Recycling released PV %q with reclaim policy %q", name, pv.Spec.PersistentVolumeReclaimPolicy)
+	} else {
+		glog.Infof("Deleting PV %q", name)
+	}
+
+	// Cleanup volume
+	err := d.cleanupPV(ctx, pv)
+	if err != nil {
+		cleaningLocalPVErr := fmt.Errorf("Error cleaning PV %q: %v", name, err.Error())
+		d.RuntimeConfig.Recorder.Event(pv, v1.EventTypeWarning, common.EventVolumeFailedDelete, cleaningLocalPVErr.Error())
+		return
+	}
+	if err = d.runPreDeleteHook(ctx, pv); err != nil {
+		glog.Errorf("Error running pre-delete hook of PV %q, not deleting it: %v", name, err)
+		d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventPreDeleteHookFailed, "Pre-delete hook failed, not deleting PV: %v", err)
+		return
+	}
+
+	// Remove API object
+	if err = d.deletePVObject(ctx, name); err != nil {
+		deletingLocalPVErr := fmt.Errorf("Error deleting PV %q: %v", name, err.Error())
+		d.RuntimeConfig.Recorder.Event(pv, v1.EventTypeWarning, common.EventVolumeFailedDelete, deletingLocalPVErr.Error())
+		return
+	}
+	metrics.DeletedVolumes.Inc(pv.Spec.StorageClassName)
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	d.VolumeLogger.Info(&util.VolumeEvent{
+		Event:    util.VolumeEventDeleted,
+		Class:    pv.Spec.StorageClassName,
+		PVName:   name,
+		HostPath: pv.Spec.Local.Path,
+		Capacity: capacity.Value(),
+		Node:     d.GetNode().Name,
+	}, fmt.Sprintf("Deleted PV %q", name))
+	if d.RemoveEmptyDirsOnDelete && !recycled {
+		d.removeEmptyDir(pv)
+	}
+	if recycled {
+		d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeNormal, common.EventVolumeRecycled, "Cleaned up and deleted released PV of volume at host path %q, it is recreated as available", pv.Spec.Local.Path)
+		return
+	}
+	d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeNormal, common.EventVolumeDeleted, "Cleaned up and deleted PV of volume at host path %q", pv.Spec.Local.Path)
+}
+
+// deletePVObject deletes the PV API object with exponential backoff, up to APIRetryAttempts
+// in total. A PV that is already gone is treated as success. The error of the last attempt
+// is returned once the attempts are exhausted or ctx is done.
+func (d *Deleter) deletePVObject(ctx context.Context, name string) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(d.APIRetryBackoff(), func() (bool, error) {
+		if err := d.RateLimiter.Wait(ctx); err != nil {
+			return false, err
+		}
+		err := d.APIUtil.DeletePV(name)
+		if err != nil && !errors.IsNotFound(err) {
+			glog.Errorf("Error deleting PV %q: %v", name, err)
+			lastErr = err
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		glog.Errorf("Giving up deleting PV %q after %d attempts", name, d.APIRetryBackoff().Steps)
+		return lastErr
+	}
+	return err
+}
+
+// removeEmptyDir removes the directory of a deleted file PV if it is empty. Block devices
+// and mount points are never removed.
+func (d *Deleter) removeEmptyDir(pv *v1.PersistentVolume) {
+	mountPath, err := d.getMountPath(pv)
+	if err != nil {
+		glog.Errorf("Error getting the path of deleted PV %q: %v", pv.Name, err)
+		return
+	}
+	if isDir, err := d.VolUtil.IsDir(mountPath); err != nil || !isDir {
+		glog.V(4).Infof("Not removing %q of deleted PV %q, it is not a directory", mountPath, pv.Name)
+		return
+	}
+	if isMountPoint, err := d.VolUtil.IsMountPoint(mountPath); err != nil || isMountPoint {
+		glog.V(4).Infof("Not removing %q of deleted PV %q, it may be a mount point", mountPath, pv.Name)
+		return
+	}
+	if err := d.VolUtil.RemoveDir(mountPath); err != nil {
+		glog.Warningf("Error removing the directory of deleted PV %q: %v", pv.Name, err)
+		return
+	}
+	glog.Infof("Removed empty directory %q of deleted PV %q", mountPath, pv.Name)
+	d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeNormal, common.EventVolumeDirRemoved, "Removed empty directory at host path %q", pv.Spec.Local.Path)
+}
+
+// runPreDeleteHook runs the pre-delete hook, if any, with the PV name and host path
+func (d *Deleter) runPreDeleteHook(ctx context.Context, pv *v1.PersistentVolume) error {
+	if d.PreDeleteHook == "" {
+		return nil
+	}
+	timeout := d.PreDeleteHookTimeout
+	if timeout <= 0 {
+		timeout = common.DefaultPreDeleteHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	glog.Infof("Running pre-delete hook %q of PV %q", d.PreDeleteHook, pv.Name)
+	return d.HookRunner.Run(ctx, d.PreDeleteHook, pv.Name, pv.Spec.Local.Path)
+}
+
+// hasBackingMedia checks that the volume of a PV that is recycled still exists, as a
+// PV recreated for it couldn't be used
+func (d *Deleter) hasBackingMedia(pv *v1.PersistentVolume) bool {
+	mountPath, err := d.getMountPath(pv)
+	if err != nil {
+		glog.Errorf("Error getting the path of PV %q: %v", pv.Name, err)
+		return false
+	}
+	exists, err := d.VolUtil.Exists(mountPath)
+	if err != nil {
+		glog.Errorf("Error checking the volume of PV %q at %q: %v", pv.Name, mountPath, err)
+		return false
+	}
+	if !exists {
+		glog.Warningf("Not recycling released PV %q, its volume at %q is missing", pv.Name, mountPath)
+		d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventMissingBackingMedia, "Not recycling released PV, the volume at host path %q is missing", pv.Spec.Local.Path)
+		return false
+	}
+	return true
+}
+
+// getMountPath returns the path of the PV's volume inside the provisioner's container
+func (d *Deleter) getMountPath(pv *v1.PersistentVolume) (string, error) {
 	if pv.Spec.Local == nil {
-		return fmt.Errorf("Unsupported volume type")
+		return "", fmt.Errorf("Unsupported volume type")
 	}
 
 	config, ok := d.DiscoveryMap[pv.Spec.StorageClassName]
 	if !ok {
-		return fmt.Errorf("Unknown storage class name %v", pv.Spec.StorageClassName)
+		return "", fmt.Errorf("Unknown storage class name %v", pv.Spec.StorageClassName)
 	}
 
-	// TODO: Get volType from PV.
-	volType := common.VolumeTypeFile
+	relativePath, err := common.VolumePath(pv, config.HostRoot())
+	if err != nil {
+		return "", fmt.Errorf("Could not get relative path: %v", err)
+	}
+	return filepath.Join(config.MountRoot(), relativePath), nil
+}
+
+// getVolumeType returns the volume type of the PV, defaulting to file if it can't be determined
+func (d *Deleter) getVolumeType(pv *v1.PersistentVolume) string {
+	mountPath, err := d.getMountPath(pv)
+	if err != nil {
+		return common.VolumeTypeFile
+	}
+	if isBlock, err := d.VolUtil.IsBlock(mountPath); err == nil && isBlock {
+		return common.VolumeTypeBlock
+	}
+	return common.VolumeTypeFile
+}
+
+func (d *Deleter) cleanupPV(ctx context.Context, pv *v1.PersistentVolume) error {
+	mountPath, err := d.getMountPath(pv)
+	if err != nil {
+		return err
+	}
+
+	volType := d.getVolumeType(pv)
 	switch volType {
 	case common.VolumeTypeFile:
-		return d.cleanupFileVolume(pv, config)
+		return d.cleanupFileVolume(pv, mountPath)
 	case common.VolumeTypeBlock:
-		return fmt.Errorf("Not yet implemented")
+		return d.cleanupBlockVolume(ctx, pv, mountPath)
 	default:
 		return fmt.Errorf("Unexpected volume type %q for deleting path %q", volType, pv.Spec.Local.Path)
 	}
 }
 
-func (d *Deleter) cleanupFileVolume(pv *v1.PersistentVolume, config common.MountConfig) error {
-	specPath := pv.Spec.Local.Path
-	relativePath, err := filepath.Rel(config.HostDir, specPath)
-	if err != nil {
-		return fmt.Errorf("Could not get relative path: %v", err)
+func (d *Deleter) cleanupFileVolume(pv *v1.PersistentVolume, mountPath string) error {
+	if d.DiscoveryMap[pv.Spec.StorageClassName].RequireMountPoint {
+		isMountPoint, err := d.VolUtil.IsMountPoint(mountPath)
+		if err != nil {
+			return err
+		}
+		if !isMountPoint {
+			glog.Warningf("PV %q path %q is not a mount point, the disk may be unmounted", pv.Name, mountPath)
+			return fmt.Errorf("path %q is not a mount point", mountPath)
+		}
 	}
 
-	mountPath := filepath.Join(config.MountDir, relativePath)
-
-	glog.Infof("Deleting PV %q contents at hostpath %q, mountpath %q", pv.Name, specPath, mountPath)
+	glog.Infof("Deleting PV %q contents at hostpath %q, mountpath %q", pv.Name, pv.Spec.Local.Path, mountPath)
 	return d.VolUtil.DeleteContents(mountPath)
 }
+
+func (d *Deleter) cleanupBlockVolume(ctx context.Context, pv *v1.PersistentVolume, mountPath string) error {
+	d.checkDeviceID(pv, mountPath)
+	if !d.WipeBlockOnDelete {
+		return nil
+	}
+
+	timeout := d.BlockWipeTimeout
+	if timeout <= 0 {
+		timeout = common.DefaultBlockWipeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	glog.Infof("Wiping PV %q block device at hostpath %q, mountpath %q", pv.Name, pv.Spec.Local.Path, mountPath)
+	if err := d.VolUtil.WipeBlock(ctx, mountPath); err != nil {
+		d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventVolumeFailedWipe, "Error wiping block device %q: %v", pv.Spec.Local.Path, err)
+		return err
+	}
+	d.RuntimeConfig.Recorder.Eventf(pv, v1.EventTypeNormal, common.EventVolumeWiped, "Wiped block device %q", pv.Spec.Local.Path)
+	return nil
+}
+
+// checkDeviceID warns if the block device of the PV is not the one it was created for
+func (d *Deleter) checkDeviceID(pv *v1.PersistentVolume, mountPath string) {
+	expectedID, found := pv.Annotations[common.AnnDeviceID]
+	if !found {
+		return
+	}
+	deviceID, err := d.VolUtil.GetDeviceID(mountPath)
+	if err != nil {
+		glog.Warningf("Error getting device ID of PV %q at hostpath %q: %v", pv.Name, pv.Spec.Local.Path, err)
+		return
+	}
+	if deviceID != expectedID {
+		glog.Warningf("PV %q block device at hostpath %q has device ID %q, but was created for %q, the media may have been swapped",
+			pv.Name, pv.Spec.Local.Path, deviceID, expectedID)
+	}
+}
@@ -17,14 +17,20 @@ limitations under the License.
 package deleter
 
 import (
+	"context"
+	"fmt"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/cache"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/record"
 )
 
@@ -36,18 +42,51 @@ const (
 type testConfig struct {
 	apiShouldFail       bool
 	volDeleteShouldFail bool
+	wipeBlockOnDelete   bool
+	dryRun              bool
+	requireMountPoint   bool
+	classDisabled       bool
+	autoRecycleReleased bool
+	hookShouldFail      bool
+	removeEmptyDirs     bool
+	// Maximum number of attempts of API calls
+	apiRetryAttempts int
+	// Number of DeletePV calls that fail before succeeding
+	deleteTransientFailures int
+	// Configure the class with glob host and mount dirs that match the test dir
+	globDirs bool
+	// Command of the pre-delete hook
+	preDeleteHook string
+	// Annotations of the node
+	nodeAnnotations map[string]string
+	// Unschedulable node
+	nodeCordoned bool
+	// Pause cleanup while the node is cordoned
+	pauseCleanupOnCordon bool
 	// Precreated PVs
 	vols map[string]*testVol
 	// Expected names of deleted PV
 	expectedDeletedPVs map[string]string
 	// The remaining fields are set during setup
-	volUtil *util.FakeVolumeUtil
-	apiUtil *util.FakeAPIUtil
-	cache   *cache.VolumeCache
+	volUtil    *util.FakeVolumeUtil
+	apiUtil    *util.FakeAPIUtil
+	cache      *cache.VolumeCache
+	recorder   *record.FakeRecorder
+	hookRunner *util.FakeHookRunner
 }
 
 type testVol struct {
-	pvPhase v1.PersistentVolumePhase
+	pvPhase       v1.PersistentVolumePhase
+	reclaimPolicy v1.PersistentVolumeReclaimPolicy
+	// Block volumes are backed by a device under the test dir
+	isBlock bool
+	// File volumes with a mount point are backed by a directory under the test dir
+	isMountPoint bool
+	// With autoRecycleReleased, file volumes are backed by a directory under the test
+	// dir, unless it is missing
+	isMissing bool
+	// Host path from a host path template, the volume is the PV name under the test dir
+	templatedHostPath string
 }
 
 func TestDeleteVolumes_Basic(t *testing.T) {
@@ -75,7 +114,7 @@ func TestDeleteVolumes_Basic(t *testing.T) {
 	}
 	d := testSetup(t, test)
 
-	d.DeletePVs()
+	d.DeletePVs(context.Background())
 	verifyDeletedPVs(t, test)
 }
 
@@ -92,10 +131,10 @@ func TestDeleteVolumes_Twice(t *testing.T) {
 	}
 	d := testSetup(t, test)
 
-	d.DeletePVs()
+	d.DeletePVs(context.Background())
 	verifyDeletedPVs(t, test)
 
-	d.DeletePVs()
+	d.DeletePVs(context.Background())
 	test.expectedDeletedPVs = map[string]string{}
 	verifyDeletedPVs(t, test)
 }
@@ -109,7 +148,7 @@ func TestDeleteVolumes_Empty(t *testing.T) {
 	}
 	d := testSetup(t, test)
 
-	d.DeletePVs()
+	d.DeletePVs(context.Background())
 	verifyDeletedPVs(t, test)
 }
 
@@ -126,11 +165,51 @@ func TestDeleteVolumes_DeletePVFails(t *testing.T) {
 	}
 	d := testSetup(t, test)
 
-	d.DeletePVs()
+	d.DeletePVs(context.Background())
 	verifyDeletedPVs(t, test)
 	verifyPVExists(t, test)
 }
 
+func TestDeleteVolumes_DeletePVRetried(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		apiRetryAttempts:        3,
+		deleteTransientFailures: 2,
+		vols:                    vols,
+		expectedDeletedPVs:      map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	// No warning for the transient failures
+	verifyEvents(t, test, []string{common.EventVolumeDeleted})
+}
+
+func TestDeleteVolumes_DeletePVRetriesExhausted(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		apiRetryAttempts:        2,
+		deleteTransientFailures: 2,
+		vols:                    vols,
+		expectedDeletedPVs:      map[string]string{},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyPVExists(t, test)
+	verifyEvents(t, test, []string{common.EventVolumeFailedDelete})
+}
+
 func TestDeleteVolumes_CleanupFails(t *testing.T) {
 	vols := map[string]*testVol{
 		"pv4": {
@@ -144,7 +223,418 @@ func TestDeleteVolumes_CleanupFails(t *testing.T) {
 	}
 	d := testSetup(t, test)
 
-	d.DeletePVs()
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyPVExists(t, test)
+}
+
+func TestDeleteVolumes_DryRun(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		dryRun:             true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyPVExists(t, test)
+}
+
+func TestDeleteVolumes_Cancelled(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{},
+	}
+	d := testSetup(t, test)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.DeletePVs(ctx)
+	verifyDeletedPVs(t, test)
+	verifyPVExists(t, test)
+}
+
+func TestDeleteVolumes_ReclaimPolicy(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase:       v1.VolumeReleased,
+			reclaimPolicy: v1.PersistentVolumeReclaimRetain,
+		},
+		"pv5": {
+			pvPhase:       v1.VolumeReleased,
+			reclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		},
+	}
+	test := &testConfig{
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv5": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	if _, found := test.cache.GetPV("pv4"); !found {
+		t.Errorf("Retained PV %q doesn't exist in cache", "pv4")
+	}
+}
+
+func TestDeleteVolumes_AutoRecycleReleased(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv3": {
+			pvPhase:       v1.VolumeBound,
+			reclaimPolicy: v1.PersistentVolumeReclaimRetain,
+		},
+		"pv4": {
+			pvPhase:       v1.VolumeReleased,
+			reclaimPolicy: v1.PersistentVolumeReclaimRetain,
+		},
+		"pv5": {
+			pvPhase:       v1.VolumeReleased,
+			reclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			isMissing:     true,
+		},
+	}
+	test := &testConfig{
+		autoRecycleReleased: true,
+		vols:                vols,
+		expectedDeletedPVs:  map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	for _, pvName := range []string{"pv3", "pv5"} {
+		if _, found := test.cache.GetPV(pvName); !found {
+			t.Errorf("PV %q doesn't exist in cache", pvName)
+		}
+	}
+	verifyEvents(t, test, []string{common.EventVolumeRecycled, common.EventMissingBackingMedia})
+}
+
+func TestDeleteVolumes_Block(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+			isBlock: true,
+		},
+	}
+	test := &testConfig{
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyEvents(t, test, []string{common.EventVolumeDeleted})
+}
+
+func TestDeleteVolumes_WipeBlock(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+			isBlock: true,
+		},
+	}
+	test := &testConfig{
+		wipeBlockOnDelete:  true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	d.pendingWg.Wait()
+	verifyDeletedPVs(t, test)
+	verifyEvents(t, test, []string{common.EventVolumeWiped, common.EventVolumeDeleted})
+}
+
+func TestDeleteVolumes_WipeBlockFails(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+			isBlock: true,
+		},
+	}
+	test := &testConfig{
+		wipeBlockOnDelete:   true,
+		volDeleteShouldFail: true,
+		vols:                vols,
+		expectedDeletedPVs:  map[string]string{},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	d.pendingWg.Wait()
+	verifyDeletedPVs(t, test)
+	verifyPVExists(t, test)
+	verifyEvents(t, test, []string{common.EventVolumeFailedWipe, common.EventVolumeFailedDelete})
+}
+
+func TestDeleteVolumes_RequireMountPoint(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase:      v1.VolumeReleased,
+			isMountPoint: true,
+		},
+		"pv5": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		requireMountPoint:  true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	if _, found := test.cache.GetPV("pv5"); !found {
+		t.Errorf("Unmounted PV %q doesn't exist in cache", "pv5")
+	}
+	verifyEvents(t, test, []string{common.EventVolumeDeleted, common.EventVolumeFailedDelete})
+}
+
+func TestDeleteVolumes_HostPathTemplate(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase:           v1.VolumeReleased,
+			isMountPoint:      true,
+			templatedHostPath: "/mnt/by-uuid/1234",
+		},
+		"pv5": {
+			pvPhase:           v1.VolumeReleased,
+			templatedHostPath: "/mnt/by-uuid/5678",
+		},
+	}
+	test := &testConfig{
+		requireMountPoint:  true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	// The volumes are found by the volume path annotation, not the host path
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyEvents(t, test, []string{common.EventVolumeDeleted, common.EventVolumeFailedDelete})
+}
+
+func TestDeleteVolumes_RemoveEmptyDirs(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+		"pv5": {
+			pvPhase: v1.VolumeReleased,
+		},
+		"pv6": {
+			pvPhase: v1.VolumeReleased,
+			isBlock: true,
+		},
+	}
+	test := &testConfig{
+		removeEmptyDirs:    true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": "", "pv5": "", "pv6": ""},
+	}
+	d := testSetup(t, test)
+	// The contents of pv5 are not removed by the fake cleanup
+	test.volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+		"test-dir/pv5": {{Name: "file1", VolumeType: util.FakeEntryFile}},
+	})
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyEvents(t, test, []string{common.EventVolumeDeleted, common.EventVolumeDeleted, common.EventVolumeDeleted, common.EventVolumeDirRemoved})
+	for pvName, expected := range map[string]bool{"pv4": false, "pv5": true, "pv6": true} {
+		exists, _ := test.volUtil.Exists(filepath.Join(testMountDir, "test-dir", pvName))
+		if exists != expected {
+			t.Errorf("Expected the volume of PV %q to exist %v, got %v", pvName, expected, exists)
+		}
+	}
+}
+
+func TestDeleteVolumes_PreDeleteHook(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+		"pv5": {
+			pvPhase: v1.VolumeBound,
+		},
+	}
+	test := &testConfig{
+		preDeleteHook:      "/hooks/reclaim",
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	expectedRuns := [][]string{{"/hooks/reclaim", "pv4", filepath.Join(testHostDir, "test-dir")}}
+	if runs := test.hookRunner.GetRuns(); !reflect.DeepEqual(runs, expectedRuns) {
+		t.Errorf("Expected hook runs %v, got %v", expectedRuns, runs)
+	}
+	verifyEvents(t, test, []string{common.EventVolumeDeleted})
+}
+
+func TestDeleteVolumes_PreDeleteHookFails(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		preDeleteHook:      "/hooks/reclaim",
+		hookShouldFail:     true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyPVExists(t, test)
+	verifyEvents(t, test, []string{common.EventPreDeleteHookFailed})
+
+	// The hook is run again in the next cycle
+	test.hookRunner.SetError(nil)
+	test.expectedDeletedPVs = map[string]string{"pv4": ""}
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	if runs := test.hookRunner.GetRuns(); len(runs) != 2 {
+		t.Errorf("Expected 2 hook runs, got %v", runs)
+	}
+	verifyEvents(t, test, []string{common.EventVolumeDeleted})
+}
+
+func TestDeleteVolumes_NoPreDeleteHook(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	if runs := test.hookRunner.GetRuns(); len(runs) != 0 {
+		t.Errorf("Expected no hook runs, got %v", runs)
+	}
+}
+
+func TestDeleteVolumes_GlobDirs(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase:      v1.VolumeReleased,
+			isMountPoint: true,
+		},
+		"pv5": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		globDirs:           true,
+		requireMountPoint:  true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{"pv4": ""},
+	}
+	d := testSetup(t, test)
+
+	// The volumes are found under the mount root with the path relative to the host root
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyEvents(t, test, []string{common.EventVolumeDeleted, common.EventVolumeFailedDelete})
+}
+
+func TestDeleteVolumes_Paused(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		nodeAnnotations:    map[string]string{common.AnnDiscoveryPaused: "true"},
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
+	verifyDeletedPVs(t, test)
+	verifyPVExists(t, test)
+}
+
+func TestDeleteVolumes_Cordoned(t *testing.T) {
+	tests := []struct {
+		pauseCleanupOnCordon bool
+		expectedDeletedPVs   map[string]string
+	}{
+		{false, map[string]string{"pv4": ""}},
+		{true, map[string]string{}},
+	}
+	for _, test := range tests {
+		config := &testConfig{
+			nodeCordoned:         true,
+			pauseCleanupOnCordon: test.pauseCleanupOnCordon,
+			vols: map[string]*testVol{
+				"pv4": {
+					pvPhase: v1.VolumeReleased,
+				},
+			},
+			expectedDeletedPVs: test.expectedDeletedPVs,
+		}
+		d := testSetup(t, config)
+
+		d.DeletePVs(context.Background())
+		verifyDeletedPVs(t, config)
+		if !test.pauseCleanupOnCordon {
+			continue
+		}
+		verifyPVExists(t, config)
+
+		// Uncordoning resumes the cleanup on the next cycle
+		node := *d.Node
+		node.Spec.Unschedulable = false
+		config.apiUtil.SetNode(&node)
+		config.expectedDeletedPVs = map[string]string{"pv4": ""}
+		d.DeletePVs(context.Background())
+		verifyDeletedPVs(t, config)
+	}
+}
+
+func TestDeleteVolumes_ClassDisabled(t *testing.T) {
+	vols := map[string]*testVol{
+		"pv4": {
+			pvPhase: v1.VolumeReleased,
+		},
+	}
+	test := &testConfig{
+		classDisabled:      true,
+		vols:               vols,
+		expectedDeletedPVs: map[string]string{},
+	}
+	d := testSetup(t, test)
+
+	d.DeletePVs(context.Background())
 	verifyDeletedPVs(t, test)
 	verifyPVExists(t, test)
 }
@@ -157,10 +647,36 @@ func testSetup(t *testing.T, config *testConfig) *Deleter {
 	fakePath := filepath.Join(testHostDir, "test-dir")
 	// Precreate PVs
 	for pvName, vol := range config.vols {
+		hostPath := fakePath
+		if vol.isBlock {
+			hostPath = filepath.Join(fakePath, pvName)
+			config.volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+				"test-dir": {{Name: pvName, VolumeType: util.FakeEntryBlock}},
+			})
+		} else if config.autoRecycleReleased || config.removeEmptyDirs {
+			hostPath = filepath.Join(fakePath, pvName)
+			if !vol.isMissing {
+				config.volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+					"test-dir": {{Name: pvName, VolumeType: util.FakeEntryFile}},
+				})
+			}
+		} else if config.requireMountPoint {
+			hostPath = filepath.Join(fakePath, pvName)
+			config.volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+				"test-dir": {{Name: pvName, VolumeType: util.FakeEntryFile, MountPoint: vol.isMountPoint}},
+			})
+		}
+		var annotations map[string]string
+		if vol.templatedHostPath != "" {
+			hostPath = vol.templatedHostPath
+			annotations = map[string]string{common.AnnVolumePath: pvName}
+		}
 		pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
-			Name:         pvName,
-			HostPath:     fakePath,
-			StorageClass: "sc1",
+			Name:          pvName,
+			HostPath:      hostPath,
+			StorageClass:  "sc1",
+			ReclaimPolicy: vol.reclaimPolicy,
+			Annotations:   annotations,
 		})
 		pv.Status.Phase = vol.pvPhase
 
@@ -172,21 +688,53 @@ func testSetup(t *testing.T, config *testConfig) *Deleter {
 	}
 
 	config.apiUtil = util.NewFakeAPIUtil(config.apiShouldFail, config.cache)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-node",
+			Annotations: config.nodeAnnotations,
+		},
+		Spec: v1.NodeSpec{Unschedulable: config.nodeCordoned},
+	}
+	config.apiUtil.SetNode(node)
+	config.apiUtil.SetTransientDeleteFailures(config.deleteTransientFailures)
+	enabled := !config.classDisabled
+	dir := "test-dir"
+	if config.globDirs {
+		dir = "test-*"
+	}
 	userConfig := &common.UserConfig{
+		Node: node,
 		DiscoveryMap: map[string]common.MountConfig{
 			"sc1": {
-				HostDir:  testHostDir + "/test-dir",
-				MountDir: testMountDir + "/test-dir",
+				HostDir:             testHostDir + "/" + dir,
+				MountDir:            testMountDir + "/" + dir,
+				RequireMountPoint:   config.requireMountPoint,
+				Enabled:             &enabled,
+				AutoRecycleReleased: config.autoRecycleReleased,
 			},
 		},
+		WipeBlockOnDelete:       config.wipeBlockOnDelete,
+		RemoveEmptyDirsOnDelete: config.removeEmptyDirs,
+		DryRun:                  config.dryRun,
+		PreDeleteHook:           config.preDeleteHook,
+		APIRetryAttempts:        config.apiRetryAttempts,
+		APIRetryInterval:        time.Millisecond,
+
+		PauseOnCordon:        true,
+		PauseCleanupOnCordon: config.pauseCleanupOnCordon,
+	}
+	config.recorder = record.NewFakeRecorder(100)
+	config.hookRunner = util.NewFakeHookRunner()
+	if config.hookShouldFail {
+		config.hookRunner.SetError(fmt.Errorf("exit status 1"))
 	}
-	fakeRecorder := &record.FakeRecorder{}
 	runtimeConfig := &common.RuntimeConfig{
 		UserConfig: userConfig,
 		Cache:      config.cache,
 		VolUtil:    config.volUtil,
 		APIUtil:    config.apiUtil,
-		Recorder:   fakeRecorder,
+		Recorder:   config.recorder,
+		HookRunner: config.hookRunner,
 	}
 	return NewDeleter(runtimeConfig)
 }
@@ -220,3 +768,27 @@ func verifyPVExists(t *testing.T, config *testConfig) {
 		}
 	}
 }
+
+// verifyEvents checks that exactly the events with the expected reasons were recorded, in any order
+func verifyEvents(t *testing.T, config *testConfig, expectedReasons []string) {
+	events := []string{}
+	for len(config.recorder.Events) > 0 {
+		events = append(events, <-config.recorder.Events)
+	}
+	for _, reason := range expectedReasons {
+		found := false
+		for i, event := range events {
+			if strings.Contains(event, " "+reason+" ") {
+				events = append(events[:i], events[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Expected event with reason %q, got none", reason)
+		}
+	}
+	for _, event := range events {
+		t.Errorf("Unexpected event %q", event)
+	}
+}
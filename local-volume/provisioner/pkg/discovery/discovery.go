@@ -17,15 +17,33 @@ limitations under the License.
 package discovery
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"hash/fnv"
+	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/kubernetes/pkg/api/v1/helper"
+	"k8s.io/kubernetes/pkg/kubelet/apis"
 )
 
 // Discoverer finds available volumes and creates PVs for them
@@ -33,101 +51,2350 @@ import (
 type Discoverer struct {
 	*common.RuntimeConfig
 	nodeAffinityAnn string
+	// How the node affinity is generated from the node labels
+	affinityConfig nodeAffinityConfig
+	pvNamePrefix   string
+	namingStrategy common.PVNamingStrategy
+	// Size in bits of the hashes in the PV names
+	hashBits int
+	// Which events are recorded
+	eventMode common.EventMode
+	// key = storageclass, value = compiled label pattern for the storageclass
+	labelPatterns map[string]*regexp.Regexp
+	// key = storageclass, value = parsed host path template for the storageclass
+	hostPathTemplates map[string]*template.Template
+	// key = storageclass, value = minimum age of the directories of file volumes
+	minDirAges map[string]time.Duration
+	// key = storageclass, value = discovery period overriding DiscoveryPeriod
+	discoveryPeriods map[string]time.Duration
+	// Capacity reporters of the classes that have one
+	capacityReporters map[string]common.CapacityReporter
+	// Patterns of directory entries that are not discovered
+	ignorePatterns []string
+
+	mutex sync.Mutex
+	// PVs whose creation is being retried in the background
+	pendingPVs map[string]bool
+	// Used to wait for background retries to finish
+	pendingWg sync.WaitGroup
+	// True while the node is annotated to pause discovery
+	paused bool
+	// True while no PVs are created because the node is cordoned, with PauseOnCordon
+	cordoned bool
+	// Last time a missing backing media event was recorded for a PV, key = PV name
+	missingMediaEvents map[string]time.Time
+	// True once the readiness gate of the class has passed, false while waiting for it, key = class name
+	readyClasses map[string]bool
+	// Result of checking if each configured storage class exists, key = class name
+	storageClassExists map[string]bool
+	// Last time a capacity shrink or growth warning was reported for a PV, key = PV name
+	capacityWarnings map[string]time.Time
+	// Volumes that failed their last health probe, key = volume path in the container
+	unhealthyVolumes map[string]bool
+	// Last time a name collision event was recorded for a PV, key = PV name
+	nameCollisionEvents map[string]time.Time
+	// Last time the host path of the volume of a PV not created because another PV has
+	// it was reported, key = name of the PV that wasn't created
+	hostPathInUseEvents map[string]hostPathInUseEvent
+	// Number of PVs that may still be created in this cycle under MaxPVsPerNode
+	pvBudget int64
+	// Set once reaching MaxPVsPerNode has been reported in this cycle
+	pvLimitReported int32
+	// Start of the last discovery of each class, key = class name
+	lastDiscoveries map[string]time.Time
+	// Start of the last discovery of each class that reconciled its existing PVs, key =
+	// class name
+	lastReconciles map[string]time.Time
+	// End of the last discovery in which all the classes succeeded, initially the creation
+	// time of the Discoverer
+	lastSuccess time.Time
+	// Set once Drain is called, no more PVs are created after that
+	draining int32
+	// Result of the last discovery and its end time, served by DebugHandler
+	lastResult     *DiscoveryResult
+	lastResultTime time.Time
+}
+
+// missingMediaEventInterval is the minimum interval between missing backing media
+// events of the same PV
+const missingMediaEventInterval = 10 * time.Minute
+
+// capacityWarningInterval is the minimum interval between capacity shrink or growth
+// warnings of the same PV
+const capacityWarningInterval = 10 * time.Minute
+
+// nameCollisionEventInterval is the minimum interval between name collision events
+// of the same PV
+const nameCollisionEventInterval = 10 * time.Minute
+
+// hostPathInUseEventInterval is the minimum interval between host path in use events
+// of the same volume
+const hostPathInUseEventInterval = 10 * time.Minute
+
+// hostPathInUseEvent is the last host path in use event of the volume of a PV
+type hostPathInUseEvent struct {
+	class string
+	time  time.Time
+}
+
+// NewDiscoverer creates a Discoverer object that will scan through
+// the configured directories and create local PVs for any new directories found
+func NewDiscoverer(config *common.RuntimeConfig) (*Discoverer, error) {
+	prefix := config.PVNamePrefix
+	if prefix == "" {
+		prefix = common.DefaultPVNamePrefix
+	}
+	namingStrategy := config.PVNamingStrategy
+	if namingStrategy == "" {
+		namingStrategy = common.PVNamingHash
+	}
+	if namingStrategy != common.PVNamingHash && namingStrategy != common.PVNamingReadable {
+		return nil, fmt.Errorf("Unsupported PV naming strategy %q", namingStrategy)
+	}
+	hashBits := config.PVNameHashBits
+	if hashBits == 0 {
+		hashBits = 32
+	}
+	if hashBits != 32 && hashBits != 64 {
+		return nil, fmt.Errorf("Unsupported PV name hash size %d, must be 32 or 64", hashBits)
+	}
+	if err := validatePVNamePrefix(prefix, namingStrategy, hashBits); err != nil {
+		return nil, err
+	}
+	eventMode := config.EventMode
+	switch eventMode {
+	case "":
+		eventMode = common.EventModePerVolume
+	case common.EventModePerVolume, common.EventModeSummary, common.EventModeNone:
+	default:
+		return nil, fmt.Errorf("Unsupported event mode %q", eventMode)
+	}
+	if config.RateLimiter == nil {
+		config.RateLimiter = util.NewRateLimiter(0, 0)
+	}
+	if config.VolumeLogger == nil {
+		config.VolumeLogger, _ = util.NewVolumeLogger(util.LogFormatText, nil)
+	}
+
+	ignorePatterns := config.IgnorePatterns
+	if ignorePatterns == nil {
+		ignorePatterns = strings.Split(common.DefaultIgnorePatterns, ",")
+	}
+	for _, pattern := range ignorePatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid ignore pattern %q: %v", pattern, err)
+		}
+	}
+
+	if err := common.ValidateExtraAnnotations(config.ExtraAnnotations); err != nil {
+		return nil, fmt.Errorf("Invalid extra annotations: %v", err)
+	}
+	if err := common.ValidateExtraLabels(config.ExtraLabels); err != nil {
+		return nil, fmt.Errorf("Invalid extra labels: %v", err)
+	}
+	if err := validateDiscoveryMap(config.DiscoveryMap); err != nil {
+		return nil, err
+	}
+	capacityReporters := map[string]common.CapacityReporter{}
+	for class, mountConfig := range config.DiscoveryMap {
+		if err := common.ValidateGlobDirs(mountConfig.HostDir, mountConfig.MountDir); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if err := common.ValidateExtraAnnotations(mountConfig.ExtraAnnotations); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if err := common.ValidateExtraLabels(mountConfig.ExtraLabels); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if err := common.ValidateMountOptions(mountConfig.MountOptions); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if err := common.ValidateCapacitySource(mountConfig.CapacitySource); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if err := common.ValidateReclaimPolicyFile(mountConfig.ReclaimPolicyFile); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		reporter, err := common.NewCapacityReporter(mountConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if reporter != nil {
+			capacityReporters[class] = reporter
+		}
+		if err := common.ValidateAccessModes(mountConfig.AccessModes); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+	}
+
+	minDirAges := map[string]time.Duration{}
+	discoveryPeriods := map[string]time.Duration{}
+	for class, mountConfig := range config.DiscoveryMap {
+		age, err := common.ParseMinDirAge(mountConfig.MinDirAge)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if age > 0 {
+			minDirAges[class] = age
+		}
+		period, err := common.ParseDiscoveryPeriod(mountConfig.DiscoveryPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if period > 0 {
+			discoveryPeriods[class] = period
+		}
+		if mountConfig.MaxVolumeConcurrency < 0 {
+			return nil, fmt.Errorf("Invalid config for storage class %q: max volume concurrency %d is negative", class, mountConfig.MaxVolumeConcurrency)
+		}
+		if err := common.ValidateCapacityScaleFactor(mountConfig); err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		if mountConfig.CapacityScaleFactor > 1 {
+			glog.Warningf("Storage class %q has capacity scale factor %v, its PVs advertise more capacity than their volumes have", class, mountConfig.CapacityScaleFactor)
+		}
+	}
+
+	for class, mountConfig := range config.DiscoveryMap {
+		for _, pattern := range mountConfig.ExcludePaths {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid config for storage class %q: invalid exclude pattern %q: %v", class, pattern, err)
+			}
+		}
+	}
+
+	labelPatterns := map[string]*regexp.Regexp{}
+	for class, mountConfig := range config.DiscoveryMap {
+		if mountConfig.LabelPattern == "" {
+			continue
+		}
+		re, err := common.CompileLabelPattern(mountConfig.LabelPattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		labelPatterns[class] = re
+	}
+
+	hostPathTemplates := map[string]*template.Template{}
+	for class, mountConfig := range config.DiscoveryMap {
+		if mountConfig.HostPathTemplate == "" {
+			continue
+		}
+		tmpl, err := common.ParseHostPathTemplate(mountConfig.HostPathTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config for storage class %q: %v", class, err)
+		}
+		hostPathTemplates[class] = tmpl
+	}
+
+	labelKeys := config.NodeAffinityLabelKeys
+	if len(labelKeys) == 0 {
+		labelKeys = []string{common.NodeLabelKey}
+	}
+	if config.NodeAffinityStrict && config.NodeAffinityFirstKey {
+		return nil, fmt.Errorf("NodeAffinityStrict and NodeAffinityFirstKey can't both be set")
+	}
+	if config.AdoptExisting && config.ScopePVInformer {
+		// The PVs to adopt don't have the node label, so the scoped informer can't find them
+		return nil, fmt.Errorf("AdoptExisting and ScopePVInformer can't both be set")
+	}
+	affinityConfig := nodeAffinityConfig{
+		labelKeys: labelKeys,
+		strict:    config.NodeAffinityStrict,
+		firstKey:  config.NodeAffinityFirstKey,
+		zone:      config.NodeAffinityZone,
+	}
+	nodeAffinityAnn, err := generateNodeAffinityAnn(config.Node, affinityConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	disabled := []string{}
+	for class, mountConfig := range config.DiscoveryMap {
+		if !mountConfig.IsEnabled() {
+			disabled = append(disabled, class)
+		}
+	}
+	if len(disabled) > 0 {
+		sort.Strings(disabled)
+		glog.Infof("Skipping the disabled storage classes %v, their volumes are not discovered or cleaned up", disabled)
+	}
+	if err := checkMountDirs(config.VolUtil, config.DiscoveryMap); err != nil {
+		return nil, err
+	}
+
+	return &Discoverer{
+		RuntimeConfig:   config,
+		nodeAffinityAnn: nodeAffinityAnn,
+		affinityConfig:  affinityConfig,
+		pvNamePrefix:    prefix,
+		namingStrategy:  namingStrategy,
+		hashBits:        hashBits,
+		eventMode:       eventMode,
+		labelPatterns:   labelPatterns,
+		ignorePatterns:  ignorePatterns,
+		pendingPVs:      map[string]bool{},
+
+		hostPathTemplates: hostPathTemplates,
+		minDirAges:        minDirAges,
+		discoveryPeriods:  discoveryPeriods,
+		capacityReporters: capacityReporters,
+		lastDiscoveries:   map[string]time.Time{},
+		lastReconciles:    map[string]time.Time{},
+
+		readyClasses:       map[string]bool{},
+		storageClassExists: map[string]bool{},
+		missingMediaEvents: map[string]time.Time{},
+		capacityWarnings:   map[string]time.Time{},
+		unhealthyVolumes:   map[string]bool{},
+
+		nameCollisionEvents: map[string]time.Time{},
+		hostPathInUseEvents: map[string]hostPathInUseEvent{},
+		lastSuccess:         time.Now(),
+	}, nil
+}
+
+// generateNodeAffinityAnn returns the alpha node affinity annotation of the PVs of the node
+func generateNodeAffinityAnn(node *v1.Node, config nodeAffinityConfig) (string, error) {
+	affinity, err := generateNodeAffinity(node, config)
+	if err != nil {
+		if IsNodeMissingLabel(err) {
+			return "", &nodeMissingLabelError{fmt.Sprintf("Failed to generate node affinity: %v", err)}
+		}
+		return "", fmt.Errorf("Failed to generate node affinity: %v", err)
+	}
+	tmpAnnotations := map[string]string{}
+	err = helper.StorageNodeAffinityToAlphaAnnotation(tmpAnnotations, affinity)
+	if err != nil {
+		return "", fmt.Errorf("Failed to convert node affinity to alpha annotation: %v", err)
+	}
+	return tmpAnnotations[v1.AlphaStorageNodeAffinityAnnotation], nil
+}
+
+// refreshNodeAffinity re-reads the node and regenerates the node affinity of new PVs
+// from its current labels. Existing PVs are not updated. The previous node affinity
+// is kept if the new one can't be generated.
+func (d *Discoverer) refreshNodeAffinity() {
+	d.RefreshNode()
+	nodeAffinityAnn, err := generateNodeAffinityAnn(d.GetNode(), d.affinityConfig)
+	if err != nil {
+		glog.Errorf("Error refreshing node affinity, keeping the previous one: %v", err)
+		return
+	}
+	if nodeAffinityAnn != d.nodeAffinityAnn {
+		glog.Infof("Node affinity of new PVs changed to %s", nodeAffinityAnn)
+		d.nodeAffinityAnn = nodeAffinityAnn
+	}
+}
+
+// validateDiscoveryMap checks that no two enabled storage classes have the same or
+// nested mount dirs or host dirs, which would give a volume the PVs of both classes.
+// The error lists all the conflicts.
+func validateDiscoveryMap(discoveryMap map[string]common.MountConfig) error {
+	classes := []string{}
+	for class, config := range discoveryMap {
+		if config.IsEnabled() {
+			classes = append(classes, class)
+		}
+	}
+	sort.Strings(classes)
+
+	conflicts := []string{}
+	for i, class := range classes {
+		for _, other := range classes[i+1:] {
+			config, otherConfig := discoveryMap[class], discoveryMap[other]
+			if isOverlappingPath(config.MountDir, otherConfig.MountDir) {
+				conflicts = append(conflicts, fmt.Sprintf("mount dir %q of storage class %q overlaps with %q of %q",
+					config.MountDir, class, otherConfig.MountDir, other))
+			}
+			if isOverlappingPath(config.HostDir, otherConfig.HostDir) {
+				conflicts = append(conflicts, fmt.Sprintf("host dir %q of storage class %q overlaps with %q of %q",
+					config.HostDir, class, otherConfig.HostDir, other))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("Invalid discovery map: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// checkMountDirs checks that the provisioner can read the mount dirs of the enabled
+// storage classes, or the mount roots of glob mount dirs, so that missing permissions
+// fail at startup instead of every discovery. Mount dirs that don't exist yet, e.g.
+// because the disks are not mounted, are skipped. The host dirs are only mounted at the
+// mount dirs, so they are not checked. The error lists all the unreadable mount dirs.
+func checkMountDirs(volUtil util.VolumeUtil, discoveryMap map[string]common.MountConfig) error {
+	classes := []string{}
+	for class, config := range discoveryMap {
+		if config.IsEnabled() {
+			classes = append(classes, class)
+		}
+	}
+	sort.Strings(classes)
+
+	unreadable := []string{}
+	for _, class := range classes {
+		mountDir := discoveryMap[class].MountRoot()
+		err := volUtil.CheckReadable(mountDir)
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		unreadable = append(unreadable, fmt.Sprintf("mount dir %q of storage class %q: %v", mountDir, class, err))
+	}
+	if len(unreadable) > 0 {
+		return fmt.Errorf("Mount dirs are not readable by uid %d, gid %d: %s", os.Geteuid(), os.Getegid(), strings.Join(unreadable, "; "))
+	}
+	return nil
+}
+
+// isOverlappingPath returns true if the paths are the same, or one is under the other.
+// Paths with glob elements overlap if any directories they match could, see
+// isOverlappingElement.
+func isOverlappingPath(path, other string) bool {
+	elements := strings.Split(filepath.Clean(path), string(filepath.Separator))
+	otherElements := strings.Split(filepath.Clean(other), string(filepath.Separator))
+	if len(elements) > len(otherElements) {
+		elements, otherElements = otherElements, elements
+	}
+	if len(elements) > 1 && elements[len(elements)-1] == "" {
+		// The root dir
+		elements = elements[:len(elements)-1]
+	}
+	for i, element := range elements {
+		if !isOverlappingElement(element, otherElements[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isOverlappingElement returns true if the path elements are the same, a glob matches the
+// other element, or both are globs whose literal prefixes before the first meta character
+// are compatible. The latter is conservative, e.g. "ssd-*" and "ssd-?" overlap, but
+// "ssd-*" and "nvme-*" don't.
+func isOverlappingElement(element, other string) bool {
+	if element == other {
+		return true
+	}
+	isGlob, isOtherGlob := common.HasGlobMeta(element), common.HasGlobMeta(other)
+	switch {
+	case isGlob && isOtherGlob:
+		prefix, otherPrefix := globPrefix(element), globPrefix(other)
+		return strings.HasPrefix(prefix, otherPrefix) || strings.HasPrefix(otherPrefix, prefix)
+	case isGlob:
+		matched, err := filepath.Match(element, other)
+		return matched || err != nil
+	case isOtherGlob:
+		matched, err := filepath.Match(other, element)
+		return matched || err != nil
+	}
+	return false
+}
+
+// globPrefix returns the literal prefix of the glob before its first meta character
+func globPrefix(glob string) string {
+	if i := strings.IndexAny(glob, `*?[\`); i >= 0 {
+		return glob[:i]
+	}
+	return glob
+}
+
+// validatePVNamePrefix checks that names generated with the prefix are valid DNS-1123 labels
+func validatePVNamePrefix(prefix string, namingStrategy common.PVNamingStrategy, hashBits int) error {
+	name := generatePVName(prefix, "", "", "", hashBits)
+	if namingStrategy == common.PVNamingReadable {
+		// The empty volume name gets the longest suffix
+		name = generateReadablePVName(prefix, "", "", "", hashBits)
+	}
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return fmt.Errorf("Invalid PV name prefix %q: %v", prefix, errs)
+	}
+	return nil
+}
+
+// nodeMissingLabelError is the error of a node that doesn't have the labels of the node
+// affinity of its PVs. Retrying doesn't help until the node is labeled or the label keys
+// are changed.
+type nodeMissingLabelError struct {
+	msg string
+}
+
+func (e *nodeMissingLabelError) Error() string {
+	return e.msg
+}
+
+// IsNodeMissingLabel returns true if err is the error of a node that doesn't have the
+// labels of the node affinity of its PVs
+func IsNodeMissingLabel(err error) bool {
+	_, ok := err.(*nodeMissingLabelError)
+	return ok
+}
+
+// nodeAffinityConfig is how the node affinity of the PVs is generated from the node labels
+type nodeAffinityConfig struct {
+	// Node label keys, each present key adds a requirement
+	labelKeys []string
+	// Fail if any of labelKeys is not present on the node
+	strict bool
+	// labelKeys are candidates in priority order, only the first present key is used
+	firstKey bool
+	// Also add a requirement for the zone label of the node, if it has one
+	zone bool
+}
+
+// zoneLabelKeys are the zone label keys of nodes, in priority order. Older nodes only
+// have the deprecated beta label.
+var zoneLabelKeys = []string{common.ZoneLabelKey, apis.LabelZoneFailureDomain}
+
+// generateNodeAffinity returns a node affinity with one requirement for each of the
+// label keys present on the node, all in the same term. Missing keys are skipped unless
+// strict is set. With firstKey, the label keys are candidates in priority order and only
+// the first one present on the node is used. It fails if none of the keys are present.
+// With zone, a requirement for the zone label of the node is added, or skipped if the
+// node has none, regardless of strict.
+// The affinity is always required: the API server rejects the storage node affinity of
+// PVs with preferred terms, and a local PV without required terms could be bound by
+// pods on other nodes, which can't use its volume.
+func generateNodeAffinity(node *v1.Node, config nodeAffinityConfig) (*v1.NodeAffinity, error) {
+	if node.Labels == nil {
+		return nil, &nodeMissingLabelError{"Node does not have labels"}
+	}
+
+	labelKeys := config.labelKeys
+	if config.firstKey {
+		for _, key := range labelKeys {
+			if _, found := node.Labels[key]; found {
+				glog.V(3).Infof("Using node label %s, the first of %v present on the node, for node affinity", key, labelKeys)
+				labelKeys = []string{key}
+				break
+			}
+		}
+	}
+
+	reqs := []v1.NodeSelectorRequirement{}
+	for _, key := range labelKeys {
+		nodeValue, found := node.Labels[key]
+		if !found {
+			if config.strict {
+				return nil, &nodeMissingLabelError{fmt.Sprintf("Node does not have expected label %s", key)}
+			}
+			glog.V(4).Infof("Node does not have label %s, skipping it for node affinity", key)
+			continue
+		}
+		reqs = append(reqs, v1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: v1.NodeSelectorOpIn,
+			Values:   []string{nodeValue},
+		})
+	}
+	if len(reqs) == 0 {
+		return nil, &nodeMissingLabelError{fmt.Sprintf("Node does not have any of the expected labels %v", labelKeys)}
+	}
+	if config.zone {
+		reqs = addZoneRequirement(node, reqs)
+	}
+
+	return &v1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{
+					MatchExpressions: reqs,
+				},
+			},
+		},
+	}, nil
+}
+
+// addZoneRequirement appends the requirement for the first zone label present on the
+// node, unless the node has none or reqs already have a requirement for a zone label
+func addZoneRequirement(node *v1.Node, reqs []v1.NodeSelectorRequirement) []v1.NodeSelectorRequirement {
+	for _, req := range reqs {
+		for _, key := range zoneLabelKeys {
+			if req.Key == key {
+				return reqs
+			}
+		}
+	}
+	for _, key := range zoneLabelKeys {
+		if zone, found := node.Labels[key]; found {
+			return append(reqs, v1.NodeSelectorRequirement{
+				Key:      key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   []string{zone},
+			})
+		}
+	}
+	glog.V(4).Infof("Node does not have any of the zone labels %v, skipping the zone for node affinity", zoneLabelKeys)
+	return reqs
+}
+
+// DiscoveryResult summarizes a discovery cycle
+type DiscoveryResult struct {
+	// Paused is true if the discovery was skipped because the node is paused
+	Paused bool
+	// Classes has the result of each discovered storage class
+	Classes map[string]*ClassResult
+}
+
+// ClassResult summarizes the discovery of a storage class
+type ClassResult struct {
+	// Names of the PVs of the new volumes that were discovered
+	Discovered []string
+	// Names of the PVs created for new volumes, or recreated with a grown capacity. PVs
+	// whose creation is retried in the background are not included.
+	Created []string
+	// Names of the PVs deleted to be recreated with a grown capacity, because their
+	// volumes have been missing for CleanupGracePeriod, or as unbound duplicates of the
+	// host path of another PV with ResolveDuplicateHostPaths
+	Deleted []string
+	// Names of the bound PVs whose volumes are missing, only checked when reconciling
+	MissingMedia []string
+	// Names of the existing PVs adopted with AdoptExisting
+	Adopted []string
+	// Err is the error that stopped the discovery of the class
+	Err error
+	// What was done with each entry of the mount dir, or why it was skipped, key = path
+	// relative to the mount dir
+	Entries map[string]*EntryResult
+
+	// Serializes the additions of the volume workers of the class
+	mutex sync.Mutex
+}
+
+// add appends the PV name to one of the name lists of the result
+func (r *ClassResult) add(names *[]string, pvName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	*names = append(*names, pvName)
+}
+
+// SkipReason is the reason code of an entry of the mount dir that was skipped
+type SkipReason string
+
+const (
+	// SkipReasonIgnored is an entry matching the ignore patterns
+	SkipReasonIgnored SkipReason = "Ignored"
+	// SkipReasonFiltered is an entry matching the exclude paths of the class
+	SkipReasonFiltered SkipReason = "Filtered"
+	// SkipReasonError is an entry that couldn't be probed
+	SkipReasonError SkipReason = "Error"
+	// SkipReasonProbeTimeout is an entry whose filesystem call or health probe timed out
+	SkipReasonProbeTimeout SkipReason = "ProbeTimeout"
+	// SkipReasonNameCollision is an entry whose PV name is taken by the PV of another volume
+	SkipReasonNameCollision SkipReason = "NameCollision"
+	// SkipReasonRetryPending is an entry whose PV creation is being retried in the background
+	SkipReasonRetryPending SkipReason = "RetryPending"
+	// SkipReasonNodeCordoned is a new volume that is not created while the node is cordoned
+	SkipReasonNodeCordoned SkipReason = "NodeCordoned"
+	// SkipReasonPartitioned is a block volume that is a whole disk with partitions
+	SkipReasonPartitioned SkipReason = "Partitioned"
+	// SkipReasonHostPathInUse is a volume whose host path already has a PV with another
+	// name, or an adoptable PV of another storage class
+	SkipReasonHostPathInUse SkipReason = "HostPathInUse"
+	// SkipReasonTooNew is a file volume modified less than the minimum age of the class ago
+	SkipReasonTooNew SkipReason = "TooNew"
+	// SkipReasonWrongFsType is a file volume whose fs type is not allowed
+	SkipReasonWrongFsType SkipReason = "WrongFsType"
+	// SkipReasonZeroCapacity is a volume with zero capacity, with SkipZeroCapacity
+	SkipReasonZeroCapacity SkipReason = "ZeroCapacity"
+	// SkipReasonTooSmall is a volume below the minimum capacity of the class
+	SkipReasonTooSmall SkipReason = "TooSmall"
+	// SkipReasonTooFewInodes is a file volume with fewer free inodes than the minimum of
+	// the class
+	SkipReasonTooFewInodes SkipReason = "TooFewInodes"
+	// SkipReasonUnhealthy is a volume that failed the health probe
+	SkipReasonUnhealthy SkipReason = "Unhealthy"
+	// SkipReasonMaxPVsReached is a new volume that is not created because the node has
+	// reached MaxPVsPerNode
+	SkipReasonMaxPVsReached SkipReason = "MaxPVsReached"
+)
+
+// EntryResult is the decision of a discovery on an entry of the mount dir
+type EntryResult struct {
+	// Type of the volume, empty if the entry wasn't probed
+	Type string `json:"type,omitempty"`
+	// What was done with the entry, or why it was skipped
+	Decision string `json:"decision"`
+	// Reason code of a skipped entry, empty if it wasn't skipped
+	Reason SkipReason `json:"reason,omitempty"`
+	// Total and free inodes of the fs of a file volume, if they were checked
+	Inodes     int64 `json:"inodes,omitempty"`
+	FreeInodes int64 `json:"freeInodes,omitempty"`
+}
+
+// setEntry records the decision on the entry of the mount dir
+func (r *ClassResult) setEntry(file, volType, format string, args ...interface{}) {
+	r.putEntry(file, &EntryResult{Type: volType, Decision: fmt.Sprintf(format, args...)})
+}
+
+// setInodes records the inodes of the entry of the mount dir, after its decision
+func (r *ClassResult) setInodes(file string, inodes, free int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry := r.Entries[file]; entry != nil {
+		entry.Inodes = inodes
+		entry.FreeInodes = free
+	}
+}
+
+func (r *ClassResult) putEntry(file string, entry *EntryResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.Entries == nil {
+		r.Entries = map[string]*EntryResult{}
+	}
+	r.Entries[file] = entry
+}
+
+// skipEntry records that the entry of the mount dir of the class was skipped, in the
+// result, the logs and the skipped volumes metric
+func (d *Discoverer) skipEntry(result *ClassResult, class, file, volType string, reason SkipReason, format string, args ...interface{}) {
+	decision := fmt.Sprintf(format, args...)
+	glog.V(4).Infof("Skipping %q of storage class %q, reason %s: %s", file, class, reason, decision)
+	metrics.SkippedVolumes.Inc(class, string(reason))
+	result.putEntry(file, &EntryResult{Type: volType, Decision: decision, Reason: reason})
+}
+
+// skipError records that the entry was skipped because of err, which is a probe timeout
+// if it is a util.TimeoutError
+func (d *Discoverer) skipError(result *ClassResult, class, file, volType string, err error) {
+	reason := SkipReasonError
+	if util.IsTimeout(err) {
+		reason = SkipReasonProbeTimeout
+	}
+	d.skipEntry(result, class, file, volType, reason, "error: %v", err)
+}
+
+// wrapError returns err with the message prepended, or as is if it is a util.TimeoutError,
+// so that its entry is skipped with SkipReasonProbeTimeout
+func wrapError(err error, format string, args ...interface{}) error {
+	if util.IsTimeout(err) {
+		return err
+	}
+	return fmt.Errorf("%s: %v", fmt.Sprintf(format, args...), err)
+}
+
+// Created returns the number of PVs created in the cycle
+func (r *DiscoveryResult) Created() int {
+	created := 0
+	for _, class := range r.Classes {
+		created += len(class.Created)
+	}
+	return created
+}
+
+// Deleted returns the number of PVs deleted in the cycle
+func (r *DiscoveryResult) Deleted() int {
+	deleted := 0
+	for _, class := range r.Classes {
+		deleted += len(class.Deleted)
+	}
+	return deleted
+}
+
+// Discovered returns the number of new volumes discovered in the cycle
+func (r *DiscoveryResult) Discovered() int {
+	discovered := 0
+	for _, class := range r.Classes {
+		discovered += len(class.Discovered)
+	}
+	return discovered
+}
+
+// Adopted returns the number of existing PVs adopted in the cycle
+func (r *DiscoveryResult) Adopted() int {
+	adopted := 0
+	for _, class := range r.Classes {
+		adopted += len(class.Adopted)
+	}
+	return adopted
+}
+
+// MissingMedia returns the number of bound PVs whose volumes are missing
+func (r *DiscoveryResult) MissingMedia() int {
+	missing := 0
+	for _, class := range r.Classes {
+		missing += len(class.MissingMedia)
+	}
+	return missing
+}
+
+// Errors returns the errors of the storage classes whose discovery failed
+func (r *DiscoveryResult) Errors() map[string]error {
+	errs := map[string]error{}
+	for name, class := range r.Classes {
+		if class.Err != nil {
+			errs[name] = class.Err
+		}
+	}
+	return errs
+}
+
+// DiscoverLocalVolumes reads the configured discovery paths, and creates PVs for the new volumes
+// Each storage class is discovered in its own goroutine, bounded by MaxDiscoveryConcurrency.
+// Once ctx is done, no more volumes are discovered and no more PVs are created.
+// The existing PVs are only reconciled with their volumes once every ReconcilePeriod.
+func (d *Discoverer) DiscoverLocalVolumes(ctx context.Context) *DiscoveryResult {
+	result := &DiscoveryResult{Classes: map[string]*ClassResult{}}
+	d.refreshNodeAffinity()
+	node := d.GetNode()
+	if common.IsPaused(node) {
+		if !d.paused {
+			glog.Infof("Node %q has annotation %s=true, pausing discovery", node.Name, common.AnnDiscoveryPaused)
+			d.paused = true
+		}
+		// Pausing is deliberate, the provisioner is still healthy
+		d.setLastSuccess()
+		result.Paused = true
+		d.setLastResult(result)
+		return result
+	}
+	if d.paused {
+		glog.Infof("Resuming discovery on node %q", node.Name)
+		d.paused = false
+	}
+	cordoned := d.PauseOnCordon && common.IsCordoned(node, d.CordonTaintKey)
+	if cordoned != d.cordoned {
+		if cordoned {
+			glog.Infof("Node %q is cordoned, pausing the creation of PVs", node.Name)
+		} else {
+			glog.Infof("Node %q is no longer cordoned, resuming the creation of PVs", node.Name)
+		}
+		d.cordoned = cordoned
+	}
+
+	d.checkStorageClasses()
+
+	if d.MaxPVsPerNode > 0 {
+		d.mutex.Lock()
+		pending := len(d.pendingPVs)
+		d.mutex.Unlock()
+		atomic.StoreInt64(&d.pvBudget, int64(d.MaxPVsPerNode-d.Cache.Size()-pending))
+		atomic.StoreInt32(&d.pvLimitReported, 0)
+	}
+
+	workers := d.MaxDiscoveryConcurrency
+	if workers <= 0 || workers > len(d.DiscoveryMap) {
+		workers = len(d.DiscoveryMap)
+	}
+	sem := make(chan struct{}, workers)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	var failed int32
+	// Classes that reconcile their existing PVs in this cycle
+	reconciling := map[string]bool{}
+	for class, config := range d.DiscoveryMap {
+		if ctx.Err() != nil {
+			break
+		}
+		if !config.IsEnabled() || !d.isClassDue(class, start) {
+			continue
+		}
+		reconcile := d.ReconcilePeriod <= 0 || start.Sub(d.lastReconciles[class]) >= d.ReconcilePeriod
+		if reconcile {
+			reconciling[class] = true
+		}
+		// Each goroutine only updates the result of its class
+		classResult := &ClassResult{Entries: map[string]*EntryResult{}}
+		result.Classes[class] = classResult
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(class string, config common.MountConfig, reconcile bool) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			classStart := time.Now()
+			outcome := metrics.OutcomeSuccess
+			if err := d.discoverVolumesAtPath(ctx, class, config, reconcile, classResult); err != nil {
+				glog.Errorf("Error discovering volumes for storage class %q: %v", class, err)
+				outcome = metrics.OutcomeError
+				atomic.StoreInt32(&failed, 1)
+				classResult.Err = err
+			}
+			metrics.ClassDiscoveryDuration.Observe(time.Since(classStart).Seconds(), class, outcome)
+			metrics.CachedVolumes.Set(float64(d.Cache.Size()))
+		}(class, config, reconcile)
+	}
+	wg.Wait()
+	if len(reconciling) > 0 && ctx.Err() == nil {
+		d.checkDuplicateHostPaths(ctx, result)
+	}
+
+	outcome := metrics.OutcomeSuccess
+	if atomic.LoadInt32(&failed) != 0 {
+		outcome = metrics.OutcomeError
+	}
+	for class := range result.Classes {
+		d.lastDiscoveries[class] = start
+		if reconciling[class] && ctx.Err() == nil {
+			d.lastReconciles[class] = start
+		}
+	}
+	if outcome == metrics.OutcomeSuccess && ctx.Err() == nil {
+		d.setLastSuccess()
+	}
+	metrics.DiscoveryDuration.Observe(time.Since(start).Seconds(), outcome)
+	if d.eventMode == common.EventModeSummary {
+		d.recordSummary(result)
+	}
+	d.setLastResult(result)
+	return result
+}
+
+// Period returns the period at which DiscoverLocalVolumes is meant to be called, the
+// shortest of DiscoveryPeriod and the discovery periods of the classes
+func (d *Discoverer) Period() time.Duration {
+	period := d.DiscoveryPeriod
+	if period <= 0 {
+		period = common.DefaultDiscoveryPeriod
+	}
+	for _, classPeriod := range d.discoveryPeriods {
+		if classPeriod < period {
+			period = classPeriod
+		}
+	}
+	return period
+}
+
+// classPeriod returns the discovery period of the class, its own period if it has one
+func (d *Discoverer) classPeriod(class string) time.Duration {
+	if period, found := d.discoveryPeriods[class]; found {
+		return period
+	}
+	if d.DiscoveryPeriod > 0 {
+		return d.DiscoveryPeriod
+	}
+	return common.DefaultDiscoveryPeriod
+}
+
+// isClassDue returns true if the class is discovered in the cycle starting at now. The
+// classes whose period is the shortest one are discovered in every cycle, the others
+// once their period has passed since their last discovery.
+func (d *Discoverer) isClassDue(class string, now time.Time) bool {
+	period := d.classPeriod(class)
+	if period <= d.Period() {
+		return true
+	}
+	last, found := d.lastDiscoveries[class]
+	return !found || now.Sub(last) >= period
+}
+
+// volumeConcurrency returns the maximum number of new volumes of the class that are
+// probed concurrently, MaxVolumeConcurrency unless the class overrides it
+func (d *Discoverer) volumeConcurrency(config common.MountConfig) int {
+	workers := d.MaxVolumeConcurrency
+	if config.MaxVolumeConcurrency > 0 {
+		workers = config.MaxVolumeConcurrency
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	return workers
+}
+
+// recordSummary records the summary event of the discovery cycle on the node, unless
+// nothing happened in the cycle
+func (d *Discoverer) recordSummary(result *DiscoveryResult) {
+	errs := result.Errors()
+	if result.Discovered() == 0 && result.Created() == 0 && result.Deleted() == 0 && result.Adopted() == 0 && result.MissingMedia() == 0 && len(errs) == 0 {
+		return
+	}
+	classes := []string{}
+	for class := range result.Classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	msg := fmt.Sprintf("Discovered %d volumes, created %d PVs, deleted %d PVs across storage classes %v",
+		result.Discovered(), result.Created(), result.Deleted(), classes)
+	if adopted := result.Adopted(); adopted > 0 {
+		msg += fmt.Sprintf(", adopted %d existing PVs", adopted)
+	}
+	if missing := result.MissingMedia(); missing > 0 {
+		msg += fmt.Sprintf(", %d bound PVs have missing volumes", missing)
+	}
+	if len(errs) > 0 {
+		failed := []string{}
+		for class := range errs {
+			failed = append(failed, class)
+		}
+		sort.Strings(failed)
+		msg += fmt.Sprintf(", discovery failed for storage classes %v", failed)
+	}
+	d.Recorder.Event(d.GetNode(), v1.EventTypeNormal, common.EventDiscoverySummary, msg)
+}
+
+// Drain stops the creation of PVs, e.g. on shutdown. Discoveries in progress and later
+// ones still run, but skip the creation of PVs for new volumes, the recreation of grown
+// PVs, and the background retries of failed creations.
+func (d *Discoverer) Drain() {
+	if atomic.CompareAndSwapInt32(&d.draining, 0, 1) {
+		glog.Info("Draining discovery, no more PVs will be created")
+	}
+}
+
+func (d *Discoverer) isDraining() bool {
+	return atomic.LoadInt32(&d.draining) != 0
+}
+
+func (d *Discoverer) setLastSuccess() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.lastSuccess = time.Now()
+}
+
+// LastSuccess returns the end of the last discovery in which all the storage classes
+// were discovered without errors
+func (d *Discoverer) LastSuccess() time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.lastSuccess
+}
+
+// HealthzHandler returns an HTTP handler that responds with 503 Service Unavailable if
+// no discovery has succeeded within the HealthzStaleness, e.g. because it is stuck
+// reading a directory, and with 200 OK otherwise
+func (d *Discoverer) HealthzHandler() http.Handler {
+	staleness := d.HealthzStaleness
+	if staleness <= 0 {
+		staleness = common.DefaultHealthzStaleness
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastSuccess := d.LastSuccess()
+		if age := time.Since(lastSuccess); age > staleness {
+			http.Error(w, fmt.Sprintf("last successful discovery at %s, %v ago, longer than %v",
+				lastSuccess.Format(time.RFC3339), age, staleness), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+func (d *Discoverer) setLastResult(result *DiscoveryResult) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// The classes that were not due keep the result of their last discovery
+	merged := &DiscoveryResult{Paused: result.Paused, Classes: map[string]*ClassResult{}}
+	if d.lastResult != nil && !result.Paused {
+		for class, classResult := range d.lastResult.Classes {
+			merged.Classes[class] = classResult
+		}
+	}
+	for class, classResult := range result.Classes {
+		merged.Classes[class] = classResult
+	}
+	d.lastResult = merged
+	d.lastResultTime = time.Now()
+}
+
+// debugClass is the debug state of a storage class served by DebugHandler
+type debugClass struct {
+	MountDir string `json:"mountDir"`
+	// Decisions of the last discovery, key = path relative to the mount dir
+	Entries map[string]*EntryResult `json:"entries"`
+	// Names of the cached PVs of the class, when the request is served
+	CachedPVs []string `json:"cachedPVs"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// debugState is the debug state of the Discoverer served by DebugHandler
+type debugState struct {
+	// End of the last discovery, zero if there was none yet
+	Time    time.Time              `json:"time"`
+	Paused  bool                   `json:"paused"`
+	Classes map[string]*debugClass `json:"classes"`
+}
+
+// DebugHandler returns a read-only handler that serves, as JSON, the decisions of the
+// last discovery on each entry of the mount dirs of the enabled storage classes, i.e.
+// their volume type and why they were skipped, and the PVs of the classes in the cache
+func (d *Discoverer) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		d.mutex.Lock()
+		result, resultTime := d.lastResult, d.lastResultTime
+		d.mutex.Unlock()
+
+		state := &debugState{Time: resultTime, Classes: map[string]*debugClass{}}
+		if result != nil {
+			state.Paused = result.Paused
+		}
+		for class, config := range d.DiscoveryMap {
+			if !config.IsEnabled() {
+				continue
+			}
+			debug := &debugClass{MountDir: config.MountDir, Entries: map[string]*EntryResult{}, CachedPVs: []string{}}
+			if result != nil && result.Classes[class] != nil {
+				classResult := result.Classes[class]
+				classResult.mutex.Lock()
+				for file, entry := range classResult.Entries {
+					debug.Entries[file] = entry
+				}
+				classResult.mutex.Unlock()
+				if classResult.Err != nil {
+					debug.Error = classResult.Err.Error()
+				}
+			}
+			for _, pv := range d.Cache.ListPVsForClass(class) {
+				debug.CachedPVs = append(debug.CachedPVs, pv.Name)
+			}
+			sort.Strings(debug.CachedPVs)
+			state.Classes[class] = debug
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(state); err != nil {
+			glog.Errorf("Error encoding the discovery debug state: %v", err)
+		}
+	})
+}
+
+// checkStorageClasses logs a warning for each configured storage class that doesn't exist
+// in the cluster. Discovery continues regardless, since the class may be created later.
+// Each class is only checked until the API server answers.
+func (d *Discoverer) checkStorageClasses() {
+	for class, config := range d.DiscoveryMap {
+		if _, checked := d.storageClassExists[class]; checked || !config.IsEnabled() {
+			continue
+		}
+		_, err := d.APIUtil.GetStorageClass(class)
+		switch {
+		case err == nil:
+			d.storageClassExists[class] = true
+		case errors.IsNotFound(err):
+			glog.Warningf("Storage class %q does not exist, its PVs can't be bound until it is created", class)
+			d.storageClassExists[class] = false
+		default:
+			glog.Errorf("Error checking if storage class %q exists: %v", class, err)
+		}
+	}
+}
+
+// CheckHostDirs checks that the HostDir of each storage class is the host path of its
+// MountDir, by creating a probe file in the MountDir and looking for it under the HostDir
+// in HostRootfs, the root fs of the host mounted in the container. Otherwise the PVs would
+// have host paths that don't exist, and pods using them would fail to mount them. Classes
+// whose MountDir doesn't exist yet or can't be written to, or with a HostPathTemplate,
+// are not checked.
+func (d *Discoverer) CheckHostDirs() error {
+	classes := []string{}
+	for class, config := range d.DiscoveryMap {
+		if config.IsEnabled() {
+			classes = append(classes, class)
+		}
+	}
+	sort.Strings(classes)
+
+	mismatches := []string{}
+	for _, class := range classes {
+		config := d.DiscoveryMap[class]
+		if _, ok := d.hostPathTemplates[class]; ok {
+			glog.V(4).Infof("Storage class %q has a host path template, not checking its host dir", class)
+			continue
+		}
+		probe := filepath.Join(config.MountRoot(), common.HostDirProbeFile)
+		err := d.VolUtil.WriteFile(probe, []byte(d.GetNode().Name))
+		if os.IsExist(err) {
+			// Left behind by a previous check that didn't finish
+			if err = d.VolUtil.RemoveFile(probe); err == nil {
+				err = d.VolUtil.WriteFile(probe, []byte(d.GetNode().Name))
+			}
+		}
+		if err != nil {
+			glog.Warningf("Not checking the host dir %q of storage class %q, error creating probe file: %v", config.HostDir, class, err)
+			continue
+		}
+		hostProbe := filepath.Join(d.HostRootfs, config.HostRoot(), common.HostDirProbeFile)
+		found, err := d.VolUtil.Exists(hostProbe)
+		if removeErr := d.VolUtil.RemoveFile(probe); removeErr != nil {
+			glog.Errorf("Error removing probe file: %v", removeErr)
+		}
+		if err != nil {
+			return fmt.Errorf("error checking the host dir %q of storage class %q: %v", config.HostDir, class, err)
+		}
+		if !found {
+			mismatches = append(mismatches, fmt.Sprintf("host dir %q of storage class %q is not the host path of mount dir %q, the probe file created in the mount dir is not at %q",
+				config.HostDir, class, config.MountDir, hostProbe))
+			continue
+		}
+		glog.V(4).Infof("Host dir %q of storage class %q matches mount dir %q", config.HostDir, class, config.MountDir)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%s", strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// discoverVolumesAtPath creates PVs for the new volumes of the storage class. With
+// reconcile, the existing PVs are also checked against their volumes, e.g. for missing
+// media or changed capacity. It only returns an error if the mount dir can't be read,
+// errors of single volumes are logged.
+// Existing PVs are only deleted because their volumes are missing from the listing if
+// they are unbound and CleanupGracePeriod is set, otherwise they are only deleted by the
+// Deleter once released.
+func (d *Discoverer) discoverVolumesAtPath(ctx context.Context, class string, config common.MountConfig, reconcile bool, result *ClassResult) error {
+	glog.V(7).Infof("Discovering volumes at hostpath %q, mount path %q for storage class %q", config.HostDir, config.MountDir, class)
+
+	files, complete, err := d.listClassVolumes(config)
+	if os.IsNotExist(err) {
+		// Most likely the disks of the class are not mounted yet
+		glog.Warningf("Mount path %q for storage class %q doesn't exist, skipping", config.MountDir, class)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading directory: %v", err)
+	}
+	if !d.isClassReady(class, config, files) {
+		return nil
+	}
+	if reconcile && complete {
+		d.checkBackingMedia(ctx, class, config, files, result)
+	}
+	if complete {
+		d.pruneHostPathInUseEvents(class, files)
+	}
+
+	workers := d.volumeConcurrency(config)
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// Set once a worker can't create more PVs
+	var stopped int32
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return fmt.Errorf("discovery aborted: %v", ctx.Err())
+		}
+		if atomic.LoadInt32(&stopped) != 0 {
+			return nil
+		}
+		if d.isIgnored(filepath.Base(file)) {
+			d.skipEntry(result, class, file, "", SkipReasonIgnored, "ignored")
+			continue
+		}
+
+		// Check if PV already exists for it
+		pvName := d.generatePVName(file, class)
+		pv, exists := d.Cache.GetPV(pvName)
+		if !exists && d.AdoptExisting {
+			if adopted, found := d.findAdoptedPV(file, class, config); found {
+				pv, pvName, exists = adopted, adopted.Name, true
+			} else if d.adoptPV(ctx, file, class, config, result) {
+				continue
+			}
+		}
+		if exists {
+			hostPath, err := d.hostPath(file, class, config)
+			if err != nil {
+				glog.Error(err)
+				d.skipError(result, class, file, "", err)
+				continue
+			}
+			if d.isNameCollision(pv, class, hostPath) {
+				d.skipEntry(result, class, file, "", SkipReasonNameCollision, "PV name collision with PV %s", pvName)
+				continue
+			}
+			result.setEntry(file, "", "has PV %s", pvName)
+			if !reconcile {
+				continue
+			}
+			// The cached PV is stale after an update, so the last seen annotation is
+			// updated in the next reconciliation
+			if !d.addProvisionerLabels(ctx, pv) && d.LastSeenInterval > 0 {
+				d.updateLastSeen(ctx, pv)
+			}
+			if config.DetectCapacityShrink || config.UpdateUnboundCapacity {
+				d.checkCapacity(ctx, pv, file, config, result)
+			}
+			continue
+		}
+		if d.isPending(pvName) {
+			d.skipEntry(result, class, file, "", SkipReasonRetryPending, "creation of PV %s is being retried", pvName)
+			continue
+		}
+		if d.cordoned {
+			d.skipEntry(result, class, file, "", SkipReasonNodeCordoned, "node is cordoned")
+			continue
+		}
+
+		if workers == 1 {
+			if !d.discoverVolume(ctx, file, class, config, result) {
+				return nil
+			}
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(file string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if !d.discoverVolume(ctx, file, class, config, result) {
+				atomic.StoreInt32(&stopped, 1)
+			}
+		}(file)
+	}
+	return nil
+}
+
+// discoverVolume creates the PV of a new volume. It returns false if no more PVs can
+// be created, because the node has reached MaxPVsPerNode.
+func (d *Discoverer) discoverVolume(ctx context.Context, file, class string, config common.MountConfig, result *ClassResult) bool {
+	filePath, err := d.resolvePath(file, config)
+	if err != nil {
+		glog.Error(err)
+		d.skipError(result, class, file, "", err)
+		return true
+	}
+	if isExcluded(file, filePath, config.ExcludePaths) {
+		d.skipEntry(result, class, file, "", SkipReasonFiltered, "excluded")
+		return true
+	}
+	volType, err := d.getVolumeType(filePath)
+	if err != nil {
+		glog.Error(err)
+		d.skipError(result, class, file, "", err)
+		return true
+	}
+	if volType == common.VolumeTypeBlock && !config.AllowPartitionedDisks {
+		partitioned, err := d.VolUtil.HasPartitions(filePath)
+		if err != nil {
+			glog.Errorf("Path %q partition check error: %v", filePath, err)
+			d.skipError(result, class, file, volType, err)
+			return true
+		}
+		if partitioned {
+			d.skipEntry(result, class, file, volType, SkipReasonPartitioned, "whole disk with partitions")
+			return true
+		}
+	}
+	if minAge := d.minDirAges[class]; minAge > 0 && volType == common.VolumeTypeFile {
+		modTime, err := d.VolUtil.GetModTime(filePath)
+		if err != nil {
+			glog.Errorf("Path %q modification time error: %v", filePath, err)
+			d.skipError(result, class, file, volType, err)
+			return true
+		}
+		if age := time.Since(modTime); age < minAge {
+			d.skipEntry(result, class, file, volType, SkipReasonTooNew, "modified less than the minimum age %v ago", minAge)
+			return true
+		}
+	}
+	capacityByte, err := d.getCapacity(filePath, volType, class, config)
+	if err != nil {
+		glog.Error(err)
+		d.skipError(result, class, file, volType, err)
+		return true
+	}
+
+	labels := map[string]string{}
+	if volType == common.VolumeTypeFile {
+		fsType, err := d.VolUtil.GetFsType(filePath)
+		if err != nil {
+			glog.Warningf("Path %q fs type error: %v", filePath, err)
+		} else if fsType != "" {
+			labels[common.LabelFsType] = fsType
+		}
+		if len(config.AllowedFsTypes) > 0 && !isAllowedFsType(fsType, config.AllowedFsTypes) {
+			glog.Warningf("Path %q has fs type %q, which is not one of the allowed %v, skipping", filePath, fsType, config.AllowedFsTypes)
+			d.skipEntry(result, class, file, volType, SkipReasonWrongFsType, "fs type %q is not allowed", fsType)
+			return true
+		}
+		readOnly, err := d.VolUtil.IsReadOnly(filePath)
+		if err != nil {
+			glog.Warningf("Path %q read-only check error: %v", filePath, err)
+		} else if readOnly {
+			labels[common.LabelReadOnly] = "true"
+		}
+		if d.loopbackFile(filePath, config) != "" {
+			labels[common.LabelLoopback] = "true"
+		}
+		if config.DetectTmpfs {
+			tmpfs, err := d.VolUtil.IsTmpfs(filePath)
+			if err != nil {
+				glog.Warningf("Path %q tmpfs check error: %v", filePath, err)
+			} else if tmpfs {
+				labels[common.LabelVolatile] = "true"
+			}
+		}
+	}
+
+	if capacityByte == 0 && d.SkipZeroCapacity {
+		d.skipEntry(result, class, file, volType, SkipReasonZeroCapacity, "zero capacity, retried in the next discovery")
+		return true
+	}
+	if capacityByte < config.MinCapacityBytes {
+		d.skipEntry(result, class, file, volType, SkipReasonTooSmall, "capacity %d is below the minimum %d", capacityByte, config.MinCapacityBytes)
+		return true
+	}
+
+	if volType == common.VolumeTypeFile && config.MinFreeInodes > 0 {
+		inodes, free, err := d.VolUtil.GetFsInodes(filePath)
+		if err != nil {
+			glog.Errorf("Path %q inode stats error: %v", filePath, err)
+			d.skipError(result, class, file, volType, err)
+			return true
+		}
+		// Recorded after the decision, which replaces the entry
+		defer result.setInodes(file, inodes, free)
+		if inodes > 0 && free < config.MinFreeInodes {
+			d.skipEntry(result, class, file, volType, SkipReasonTooFewInodes, "%d free inodes is below the minimum %d", free, config.MinFreeInodes)
+			return true
+		}
+	}
+
+	if reported, err := d.checkHealth(ctx, filePath); err != nil {
+		if reported {
+			hostPath, _ := d.hostPath(file, class, config)
+			d.Recorder.Eventf(d.GetNode(), v1.EventTypeWarning, common.EventVolumeUnhealthy, "Volume at host path %q failed the health probe, not creating a PV: %v", hostPath, err)
+		}
+		reason := SkipReasonUnhealthy
+		if util.IsTimeout(err) {
+			reason = SkipReasonProbeTimeout
+		}
+		d.skipEntry(result, class, file, volType, reason, "failed the health probe: %v", err)
+		return true
+	}
+
+	if !d.reservePV() {
+		d.skipEntry(result, class, file, volType, SkipReasonMaxPVsReached, "maximum number of PVs of the node reached")
+		return false
+	}
+	result.setEntry(file, volType, "new volume with capacity %d", capacityByte)
+	d.createPV(ctx, file, class, config, capacityByte, volType, labels, result)
+	return true
+}
+
+// checkHealth probes the volume at filePath if HealthCheck is set. A failure is logged,
+// and reported is true, only when the volume wasn't already unhealthy, so that a failing
+// disk isn't reported again at every discovery.
+func (d *Discoverer) checkHealth(ctx context.Context, filePath string) (reported bool, err error) {
+	if !d.HealthCheck {
+		return false, nil
+	}
+	timeout := d.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = common.DefaultHealthCheckTimeout
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = d.VolUtil.ProbeHealth(probeCtx, filePath)
+	if err != nil && probeCtx.Err() == context.DeadlineExceeded {
+		err = &util.TimeoutError{Op: "ProbeHealth", Path: filePath, Timeout: timeout}
+	}
+
+	d.mutex.Lock()
+	wasUnhealthy := d.unhealthyVolumes[filePath]
+	if err != nil {
+		d.unhealthyVolumes[filePath] = true
+	} else {
+		delete(d.unhealthyVolumes, filePath)
+	}
+	d.mutex.Unlock()
+
+	switch {
+	case err != nil && !wasUnhealthy:
+		glog.Warningf("Volume at %q failed the health probe: %v", filePath, err)
+		return true, err
+	case err == nil && wasUnhealthy:
+		glog.Infof("Volume at %q passes the health probe again", filePath)
+	}
+	return false, err
+}
+
+// isClassReady returns true once the readiness gate of the class has passed, i.e. the
+// mount dir has at least ReadyMinEntries volumes and the ReadySentinel file exists.
+// The gate is only checked until it passes, so that discovery isn't held up when the
+// volumes are removed later.
+func (d *Discoverer) isClassReady(class string, config common.MountConfig, files []string) bool {
+	if config.ReadyMinEntries == 0 && config.ReadySentinel == "" {
+		return true
+	}
+	d.mutex.Lock()
+	ready, waiting := d.readyClasses[class]
+	d.mutex.Unlock()
+	if ready {
+		return true
+	}
+
+	reason := ""
+	if config.ReadySentinel != "" {
+		sentinel := filepath.Join(config.MountRoot(), config.ReadySentinel)
+		exists, err := d.VolUtil.Exists(sentinel)
+		if err != nil {
+			glog.Errorf("Error checking sentinel %q of storage class %q: %v", sentinel, class, err)
+		}
+		if !exists {
+			reason = fmt.Sprintf("sentinel %q doesn't exist", sentinel)
+		}
+	}
+	if reason == "" && config.ReadyMinEntries > 0 {
+		volumes := 0
+		for _, file := range files {
+			if !d.isIgnored(filepath.Base(file)) {
+				volumes++
+			}
+		}
+		if volumes < config.ReadyMinEntries {
+			reason = fmt.Sprintf("%d of %d volumes found", volumes, config.ReadyMinEntries)
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if reason != "" {
+		if !waiting {
+			glog.Infof("Storage class %q is waiting for mounts at %q: %s", class, config.MountDir, reason)
+			d.readyClasses[class] = false
+		}
+		return false
+	}
+	glog.Infof("Mounts of storage class %q at %q are ready", class, config.MountDir)
+	d.readyClasses[class] = true
+	return true
+}
+
+// provisionerLabels returns the labels that identify the provisioner and node of the
+// PVs created by the provisioner, without the ones that can't be set
+func (d *Discoverer) provisionerLabels(provisionerName string) map[string]string {
+	labels := map[string]string{
+		common.LabelProvisionedBy: common.ProvisionerLabelValue(provisionerName),
+	}
+	if value := common.NodeLabelValue(d.GetNode()); value != "" {
+		labels[common.LabelNode] = value
+	}
+	return labels
+}
+
+// addProvisionerLabels adds the provisioner labels to a PV that was created without
+// them, so that it is still watched with ScopePVInformer. It returns true if the PV was
+// updated.
+func (d *Discoverer) addProvisionerLabels(ctx context.Context, pv *v1.PersistentVolume) bool {
+	missing := map[string]string{}
+	for k, v := range d.provisionerLabels(pv.Annotations[common.AnnProvisionedBy]) {
+		if _, found := pv.Labels[k]; !found {
+			missing[k] = v
+		}
+	}
+	if len(missing) == 0 {
+		return false
+	}
+	if d.DryRun {
+		glog.V(4).Infof("Dry run: skipping update of the provisioner labels of PV %q", pv.Name)
+		return false
+	}
+
+	// The cached PV is shared with the informer, so only a copy is modified
+	updated := *pv
+	updated.Labels = mergeMaps(pv.Labels, missing)
+
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to update PV %q: %v", pv.Name, err)
+		return false
+	}
+	if _, err := d.APIUtil.UpdatePV(&updated); err != nil {
+		// It is retried in the next discovery cycle
+		glog.Errorf("Error adding the provisioner labels to PV %q: %v", pv.Name, err)
+		return false
+	}
+	glog.V(4).Infof("Added the provisioner labels %v to PV %q", missing, pv.Name)
+	return true
+}
+
+// updateLastSeen sets the last seen annotation of the PV to now, unless it was updated
+// within LastSeenInterval
+func (d *Discoverer) updateLastSeen(ctx context.Context, pv *v1.PersistentVolume) {
+	now := time.Now()
+	if lastSeen, err := time.Parse(time.RFC3339, pv.Annotations[common.AnnLastSeen]); err == nil && now.Sub(lastSeen) < d.LastSeenInterval {
+		return
+	}
+	d.updateAnnotation(ctx, pv, common.AnnLastSeen, now.UTC().Format(time.RFC3339))
+}
+
+// updateAnnotation sets the annotation of the PV, or removes it if value is empty.
+// Errors are logged, the update is retried in the next discovery.
+func (d *Discoverer) updateAnnotation(ctx context.Context, pv *v1.PersistentVolume, key, value string) {
+	if d.DryRun {
+		glog.V(4).Infof("Dry run: skipping update of the %s annotation of PV %q", key, pv.Name)
+		return
+	}
+
+	// The cached PV is shared with the informer, so only a copy is modified
+	updated := *pv
+	updated.Annotations = map[string]string{}
+	for k, v := range pv.Annotations {
+		updated.Annotations[k] = v
+	}
+	if value == "" {
+		delete(updated.Annotations, key)
+	} else {
+		updated.Annotations[key] = value
+	}
+
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to update PV %q: %v", pv.Name, err)
+		return
+	}
+	if _, err := d.APIUtil.UpdatePV(&updated); err != nil {
+		glog.Errorf("Error updating the %s annotation of PV %q: %v", key, pv.Name, err)
+		return
+	}
+	glog.V(4).Infof("Updated the %s annotation of PV %q", key, pv.Name)
+}
+
+// reportHostPathInUse logs and records a warning event for the PV whose host path is the
+// host path of the volume of pvName, at most every hostPathInUseEventInterval
+func (d *Discoverer) reportHostPathInUse(existing *v1.PersistentVolume, pvName, class, hostPath string) {
+	d.mutex.Lock()
+	last, found := d.hostPathInUseEvents[pvName]
+	throttled := found && time.Since(last.time) < hostPathInUseEventInterval
+	if !throttled {
+		d.hostPathInUseEvents[pvName] = hostPathInUseEvent{class: class, time: time.Now()}
+	}
+	d.mutex.Unlock()
+
+	if throttled {
+		return
+	}
+	glog.Warningf("Volume at hostpath %q already has PV %q of storage class %q, not creating PV %q for it",
+		hostPath, existing.Name, existing.Spec.StorageClassName, pvName)
+	d.Recorder.Eventf(existing, v1.EventTypeWarning, common.EventHostPathInUse, "Host path %q of the PV is also discovered as a new volume, not creating PV %q for it", hostPath, pvName)
+}
+
+// pruneHostPathInUseEvents forgets the host path in use events of the volumes of the
+// class that are not in files anymore
+func (d *Discoverer) pruneHostPathInUseEvents(class string, files []string) {
+	names := map[string]bool{}
+	for _, file := range files {
+		names[d.generatePVName(file, class)] = true
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for pvName, event := range d.hostPathInUseEvents {
+		if event.class == class && !names[pvName] {
+			delete(d.hostPathInUseEvents, pvName)
+		}
+	}
+}
+
+// findAdoptedPV returns the PV of the class at the host path of the volume whose name is
+// not generated from it, i.e. a PV adopted with AdoptExisting
+func (d *Discoverer) findAdoptedPV(file, class string, config common.MountConfig) (*v1.PersistentVolume, bool) {
+	hostPath, err := d.hostPath(file, class, config)
+	if err != nil {
+		return nil, false
+	}
+	// The host path may also have a PV of another class, see checkDuplicateHostPaths
+	for _, pv := range d.Cache.GetPVsByHostPath(hostPath) {
+		if pv.Spec.StorageClassName == class {
+			return pv, true
+		}
+	}
+	return nil, false
+}
+
+// adoptPV sets the provisioner annotation and labels of the adoptable PV at the host path
+// of the volume, so that it is managed by the provisioner instead of getting a duplicate
+// PV. It returns true if the volume has an adoptable PV, even if it couldn't be adopted
+// now, in which case it is retried in the next discovery.
+func (d *Discoverer) adoptPV(ctx context.Context, file, class string, config common.MountConfig, result *ClassResult) bool {
+	hostPath, err := d.hostPath(file, class, config)
+	if err != nil {
+		return false
+	}
+	hostPath = filepath.Clean(hostPath)
+	var pv *v1.PersistentVolume
+	for _, candidate := range d.Cache.ListAdoptablePVs() {
+		if filepath.Clean(candidate.Spec.Local.Path) == hostPath {
+			pv = candidate
+			break
+		}
+	}
+	if pv == nil {
+		return false
+	}
+	if pv.Spec.StorageClassName != class {
+		d.skipEntry(result, class, file, "", SkipReasonHostPathInUse, "host path has PV %s of storage class %q", pv.Name, pv.Spec.StorageClassName)
+		return true
+	}
+	if d.DryRun {
+		glog.Infof("Dry run: skipping adoption of PV %q of volume at hostpath %q", pv.Name, hostPath)
+		result.setEntry(file, "", "dry run: not adopting PV %s", pv.Name)
+		return true
+	}
+
+	provisionerName := d.Name
+	if config.ProvisionerName != "" {
+		provisionerName = config.ProvisionerName
+	}
+	// The cached PV is shared with the informer, so only a copy is modified
+	updated := *pv
+	updated.Annotations = mergeMaps(pv.Annotations, map[string]string{common.AnnProvisionedBy: provisionerName})
+	updated.Labels = mergeMaps(pv.Labels, d.provisionerLabels(provisionerName))
+
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to adopt PV %q: %v", pv.Name, err)
+		d.skipError(result, class, file, "", err)
+		return true
+	}
+	if _, err := d.APIUtil.UpdatePV(&updated); err != nil {
+		glog.Errorf("Error adopting PV %q of volume at hostpath %q: %v", pv.Name, hostPath, err)
+		d.skipError(result, class, file, "", wrapError(err, "error adopting PV %s", pv.Name))
+		return true
+	}
+	glog.Infof("Adopted existing PV %q of volume at hostpath %q for storage class %q", pv.Name, hostPath, class)
+	result.setEntry(file, "", "adopted PV %s", pv.Name)
+	result.add(&result.Adopted, pv.Name)
+	return true
+}
+
+// resolveVolume returns the path of the volume file inside the mount dir, with symlinks
+// resolved if configured, and its volume type
+func (d *Discoverer) resolveVolume(file string, config common.MountConfig) (string, string, error) {
+	filePath, err := d.resolvePath(file, config)
+	if err != nil {
+		return "", "", err
+	}
+	volType, err := d.getVolumeType(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	return filePath, volType, nil
+}
+
+// resolvePath returns the path of the volume file inside the mount dir, with symlinks
+// resolved if configured
+func (d *Discoverer) resolvePath(file string, config common.MountConfig) (string, error) {
+	filePath := filepath.Join(config.MountRoot(), file)
+	if !config.ResolveSymlinks {
+		return filePath, nil
+	}
+	resolved, err := d.VolUtil.EvalSymlinks(filePath)
+	if err != nil {
+		return "", wrapError(err, "Error resolving symlink %q", filePath)
+	}
+	return resolved, nil
+}
+
+// isExcluded returns true if any of the patterns matches the name or the relative path of
+// the volume file, or the resolved path of the volume or its name
+func isExcluded(file, resolvedPath string, patterns []string) bool {
+	candidates := []string{filepath.Base(file), file, resolvedPath, filepath.Base(resolvedPath)}
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if matched, _ := filepath.Match(pattern, candidate); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getCapacity returns the capacity to advertise for the volume at filePath, after
+// the reserved capacity is subtracted, it is rounded down and shaped by the capacity
+// reporter of the class
+func (d *Discoverer) getCapacity(filePath, volType, class string, config common.MountConfig) (int64, error) {
+	var capacityByte int64
+	var err error
+	switch volType {
+	case common.VolumeTypeBlock:
+		capacityByte, err = d.VolUtil.GetBlockCapacityByte(filePath)
+		if err != nil {
+			return 0, wrapError(err, "Path %q block stats error", filePath)
+		}
+	case common.VolumeTypeFile:
+		capacityByte, err = d.getFsCapacity(filePath, config)
+		if err != nil {
+			return 0, err
+		}
+		capacityByte = reserveCapacity(capacityByte, config)
+	default:
+		return 0, fmt.Errorf("Path %q has unexpected volume type %q", filePath, volType)
+	}
+	capacityByte = scaleCapacity(capacityByte, config.CapacityScaleFactor)
+	capacityByte = roundCapacity(capacityByte, config.CapacityRoundingBytes)
+	if reporter := d.capacityReporters[class]; reporter != nil {
+		capacityByte = reporter.ReportCapacity(capacityByte)
+	}
+	return capacityByte, nil
+}
+
+// getFsCapacity returns the capacity of the file volume at filePath from the capacity
+// source of the class, or the allocated size of its backing file if it is a detected
+// loopback volume. If these can't be read, the fs capacity is used.
+func (d *Discoverer) getFsCapacity(filePath string, config common.MountConfig) (int64, error) {
+	if backingFile := d.loopbackFile(filePath, config); backingFile != "" {
+		capacityByte, err := d.VolUtil.GetAllocatedByte(backingFile)
+		if err == nil {
+			return capacityByte, nil
+		}
+		glog.Warningf("Path %q loopback file %q size error, using the fs capacity instead: %v", filePath, backingFile, err)
+	}
+	if config.CapacitySource == common.CapacitySourceQuota {
+		capacityByte, err := d.VolUtil.GetQuotaCapacityByte(filePath)
+		if err == nil {
+			return capacityByte, nil
+		}
+		glog.Warningf("Path %q quota error, using the fs capacity instead: %v", filePath, err)
+	}
+	capacityByte, err := d.VolUtil.GetFsCapacityByte(filePath)
+	if err != nil {
+		return 0, wrapError(err, "Path %q fs stats error", filePath)
+	}
+	return capacityByte, nil
+}
+
+// loopbackFile returns the backing file of the file volume at filePath if the class
+// detects loopback volumes and the volume is mounted from a loop device
+func (d *Discoverer) loopbackFile(filePath string, config common.MountConfig) string {
+	if !config.DetectLoopback {
+		return ""
+	}
+	backingFile, err := d.VolUtil.GetLoopbackBackingFile(filePath)
+	if err != nil {
+		glog.Warningf("Path %q loopback detection error: %v", filePath, err)
+		return ""
+	}
+	return backingFile
+}
+
+// checkCapacity compares the current capacity of the volume of an existing PV with its
+// advertised capacity. With DetectCapacityShrink, a throttled warning event is recorded
+// if it is less, beyond the tolerance of the class. With UpdateUnboundCapacity, the PV
+// is recreated with the new capacity if it is more and the PV is unbound. Bound PVs
+// are never changed, only a throttled warning is logged.
+func (d *Discoverer) checkCapacity(ctx context.Context, pv *v1.PersistentVolume, file string, config common.MountConfig, result *ClassResult) {
+	filePath, volType, err := d.resolveVolume(file, config)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	capacityByte, err := d.getCapacity(filePath, volType, pv.Spec.StorageClassName, config)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+
+	advertised := pv.Spec.Capacity[v1.ResourceStorage]
+	advertisedByte := advertised.Value()
+	switch {
+	case config.DetectCapacityShrink && isCapacityShrunk(advertisedByte, capacityByte, config.CapacityShrinkTolerancePercent):
+		if !d.throttleCapacityWarning(pv.Name) {
+			glog.Warningf("PV %q advertises capacity %d, but its volume at hostpath %q has %d", pv.Name, advertisedByte, pv.Spec.Local.Path, capacityByte)
+			d.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventCapacityShrunk, "Volume at host path %q has capacity %d, less than the advertised %d", pv.Spec.Local.Path, capacityByte, advertisedByte)
+		}
+	case config.UpdateUnboundCapacity && capacityByte > advertisedByte:
+		if isUnbound(pv) {
+			d.recreatePV(ctx, pv, config, capacityByte, result)
+		} else if !d.throttleCapacityWarning(pv.Name) {
+			glog.Warningf("Volume at hostpath %q has grown to %d, but PV %q is bound, leaving its capacity at %d", pv.Spec.Local.Path, capacityByte, pv.Name, advertisedByte)
+		}
+	default:
+		d.mutex.Lock()
+		delete(d.capacityWarnings, pv.Name)
+		d.mutex.Unlock()
+	}
+}
+
+// throttleCapacityWarning returns true if a capacity warning was reported for the PV
+// within capacityWarningInterval, otherwise it records that one is reported now
+func (d *Discoverer) throttleCapacityWarning(pvName string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	last, found := d.capacityWarnings[pvName]
+	if found && time.Since(last) < capacityWarningInterval {
+		return true
+	}
+	d.capacityWarnings[pvName] = time.Now()
+	return false
+}
+
+// isNameCollision returns true if the PV with the generated name of the volume at
+// hostPath is not the PV of that volume, e.g. because two volumes have the same hash.
+// The volume is then left without a PV, and an error event is recorded for the PV.
+func (d *Discoverer) isNameCollision(pv *v1.PersistentVolume, class, hostPath string) bool {
+	if pv.Spec.Local != nil && filepath.Clean(pv.Spec.Local.Path) == filepath.Clean(hostPath) {
+		return false
+	}
+	pvPath := ""
+	if pv.Spec.Local != nil {
+		pvPath = pv.Spec.Local.Path
+	}
+
+	d.mutex.Lock()
+	last, found := d.nameCollisionEvents[pv.Name]
+	throttled := found && time.Since(last) < nameCollisionEventInterval
+	if !throttled {
+		d.nameCollisionEvents[pv.Name] = time.Now()
+	}
+	d.mutex.Unlock()
+
+	if !throttled {
+		glog.Errorf("PV name collision: the generated name %q of the volume at hostpath %q for storage class %q is used by the PV of hostpath %q, not creating a PV for the volume",
+			pv.Name, hostPath, class, pvPath)
+		d.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventPVNameCollision, "PV name is also generated for the volume at host path %q, which has no PV", hostPath)
+	}
+	return true
+}
+
+// isUnbound returns true if the PV is available and not reserved for a claim
+func isUnbound(pv *v1.PersistentVolume) bool {
+	return pv.Status.Phase == v1.VolumeAvailable && pv.Spec.ClaimRef == nil
+}
+
+// isUnboundOnServer returns true if the PV is still unbound according to the API server.
+// A claim may have been bound to it since the cached PV was delivered by the informer,
+// so this is checked right before deleting an unbound PV.
+func (d *Discoverer) isUnboundOnServer(ctx context.Context, pv *v1.PersistentVolume) bool {
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to get PV %q: %v", pv.Name, err)
+		return false
+	}
+	current, err := d.APIUtil.GetPV(pv.Name)
+	if err != nil {
+		glog.Errorf("Error getting PV %q: %v", pv.Name, err)
+		return false
+	}
+	if current.UID != pv.UID || !isUnbound(current) {
+		glog.Infof("PV %q has been bound or replaced since it was cached, leaving it", pv.Name)
+		return false
+	}
+	return true
 }
 
-// NewDiscoverer creates a Discoverer object that will scan through
-// the configured directories and create local PVs for any new directories found
-func NewDiscoverer(config *common.RuntimeConfig) (*Discoverer, error) {
-	affinity, err := generateNodeAffinity(config.Node)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to generate node affinity: %v", err)
+// recreatePV deletes the unbound PV and creates it again with the new capacity, keeping
+// its labels. Its annotations are set like for a new PV, without the state of previous
+// syncs. If creating it fails, the volume is discovered again like a new one once the PV
+// is removed from the cache.
+func (d *Discoverer) recreatePV(ctx context.Context, pv *v1.PersistentVolume, config common.MountConfig, capacityByte int64, result *ClassResult) {
+	if d.isDraining() {
+		glog.V(4).Infof("Draining, not recreating PV %q with capacity %d", pv.Name, capacityByte)
+		return
 	}
-	tmpAnnotations := map[string]string{}
-	err = helper.StorageNodeAffinityToAlphaAnnotation(tmpAnnotations, affinity)
+	if d.cordoned {
+		glog.V(4).Infof("Node is cordoned, not recreating PV %q with capacity %d", pv.Name, capacityByte)
+		return
+	}
+	oldCapacity := pv.Spec.Capacity[v1.ResourceStorage]
+	glog.Infof("Volume at hostpath %q has grown from %d to %d, recreating unbound PV %q",
+		pv.Spec.Local.Path, oldCapacity.Value(), capacityByte, pv.Name)
+
+	labels := map[string]string{}
+	for k, v := range pv.Labels {
+		labels[k] = v
+	}
+	annotations := mergeMaps(d.ExtraAnnotations, config.ExtraAnnotations)
+	// Set by createPV for the volume, which hasn't changed other than growing
+	for _, key := range []string{common.AnnVolumePath, common.AnnVolatile, v1.MountOptionAnnotation} {
+		if value, found := pv.Annotations[key]; found {
+			annotations[key] = value
+		}
+	}
+	pvSpec := common.CreateLocalPVSpec(&common.LocalPVConfig{
+		Name:            pv.Name,
+		HostPath:        pv.Spec.Local.Path,
+		Capacity:        capacityByte,
+		StorageClass:    pv.Spec.StorageClassName,
+		ProvisionerName: pv.Annotations[common.AnnProvisionedBy],
+		AffinityAnn:     d.nodeAffinityAnn,
+		Labels:          labels,
+		ReclaimPolicy:   pv.Spec.PersistentVolumeReclaimPolicy,
+		DeviceID:        pv.Annotations[common.AnnDeviceID],
+		OwnerReferences: pv.OwnerReferences,
+		Annotations:     annotations,
+		AccessModes:     pv.Spec.AccessModes,
+	})
+
+	if d.DryRun {
+		glog.Infof("Dry run: skipping recreation of PV %q with capacity %d", pv.Name, capacityByte)
+		return
+	}
+
+	if !d.isUnboundOnServer(ctx, pv) {
+		return
+	}
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to delete PV %q: %v", pv.Name, err)
+		return
+	}
+	if err := d.APIUtil.DeletePV(pv.Name); err != nil {
+		glog.Errorf("Error deleting PV %q to recreate it: %v", pv.Name, err)
+		return
+	}
+	result.add(&result.Deleted, pv.Name)
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to recreate PV %q: %v", pv.Name, err)
+		return
+	}
+	if _, err := d.APIUtil.CreatePV(pvSpec); err != nil {
+		glog.Errorf("Error recreating PV %q: %v", pv.Name, err)
+		return
+	}
+	result.add(&result.Created, pv.Name)
+	glog.Infof("Recreated PV %q with capacity %d", pv.Name, capacityByte)
+	d.Recorder.Eventf(pvSpec, v1.EventTypeNormal, common.EventVolumeResized, "Recreated PV for volume at host path %q with capacity %d, was %d", pv.Spec.Local.Path, capacityByte, oldCapacity.Value())
+}
+
+// isCapacityShrunk returns true if capacity is less than advertised by more than
+// tolerancePercent of advertised
+func isCapacityShrunk(advertised, capacity int64, tolerancePercent int) bool {
+	return advertised-capacity > advertised/100*int64(tolerancePercent)
+}
+
+// listVolumes returns the paths relative to mountDir of the entries depth levels below
+// it, depth one or less means the entries of mountDir. Ignored directories are not
+// descended into. Subdirectories that can't be read are skipped and complete is false.
+func (d *Discoverer) listVolumes(mountDir string, depth int) (files []string, complete bool, err error) {
+	files, err = d.VolUtil.ReadDir(mountDir)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to convert node affinity to alpha annotation: %v", err)
+		return nil, false, err
+	}
+	complete = true
+	for level := 1; level < depth; level++ {
+		dirs := files
+		files = []string{}
+		for _, dir := range dirs {
+			if d.isIgnored(filepath.Base(dir)) {
+				continue
+			}
+			dirPath := filepath.Join(mountDir, dir)
+			if isDir, err := d.VolUtil.IsDir(dirPath); err != nil || !isDir {
+				glog.V(5).Infof("Skipping %q, it is not a directory", dirPath)
+				continue
+			}
+			entries, err := d.VolUtil.ReadDir(dirPath)
+			if err != nil {
+				glog.Errorf("Error reading directory %q: %v", dirPath, err)
+				complete = false
+				continue
+			}
+			for _, entry := range entries {
+				files = append(files, filepath.Join(dir, entry))
+			}
+		}
 	}
-	return &Discoverer{RuntimeConfig: config, nodeAffinityAnn: tmpAnnotations[v1.AlphaStorageNodeAffinityAnnotation]}, nil
+	return files, complete, nil
 }
 
-func generateNodeAffinity(node *v1.Node) (*v1.NodeAffinity, error) {
-	if node.Labels == nil {
-		return nil, fmt.Errorf("Node does not have labels")
+// listClassVolumes returns the paths relative to the mount root of the volumes of the
+// class. A glob in the mount dir is expanded into base dirs, whose volumes are listed
+// together, prefixed with their path relative to the mount root. Base dirs that can't be
+// read are skipped and complete is false.
+func (d *Discoverer) listClassVolumes(config common.MountConfig) (files []string, complete bool, err error) {
+	root, pattern := common.SplitGlob(config.MountDir)
+	if pattern == "" {
+		return d.listVolumes(config.MountDir, config.NestedDepth)
+	}
+	bases, err := d.VolUtil.Glob(config.MountDir)
+	if err != nil {
+		return nil, false, err
 	}
-	nodeValue, found := node.Labels[common.NodeLabelKey]
-	if !found {
-		return nil, fmt.Errorf("Node does not have expected label %s", common.NodeLabelKey)
+	if len(bases) == 0 {
+		return nil, false, &os.PathError{Op: "glob", Path: config.MountDir, Err: os.ErrNotExist}
 	}
 
-	return &v1.NodeAffinity{
-		RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
-			NodeSelectorTerms: []v1.NodeSelectorTerm{
-				{
-					MatchExpressions: []v1.NodeSelectorRequirement{
-						{
-							Key:      common.NodeLabelKey,
-							Operator: v1.NodeSelectorOpIn,
-							Values:   []string{nodeValue},
-						},
-					},
-				},
-			},
-		},
-	}, nil
+	complete = true
+	for _, base := range bases {
+		baseFiles, baseComplete, err := d.listVolumes(base, config.NestedDepth)
+		if err != nil {
+			glog.Errorf("Error reading directory %q of mount dir %q: %v", base, config.MountDir, err)
+			complete = false
+			continue
+		}
+		complete = complete && baseComplete
+		relativeBase, err := filepath.Rel(root, base)
+		if err != nil {
+			glog.Errorf("Error getting the path of directory %q relative to %q: %v", base, root, err)
+			complete = false
+			continue
+		}
+		for _, file := range baseFiles {
+			files = append(files, filepath.Join(relativeBase, file))
+		}
+	}
+	return files, complete, nil
 }
 
-// DiscoverLocalVolumes reads the configured discovery paths, and creates PVs for the new volumes
-func (d *Discoverer) DiscoverLocalVolumes() {
-	for class, config := range d.DiscoveryMap {
-		d.discoverVolumesAtPath(class, config)
+// reservePV returns true if one more PV may be created under MaxPVsPerNode. It records
+// a warning event for the node the first time the limit is reached in a cycle.
+func (d *Discoverer) reservePV() bool {
+	if d.MaxPVsPerNode <= 0 || atomic.AddInt64(&d.pvBudget, -1) >= 0 {
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&d.pvLimitReported, 0, 1) {
+		glog.Warningf("Node %q has reached the maximum of %d PVs, not creating more", d.GetNode().Name, d.MaxPVsPerNode)
+		d.Recorder.Eventf(d.GetNode(), v1.EventTypeWarning, common.EventMaxPVsReached, "Not creating more PVs, the node has reached the maximum of %d", d.MaxPVsPerNode)
 	}
+	return false
 }
 
-func (d *Discoverer) discoverVolumesAtPath(class string, config common.MountConfig) {
-	glog.V(7).Infof("Discovering volumes at hostpath %q, mount path %q for storage class %q", config.HostDir, config.MountDir, class)
+// checkBackingMedia records a warning event for the bound PVs of the class whose volumes
+// are not in files, the listing of the mount dir. Events of a PV are throttled to one per
+// missingMediaEventInterval, but the PV is in the result of every check. The other PVs
+// are checked by checkMissingVolume, by up to MaxVolumeConcurrency workers, since a node
+// that lost many disks has as many PVs to delete.
+func (d *Discoverer) checkBackingMedia(ctx context.Context, class string, config common.MountConfig, files []string, result *ClassResult) {
+	present := map[string]bool{}
+	for _, file := range files {
+		present[file] = true
+	}
 
-	files, err := d.VolUtil.ReadDir(config.MountDir)
-	if err != nil {
-		glog.Errorf("Error reading directory: %v", err)
+	workers := d.volumeConcurrency(config)
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, pv := range d.Cache.ListPVsForClass(class) {
+		if pv.Spec.Local == nil {
+			continue
+		}
+		file, err := common.VolumePath(pv, config.HostRoot())
+		if err != nil || strings.Count(file, string(filepath.Separator)) != volumeDepth(config)-1 {
+			continue
+		}
+		if pv.Status.Phase != v1.VolumeBound {
+			if workers == 1 {
+				d.checkMissingVolume(ctx, pv, !present[file], result)
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(pv *v1.PersistentVolume, missing bool) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				d.checkMissingVolume(ctx, pv, missing, result)
+			}(pv, !present[file])
+			continue
+		}
+
+		d.mutex.Lock()
+		if present[file] {
+			delete(d.missingMediaEvents, pv.Name)
+			d.mutex.Unlock()
+			continue
+		}
+		result.add(&result.MissingMedia, pv.Name)
+		last, found := d.missingMediaEvents[pv.Name]
+		throttled := found && time.Since(last) < missingMediaEventInterval
+		if !throttled {
+			d.missingMediaEvents[pv.Name] = time.Now()
+		}
+		d.mutex.Unlock()
+
+		if !throttled {
+			d.VolumeLogger.Warning(&util.VolumeEvent{
+				Event:    util.VolumeEventMissingMedia,
+				Class:    class,
+				PVName:   pv.Name,
+				HostPath: pv.Spec.Local.Path,
+				Node:     d.GetNode().Name,
+			}, fmt.Sprintf("Missing backing media for bound PV %q at hostpath %q", pv.Name, pv.Spec.Local.Path))
+			d.Recorder.Eventf(pv, v1.EventTypeWarning, common.EventMissingBackingMedia, "Volume at host path %q of bound PV is missing", pv.Spec.Local.Path)
+		}
+	}
+}
+
+// checkMissingVolume deletes the unbound PV once its volume has been missing for
+// CleanupGracePeriod. The time the volume was first found missing is kept in the
+// AnnMissingSince annotation of the PV, so that it survives restarts, and the annotation
+// is removed once the volume is back. PVs with reclaim policy Retain are annotated, but
+// left for the admin to delete, like the deleter does once they are released.
+func (d *Discoverer) checkMissingVolume(ctx context.Context, pv *v1.PersistentVolume, missing bool, result *ClassResult) {
+	since, annotated := pv.Annotations[common.AnnMissingSince]
+	if !missing {
+		if annotated {
+			glog.Infof("Volume at hostpath %q of PV %q is back, clearing its missing since annotation", pv.Spec.Local.Path, pv.Name)
+			d.updateAnnotation(ctx, pv, common.AnnMissingSince, "")
+		}
+		return
+	}
+	if d.CleanupGracePeriod <= 0 || !isUnbound(pv) {
 		return
 	}
 
-	for _, file := range files {
-		// Check if PV already exists for it
-		pvName := generatePVName(file, d.Node.Name, class)
-		_, exists := d.Cache.GetPV(pvName)
-		if exists {
-			continue
+	retain := pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain
+	missingSince, err := time.Parse(time.RFC3339, since)
+	if !annotated || err != nil {
+		if retain {
+			glog.Warningf("Volume at hostpath %q of unbound PV %q is missing, leaving the PV for manual cleanup since it has reclaim policy %q", pv.Spec.Local.Path, pv.Name, pv.Spec.PersistentVolumeReclaimPolicy)
+		} else {
+			glog.Warningf("Volume at hostpath %q of unbound PV %q is missing, deleting the PV if it's still missing in %v", pv.Spec.Local.Path, pv.Name, d.CleanupGracePeriod)
 		}
+		d.updateAnnotation(ctx, pv, common.AnnMissingSince, time.Now().UTC().Format(time.RFC3339))
+		return
+	}
+	if retain || time.Since(missingSince) < d.CleanupGracePeriod {
+		return
+	}
 
-		filePath := filepath.Join(config.MountDir, file)
-		volType, err := d.getVolumeType(filePath)
-		if err != nil {
-			glog.Error(err)
+	if d.isDraining() || d.cordoned {
+		glog.V(4).Infof("Not deleting PV %q of missing volume at hostpath %q now", pv.Name, pv.Spec.Local.Path)
+		return
+	}
+	if d.DryRun {
+		glog.Infof("Dry run: skipping deletion of PV %q, its volume at hostpath %q has been missing since %v", pv.Name, pv.Spec.Local.Path, since)
+		return
+	}
+	if !d.isUnboundOnServer(ctx, pv) {
+		return
+	}
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to delete PV %q: %v", pv.Name, err)
+		return
+	}
+	if err := d.APIUtil.DeletePV(pv.Name); err != nil {
+		glog.Errorf("Error deleting PV %q of missing volume: %v", pv.Name, err)
+		return
+	}
+	result.add(&result.Deleted, pv.Name)
+	glog.Infof("Deleted unbound PV %q, its volume at hostpath %q has been missing since %v", pv.Name, pv.Spec.Local.Path, since)
+}
+
+// checkDuplicateHostPaths records a warning event for each host path of more than one
+// cached PV. With ResolveDuplicateHostPaths, the unbound duplicates are deleted, keeping
+// the PVs that are not unbound, or the oldest PV if all are.
+func (d *Discoverer) checkDuplicateHostPaths(ctx context.Context, result *DiscoveryResult) {
+	pvsByPath := map[string][]*v1.PersistentVolume{}
+	for _, pv := range d.Cache.ListPVs() {
+		if pv.Spec.Local == nil {
 			continue
 		}
+		path := filepath.Clean(pv.Spec.Local.Path)
+		pvsByPath[path] = append(pvsByPath[path], pv)
+	}
+	paths := []string{}
+	for path, pvs := range pvsByPath {
+		if len(pvs) > 1 {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
 
-		var capacityByte int64
-		switch volType {
-		case common.VolumeTypeBlock:
-			capacityByte, err = d.VolUtil.GetBlockCapacityByte(filePath)
-			if err != nil {
-				glog.Errorf("Path %q block stats error: %v", filePath, err)
+	for _, path := range paths {
+		pvs := pvsByPath[path]
+		sort.Slice(pvs, func(i, j int) bool {
+			if !pvs[i].CreationTimestamp.Equal(pvs[j].CreationTimestamp) {
+				return pvs[i].CreationTimestamp.Before(pvs[j].CreationTimestamp)
+			}
+			return pvs[i].Name < pvs[j].Name
+		})
+		names := []string{}
+		allUnbound := true
+		for _, pv := range pvs {
+			names = append(names, pv.Name)
+			allUnbound = allUnbound && isUnbound(pv)
+		}
+		glog.Warningf("PVs %v have the same host path %q", names, path)
+		d.Recorder.Eventf(d.GetNode(), v1.EventTypeWarning, common.EventDuplicateHostPath, "PVs %v have the same host path %q", names, path)
+		if !d.ResolveDuplicateHostPaths {
+			continue
+		}
+		if d.isDraining() || d.cordoned {
+			glog.V(4).Infof("Not deleting the duplicate PVs of host path %q now", path)
+			continue
+		}
+		for i, pv := range pvs {
+			if !isUnbound(pv) || (allUnbound && i == 0) {
 				continue
 			}
-		case common.VolumeTypeFile:
-			capacityByte, err = d.VolUtil.GetFsCapacityByte(filePath)
-			if err != nil {
-				glog.Errorf("Path %q fs stats error: %v", filePath, err)
+			if d.DryRun {
+				glog.Infof("Dry run: skipping deletion of unbound PV %q, its host path %q is a duplicate", pv.Name, path)
 				continue
 			}
-		default:
-			glog.Errorf("Path %q has unexpected volume type %q", filePath, volType)
-			continue
+			if !d.isUnboundOnServer(ctx, pv) {
+				continue
+			}
+			if err := d.RateLimiter.Wait(ctx); err != nil {
+				glog.Errorf("Error waiting to delete PV %q: %v", pv.Name, err)
+				return
+			}
+			if err := d.APIUtil.DeletePV(pv.Name); err != nil {
+				glog.Errorf("Error deleting duplicate PV %q: %v", pv.Name, err)
+				continue
+			}
+			if classResult, found := result.Classes[pv.Spec.StorageClassName]; found {
+				classResult.add(&classResult.Deleted, pv.Name)
+			}
+			glog.Infof("Deleted unbound PV %q, its host path %q is a duplicate", pv.Name, path)
+		}
+	}
+}
+
+// nestedDepth returns the number of directory levels below the mount dir of the volumes
+func nestedDepth(config common.MountConfig) int {
+	if config.NestedDepth < 1 {
+		return 1
+	}
+	return config.NestedDepth
+}
+
+// volumeDepth returns the number of directory levels below the mount root of the
+// volumes, including the glob elements of the mount dir
+func volumeDepth(config common.MountConfig) int {
+	depth := nestedDepth(config)
+	if _, pattern := common.SplitGlob(config.MountDir); pattern != "" {
+		depth += strings.Count(pattern, string(filepath.Separator)) + 1
+	}
+	return depth
+}
+
+// isAllowedFsType checks if fsType is in allowedFsTypes. An unknown type is never allowed.
+func isAllowedFsType(fsType string, allowedFsTypes []string) bool {
+	if fsType == "" {
+		return false
+	}
+	for _, allowed := range allowedFsTypes {
+		if fsType == allowed {
+			return true
 		}
+	}
+	return false
+}
+
+// roundCapacity rounds the capacity down to a multiple of granularity, if it is positive
+func roundCapacity(capacityByte, granularity int64) int64 {
+	if granularity <= 0 {
+		return capacityByte
+	}
+	return capacityByte - capacityByte%granularity
+}
+
+// scaleCapacity multiplies the capacity by factor, if it is positive
+func scaleCapacity(capacityByte int64, factor float64) int64 {
+	if factor <= 0 {
+		return capacityByte
+	}
+	return int64(float64(capacityByte) * factor)
+}
 
-		d.createPV(file, class, config, capacityByte, volType)
+// reserveCapacity returns the fs capacity left after subtracting the class's reserved capacity
+func reserveCapacity(capacityByte int64, config common.MountConfig) int64 {
+	capacityByte -= capacityByte * int64(config.ReservedCapacityPercent) / 100
+	capacityByte -= config.ReservedCapacityBytes
+	if capacityByte < 0 {
+		return 0
 	}
+	return capacityByte
+}
+
+// isIgnored returns true if the directory entry matches any of the ignore patterns
+func (d *Discoverer) isIgnored(file string) bool {
+	for _, pattern := range d.ignorePatterns {
+		if matched, _ := filepath.Match(pattern, file); matched {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *Discoverer) getVolumeType(fullPath string) (string, error) {
@@ -139,41 +2406,359 @@ func (d *Discoverer) getVolumeType(fullPath string) (string, error) {
 	if isblk {
 		return common.VolumeTypeBlock, nil
 	}
+	if util.IsTimeout(errdir) {
+		return "", errdir
+	}
+	if util.IsTimeout(errblk) {
+		return "", errblk
+	}
 
 	return "", fmt.Errorf("Block device check for %q failed: DirErr - %v BlkErr - %v", fullPath, errdir, errblk)
 
 }
 
-func generatePVName(file, node, class string) string {
+// nameHash returns the FNV-1a hash of the parts as hex, with hashBits bits. 32-bit
+// hashes are zero padded only if pad is set, to keep the names of the existing PVs.
+// The parts of 32-bit hashes are concatenated, to keep the names of the existing PVs
+// too, so e.g. "ab", "c" and "a", "bc" have the same hash. 64-bit hashes already change
+// all the names, so their parts are length-prefixed, which makes the input unambiguous.
+func nameHash(hashBits int, pad bool, parts ...string) string {
+	if hashBits == 64 {
+		h := fnv.New64a()
+		for _, part := range parts {
+			fmt.Fprintf(h, "%d:%s", len(part), part)
+		}
+		return fmt.Sprintf("%016x", h.Sum64())
+	}
 	h := fnv.New32a()
-	h.Write([]byte(file))
-	h.Write([]byte(node))
-	h.Write([]byte(class))
-	// This is the FNV-1a 32-bit hash
-	return fmt.Sprintf("local-pv-%x", h.Sum32())
+	for _, part := range parts {
+		h.Write([]byte(part))
+	}
+	if pad {
+		return fmt.Sprintf("%08x", h.Sum32())
+	}
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+func generatePVName(prefix, file, node, class string, hashBits int) string {
+	// This is the FNV-1a 32-bit or 64-bit hash
+	return prefix + nameHash(hashBits, false, file, node, class)
+}
+
+// generatePVName returns the name of the PV for the volume with the configured naming strategy
+func (d *Discoverer) generatePVName(file, class string) string {
+	if d.namingStrategy == common.PVNamingReadable {
+		return generateReadablePVName(d.pvNamePrefix, file, d.GetNode().Name, class, d.hashBits)
+	}
+	return generatePVName(d.pvNamePrefix, file, d.GetNode().Name, class, d.hashBits)
+}
+
+var (
+	readableNameRegexp = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
+	invalidNameChars   = regexp.MustCompile("[^-a-z0-9]+")
+)
+
+// generateReadablePVName returns prefix + file + "-" + hash of the node and class. The
+// name only depends on the volume, so that it stays the same across restarts. If file
+// is not a valid name, e.g. because it has upper case letters, or is too long, it is
+// sanitized and the hash of generatePVName is appended to keep the name unique.
+func generateReadablePVName(prefix, file, node, class string, hashBits int) string {
+	classHash := nameHash(hashBits, true, node, class)
+	name := fmt.Sprintf("%s%s-%s", prefix, file, classHash)
+	if readableNameRegexp.MatchString(file) && len(name) <= validation.DNS1123LabelMaxLength {
+		return name
+	}
+
+	suffix := fmt.Sprintf("-%s-%s", classHash, nameHash(hashBits, true, file, node, class))
+	sanitized := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(file), "-"), "-")
+	if maxLen := validation.DNS1123LabelMaxLength - len(prefix) - len(suffix); len(sanitized) > maxLen {
+		if maxLen < 0 {
+			maxLen = 0
+		}
+		sanitized = strings.TrimRight(sanitized[:maxLen], "-")
+	}
+	return prefix + sanitized + suffix
+}
+
+// hostPath returns the host path of the PV of the volume, from the host path template
+// of the class if it has one
+func (d *Discoverer) hostPath(file, class string, config common.MountConfig) (string, error) {
+	tmpl, ok := d.hostPathTemplates[class]
+	if !ok {
+		return filepath.Join(config.HostRoot(), file), nil
+	}
+	path, err := common.ExecuteHostPathTemplate(tmpl, &common.HostPathTemplateData{Name: file, Class: class, Node: d.GetNode().Name})
+	if err != nil {
+		return "", fmt.Errorf("Error generating host path of volume %q for storage class %q: %v", file, class, err)
+	}
+	return path, nil
 }
 
-func (d *Discoverer) createPV(file, class string, config common.MountConfig, capacityByte int64, volType string) {
-	pvName := generatePVName(file, d.Node.Name, class)
-	outsidePath := filepath.Join(config.HostDir, file)
+func (d *Discoverer) createPV(ctx context.Context, file, class string, config common.MountConfig, capacityByte int64, volType string, labels map[string]string, result *ClassResult) {
+	pvName := d.generatePVName(file, class)
+	outsidePath, err := d.hostPath(file, class, config)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	if d.isDraining() {
+		glog.V(4).Infof("Draining, not creating PV %q for volume at %q", pvName, outsidePath)
+		return
+	}
+	if existing, found := d.Cache.GetPVByHostPath(outsidePath); found {
+		// E.g. a stale PV of a previous provisioner version, creating the PV would hand
+		// out the volume twice
+		d.reportHostPathInUse(existing, pvName, class, outsidePath)
+		d.skipEntry(result, class, file, volType, SkipReasonHostPathInUse, "host path has PV %s", existing.Name)
+		return
+	}
+
+	d.VolumeLogger.Info(&util.VolumeEvent{
+		Event:    util.VolumeEventDiscovered,
+		Class:    class,
+		PVName:   pvName,
+		HostPath: outsidePath,
+		Capacity: capacityByte,
+		Node:     d.GetNode().Name,
+	}, fmt.Sprintf("Found new volume of volumeType %q at host path %q with capacity %d, creating Local PV %q",
+		volType, outsidePath, capacityByte, pvName))
+	metrics.DiscoveredVolumes.Inc(class)
+	result.add(&result.Discovered, pvName)
+
+	// Labels of the storage class override the global ones, the labels found by the
+	// provisioner override both
+	labels = mergeMaps(d.ExtraLabels, config.ExtraLabels, labels)
+	if re, ok := d.labelPatterns[class]; ok {
+		d.addPatternLabels(labels, re, file)
+	}
+
+	deviceID := ""
+	if volType == common.VolumeTypeBlock {
+		var err error
+		deviceID, err = d.VolUtil.GetDeviceID(filepath.Join(config.MountRoot(), file))
+		if err != nil {
+			glog.Warningf("Error getting device ID of volume at %q: %v", outsidePath, err)
+		}
+	}
 
-	glog.Infof("Found new volume of volumeType %q at host path %q with capacity %d, creating Local PV %q",
-		volType, outsidePath, capacityByte, pvName)
+	provisionerName := d.Name
+	if config.ProvisionerName != "" {
+		provisionerName = config.ProvisionerName
+	}
+	labels = mergeMaps(labels, d.provisionerLabels(provisionerName))
+	var ownerRefs []metav1.OwnerReference
+	if d.SetNodeOwnerRef {
+		ownerRefs = []metav1.OwnerReference{common.NodeOwnerReference(d.GetNode())}
+	}
+	annotations := mergeMaps(d.ExtraAnnotations, config.ExtraAnnotations)
+	if _, ok := d.hostPathTemplates[class]; ok {
+		// The host path can't be mapped back to the volume
+		annotations[common.AnnVolumePath] = file
+	}
+	if labels[common.LabelVolatile] == "true" {
+		annotations[common.AnnVolatile] = "Volume is on tmpfs, its data is lost when the node reboots"
+	}
+	var accessModes []v1.PersistentVolumeAccessMode
+	for _, mode := range config.AccessModes {
+		accessModes = append(accessModes, v1.PersistentVolumeAccessMode(mode))
+	}
+	if config.ReadOnlyManyAccessMode && labels[common.LabelReadOnly] == "true" {
+		accessModes = []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}
+	}
+	var mountOptions []string
+	reclaimPolicy := config.ReclaimPolicy
+	if volType == common.VolumeTypeFile {
+		mountOptions = config.MountOptions
+		if config.ReclaimPolicyFile != "" {
+			reclaimPolicy = d.fileReclaimPolicy(filepath.Join(config.MountRoot(), file, config.ReclaimPolicyFile), reclaimPolicy)
+		}
+	}
 
-	// TODO: Set block volumeType when the API is ready.
+	// TODO: Set spec.volumeMode from volType once the vendored API has it, see TODO.md.
 	pvSpec := common.CreateLocalPVSpec(&common.LocalPVConfig{
 		Name:            pvName,
 		HostPath:        outsidePath,
 		Capacity:        capacityByte,
 		StorageClass:    class,
-		ProvisionerName: d.Name,
+		ProvisionerName: provisionerName,
 		AffinityAnn:     d.nodeAffinityAnn,
+		Labels:          labels,
+		ReclaimPolicy:   reclaimPolicy,
+		DeviceID:        deviceID,
+		OwnerReferences: ownerRefs,
+		Annotations:     annotations,
+		AccessModes:     accessModes,
+		MountOptions:    mountOptions,
 	})
 
-	_, err := d.APIUtil.CreatePV(pvSpec)
+	if d.DryRun {
+		spec, _ := json.Marshal(pvSpec)
+		glog.Infof("Dry run: skipping creation of PV %q for volume at %q: %s", pvName, outsidePath, spec)
+		return
+	}
+
+	if err := d.RateLimiter.Wait(ctx); err != nil {
+		glog.Errorf("Error waiting to create PV %q for volume at %q: %v", pvName, outsidePath, err)
+		return
+	}
+	_, err = d.APIUtil.CreatePV(pvSpec)
+	if errors.IsAlreadyExists(err) {
+		// Created by another discovery cycle, which already noted its creation
+		glog.V(4).Infof("PV %q for volume at %q already exists", pvName, outsidePath)
+		return
+	}
 	if err != nil {
 		glog.Errorf("Error creating PV %q for volume at %q: %v", pvName, outsidePath, err)
+		if d.APIRetryAttempts > 1 && ctx.Err() == nil {
+			// Retry in the background so that the backoff doesn't hold up other volumes
+			d.setPending(pvName, true)
+			d.pendingWg.Add(1)
+			go func() {
+				defer d.pendingWg.Done()
+				defer d.setPending(pvName, false)
+				d.retryCreatePV(ctx, pvSpec, outsidePath)
+			}()
+		}
+		return
+	}
+	result.add(&result.Created, pvName)
+	d.volumeCreated(pvSpec, outsidePath, capacityByte)
+}
+
+// fileReclaimPolicy returns the reclaim policy in the reclaim policy file of a volume, or
+// classPolicy if the file doesn't exist or has an unsupported policy
+func (d *Discoverer) fileReclaimPolicy(path string, classPolicy v1.PersistentVolumeReclaimPolicy) v1.PersistentVolumeReclaimPolicy {
+	content, err := d.VolUtil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Error reading reclaim policy file %q, using the policy of the class: %v", path, err)
+		}
+		return classPolicy
+	}
+	policy := v1.PersistentVolumeReclaimPolicy(strings.TrimSpace(string(content)))
+	switch policy {
+	case v1.PersistentVolumeReclaimDelete, v1.PersistentVolumeReclaimRetain:
+		glog.V(4).Infof("Reclaim policy file %q sets reclaim policy %q", path, policy)
+		return policy
+	}
+	glog.Warningf("Reclaim policy file %q has unsupported reclaim policy %q, using the policy of the class", path, policy)
+	return classPolicy
+}
+
+// mergeMaps returns a new map with the entries of all maps, the later maps take precedence
+func mergeMaps(maps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// addPatternLabels adds a label for each named capture group of re that matches file
+func (d *Discoverer) addPatternLabels(labels map[string]string, re *regexp.Regexp, file string) {
+	match := re.FindStringSubmatch(file)
+	if match == nil {
+		glog.V(4).Infof("Volume %q does not match label pattern %q", file, re.String())
 		return
 	}
-	glog.Infof("Created PV %q for volume at %q", pvName, outsidePath)
+	for i, name := range re.SubexpNames() {
+		if name == "" || match[i] == "" {
+			continue
+		}
+		if errs := validation.IsValidLabelValue(match[i]); len(errs) > 0 {
+			glog.Warningf("Volume %q label %q has invalid value %q: %v", file, name, match[i], errs)
+			continue
+		}
+		labels[name] = match[i]
+	}
+}
+
+// errDraining aborts the retries of a PV creation once the Discoverer is drained
+var errDraining = fmt.Errorf("draining")
+
+// retryCreatePV retries creating the PV with exponential backoff, up to APIRetryAttempts in total.
+// An already existing PV stops the retries without noting a creation, since another discovery
+// cycle may have created it.
+// The retries stop once ctx is done or the Discoverer is drained.
+func (d *Discoverer) retryCreatePV(ctx context.Context, pvSpec *v1.PersistentVolume, outsidePath string) {
+	// The first attempt was made by createPV
+	backoff := d.APIRetryBackoff()
+	backoff.Steps--
+
+	select {
+	case <-time.After(backoff.Duration):
+	case <-ctx.Done():
+		glog.Errorf("Giving up creating PV %q for volume at %q: %v", pvSpec.Name, outsidePath, ctx.Err())
+		return
+	}
+	exists := false
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if d.isDraining() {
+			return false, errDraining
+		}
+		if err := d.RateLimiter.Wait(ctx); err != nil {
+			return false, err
+		}
+		_, err := d.APIUtil.CreatePV(pvSpec)
+		if errors.IsAlreadyExists(err) {
+			exists = true
+			return true, nil
+		}
+		if err != nil {
+			glog.Errorf("Error retrying creation of PV %q for volume at %q: %v", pvSpec.Name, outsidePath, err)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == errDraining {
+		glog.Infof("Draining, giving up creating PV %q for volume at %q", pvSpec.Name, outsidePath)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Giving up creating PV %q for volume at %q after %d attempts", pvSpec.Name, outsidePath, d.APIRetryAttempts)
+		return
+	}
+	if exists {
+		glog.V(4).Infof("PV %q for volume at %q already exists", pvSpec.Name, outsidePath)
+		return
+	}
+	capacity := pvSpec.Spec.Capacity[v1.ResourceStorage]
+	d.volumeCreated(pvSpec, outsidePath, capacity.Value())
+}
+
+// volumeCreated records the creation of the PV in the metrics, logs and events
+func (d *Discoverer) volumeCreated(pvSpec *v1.PersistentVolume, outsidePath string, capacityByte int64) {
+	class := pvSpec.Spec.StorageClassName
+	metrics.CreatedVolumes.Inc(class)
+	d.VolumeLogger.Info(&util.VolumeEvent{
+		Event:    util.VolumeEventCreated,
+		Class:    class,
+		PVName:   pvSpec.Name,
+		HostPath: outsidePath,
+		Capacity: capacityByte,
+		Node:     d.GetNode().Name,
+	}, fmt.Sprintf("Created PV %q for volume at %q", pvSpec.Name, outsidePath))
+	d.Recorder.Eventf(pvSpec, v1.EventTypeNormal, common.EventVolumeCreated, "Created PV for volume at host path %q with capacity %d", outsidePath, capacityByte)
+
+	d.mutex.Lock()
+	delete(d.hostPathInUseEvents, pvSpec.Name)
+	d.mutex.Unlock()
+}
+
+func (d *Discoverer) isPending(pvName string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.pendingPVs[pvName]
+}
+
+func (d *Discoverer) setPending(pvName string, pending bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if pending {
+		d.pendingPVs[pvName] = true
+	} else {
+		delete(d.pendingPVs, pvName)
+	}
 }
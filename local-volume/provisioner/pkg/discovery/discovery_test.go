@@ -17,15 +17,29 @@ limitations under the License.
 package discovery
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/cache"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/api/v1/helper"
 )
 
@@ -39,6 +53,7 @@ const (
 var testNode = &v1.Node{
 	ObjectMeta: metav1.ObjectMeta{
 		Name: testNodeName,
+		UID:  "test-node-uid",
 		Labels: map[string]string{
 			common.NodeLabelKey: testNodeName,
 		},
@@ -65,34 +80,3763 @@ type testConfig struct {
 	expectedVolumes map[string][]*util.FakeDirEntry
 	// True if testing api failure
 	apiShouldFail bool
+	// Number of CreatePV calls that fail before succeeding
+	apiTransientFailures int
+	// Maximum number of attempts for a failed API call
+	apiRetryAttempts int
+	// Maximum number of storage classes discovered concurrently
+	maxConcurrency int
+	// Maximum number of new volumes of a class probed concurrently
+	maxVolumeConcurrency int
+	// Which events are recorded, empty means per volume
+	eventMode common.EventMode
+	// Prefix of the generated PV names, empty means the default prefix
+	pvNamePrefix string
+	// The discovery configuration, defaults to scMapping
+	discoveryMap map[string]common.MountConfig
+	// True if testing dry run mode
+	dryRun bool
+	// Maximum number of PVs of the node
+	maxPVs int
+	// Skip volumes with zero capacity
+	skipZeroCapacity bool
+	// Storage classes of the discovery configuration that don't exist in the API server
+	missingClasses map[string]bool
+	// True if the PVs should be owned by the node
+	setNodeOwnerRef bool
+	// Annotations added to all the PVs
+	extraAnnotations map[string]string
+	// Labels added to all the PVs
+	extraLabels map[string]string
+	// Minimum interval between updates of the last seen annotation
+	lastSeenInterval time.Duration
+	// Minimum period between the reconciliations of the existing PVs
+	reconcilePeriod time.Duration
 	// The rest are set during setup
-	volUtil *util.FakeVolumeUtil
-	apiUtil *util.FakeAPIUtil
-	cache   *cache.VolumeCache
+	volUtil  *util.FakeVolumeUtil
+	apiUtil  *util.FakeAPIUtil
+	cache    *cache.VolumeCache
+	recorder *record.FakeRecorder
 }
 
 func TestDiscoverVolumes_Basic(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024, FsType: "ext4"},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024 * 1024, DeviceID: "wwn-0x5000c500a1b2c3d4"},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile, FsType: "xfs"},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyCreatedEvents(t, test, 4)
+}
+
+func TestDiscoverVolumes_BasicTwice(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// Second time should not create any new volumes
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_SingleWorker(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		maxConcurrency:  1,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_VolumeConcurrency(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:            vols,
+		expectedVolumes:      vols,
+		maxConcurrency:       1,
+		maxVolumeConcurrency: 2,
+	}
+	d := testSetup(t, test)
+	test.volUtil.SetCapacityDelay(10 * time.Millisecond)
+
+	result := d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	if result.Created() != 4 {
+		t.Errorf("Expected 4 created PVs in the result, got %v", result.Created())
+	}
+}
+
+func TestDiscoverVolumes_VolumeConcurrencyMaxPVs(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+			{Name: "mount3", VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:            vols,
+		maxVolumeConcurrency: 3,
+		maxPVs:               2,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	if created := test.apiUtil.GetAndResetCreatedPVs(); len(created) != 2 {
+		t.Errorf("Expected 2 created PVs, got %v", len(created))
+	}
+}
+
+// BenchmarkDiscoverVolumes_VolumeConcurrency discovers 24 slow disks, one at a time and
+// with 8 workers
+func BenchmarkDiscoverVolumes_VolumeConcurrency(b *testing.B) {
+	files := []*util.FakeDirEntry{}
+	for i := 0; i < 24; i++ {
+		files = append(files, &util.FakeDirEntry{Name: fmt.Sprintf("disk%d", i), VolumeType: util.FakeEntryBlock})
+	}
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				test := &testConfig{
+					dirLayout:            map[string][]*util.FakeDirEntry{"dir1": files},
+					maxVolumeConcurrency: workers,
+				}
+				d := testSetup(b, test)
+				test.volUtil.SetCapacityDelay(time.Millisecond)
+				if created := d.DiscoverLocalVolumes(context.Background()).Created(); created != len(files) {
+					b.Fatalf("Expected %v created PVs, got %v", len(files), created)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoverVolumes_PVNamePrefix(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		pvNamePrefix:    "ssd-pv-",
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestNewDiscoverer_InvalidPVNamePrefix(t *testing.T) {
+	for _, prefix := range []string{"Local-PV-", "-pv-", "local_pv_"} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node:         testNode,
+				DiscoveryMap: scMapping,
+				PVNamePrefix: prefix,
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for PV name prefix %q", prefix)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidPVNamingStrategy(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node:             testNode,
+			DiscoveryMap:     scMapping,
+			PVNamingStrategy: "Random",
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for PV naming strategy %q", runConfig.PVNamingStrategy)
+	}
+}
+
+func TestNewDiscoverer_AdoptExistingWithScopePVInformer(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node:            testNode,
+			DiscoveryMap:    scMapping,
+			AdoptExisting:   true,
+			ScopePVInformer: true,
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for AdoptExisting with ScopePVInformer")
+	}
+}
+
+func TestNewDiscoverer_InvalidPVNameHashBits(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node:           testNode,
+			DiscoveryMap:   scMapping,
+			PVNameHashBits: 48,
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for PV name hash size %d", runConfig.PVNameHashBits)
+	}
+}
+
+func TestGeneratePVName_64BitHash(t *testing.T) {
+	cases := map[common.PVNamingStrategy]map[string]string{
+		common.PVNamingHash: {
+			"mount1": "local-pv-bf847a6475fe0135",
+		},
+		common.PVNamingReadable: {
+			"mount1":    "local-pv-mount1-575930dad034b45d",
+			"SSD_Slot7": "local-pv-ssd-slot7-575930dad034b45d-cb180f8b6f04abfe",
+		},
+	}
+	for strategy, names := range cases {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node:             testNode,
+				DiscoveryMap:     scMapping,
+				PVNamingStrategy: strategy,
+				PVNameHashBits:   64,
+			},
+			VolUtil: util.NewFakeVolumeUtil(false),
+			Name:    testProvisionerName,
+		}
+		d, err := NewDiscoverer(runConfig)
+		if err != nil {
+			t.Fatalf("Error setting up discoverer: %v", err)
+		}
+		for file, expected := range names {
+			name := d.generatePVName(file, "sc1")
+			if name != expected {
+				t.Errorf("Expected %s PV name %q for %q, got %q", strategy, expected, file, name)
+			}
+			if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+				t.Errorf("PV name %q for %q is invalid: %v", name, file, errs)
+			}
+		}
+	}
+}
+
+func TestNameHash_Unambiguous(t *testing.T) {
+	// Concatenated, the parts of the 32-bit hashes are ambiguous, which is kept for the
+	// names of the existing PVs
+	if a, b := nameHash(32, false, "ab", "c", "sc1"), nameHash(32, false, "a", "bc", "sc1"); a != b {
+		t.Errorf("Expected the same 32-bit hash of concatenated parts, got %q and %q", a, b)
+	}
+	if a, b := nameHash(64, false, "ab", "c", "sc1"), nameHash(64, false, "a", "bc", "sc1"); a == b {
+		t.Errorf("Expected different 64-bit hashes of length-prefixed parts, got %q", a)
+	}
+}
+
+func TestGenerateReadablePVName(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	cases := map[string]string{
+		// Valid names are kept, with the node and class hash as suffix
+		"mount1":    "local-pv-mount1-8b086149",
+		"ssd-slot7": "local-pv-ssd-slot7-8b086149",
+		// Other names are sanitized and get the volume hash too
+		"SSD_Slot7": "local-pv-ssd-slot7-8b086149-07737cdf",
+		"___":       "local-pv--8b086149-cd914cb4",
+		long:        "local-pv-" + long[:36] + "-8b086149-64f26635",
+	}
+	for file, expected := range cases {
+		name := generateReadablePVName(common.DefaultPVNamePrefix, file, testNodeName, "sc1", 32)
+		if name != expected {
+			t.Errorf("Expected PV name %q for %q, got %q", expected, file, name)
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			t.Errorf("PV name %q for %q is invalid: %v", name, file, errs)
+		}
+	}
+}
+
+func TestDiscoverVolumes_MissingStorageClass(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		missingClasses:  map[string]bool{"sc2": true},
+	}
+	d := testSetup(t, test)
+
+	// A missing class doesn't block its discovery
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	expected := map[string]bool{"sc1": true, "sc2": false}
+	if !reflect.DeepEqual(d.storageClassExists, expected) {
+		t.Errorf("Expected storage class check results %v, got %v", expected, d.storageClassExists)
+	}
+
+	// The result is cached
+	test.apiUtil.SetStorageClass(&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "sc2"}})
+	d.DiscoverLocalVolumes(context.Background())
+	if !reflect.DeepEqual(d.storageClassExists, expected) {
+		t.Errorf("Expected cached storage class check results %v, got %v", expected, d.storageClassExists)
+	}
+}
+
+func TestDiscoverVolumes_NodeOwnerRef(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		setNodeOwnerRef: true,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_ExtraAnnotations(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	discoveryMap := newDiscoveryMap(func(config *common.MountConfig) {})
+	sc2 := discoveryMap["sc2"]
+	sc2.ExtraAnnotations = map[string]string{"example.com/team": "storage"}
+	discoveryMap["sc2"] = sc2
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap:    discoveryMap,
+		extraAnnotations: map[string]string{
+			"example.com/cost-center": "1234",
+			"example.com/team":        "platform",
+		},
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	createdPVs := test.apiUtil.GetAndResetCreatedPVs()
+	expected := map[string]map[string]string{
+		"sc1": {"example.com/cost-center": "1234", "example.com/team": "platform"},
+		"sc2": {"example.com/cost-center": "1234", "example.com/team": "storage"},
+	}
+	if len(createdPVs) != 2 {
+		t.Fatalf("Expected 2 created PVs, got %v", len(createdPVs))
+	}
+	for _, pv := range createdPVs {
+		for key, value := range expected[pv.Spec.StorageClassName] {
+			if pv.Annotations[key] != value {
+				t.Errorf("PV %q annotation %q is %q, expected %q", pv.Name, key, pv.Annotations[key], value)
+			}
+		}
+		verifyProvisionerName(t, pv, testProvisionerName)
+		verifyNodeAffinity(t, pv)
+	}
+}
+
+func TestNewDiscoverer_InvalidExtraAnnotations(t *testing.T) {
+	for _, annotations := range []map[string]string{
+		{"bad key": "value"},
+		{common.AnnProvisionedBy: "other-provisioner"},
+		{v1.AlphaStorageNodeAffinityAnnotation: "{}"},
+	} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node:             testNode,
+				DiscoveryMap:     scMapping,
+				ExtraAnnotations: annotations,
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for extra annotations %v", annotations)
+		}
+
+		runConfig = &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.ExtraAnnotations = annotations
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for storage class extra annotations %v", annotations)
+		}
+	}
+}
+
+func TestDiscoverVolumes_ReadinessGate(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	sc1 := scMapping["sc1"]
+	sc1.ReadySentinel = ".ready"
+	sc2 := scMapping["sc2"]
+	sc2.ReadyMinEntries = 2
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{},
+		discoveryMap:    map[string]common.MountConfig{"sc1": sc1, "sc2": sc2},
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// The sentinel is not discovered as a volume
+	newVols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: ".ready", VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test.volUtil.AddNewDirEntries(testMountDir, newVols)
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{
+		"dir1": vols["dir1"],
+		"dir2": append(vols["dir2"], newVols["dir2"]...),
+	}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	expected := map[string]bool{"sc1": true, "sc2": true}
+	if !reflect.DeepEqual(d.readyClasses, expected) {
+		t.Errorf("Expected ready classes %v, got %v", expected, d.readyClasses)
+	}
+}
+
+func TestDiscoverVolumes_LastSeen(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:        vols,
+		expectedVolumes:  vols,
+		lastSeenInterval: time.Hour,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyLastSeenUpdates(t, test, 0)
+
+	// The PVs are stamped once they are found again
+	d.DiscoverLocalVolumes(context.Background())
+	verifyLastSeenUpdates(t, test, 2)
+
+	// The updates are throttled
+	d.DiscoverLocalVolumes(context.Background())
+	verifyLastSeenUpdates(t, test, 0)
+
+	pv, _ := test.cache.GetPV(expectedPVName(test, vols["dir1"][0]))
+	pv.Annotations[common.AnnLastSeen] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	d.DiscoverLocalVolumes(context.Background())
+	verifyLastSeenUpdates(t, test, 1)
+}
+
+func TestDiscoverVolumes_AddProvisionerLabels(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	// Created before PVs got the provisioner labels
+	pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+		Name:            expectedPVName(test, vols["dir1"][0]),
+		HostPath:        filepath.Join(testHostDir, "dir1", "mount1"),
+		StorageClass:    "sc1",
+		ProvisionerName: testProvisionerName,
+	})
+	test.cache.AddPV(pv)
+
+	d.DiscoverLocalVolumes(context.Background())
+	updatedPVs := test.apiUtil.GetAndResetUpdatedPVs()
+	if len(updatedPVs) != 1 {
+		t.Fatalf("Expected 1 updated PV, got %v", len(updatedPVs))
+	}
+	if node := updatedPVs[pv.Name].Labels[common.LabelNode]; node != testNodeName {
+		t.Errorf("Expected node label %q, got %q", testNodeName, node)
+	}
+	if name := updatedPVs[pv.Name].Labels[common.LabelProvisionedBy]; name != testProvisionerName {
+		t.Errorf("Expected provisioned by label %q, got %q", testProvisionerName, name)
+	}
+	if len(pv.Labels) != 0 {
+		t.Errorf("Expected the cached PV to be left unmodified, got labels %v", pv.Labels)
+	}
+}
+
+func TestProvisionerLabelValue(t *testing.T) {
+	long := "local-volume-provisioner-" + strings.Repeat("node", 10) + "-2f3a6b1c-0c2e-11e8-b7b1-42010a800002"
+	for _, name := range []string{testProvisionerName, long, "local/provisioner", strings.Repeat("-", 70)} {
+		value := common.ProvisionerLabelValue(name)
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			t.Errorf("Label value %q of %q is not valid: %v", value, name, errs)
+		}
+		if name == testProvisionerName && value != name {
+			t.Errorf("Expected valid name %q to be kept, got %q", name, value)
+		}
+	}
+	if common.ProvisionerLabelValue(long) == common.ProvisionerLabelValue(long+"0") {
+		t.Errorf("Expected names with the same prefix to get different label values")
+	}
+}
+
+func TestCreateLocalPVSpec_Capacity(t *testing.T) {
+	tests := []struct {
+		bytes    int64
+		expected string
+	}{
+		{1860 * 1024 * 1024 * 1024, "1860Gi"},
+		{1024 * 1024 * 1024 * 1024, "1Ti"},
+		{1536 * 1024 * 1024, "1536Mi"},
+		{100 * 1024, "100Ki"},
+		// Byte counts that are not binary multiples are rendered as is
+		{1000 * 1000 * 1000, "1000000000"},
+		{1234567, "1234567"},
+		{0, "0"},
+	}
+	for _, test := range tests {
+		pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+			Name:         "pv1",
+			HostPath:     "/mnt/disks/mount1",
+			Capacity:     test.bytes,
+			StorageClass: "sc1",
+		})
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		if capacity.String() != test.expected {
+			t.Errorf("Expected capacity %q for %d bytes, got %q", test.expected, test.bytes, capacity.String())
+		}
+		if capacity.Value() != test.bytes {
+			t.Errorf("Expected capacity value %d, got %d", test.bytes, capacity.Value())
+		}
+	}
+}
+
+func TestDiscoverVolumes_ReconcilePeriod(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:        vols,
+		expectedVolumes:  vols,
+		lastSeenInterval: time.Nanosecond,
+		reconcilePeriod:  time.Hour,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// New volumes are still discovered between the reconciliations
+	newVols := map[string][]*util.FakeDirEntry{
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test.volUtil.AddNewDirEntries(testMountDir, newVols)
+	test.expectedVolumes = newVols
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyLastSeenUpdates(t, test, 0)
+
+	// The existing PVs are reconciled once the period has passed
+	for class := range d.lastReconciles {
+		d.lastReconciles[class] = time.Now().Add(-2 * time.Hour)
+	}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyLastSeenUpdates(t, test, 3)
+	d.DiscoverLocalVolumes(context.Background())
+	verifyLastSeenUpdates(t, test, 0)
+}
+
+func TestDiscoverVolumes_Healthz(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	handler := d.HealthzHandler()
+
+	// Healthy until the staleness has passed since the start
+	verifyHealthz(t, handler, http.StatusOK)
+	d.lastSuccess = time.Now().Add(-2 * common.DefaultHealthzStaleness)
+	verifyHealthz(t, handler, http.StatusServiceUnavailable)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyHealthz(t, handler, http.StatusOK)
+
+	// A failed discovery doesn't count
+	d.lastSuccess = time.Now().Add(-2 * common.DefaultHealthzStaleness)
+	test.volUtil.SetError(util.FakeOpReadDir, filepath.Join(testMountDir, "dir1"), fmt.Errorf("injected error"))
+	d.DiscoverLocalVolumes(context.Background())
+	verifyHealthz(t, handler, http.StatusServiceUnavailable)
+}
+
+func TestDiscoverVolumes_EventComponent(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		maxPVs:    1,
+	}
+	d := testSetup(t, test)
+	// The recorder needs the kind of the objects that were not read from the API server
+	node := *testNode
+	node.TypeMeta = metav1.TypeMeta{Kind: "Node", APIVersion: "v1"}
+	test.apiUtil.SetNode(&node)
+	broadcaster := record.NewBroadcaster()
+	events := make(chan *v1.Event, 10)
+	watcher := broadcaster.StartEventWatcher(func(event *v1.Event) {
+		events <- event
+	})
+	defer watcher.Stop()
+	d.Recorder = common.NewEventRecorder(broadcaster, "local-volume-provisioner", common.EventModePerVolume)
+
+	d.DiscoverLocalVolumes(context.Background())
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Reason != common.EventMaxPVsReached {
+				continue
+			}
+			if event.Source.Component != "local-volume-provisioner" {
+				t.Errorf("Expected event source component %q, got %q", "local-volume-provisioner", event.Source.Component)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the %s event", common.EventMaxPVsReached)
+		}
+	}
+}
+
+func TestDiscoverVolumes_DebugHandler(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+			{Name: "lost+found", VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": vols["dir1"][:2],
+		},
+	}
+	d := testSetup(t, test)
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	// The existing PVs are found in the next discovery
+	d.DiscoverLocalVolumes(context.Background())
+
+	recorder := httptest.NewRecorder()
+	d.DebugHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/discovery", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, got %v: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	state := &debugState{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), state); err != nil {
+		t.Fatalf("Error decoding the debug state: %v", err)
+	}
+	sc1 := state.Classes["sc1"]
+	if sc1 == nil {
+		t.Fatalf("Expected the debug state of class sc1, got %+v", state.Classes)
+	}
+	expected := map[string]*EntryResult{
+		"mount1":     {Decision: "has PV local-pv-aaaafef5"},
+		"mount2":     {Decision: "has PV local-pv-79412c38"},
+		"lost+found": {Decision: "ignored", Reason: SkipReasonIgnored},
+	}
+	if !reflect.DeepEqual(sc1.Entries, expected) {
+		t.Errorf("Expected entries %+v, got %+v", expected, sc1.Entries)
+	}
+	if expected := []string{"local-pv-79412c38", "local-pv-aaaafef5"}; !reflect.DeepEqual(sc1.CachedPVs, expected) {
+		t.Errorf("Expected cached PVs %v, got %v", expected, sc1.CachedPVs)
+	}
+
+	// The decisions on new volumes include their type
+	test.volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+		"dir2": {{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryBlock}},
+	})
+	test.volUtil.SetError(util.FakeOpGetBlockCapacityByte, filepath.Join(testMountDir, "dir2", "mount1"), fmt.Errorf("injected error"))
+	result := d.DiscoverLocalVolumes(context.Background())
+	entry := result.Classes["sc2"].Entries["mount1"]
+	if entry == nil || entry.Type != common.VolumeTypeBlock || !strings.HasSuffix(entry.Decision, "injected error") {
+		t.Errorf("Expected a block entry with the capacity error, got %+v", entry)
+	}
+}
+
+func verifyHealthz(t *testing.T, handler http.Handler, expected int) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != expected {
+		t.Errorf("Expected /healthz status %v, got %v: %s", expected, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDiscoverVolumes_ClassDisabled(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	disabled := false
+	discoveryMap := newDiscoveryMap(func(config *common.MountConfig) {})
+	sc2 := discoveryMap["sc2"]
+	sc2.Enabled = &disabled
+	discoveryMap["sc2"] = sc2
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": vols["dir1"],
+		},
+		discoveryMap: discoveryMap,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_MinCapacity(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024 * 1024},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile, Capacity: 1024 * 1024},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {vols["dir1"][1]},
+			"dir2": {vols["dir2"][0]},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.MinCapacityBytes = 1024 * 1024
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_ResolveSymlinks(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, SymlinkTarget: testMountDir + "/targets/disk1"},
+			// Broken symlink
+			{Name: "mount2", Hash: 0x79412c38, SymlinkTarget: testMountDir + "/targets/missing"},
+		},
+		"targets": {
+			{Name: "disk1", VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {{Name: "mount1", Hash: 0xaaaafef5, Capacity: 100 * 1024 * 1024}},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.ResolveSymlinks = true
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_DeviceMapperSymlinks(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			// Links to the /dev/mapper/<vg>-<lv> and /dev/<vg>/<lv> links of LVM volumes
+			{Name: "vg-lv1", Hash: 0x3e0eec46, SymlinkTarget: "/dev/mapper/vg-lv1", Capacity: 100 * 1024 * 1024},
+			{Name: "vg-lv2", Hash: 0xb4233b77, SymlinkTarget: "/dev/vg/lv2", Capacity: 200 * 1024 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	test.volUtil.AddNewDirEntries("/dev", map[string][]*util.FakeDirEntry{
+		"mapper": {
+			{Name: "vg-lv1", SymlinkTarget: "/dev/dm-0"},
+			{Name: "vg-lv2", SymlinkTarget: "/dev/dm-1"},
+		},
+		"vg": {
+			{Name: "lv2", SymlinkTarget: "/dev/dm-1"},
+		},
+		"": {
+			{Name: "dm-0", VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024 * 1024},
+			{Name: "dm-1", VolumeType: util.FakeEntryBlock, Capacity: 200 * 1024 * 1024},
+		},
+	})
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestGenerateNodeAffinity_LabelKeys(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testNodeName,
+			Labels: map[string]string{
+				common.NodeLabelKey: testNodeName,
+				"rack":              "rack1",
+			},
+		},
+	}
+
+	affinity, err := generateNodeAffinity(node, nodeAffinityConfig{labelKeys: []string{"rack", "missing", common.NodeLabelKey}})
+	if err != nil {
+		t.Fatalf("Unexpected error generating node affinity: %v", err)
+	}
+	reqs := affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions
+	expected := []v1.NodeSelectorRequirement{
+		{Key: "rack", Operator: v1.NodeSelectorOpIn, Values: []string{"rack1"}},
+		{Key: common.NodeLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{testNodeName}},
+	}
+	if !reflect.DeepEqual(reqs, expected) {
+		t.Errorf("Expected node selector requirements %+v, got %+v", expected, reqs)
+	}
+
+	if _, err := generateNodeAffinity(node, nodeAffinityConfig{labelKeys: []string{"missing"}}); !IsNodeMissingLabel(err) {
+		t.Errorf("Expected a node missing label error when node has none of the label keys, got %v", err)
+	}
+	if _, err := generateNodeAffinity(node, nodeAffinityConfig{labelKeys: []string{"rack", "missing", common.NodeLabelKey}, strict: true}); !IsNodeMissingLabel(err) {
+		t.Errorf("Expected a node missing label error in strict mode when node is missing one of the label keys, got %v", err)
+	}
+}
+
+func TestGenerateNodeAffinity_FirstKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		expectedKey string
+	}{
+		{
+			name:        "first key present",
+			labels:      map[string]string{"node-id": "id1", common.NodeLabelKey: testNodeName},
+			expectedKey: "node-id",
+		},
+		{
+			name:        "fallback key",
+			labels:      map[string]string{common.NodeLabelKey: testNodeName, "rack": "rack1"},
+			expectedKey: common.NodeLabelKey,
+		},
+		{
+			name:   "no key present",
+			labels: map[string]string{"rack": "rack1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName, Labels: test.labels}}
+		affinity, err := generateNodeAffinity(node, nodeAffinityConfig{labelKeys: []string{"node-id", common.NodeLabelKey}, firstKey: true})
+		if test.expectedKey == "" {
+			if !IsNodeMissingLabel(err) {
+				t.Errorf("Expected a node missing label error, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error generating node affinity: %v", err)
+			continue
+		}
+		reqs := affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions
+		expected := []v1.NodeSelectorRequirement{
+			{Key: test.expectedKey, Operator: v1.NodeSelectorOpIn, Values: []string{test.labels[test.expectedKey]}},
+		}
+		if !reflect.DeepEqual(reqs, expected) {
+			t.Errorf("Expected node selector requirements %+v, got %+v", expected, reqs)
+		}
+	}
+}
+
+func TestGenerateNodeAffinity_Zone(t *testing.T) {
+	hostReq := v1.NodeSelectorRequirement{Key: common.NodeLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{testNodeName}}
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected []v1.NodeSelectorRequirement
+	}{
+		{
+			name:   "zone label",
+			labels: map[string]string{common.NodeLabelKey: testNodeName, common.ZoneLabelKey: "zone1"},
+			expected: []v1.NodeSelectorRequirement{
+				hostReq,
+				{Key: common.ZoneLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"zone1"}},
+			},
+		},
+		{
+			name:   "beta zone label",
+			labels: map[string]string{common.NodeLabelKey: testNodeName, "failure-domain.beta.kubernetes.io/zone": "zone2"},
+			expected: []v1.NodeSelectorRequirement{
+				hostReq,
+				{Key: "failure-domain.beta.kubernetes.io/zone", Operator: v1.NodeSelectorOpIn, Values: []string{"zone2"}},
+			},
+		},
+		{
+			name:     "no zone label",
+			labels:   map[string]string{common.NodeLabelKey: testNodeName},
+			expected: []v1.NodeSelectorRequirement{hostReq},
+		},
+	}
+
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName, Labels: test.labels}}
+		affinity, err := generateNodeAffinity(node, nodeAffinityConfig{labelKeys: []string{common.NodeLabelKey}, strict: true, zone: true})
+		if err != nil {
+			t.Errorf("Unexpected error generating node affinity: %v", err)
+			continue
+		}
+		reqs := affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions
+		if !reflect.DeepEqual(reqs, test.expected) {
+			t.Errorf("Expected node selector requirements %+v, got %+v", test.expected, reqs)
+		}
+	}
+
+	// The zone is not added twice when it is also one of the label keys
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName, Labels: map[string]string{common.ZoneLabelKey: "zone1"}}}
+	affinity, err := generateNodeAffinity(node, nodeAffinityConfig{labelKeys: []string{common.ZoneLabelKey}, zone: true})
+	if err != nil {
+		t.Fatalf("Unexpected error generating node affinity: %v", err)
+	}
+	if reqs := affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions; len(reqs) != 1 {
+		t.Errorf("Expected 1 node selector requirement, got %+v", reqs)
+	}
+}
+
+func TestNewDiscoverer_NodeMissingLabel(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node:         &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName}},
+			DiscoveryMap: scMapping,
+		},
+		Name: testProvisionerName,
+	}
+	_, err := NewDiscoverer(runConfig)
+	if !IsNodeMissingLabel(err) {
+		t.Fatalf("Expected a node missing label error, got %v", err)
+	}
+	if expected := "Failed to generate node affinity: Node does not have labels"; err.Error() != expected {
+		t.Errorf("Expected error %q, got %q", expected, err.Error())
+	}
+}
+
+func TestDiscoverVolumes_RefreshNodeAffinity(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+	}
+	d := testSetup(t, test)
+
+	relabeledNode := *testNode
+	relabeledNode.Labels = map[string]string{common.NodeLabelKey: "relabeled-node"}
+	test.apiUtil.SetNode(&relabeledNode)
+	d.DiscoverLocalVolumes(context.Background())
+
+	createdPVs := test.apiUtil.GetAndResetCreatedPVs()
+	if len(createdPVs) != 1 {
+		t.Fatalf("Expected 1 created PV, got %v", len(createdPVs))
+	}
+	for _, pv := range createdPVs {
+		affinity, err := helper.GetStorageNodeAffinityFromAnnotation(pv.Annotations)
+		if err != nil {
+			t.Fatalf("Could not get node affinity from annotation: %v", err)
+		}
+		reqs := affinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions
+		expected := []v1.NodeSelectorRequirement{
+			{Key: common.NodeLabelKey, Operator: v1.NodeSelectorOpIn, Values: []string{"relabeled-node"}},
+		}
+		if !reflect.DeepEqual(reqs, expected) {
+			t.Errorf("Expected node selector requirements %+v, got %+v", expected, reqs)
+		}
+	}
+}
+
+func TestDiscoverVolumes_ExcludePaths(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "sda", Hash: 0xcf7e469d, VolumeType: util.FakeEntryBlock},
+			{Name: "sdb", Hash: 0x80535f00, VolumeType: util.FakeEntryBlock},
+			{Name: "sdc", Hash: 0x88679cab, VolumeType: util.FakeEntryBlock},
+			// Resolves to an excluded device
+			{Name: "by-id-disk", Hash: 0xe3ff7e98, SymlinkTarget: testMountDir + "/dev/sda"},
+		},
+		"dev": {
+			{Name: "sda", VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {{Name: "sdc", Hash: 0x88679cab}},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.ResolveSymlinks = true
+			config.ExcludePaths = []string{"sd[ab]"}
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_MinDirAge(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, ModTime: time.Now().Add(-time.Hour)},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile, ModTime: time.Now()},
+			// Block volumes are not checked
+			{Name: "sda", Hash: 0xcf7e469d, VolumeType: util.FakeEntryBlock, ModTime: time.Now()},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {vols["dir1"][0], vols["dir1"][2]},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.MinDirAge = "10m"
+		}),
+	}
+	d := testSetup(t, test)
+
+	result := d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	if entry := result.Classes["sc1"].Entries["mount2"]; entry == nil || !strings.Contains(entry.Decision, "minimum age") {
+		t.Errorf("Expected mount2 to be deferred for its age, got %+v", entry)
+	}
+
+	// The deferred directory is discovered once it is old enough
+	vols["dir1"][1].ModTime = time.Now().Add(-time.Hour)
+	d.DiscoverLocalVolumes(context.Background())
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{
+		"dir1": {vols["dir1"][1]},
+	}
+	verifyCreatedPVs(t, test)
+}
+
+func TestNewDiscoverer_InvalidMinDirAge(t *testing.T) {
+	for _, age := range []string{"10", "-1m"} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.MinDirAge = age
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for min dir age %q", age)
+		}
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	tests := []struct {
+		file         string
+		resolvedPath string
+		patterns     []string
+		expected     bool
+	}{
+		{file: "sda", resolvedPath: "/mnt/sda", patterns: nil, expected: false},
+		{file: "sda", resolvedPath: "/mnt/sda", patterns: []string{"sd[ab]"}, expected: true},
+		{file: "sdc", resolvedPath: "/mnt/sdc", patterns: []string{"sd[ab]"}, expected: false},
+		{file: "pool1/sdb", resolvedPath: "/mnt/pool1/sdb", patterns: []string{"sd[ab]"}, expected: true},
+		{file: "pool1/sdc", resolvedPath: "/mnt/pool1/sdc", patterns: []string{"pool1/*"}, expected: true},
+		{file: "disk1", resolvedPath: "/dev/sda1", patterns: []string{"/dev/sda*"}, expected: true},
+		{file: "disk1", resolvedPath: "/dev/sdb1", patterns: []string{"/dev/sda*", "swap*"}, expected: false},
+	}
+	for _, test := range tests {
+		excluded := isExcluded(test.file, test.resolvedPath, test.patterns)
+		if excluded != test.expected {
+			t.Errorf("isExcluded(%q, %q, %v) = %v, expected %v", test.file, test.resolvedPath, test.patterns, excluded, test.expected)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidExcludePath(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node: testNode,
+			DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+				config.ExcludePaths = []string{"sd[a"}
+			}),
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for invalid exclude pattern")
+	}
+}
+
+func TestDiscoverVolumes_ReadOnly(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, ReadOnly: true},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile, ReadOnly: true},
+		},
+	}
+	discoveryMap := newDiscoveryMap(func(config *common.MountConfig) {})
+	sc1 := discoveryMap["sc1"]
+	sc1.ReadOnlyManyAccessMode = true
+	discoveryMap["sc1"] = sc1
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap:    discoveryMap,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	expected := map[string]struct {
+		readOnly   string
+		accessMode v1.PersistentVolumeAccessMode
+	}{
+		"local-pv-aaaafef5": {readOnly: "true", accessMode: v1.ReadOnlyMany},
+		"local-pv-79412c38": {readOnly: "", accessMode: v1.ReadWriteOnce},
+		"local-pv-a7aafa3c": {readOnly: "true", accessMode: v1.ReadWriteOnce},
+	}
+	for pvName, exp := range expected {
+		pv, found := pvs[pvName]
+		if !found {
+			t.Errorf("PV %q not created", pvName)
+			continue
+		}
+		if readOnly := pv.Labels[common.LabelReadOnly]; readOnly != exp.readOnly {
+			t.Errorf("PV %q expected read-only label %q, got %q", pvName, exp.readOnly, readOnly)
+		}
+		expectedModes := []v1.PersistentVolumeAccessMode{exp.accessMode}
+		if !reflect.DeepEqual(pv.Spec.AccessModes, expectedModes) {
+			t.Errorf("PV %q expected access modes %v, got %v", pvName, expectedModes, pv.Spec.AccessModes)
+		}
+	}
+}
+
+func TestDiscoverVolumes_Tmpfs(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Tmpfs: true},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			// Not detected without DetectTmpfs
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile, Tmpfs: true},
+		},
+	}
+	discoveryMap := newDiscoveryMap(func(config *common.MountConfig) {})
+	sc1 := discoveryMap["sc1"]
+	sc1.DetectTmpfs = true
+	discoveryMap["sc1"] = sc1
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap:    discoveryMap,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	expected := map[string]bool{
+		"local-pv-aaaafef5": true,
+		"local-pv-79412c38": false,
+		"local-pv-a7aafa3c": false,
+	}
+	for pvName, volatile := range expected {
+		pv, found := pvs[pvName]
+		if !found {
+			t.Errorf("PV %q not created", pvName)
+			continue
+		}
+		_, labeled := pv.Labels[common.LabelVolatile]
+		_, annotated := pv.Annotations[common.AnnVolatile]
+		if labeled != volatile || annotated != volatile {
+			t.Errorf("PV %q expected volatile %v, got label %v, annotation %v", pvName, volatile, labeled, annotated)
+		}
+	}
+}
+
+func TestDiscoverVolumes_MinFreeInodes(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", VolumeType: util.FakeEntryFile, Inodes: 10000, FreeInodes: 5000},
+			{Name: "full", VolumeType: util.FakeEntryFile, Inodes: 10000, FreeInodes: 10},
+			// No inode limit
+			{Name: "btrfs", VolumeType: util.FakeEntryFile},
+			{Name: "broken", VolumeType: util.FakeEntryFile, Inodes: 10000, FreeInodes: 5000},
+		},
+		"dir2": {
+			// Not checked without MinFreeInodes
+			{Name: "mount1", VolumeType: util.FakeEntryFile, Inodes: 10000, FreeInodes: 10},
+		},
+	}
+	discoveryMap := newDiscoveryMap(func(config *common.MountConfig) {})
+	sc1 := discoveryMap["sc1"]
+	sc1.MinFreeInodes = 1000
+	discoveryMap["sc1"] = sc1
+	test := &testConfig{
+		dirLayout:    vols,
+		discoveryMap: discoveryMap,
+	}
+	d := testSetup(t, test)
+	test.volUtil.SetError(util.FakeOpGetFsInodes, filepath.Join(testMountDir, "dir1", "broken"), fmt.Errorf("injected error"))
+
+	result := d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	tests := []struct {
+		class      string
+		file       string
+		created    bool
+		reason     SkipReason
+		inodes     int64
+		freeInodes int64
+	}{
+		{class: "sc1", file: "mount1", created: true, inodes: 10000, freeInodes: 5000},
+		{class: "sc1", file: "full", reason: SkipReasonTooFewInodes, inodes: 10000, freeInodes: 10},
+		{class: "sc1", file: "btrfs", created: true},
+		{class: "sc1", file: "broken", reason: SkipReasonError},
+		{class: "sc2", file: "mount1", created: true},
+	}
+	for _, test := range tests {
+		pvName := d.generatePVName(test.file, test.class)
+		if _, created := pvs[pvName]; created != test.created {
+			t.Errorf("Expected PV %q for %q of class %q created %v, got %v", pvName, test.file, test.class, test.created, created)
+		}
+		entry := result.Classes[test.class].Entries[test.file]
+		if entry == nil {
+			t.Errorf("Expected an entry for %q of class %q", test.file, test.class)
+			continue
+		}
+		if entry.Reason != test.reason || entry.Inodes != test.inodes || entry.FreeInodes != test.freeInodes {
+			t.Errorf("Expected entry %q of class %q to have reason %q, inodes %d/%d, got %+v", test.file, test.class, test.reason, test.freeInodes, test.inodes, entry)
+		}
+	}
+}
+
+func TestDiscoverVolumes_ReclaimPolicyFile(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+		"dir1/mount1": {
+			{Name: ".reclaim-policy", VolumeType: util.FakeEntryUnknown, Content: "Retain\n"},
+		},
+		"dir1/mount2": {
+			{Name: ".reclaim-policy", VolumeType: util.FakeEntryUnknown, Content: "Recycle"},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": vols["dir1"],
+			"dir2": vols["dir2"],
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.ReclaimPolicyFile = ".reclaim-policy"
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	expected := map[string]v1.PersistentVolumeReclaimPolicy{
+		"local-pv-aaaafef5": v1.PersistentVolumeReclaimRetain,
+		// Unsupported policy, the class default is used
+		"local-pv-79412c38": v1.PersistentVolumeReclaimDelete,
+		// No reclaim policy file
+		"local-pv-a7aafa3c": v1.PersistentVolumeReclaimDelete,
+	}
+	for pvName, policy := range expected {
+		pv, found := pvs[pvName]
+		if !found {
+			t.Errorf("PV %q not created", pvName)
+			continue
+		}
+		if pv.Spec.PersistentVolumeReclaimPolicy != policy {
+			t.Errorf("PV %q expected reclaim policy %q, got %q", pvName, policy, pv.Spec.PersistentVolumeReclaimPolicy)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidReclaimPolicyFile(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node: testNode,
+			DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+				config.ReclaimPolicyFile = "config/.reclaim-policy"
+			}),
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for reclaim policy file %q", "config/.reclaim-policy")
+	}
+}
+
+func TestDiscoverVolumes_ClassDiscoveryPeriod(t *testing.T) {
+	discoveryMap := newDiscoveryMap(func(config *common.MountConfig) {})
+	sc1 := discoveryMap["sc1"]
+	sc1.DiscoveryPeriod = "1h"
+	discoveryMap["sc1"] = sc1
+	sc2 := discoveryMap["sc2"]
+	sc2.DiscoveryPeriod = "1s"
+	discoveryMap["sc2"] = sc2
+	test := &testConfig{
+		dirLayout: map[string][]*util.FakeDirEntry{
+			"dir1": {{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile}},
+			"dir2": {{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile}},
+		},
+		discoveryMap: discoveryMap,
+	}
+	d := testSetup(t, test)
+	if period := d.Period(); period != time.Second {
+		t.Errorf("Expected the shortest period %v, got %v", time.Second, period)
+	}
+
+	// All the classes are discovered first
+	test.expectedVolumes = test.dirLayout
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// sc1 isn't due yet, sc2 has the shortest period and is discovered in every cycle
+	newVols := map[string][]*util.FakeDirEntry{
+		"dir1": {{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile}},
+		"dir2": {{Name: "mount2", VolumeType: util.FakeEntryFile}},
+	}
+	test.volUtil.AddNewDirEntries(testMountDir, newVols)
+	result := d.DiscoverLocalVolumes(context.Background())
+	if _, found := result.Classes["sc1"]; found {
+		t.Errorf("Expected storage class %q not to be discovered before its period", "sc1")
+	}
+	created := test.apiUtil.GetAndResetCreatedPVs()
+	if _, found := created[d.generatePVName("mount2", "sc2")]; len(created) != 1 || !found {
+		t.Errorf("Expected only the PV of %q of class %q to be created, got %v", "mount2", "sc2", created)
+	}
+	// The debug state keeps the last result of sc1
+	if d.lastResult.Classes["sc1"] == nil {
+		t.Errorf("Expected the last result of storage class %q to be kept", "sc1")
+	}
+
+	d.lastDiscoveries["sc1"] = time.Now().Add(-2 * time.Hour)
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{"dir1": newVols["dir1"]}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverer_VolumeConcurrency(t *testing.T) {
+	tests := []struct {
+		name            string
+		global          int
+		class           int
+		expectedWorkers int
+	}{
+		{name: "default", expectedWorkers: 1},
+		{name: "global", global: 4, expectedWorkers: 4},
+		{name: "class override", global: 4, class: 2, expectedWorkers: 2},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		d := &Discoverer{RuntimeConfig: &common.RuntimeConfig{UserConfig: &common.UserConfig{MaxVolumeConcurrency: test.global}}}
+		if workers := d.volumeConcurrency(common.MountConfig{MaxVolumeConcurrency: test.class}); workers != test.expectedWorkers {
+			t.Errorf("Expected %v workers, got %v", test.expectedWorkers, workers)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidClassDiscoveryPeriod(t *testing.T) {
+	for _, period := range []string{"10", "-1m", "0s"} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.DiscoveryPeriod = period
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for discovery period %q", period)
+		}
+	}
+}
+
+func TestCheckHostDirs(t *testing.T) {
+	sc1Probe := filepath.Join(testMountDir, "dir1", common.HostDirProbeFile)
+	tests := []struct {
+		name string
+		// Host path mounted at the mount dir
+		hostMount     string
+		staleProbe    bool
+		probeError    bool
+		expectedError string
+	}{
+		{
+			name:      "matching",
+			hostMount: testHostDir,
+		},
+		{
+			name:          "mismatch",
+			hostMount:     "/mnt/ssds",
+			expectedError: `host dir "/mnt/disks/dir1" of storage class "sc1" is not the host path of mount dir "/discoveryPath/dir1"`,
+		},
+		{
+			name:       "stale probe file",
+			hostMount:  testHostDir,
+			staleProbe: true,
+		},
+		{
+			name:       "read-only mount dir",
+			hostMount:  "/mnt/ssds",
+			probeError: true,
+			// sc2 is still checked
+			expectedError: `host dir "/mnt/disks/dir2" of storage class "sc2"`,
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		config := &testConfig{
+			dirLayout: map[string][]*util.FakeDirEntry{
+				"dir1": {{Name: "mount1", VolumeType: util.FakeEntryFile}},
+				"dir2": {},
+			},
+		}
+		d := testSetup(t, config)
+		d.HostRootfs = "/rootfs"
+		config.volUtil.AddBindMount(filepath.Join("/rootfs", test.hostMount), testMountDir)
+		if test.staleProbe {
+			config.volUtil.WriteFile(sc1Probe, []byte("stale"))
+		}
+		if test.probeError {
+			config.volUtil.SetError(util.FakeOpWriteFile, sc1Probe, fmt.Errorf("read-only file system"))
+		}
+
+		err := d.CheckHostDirs()
+		if test.expectedError == "" && err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+		if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+			t.Errorf("Expected error containing %q, got %v", test.expectedError, err)
+		}
+		if exists, _ := config.volUtil.Exists(sc1Probe); exists {
+			t.Errorf("Expected the probe file %q to be removed", sc1Probe)
+		}
+	}
+}
+
+func TestDiscoverVolumes_MountOptions(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.MountOptions = []string{"noatime", "nodiratime"}
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	// Block volumes ignore the mount options
+	expected := map[string]string{
+		"local-pv-aaaafef5": "noatime,nodiratime",
+		"local-pv-79412c38": "",
+	}
+	for pvName, options := range expected {
+		pv, found := pvs[pvName]
+		if !found {
+			t.Errorf("PV %q not created", pvName)
+			continue
+		}
+		if pv.Annotations[v1.MountOptionAnnotation] != options {
+			t.Errorf("PV %q expected mount options %q, got %q", pvName, options, pv.Annotations[v1.MountOptionAnnotation])
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidMountOptions(t *testing.T) {
+	for _, options := range [][]string{{"noatime", ""}, {" "}, {"noatime,nodiratime"}} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.MountOptions = options
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for mount options %q", options)
+		}
+	}
+}
+
+func TestDiscoverVolumes_AccessModes(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			if config.HostDir == filepath.Join(testHostDir, "dir1") {
+				config.AccessModes = []string{"ReadOnlyMany", "ReadWriteOnce"}
+			}
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	expected := map[string][]v1.PersistentVolumeAccessMode{
+		expectedPVName(test, vols["dir1"][0]): {v1.ReadOnlyMany, v1.ReadWriteOnce},
+		expectedPVName(test, vols["dir2"][0]): {v1.ReadWriteOnce},
+	}
+	for pvName, modes := range expected {
+		pv, found := pvs[pvName]
+		if !found {
+			t.Errorf("PV %q not created", pvName)
+			continue
+		}
+		if !reflect.DeepEqual(pv.Spec.AccessModes, modes) {
+			t.Errorf("PV %q expected access modes %v, got %v", pvName, modes, pv.Spec.AccessModes)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidAccessModes(t *testing.T) {
+	for _, modes := range [][]string{{"ReadWriteOnce", "ReadWriteOnce"}, {"ReadWrite"}, {""}} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.AccessModes = modes
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for access modes %q", modes)
+		}
+	}
+}
+
+func TestDiscoverVolumes_HostPathTemplate(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			if config.HostDir == filepath.Join(testHostDir, "dir1") {
+				config.HostPathTemplate = "/mnt/by-uuid/{{.Node}}/{{.Class}}-{{.Name}}"
+			}
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	templated := pvs[expectedPVName(test, vols["dir1"][0])]
+	if templated == nil {
+		t.Fatalf("PV of dir1/mount1 not created")
+	}
+	if path, expected := templated.Spec.Local.Path, "/mnt/by-uuid/"+testNodeName+"/sc1-mount1"; path != expected {
+		t.Errorf("Expected host path %q, got %q", expected, path)
+	}
+	if path := templated.Annotations[common.AnnVolumePath]; path != "mount1" {
+		t.Errorf("Expected volume path annotation %q, got %q", "mount1", path)
+	}
+	plain := pvs[expectedPVName(test, vols["dir2"][0])]
+	if plain == nil {
+		t.Fatalf("PV of dir2/mount1 not created")
+	}
+	if path, expected := plain.Spec.Local.Path, filepath.Join(testHostDir, "dir2", "mount1"); path != expected {
+		t.Errorf("Expected host path %q, got %q", expected, path)
+	}
+	if _, found := plain.Annotations[common.AnnVolumePath]; found {
+		t.Errorf("Expected no volume path annotation without a host path template")
+	}
+
+	// The templated PV is recognized as the PV of its volume
+	d.DiscoverLocalVolumes(context.Background())
+	if pvs := test.apiUtil.GetAndResetCreatedPVs(); len(pvs) != 0 {
+		t.Errorf("Expected no created PVs, got %v", len(pvs))
+	}
+	verifyEvents(t, test, common.EventPVNameCollision, 0)
+}
+
+func TestNewDiscoverer_InvalidHostPathTemplate(t *testing.T) {
+	for _, text := range []string{"/mnt/{{.Name", "/mnt/{{.Volume}}", "disks/{{.Name}}"} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.HostPathTemplate = text
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for host path template %q", text)
+		}
+	}
+}
+
+func TestDiscoverVolumes_LabelPattern(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "ssd-rack3", Hash: 0xfddc1170, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.LabelPattern = `^(?P<media>[a-z]+)-rack(?P<rack>[0-9]+)$`
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	expectedLabels := map[string]map[string]string{
+		"local-pv-aaaafef5": {common.LabelNode: testNodeName, common.LabelProvisionedBy: testProvisionerName},
+		"local-pv-fddc1170": {common.LabelNode: testNodeName, common.LabelProvisionedBy: testProvisionerName, "media": "ssd", "rack": "3"},
+	}
+	for pvName, labels := range expectedLabels {
+		pv, found := pvs[pvName]
+		if !found {
+			t.Errorf("PV %q not created", pvName)
+			continue
+		}
+		if len(pv.Labels) != len(labels) {
+			t.Errorf("PV %q expected labels %v, got %v", pvName, labels, pv.Labels)
+		}
+		for key, value := range labels {
+			if pv.Labels[key] != value {
+				t.Errorf("PV %q expected label %s=%s, got %v", pvName, key, value, pv.Labels)
+			}
+		}
+	}
+}
+
+func TestDiscoverVolumes_ExtraLabels(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "ssd-rack3", Hash: 0xfddc1170, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.LabelPattern = `^(?P<media>[a-z]+)-rack(?P<rack>[0-9]+)$`
+			config.ExtraLabels = map[string]string{"team": "storage", "media": "hdd"}
+		}),
+		extraLabels: map[string]string{"team": "platform", "tier": "gold"},
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+
+	expectedLabels := map[string]map[string]string{
+		"local-pv-aaaafef5": {common.LabelNode: testNodeName, common.LabelProvisionedBy: testProvisionerName, "team": "storage", "tier": "gold", "media": "hdd"},
+		"local-pv-fddc1170": {common.LabelNode: testNodeName, common.LabelProvisionedBy: testProvisionerName, "team": "storage", "tier": "gold", "media": "ssd", "rack": "3"},
+	}
+	for pvName, labels := range expectedLabels {
+		pv, found := pvs[pvName]
+		if !found {
+			t.Errorf("PV %q not created", pvName)
+			continue
+		}
+		if !reflect.DeepEqual(pv.Labels, labels) {
+			t.Errorf("PV %q expected labels %v, got %v", pvName, labels, pv.Labels)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidExtraLabels(t *testing.T) {
+	for _, labels := range []map[string]string{
+		{"bad key": "value"},
+		{"key": "bad value"},
+		{common.LabelFsType: "ext4"},
+	} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node:         testNode,
+				DiscoveryMap: scMapping,
+				ExtraLabels:  labels,
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for extra labels %v", labels)
+		}
+
+		runConfig = &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.ExtraLabels = labels
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for storage class extra labels %v", labels)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidLabelPattern(t *testing.T) {
+	for _, pattern := range []string{`(?P<media>[a-z]+`, `^([a-z]+)-rack([0-9]+)$`, `^(?P<bad_key!>[a-z]+)$`} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.LabelPattern = pattern
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for label pattern %q", pattern)
+		}
+	}
+}
+
+func TestDiscoverVolumes_IgnorePatterns(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: ".hidden", VolumeType: util.FakeEntryFile},
+			{Name: "lost+found", VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {vols["dir1"][0]},
+		},
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_ReservedCapacity(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {
+				// 10% and 1KiB reserved
+				{Name: "mount1", Hash: 0xaaaafef5, Capacity: 89 * 1024},
+				// Block volumes are not affected
+				{Name: "mount2", Hash: 0x79412c38, Capacity: 100 * 1024},
+			},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.ReservedCapacityPercent = 10
+			config.ReservedCapacityBytes = 1024
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_QuotaCapacity(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024 * 1024, QuotaCapacity: 10 * 1024 * 1024},
+			// Not in a project, falls back to the fs capacity
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, Capacity: 10 * 1024 * 1024},
+				{Name: "mount2", Hash: 0x79412c38, Capacity: 100 * 1024 * 1024},
+			},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.CapacitySource = common.CapacitySourceQuota
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_SkipZeroCapacity(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {vols["dir1"][1]},
+		},
+		skipZeroCapacity: true,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// The volume is retried once it has capacity
+	vols["dir1"][0].Capacity = 100 * 1024
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{
+		"dir1": {vols["dir1"][0]},
+	}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_Loopback(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024 * 1024,
+				LoopbackFile: "/var/lib/loop/disk1.img", LoopbackAllocated: 10 * 1024 * 1024},
+			// The size of the backing file can't be read, falls back to the fs capacity
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024 * 1024,
+				LoopbackFile: "/var/lib/loop/disk2.img"},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, Capacity: 10 * 1024 * 1024},
+				{Name: "mount2", Hash: 0x79412c38, Capacity: 100 * 1024 * 1024},
+			},
+			"dir2": {
+				{Name: "mount1", Hash: 0xa7aafa3c, Capacity: 100 * 1024 * 1024},
+			},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.DetectLoopback = true
+		}),
+	}
+	d := testSetup(t, test)
+	test.volUtil.SetError(util.FakeOpGetAllocatedByte, "/var/lib/loop/disk2.img", fmt.Errorf("injected error"))
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	expected := map[string]string{
+		expectedPVName(test, vols["dir1"][0]): "true",
+		expectedPVName(test, vols["dir1"][1]): "true",
+		expectedPVName(test, vols["dir2"][0]): "",
+	}
+	for pvName, loopback := range expected {
+		pv, found := test.cache.GetPV(pvName)
+		if !found {
+			continue
+		}
+		if label := pv.Labels[common.LabelLoopback]; label != loopback {
+			t.Errorf("PV %q expected loopback label %q, got %q", pvName, loopback, label)
+		}
+	}
+}
+
+func TestDiscoverVolumes_CapacityReporter(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	tests := []struct {
+		name     string
+		reporter string
+		percent  int
+		// Expected capacities of the file and block volumes
+		expectedFile  int64
+		expectedBlock int64
+	}{
+		{
+			name:          "none",
+			expectedFile:  2*gib + 1024,
+			expectedBlock: 3*gib + 1024,
+		},
+		{
+			name:          "exact",
+			reporter:      common.CapacityReporterExact,
+			expectedFile:  2*gib + 1024,
+			expectedBlock: 3*gib + 1024,
+		},
+		{
+			name:          "round down to GiB",
+			reporter:      common.CapacityReporterRoundDownGiB,
+			expectedFile:  2 * gib,
+			expectedBlock: 3 * gib,
+		},
+		{
+			name:          "reserve percent",
+			reporter:      common.CapacityReporterReservePercent,
+			percent:       50,
+			expectedFile:  gib + 512,
+			expectedBlock: (3*gib + 1024) / 2,
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		vols := map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 2*gib + 1024},
+				{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 3*gib + 1024},
+			},
+		}
+		config := &testConfig{
+			dirLayout: vols,
+			expectedVolumes: map[string][]*util.FakeDirEntry{
+				"dir1": {
+					{Name: "mount1", Hash: 0xaaaafef5, Capacity: test.expectedFile},
+					{Name: "mount2", Hash: 0x79412c38, Capacity: test.expectedBlock},
+				},
+			},
+			discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+				config.CapacityReporter = test.reporter
+				config.CapacityReporterPercent = test.percent
+			}),
+		}
+		d := testSetup(t, config)
+
+		d.DiscoverLocalVolumes(context.Background())
+		verifyCreatedPVs(t, config)
+	}
+}
+
+func TestDiscoverVolumes_CapacityScaleFactor(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	tests := []struct {
+		name       string
+		factor     float64
+		overcommit bool
+		rounding   int64
+		// Expected capacities of the file and block volumes
+		expectedFile  int64
+		expectedBlock int64
+	}{
+		{
+			name:          "none",
+			expectedFile:  10 * gib,
+			expectedBlock: 20 * gib,
+		},
+		{
+			name:          "thin media",
+			factor:        0.8,
+			expectedFile:  8 * gib,
+			expectedBlock: 16 * gib,
+		},
+		{
+			name:          "rounded after scaling",
+			factor:        0.75,
+			rounding:      5 * gib,
+			expectedFile:  5 * gib,
+			expectedBlock: 15 * gib,
+		},
+		{
+			name:          "overcommit",
+			factor:        1.5,
+			overcommit:    true,
+			expectedFile:  15 * gib,
+			expectedBlock: 30 * gib,
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		vols := map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 10 * gib},
+				{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 20 * gib},
+			},
+		}
+		config := &testConfig{
+			dirLayout: vols,
+			expectedVolumes: map[string][]*util.FakeDirEntry{
+				"dir1": {
+					{Name: "mount1", Hash: 0xaaaafef5, Capacity: test.expectedFile},
+					{Name: "mount2", Hash: 0x79412c38, Capacity: test.expectedBlock},
+				},
+			},
+			discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+				config.CapacityScaleFactor = test.factor
+				config.AllowCapacityOvercommit = test.overcommit
+				config.CapacityRoundingBytes = test.rounding
+			}),
+		}
+		d := testSetup(t, config)
+
+		d.DiscoverLocalVolumes(context.Background())
+		verifyCreatedPVs(t, config)
+	}
+}
+
+func TestNewDiscoverer_InvalidCapacityScaleFactor(t *testing.T) {
+	for _, factor := range []float64{-0.5, 1.2, math.NaN(), math.Inf(1)} {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.CapacityScaleFactor = factor
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for capacity scale factor %v", factor)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidCapacityReporter(t *testing.T) {
+	tests := []struct {
+		name     string
+		reporter string
+		percent  int
+	}{
+		{
+			name:     "unknown reporter",
+			reporter: "roundUpGiB",
+		},
+		{
+			name:     "percent above 100",
+			reporter: common.CapacityReporterReservePercent,
+			percent:  101,
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node: testNode,
+				DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+					config.CapacityReporter = test.reporter
+					config.CapacityReporterPercent = test.percent
+				}),
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for capacity reporter %q with percent %d", test.reporter, test.percent)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidCapacitySource(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node: testNode,
+			DiscoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+				config.CapacitySource = "du"
+			}),
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for capacity source %q", "du")
+	}
+}
+
+func TestIsOverlappingPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		other    string
+		expected bool
+	}{
+		{path: "/mnt/disks", other: "/mnt/disks", expected: true},
+		{path: "/mnt/disks/", other: "/mnt/disks", expected: true},
+		{path: "/mnt/disks", other: "/mnt/disks/ssd", expected: true},
+		{path: "/mnt/disks/ssd/nvme", other: "/mnt/disks", expected: true},
+		{path: "/mnt/disks/./ssd", other: "/mnt/disks/ssd/", expected: true},
+		{path: "/", other: "/mnt/disks", expected: true},
+		{path: "/mnt/disks", other: "/mnt/disks-ssd", expected: false},
+		{path: "/mnt/ssd", other: "/mnt/hdd", expected: false},
+		{path: "/mnt/disks/../ssd", other: "/mnt/disks", expected: false},
+		{path: "/mnt/ssd-*", other: "/mnt/ssd-a", expected: true},
+		{path: "/mnt/ssd-a/disk1", other: "/mnt/ssd-*", expected: true},
+		{path: "/mnt/ssd-*", other: "/mnt/nvme-*", expected: false},
+		{path: "/mnt/ssd-*", other: "/mnt/ssd-[ab]", expected: true},
+		{path: "/mnt/*", other: "/mnt/nvme-*", expected: true},
+		{path: "/mnt/ssd-*", other: "/mnt/hdd", expected: false},
+		{path: "/mnt/ssd-*", other: "/mnt", expected: true},
+	}
+	for _, test := range tests {
+		if overlapping := isOverlappingPath(test.path, test.other); overlapping != test.expected {
+			t.Errorf("Paths %q and %q: expected overlapping %v, got %v", test.path, test.other, test.expected, overlapping)
+		}
+	}
+}
+
+func TestValidateDiscoveryMap(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name         string
+		discoveryMap map[string]common.MountConfig
+		conflicts    []string
+	}{
+		{
+			name:         "separate",
+			discoveryMap: scMapping,
+		},
+		{
+			name: "same mount dir",
+			discoveryMap: map[string]common.MountConfig{
+				"sc1": {HostDir: "/mnt/disks/ssd", MountDir: "/local-disks"},
+				"sc2": {HostDir: "/mnt/disks/hdd", MountDir: "/local-disks/"},
+			},
+			conflicts: []string{`mount dir "/local-disks" of storage class "sc1" overlaps with "/local-disks/" of "sc2"`},
+		},
+		{
+			name: "nested host dir",
+			discoveryMap: map[string]common.MountConfig{
+				"sc1": {HostDir: "/mnt/disks/ssd", MountDir: "/local-ssd"},
+				"sc2": {HostDir: "/mnt/disks", MountDir: "/local-disks"},
+			},
+			conflicts: []string{`host dir "/mnt/disks/ssd" of storage class "sc1" overlaps with "/mnt/disks" of "sc2"`},
+		},
+		{
+			name: "all conflicts",
+			discoveryMap: map[string]common.MountConfig{
+				"sc1": {HostDir: "/mnt/disks", MountDir: "/local-disks"},
+				"sc2": {HostDir: "/mnt/disks/ssd", MountDir: "/local-disks/ssd"},
+				"sc3": {HostDir: "/mnt/disks/hdd", MountDir: "/local-hdd"},
+			},
+			conflicts: []string{
+				`mount dir "/local-disks" of storage class "sc1" overlaps with "/local-disks/ssd" of "sc2"`,
+				`host dir "/mnt/disks" of storage class "sc1" overlaps with "/mnt/disks/ssd" of "sc2"`,
+				`host dir "/mnt/disks" of storage class "sc1" overlaps with "/mnt/disks/hdd" of "sc3"`,
+			},
+		},
+		{
+			name: "similar prefix",
+			discoveryMap: map[string]common.MountConfig{
+				"sc1": {HostDir: "/mnt/disks", MountDir: "/local-disks"},
+				"sc2": {HostDir: "/mnt/disks-ssd", MountDir: "/local-disks-ssd"},
+			},
+		},
+		{
+			name: "disabled class",
+			discoveryMap: map[string]common.MountConfig{
+				"sc1": {HostDir: "/mnt/disks", MountDir: "/local-disks"},
+				"sc2": {HostDir: "/mnt/disks", MountDir: "/local-disks", Enabled: &disabled},
+			},
+		},
+	}
+	for _, test := range tests {
+		err := validateDiscoveryMap(test.discoveryMap)
+		if len(test.conflicts) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected conflicts %v, got no error", test.name, test.conflicts)
+			continue
+		}
+		if expected := "Invalid discovery map: " + strings.Join(test.conflicts, "; "); err.Error() != expected {
+			t.Errorf("%s: expected error %q, got %q", test.name, expected, err)
+		}
+	}
+}
+
+func TestNewDiscoverer_InvalidGlobDirs(t *testing.T) {
+	tests := []common.MountConfig{
+		{HostDir: testHostDir + "/ssd-*", MountDir: testMountDir + "/ssd"},
+		{HostDir: testHostDir + "/ssd", MountDir: testMountDir + "/ssd-*"},
+		{HostDir: testHostDir + "/ssd-*", MountDir: testMountDir + "/nvme-*"},
+		{HostDir: testHostDir + "/ssd-[", MountDir: testMountDir + "/ssd-["},
+	}
+	for _, config := range tests {
+		runConfig := &common.RuntimeConfig{
+			UserConfig: &common.UserConfig{
+				Node:         testNode,
+				DiscoveryMap: map[string]common.MountConfig{"sc1": config},
+			},
+			Name: testProvisionerName,
+		}
+		if _, err := NewDiscoverer(runConfig); err == nil {
+			t.Errorf("Expected error for host dir %q and mount dir %q", config.HostDir, config.MountDir)
+		}
+	}
+}
+
+func TestNewDiscoverer_UnreadableMountDirs(t *testing.T) {
+	disabled := false
+	volUtil := util.NewFakeVolumeUtil(false)
+	volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+		"dir1": {{Name: "mount1", VolumeType: util.FakeEntryFile}},
+		"dir2": {{Name: "mount1", VolumeType: util.FakeEntryFile}},
+		"dir3": {{Name: "mount1", VolumeType: util.FakeEntryFile}},
+	})
+	denied := &os.PathError{Op: "open", Path: testMountDir, Err: os.ErrPermission}
+	for _, dir := range []string{"dir1", "dir3", "ssd"} {
+		volUtil.SetError(util.FakeOpCheckReadable, filepath.Join(testMountDir, dir), denied)
+	}
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node: testNode,
+			DiscoveryMap: map[string]common.MountConfig{
+				"sc1": {HostDir: testHostDir + "/dir1", MountDir: testMountDir + "/dir1"},
+				"sc2": {HostDir: testHostDir + "/dir2", MountDir: testMountDir + "/dir2"},
+				// Disabled classes are not checked
+				"sc3": {HostDir: testHostDir + "/dir3", MountDir: testMountDir + "/dir3", Enabled: &disabled},
+				// Glob mount dirs are checked at their root
+				"sc4": {HostDir: testHostDir + "/ssd/*", MountDir: testMountDir + "/ssd/*"},
+				// Missing mount dirs are skipped
+				"sc5": {HostDir: testHostDir + "/dir5", MountDir: testMountDir + "/dir5"},
+			},
+		},
+		VolUtil: volUtil,
+		Name:    testProvisionerName,
+	}
+	_, err := NewDiscoverer(runConfig)
+	if err == nil {
+		t.Fatalf("Expected error for unreadable mount dirs")
+	}
+	expected := fmt.Sprintf("Mount dirs are not readable by uid %d, gid %d: "+
+		"mount dir %q of storage class \"sc1\": %v; mount dir %q of storage class \"sc4\": %v",
+		os.Geteuid(), os.Getegid(), testMountDir+"/dir1", denied, testMountDir+"/ssd", denied)
+	if err.Error() != expected {
+		t.Errorf("Expected error %q, got %q", expected, err.Error())
+	}
+}
+
+func TestNewDiscoverer_OverlappingMountDirs(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node: testNode,
+			DiscoveryMap: map[string]common.MountConfig{
+				"sc1": {HostDir: testHostDir, MountDir: testMountDir},
+				"sc2": {HostDir: testHostDir + "/dir2", MountDir: testMountDir + "/dir2"},
+			},
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for nested mount dirs")
+	}
+}
+
+func TestReserveCapacity(t *testing.T) {
+	tests := []struct {
+		capacity int64
+		percent  int
+		bytes    int64
+		expected int64
+	}{
+		{capacity: 1000, expected: 1000},
+		{capacity: 1000, percent: 5, expected: 950},
+		{capacity: 1000, bytes: 100, expected: 900},
+		{capacity: 1000, percent: 100, expected: 0},
+		{capacity: 1000, percent: 50, bytes: 600, expected: 0},
+	}
+	for _, test := range tests {
+		config := common.MountConfig{ReservedCapacityPercent: test.percent, ReservedCapacityBytes: test.bytes}
+		if capacity := reserveCapacity(test.capacity, config); capacity != test.expected {
+			t.Errorf("Reserving %d%% and %d bytes of %d: expected %d, got %d", test.percent, test.bytes, test.capacity, test.expected, capacity)
+		}
+	}
+}
+
+func TestDiscoverVolumes_CapacityRounding(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 1998784921},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 3 * 1024 * 1024 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, Capacity: 1024 * 1024 * 1024},
+				{Name: "mount2", Hash: 0x79412c38, Capacity: 3 * 1024 * 1024 * 1024},
+			},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.CapacityRoundingBytes = 1024 * 1024 * 1024
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_ClassProvisionerName(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+		},
+	}
+	discoveryMap := newDiscoveryMap(func(config *common.MountConfig) {})
+	sc1 := discoveryMap["sc1"]
+	sc1.ProvisionerName = "local-volume-provisioner"
+	discoveryMap["sc1"] = sc1
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap:    discoveryMap,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_AllowedFsTypes(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, FsType: "ext4"},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+			{Name: "mount3", VolumeType: util.FakeEntryFile, FsType: "nfs"},
+			{Name: "mount4", VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, FsType: "ext4"},
+				// Block volumes are not affected
+				{Name: "mount2", Hash: 0x79412c38},
+			},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.AllowedFsTypes = []string{"ext4", "xfs"}
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestRoundCapacity(t *testing.T) {
+	tests := []struct {
+		capacity    int64
+		granularity int64
+		expected    int64
+	}{
+		{capacity: 1999, expected: 1999},
+		{capacity: 1999, granularity: -1, expected: 1999},
+		{capacity: 1999, granularity: 1000, expected: 1000},
+		{capacity: 2000, granularity: 1000, expected: 2000},
+		{capacity: 2001, granularity: 1000, expected: 2000},
+		{capacity: 999, granularity: 1000, expected: 0},
+		{capacity: 0, granularity: 1000, expected: 0},
+	}
+	for _, test := range tests {
+		if capacity := roundCapacity(test.capacity, test.granularity); capacity != test.expected {
+			t.Errorf("Rounding %d down to a multiple of %d: expected %d, got %d", test.capacity, test.granularity, test.expected, capacity)
+		}
+	}
+}
+
+func TestDiscoverVolumes_NoDir(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_EmptyDir(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_NewVolumesLater(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+
+	verifyCreatedPVs(t, test)
+
+	// Some new mount points show up
+	newVols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount3", Hash: 0xf34b8003, VolumeType: util.FakeEntryFile},
+			{Name: "mount4", Hash: 0x144e29de, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test.volUtil.AddNewDirEntries(testMountDir, newVols)
+	test.expectedVolumes = newVols
+
+	d.DiscoverLocalVolumes(context.Background())
+
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_CreatePVFails(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		apiShouldFail:   true,
+		dirLayout:       vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{},
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+
+	verifyCreatedPVs(t, test)
+	verifyPVsNotInCache(t, test)
+}
+
+func TestDiscoverVolumes_CreatePVRetry(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		apiTransientFailures: 3,
+		apiRetryAttempts:     4,
+		dirLayout:            vols,
+		expectedVolumes:      vols,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	d.pendingWg.Wait()
+
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_CreatePVRetryExhausted(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		apiTransientFailures: 3,
+		apiRetryAttempts:     3,
+		dirLayout:            vols,
+		expectedVolumes:      map[string][]*util.FakeDirEntry{},
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	d.pendingWg.Wait()
+
+	verifyCreatedPVs(t, test)
+	verifyPVsNotInCache(t, test)
+
+	// The next discovery cycle tries again
+	test.expectedVolumes = vols
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_CreatePVAlreadyExists(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	tests := []struct {
+		name              string
+		transientFailures int
+	}{
+		{name: "first attempt"},
+		{name: "retry", transientFailures: 1},
+	}
+	for _, tc := range tests {
+		t.Logf("Test %q", tc.name)
+		test := &testConfig{
+			apiTransientFailures: tc.transientFailures,
+			apiRetryAttempts:     3,
+			dirLayout:            vols,
+			expectedVolumes:      map[string][]*util.FakeDirEntry{},
+		}
+		d := testSetup(t, test)
+		// Created by another discovery cycle, but not in the cache yet
+		name := d.generatePVName("mount1", "sc1")
+		test.apiUtil.SetServerPV(&v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}})
+
+		d.DiscoverLocalVolumes(context.Background())
+		d.pendingWg.Wait()
+
+		verifyCreatedPVs(t, test)
+		verifyEvents(t, test, common.EventVolumeCreated, 0)
+		if created := d.lastResult.Classes["sc1"].Created; len(created) != 0 {
+			t.Errorf("Expected no created PVs in the result, got %v", created)
+		}
+	}
+}
+
+func TestDiscoverVolumes_JSONLogFormat(t *testing.T) {
 	vols := map[string][]*util.FakeDirEntry{
 		"dir1": {
 			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024},
-			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024 * 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	out := &bytes.Buffer{}
+	logger, err := util.NewVolumeLogger(util.LogFormatJSON, out)
+	if err != nil {
+		t.Fatalf("Error creating volume logger: %v", err)
+	}
+	d.VolumeLogger = logger
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	events := []string{}
+	for _, line := range lines {
+		event := &util.VolumeEvent{}
+		if err := json.Unmarshal([]byte(line), event); err != nil {
+			t.Fatalf("Error decoding log line %q: %v", line, err)
+		}
+		events = append(events, event.Event)
+		expected := &util.VolumeEvent{
+			Event:    event.Event,
+			Class:    "sc1",
+			PVName:   expectedPVName(test, vols["dir1"][0]),
+			HostPath: filepath.Join(testHostDir, "dir1", "mount1"),
+			Capacity: 100 * 1024,
+			Node:     testNodeName,
+		}
+		if !reflect.DeepEqual(event, expected) {
+			t.Errorf("Expected log line %+v, got %+v", expected, event)
+		}
+	}
+	expectedEvents := []string{util.VolumeEventDiscovered, util.VolumeEventCreated}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("Expected logged events %v, got %v", expectedEvents, events)
+	}
+}
+
+func TestDiscoverVolumes_DryRun(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dryRun:          true,
+		dirLayout:       vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{},
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+
+	verifyCreatedPVs(t, test)
+	verifyPVsNotInCache(t, test)
+}
+
+func TestDiscoverVolumes_Paused(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{},
+	}
+	d := testSetup(t, test)
+
+	pausedNode := *testNode
+	pausedNode.Annotations = map[string]string{common.AnnDiscoveryPaused: "true"}
+	test.apiUtil.SetNode(&pausedNode)
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// Removing the annotation resumes discovery on the next cycle
+	test.apiUtil.SetNode(testNode)
+	d.DiscoverLocalVolumes(context.Background())
+	test.expectedVolumes = vols
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_PauseOnCordon(t *testing.T) {
+	unschedulable := *testNode
+	unschedulable.Spec.Unschedulable = true
+	tainted := *testNode
+	tainted.Spec.Taints = []v1.Taint{{Key: "maintenance", Effect: v1.TaintEffectNoSchedule}}
+	otherTaint := *testNode
+	otherTaint.Spec.Taints = []v1.Taint{{Key: "dedicated", Effect: v1.TaintEffectNoSchedule}}
+
+	tests := []struct {
+		name          string
+		node          *v1.Node
+		pauseOnCordon bool
+		expectCreated bool
+	}{
+		{"unschedulable", &unschedulable, true, false},
+		{"tainted", &tainted, true, false},
+		{"other taint", &otherTaint, true, true},
+		{"disabled", &unschedulable, false, true},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		vols := map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			},
+		}
+		config := &testConfig{
+			dirLayout:       vols,
+			expectedVolumes: map[string][]*util.FakeDirEntry{},
+		}
+		if test.expectCreated {
+			config.expectedVolumes = vols
+		}
+		d := testSetup(t, config)
+		d.PauseOnCordon = test.pauseOnCordon
+		d.CordonTaintKey = "maintenance"
+
+		config.apiUtil.SetNode(test.node)
+		d.DiscoverLocalVolumes(context.Background())
+		verifyCreatedPVs(t, config)
+		if test.expectCreated {
+			continue
+		}
+
+		// Uncordoning resumes the creation on the next cycle
+		config.apiUtil.SetNode(testNode)
+		d.DiscoverLocalVolumes(context.Background())
+		config.expectedVolumes = vols
+		verifyCreatedPVs(t, config)
+	}
+}
+
+func TestDiscoverVolumes_FsOperationTimeout(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{},
+	}
+	d := testSetup(t, test)
+	// The capacity probes hang, the volumes are skipped instead of blocking the discovery
+	test.volUtil.SetCapacityDelay(time.Hour)
+	d.VolUtil = util.NewTimeoutVolumeUtil(test.volUtil, 100*time.Millisecond)
+
+	done := make(chan *DiscoveryResult)
+	go func() {
+		done <- d.DiscoverLocalVolumes(context.Background())
+	}()
+	var result *DiscoveryResult
+	select {
+	case result = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Discovery blocked on the hung capacity probes")
+	}
+	verifyCreatedPVs(t, test)
+	for file, entry := range result.Classes["sc1"].Entries {
+		if entry.Reason != SkipReasonProbeTimeout {
+			t.Errorf("Expected entry %q to be skipped with reason %s, got %+v", file, SkipReasonProbeTimeout, entry)
+		}
+	}
+
+	// The hung paths fail immediately in the next discovery
+	start := time.Now()
+	d.DiscoverLocalVolumes(context.Background())
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("Expected the hung paths to fail immediately, discovery took %v", elapsed)
+	}
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_SkipReasons(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "lost+found", VolumeType: util.FakeEntryFile, FsType: "ext4", Capacity: 1024},
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, FsType: "ext4", Capacity: 1024},
+			{Name: "small", VolumeType: util.FakeEntryFile, FsType: "ext4", Capacity: 10},
+			{Name: "xfs", VolumeType: util.FakeEntryFile, FsType: "xfs", Capacity: 1024},
+			{Name: "excluded", VolumeType: util.FakeEntryFile, FsType: "ext4", Capacity: 1024},
+			{Name: "broken", VolumeType: util.FakeEntryFile, FsType: "ext4", Capacity: 1024},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": vols["dir1"][1:2],
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.MinCapacityBytes = 100
+			config.AllowedFsTypes = []string{"ext4"}
+			config.ExcludePaths = []string{"excluded"}
+		}),
+	}
+	d := testSetup(t, test)
+	test.volUtil.SetError(util.FakeOpGetFsCapacityByte, filepath.Join(testMountDir, "dir1", "broken"), fmt.Errorf("injected error"))
+
+	result := d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	expected := map[string]SkipReason{
+		"lost+found": SkipReasonIgnored,
+		"mount1":     "",
+		"small":      SkipReasonTooSmall,
+		"xfs":        SkipReasonWrongFsType,
+		"excluded":   SkipReasonFiltered,
+		"broken":     SkipReasonError,
+	}
+	entries := result.Classes["sc1"].Entries
+	for file, reason := range expected {
+		entry := entries[file]
+		if entry == nil {
+			t.Errorf("Expected an entry for %q", file)
+			continue
+		}
+		if entry.Reason != reason {
+			t.Errorf("Expected entry %q to have reason %q, got %+v", file, reason, entry)
+		}
+	}
+}
+
+func TestDiscoverVolumes_Partitions(t *testing.T) {
+	tests := []struct {
+		name             string
+		allowPartitioned bool
+		expectedCreated  []string
+	}{
+		{
+			name:            "partitioned disk skipped",
+			expectedCreated: []string{"sdb1", "sdb2", "sdc"},
+		},
+		{
+			name:             "partitioned disk allowed",
+			allowPartitioned: true,
+			expectedCreated:  []string{"sdb", "sdb1", "sdb2", "sdc"},
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		vols := map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "sdb", VolumeType: util.FakeEntryBlock, HasPartitions: true},
+				{Name: "sdb1", VolumeType: util.FakeEntryBlock},
+				{Name: "sdb2", VolumeType: util.FakeEntryBlock},
+				// Not partitioned
+				{Name: "sdc", VolumeType: util.FakeEntryBlock},
+			},
+		}
+		config := &testConfig{
+			dirLayout:       vols,
+			expectedVolumes: map[string][]*util.FakeDirEntry{},
+			discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+				config.AllowPartitionedDisks = test.allowPartitioned
+			}),
+		}
+		d := testSetup(t, config)
+
+		result := d.DiscoverLocalVolumes(context.Background())
+		created := config.apiUtil.GetAndResetCreatedPVs()
+		if len(created) != len(test.expectedCreated) {
+			t.Errorf("Expected %v created PVs, got %v", len(test.expectedCreated), len(created))
+		}
+		for _, file := range test.expectedCreated {
+			if _, found := created[d.generatePVName(file, "sc1")]; !found {
+				t.Errorf("Expected a PV for %q", file)
+			}
+		}
+		if !test.allowPartitioned {
+			if entry := result.Classes["sc1"].Entries["sdb"]; entry == nil || entry.Reason != SkipReasonPartitioned {
+				t.Errorf("Expected sdb to be skipped with reason %s, got %+v", SkipReasonPartitioned, entry)
+			}
+		}
+	}
+}
+
+func TestDiscoverVolumes_HealthCheck(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {{Name: "mount1", Hash: 0xaaaafef5}},
+		},
+	}
+	d := testSetup(t, test)
+	d.HealthCheck = true
+	failingPath := filepath.Join(testMountDir, "dir1", "mount2")
+	test.volUtil.SetError(util.FakeOpProbeHealth, failingPath, fmt.Errorf("injected I/O error"))
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyEvents(t, test, common.EventVolumeUnhealthy, 1)
+
+	// The failing volume is retried, but reported only once
+	d.DiscoverLocalVolumes(context.Background())
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
+	verifyCreatedPVs(t, test)
+	verifyEvents(t, test, common.EventVolumeUnhealthy, 0)
+
+	// The volumes of existing PVs are not probed, and their PVs are kept
+	existingPath := filepath.Join(testMountDir, "dir1", "mount1")
+	test.volUtil.SetError(util.FakeOpProbeHealth, existingPath, fmt.Errorf("injected I/O error"))
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyEvents(t, test, common.EventVolumeUnhealthy, 0)
+	if deleted := test.apiUtil.GetAndResetDeletedPVs(); len(deleted) != 0 {
+		t.Errorf("Expected no deleted PVs, got %v", deleted)
+	}
+	if d.unhealthyVolumes[existingPath] {
+		t.Errorf("Expected the volume of existing PV at %q not to be probed", existingPath)
+	}
+
+	// Once the volume passes the probe, its PV is created
+	test.volUtil.SetError(util.FakeOpProbeHealth, failingPath, nil)
+	d.DiscoverLocalVolumes(context.Background())
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{
+		"dir1": {{Name: "mount2", Hash: 0x79412c38}},
+	}
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_Drain(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// Once drained, e.g. on shutdown, new volumes get no PVs
+	newVols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test.volUtil.AddNewDirEntries(testMountDir, newVols)
+	d.Drain()
+	d.DiscoverLocalVolumes(context.Background())
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
+	verifyCreatedPVs(t, test)
+}
+
+func TestDiscoverVolumes_DirRemoved(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	// The PVs must survive the mount dir disappearing, e.g. when the disks are unmounted
+	test.volUtil.RemoveDirListing(filepath.Join(testMountDir, "dir1"))
+	d.DiscoverLocalVolumes(context.Background())
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
+	verifyCreatedPVs(t, test)
+	if deletedPVs := test.apiUtil.GetAndResetDeletedPVs(); len(deletedPVs) != 0 {
+		t.Errorf("Expected no deleted PVs, got %v", len(deletedPVs))
+	}
+	for _, file := range vols["dir1"] {
+		pvName := expectedPVName(test, file)
+		if _, exists := test.cache.GetPV(pvName); !exists {
+			t.Errorf("PV %q not in cache", pvName)
+		}
+	}
+}
+
+func TestDiscoverVolumes_Cancelled(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{},
+	}
+	d := testSetup(t, test)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.DiscoverLocalVolumes(ctx)
+
+	verifyCreatedPVs(t, test)
+	verifyPVsNotInCache(t, test)
+}
+
+func TestDiscoverVolumes_GlobMountDir(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"ssd-a": {
+			{Name: "mount1", VolumeType: util.FakeEntryFile},
+		},
+		"ssd-b": {
+			{Name: "mount1", VolumeType: util.FakeEntryFile},
+			{Name: "mount2", VolumeType: util.FakeEntryBlock},
+		},
+		"hdd": {
+			{Name: "mount1", VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		discoveryMap: map[string]common.MountConfig{
+			"sc1": {
+				HostDir:  testHostDir + "/ssd-*",
+				MountDir: testMountDir + "/ssd-*",
+			},
+		},
+	}
+	d := testSetup(t, test)
+	bound := common.CreateLocalPVSpec(&common.LocalPVConfig{
+		Name:         "pv-bound",
+		HostPath:     filepath.Join(testHostDir, "ssd-c", "mount1"),
+		StorageClass: "sc1",
+	})
+	bound.Status.Phase = v1.VolumeBound
+	test.cache.AddPV(bound)
+
+	result := d.DiscoverLocalVolumes(context.Background())
+	pvs := test.apiUtil.GetAndResetCreatedPVs()
+	paths := []string{}
+	for _, pv := range pvs {
+		paths = append(paths, pv.Spec.Local.Path)
+	}
+	sort.Strings(paths)
+	expected := []string{
+		filepath.Join(testHostDir, "ssd-a", "mount1"),
+		filepath.Join(testHostDir, "ssd-b", "mount1"),
+		filepath.Join(testHostDir, "ssd-b", "mount2"),
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected PVs with host paths %v, got %v", expected, paths)
+	}
+	// The volumes of all the base dirs are listed, so only the PV of the removed base
+	// dir is missing
+	if missing := result.Classes["sc1"].MissingMedia; !reflect.DeepEqual(missing, []string{"pv-bound"}) {
+		t.Errorf("Expected missing media PVs [pv-bound], got %v", missing)
+	}
+
+	// A new base dir is discovered in the next cycle
+	test.volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+		"ssd-c": {{Name: "mount1", VolumeType: util.FakeEntryFile}},
+	})
+	test.cache.DeletePV(bound.Name)
+	d.DiscoverLocalVolumes(context.Background())
+	pvs = test.apiUtil.GetAndResetCreatedPVs()
+	if len(pvs) != 1 {
+		t.Fatalf("Expected 1 created PV, got %d", len(pvs))
+	}
+	for _, pv := range pvs {
+		if expected := filepath.Join(testHostDir, "ssd-c", "mount1"); pv.Spec.Local.Path != expected {
+			t.Errorf("Expected PV with host path %q, got %q", expected, pv.Spec.Local.Path)
+		}
+	}
+}
+
+func TestDiscoverVolumes_MissingBackingMedia(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	for _, phase := range []v1.PersistentVolumePhase{v1.VolumeBound, v1.VolumeAvailable} {
+		pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+			Name:         "pv-" + strings.ToLower(string(phase)),
+			HostPath:     filepath.Join(testHostDir, "dir1", "mount-"+string(phase)),
+			StorageClass: "sc1",
+		})
+		pv.Status.Phase = phase
+		test.cache.AddPV(pv)
+	}
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyEvents(t, test, common.EventMissingBackingMedia, 1)
+
+	// The event is throttled while the media stays missing
+	d.DiscoverLocalVolumes(context.Background())
+	verifyEvents(t, test, common.EventMissingBackingMedia, 0)
+}
+
+func TestDiscoverVolumes_CleanupGracePeriod(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	d.CleanupGracePeriod = time.Hour
+	unboundName := d.generatePVName("missing", "sc1")
+	for name, phase := range map[string]v1.PersistentVolumePhase{"pv-bound": v1.VolumeBound, unboundName: v1.VolumeAvailable} {
+		pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+			Name:         name,
+			HostPath:     filepath.Join(testHostDir, "dir1", "missing"),
+			StorageClass: "sc1",
+		})
+		pv.Status.Phase = phase
+		test.cache.AddPV(pv)
+	}
+
+	// The unbound PV is annotated when its volume is first found missing
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	updatedPVs := test.apiUtil.GetAndResetUpdatedPVs()
+	if len(updatedPVs) != 1 || updatedPVs[unboundName] == nil {
+		t.Fatalf("Expected only PV %q to be updated, got %v", unboundName, updatedPVs)
+	}
+	if _, err := time.Parse(time.RFC3339, updatedPVs[unboundName].Annotations[common.AnnMissingSince]); err != nil {
+		t.Errorf("Expected a valid %s annotation: %v", common.AnnMissingSince, err)
+	}
+
+	// The PV is kept within the grace period
+	d.DiscoverLocalVolumes(context.Background())
+	if deleted := test.apiUtil.GetAndResetDeletedPVs(); len(deleted) != 0 {
+		t.Errorf("Expected no deleted PVs within the grace period, got %v", deleted)
+	}
+
+	// The annotation is removed when the volume is back
+	missingPath := filepath.Join(testMountDir, "dir1", "missing")
+	test.volUtil.AddNewDirEntries(testMountDir, map[string][]*util.FakeDirEntry{
+		"dir1": {{Name: "missing", VolumeType: util.FakeEntryFile}},
+	})
+	d.DiscoverLocalVolumes(context.Background())
+	pv, _ := test.cache.GetPV(unboundName)
+	if since, found := pv.Annotations[common.AnnMissingSince]; found {
+		t.Errorf("Expected the %s annotation to be removed, got %q", common.AnnMissingSince, since)
+	}
+	if err := test.volUtil.RemoveDir(missingPath); err != nil {
+		t.Fatalf("Error removing %q: %v", missingPath, err)
+	}
+
+	// Only the unbound PV is deleted once the grace period has passed
+	pv.Annotations[common.AnnMissingSince] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	result := d.DiscoverLocalVolumes(context.Background())
+	deleted := test.apiUtil.GetAndResetDeletedPVs()
+	if len(deleted) != 1 || deleted[unboundName] == nil {
+		t.Errorf("Expected only PV %q to be deleted, got %v", unboundName, deleted)
+	}
+	if result.Deleted() != 1 {
+		t.Errorf("Expected 1 deleted PV in the result, got %v", result.Deleted())
+	}
+}
+
+func TestDiscoverVolumes_CleanupGracePeriodKeptPVs(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+	}
+	d := testSetup(t, test)
+	d.CleanupGracePeriod = time.Hour
+	cases := []struct {
+		file          string
+		reclaimPolicy v1.PersistentVolumeReclaimPolicy
+		boundOnServer bool
+		expectDeleted bool
+	}{
+		{file: "delete", reclaimPolicy: v1.PersistentVolumeReclaimDelete, expectDeleted: true},
+		{file: "retain", reclaimPolicy: v1.PersistentVolumeReclaimRetain},
+		{file: "bound-since-cached", reclaimPolicy: v1.PersistentVolumeReclaimDelete, boundOnServer: true},
+	}
+	for _, c := range cases {
+		pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+			Name:          d.generatePVName(c.file, "sc1"),
+			HostPath:      filepath.Join(testHostDir, "dir1", c.file),
+			StorageClass:  "sc1",
+			ReclaimPolicy: c.reclaimPolicy,
+		})
+		pv.Status.Phase = v1.VolumeAvailable
+		pv.Annotations[common.AnnMissingSince] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+		test.cache.AddPV(pv)
+		if c.boundOnServer {
+			// A claim is bound to the PV, but the informer hasn't delivered the update yet
+			bound := *pv
+			bound.Status.Phase = v1.VolumeBound
+			bound.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: "claim"}
+			test.apiUtil.SetServerPV(&bound)
+		}
+	}
+
+	d.DiscoverLocalVolumes(context.Background())
+	deleted := test.apiUtil.GetAndResetDeletedPVs()
+	for _, c := range cases {
+		t.Logf("Test %q", c.file)
+		name := d.generatePVName(c.file, "sc1")
+		if _, found := deleted[name]; found != c.expectDeleted {
+			t.Errorf("Expected PV %q deleted %v, got %v", name, c.expectDeleted, found)
+		}
+	}
+}
+
+// addMissingPVs adds count unbound PVs of class sc1 whose volumes have been missing for
+// longer than the cleanup grace period of d
+func addMissingPVs(test *testConfig, d *Discoverer, count int) {
+	d.CleanupGracePeriod = time.Hour
+	for i := 0; i < count; i++ {
+		file := fmt.Sprintf("missing%d", i)
+		pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+			Name:         d.generatePVName(file, "sc1"),
+			HostPath:     filepath.Join(testHostDir, "dir1", file),
+			StorageClass: "sc1",
+		})
+		pv.Status.Phase = v1.VolumeAvailable
+		pv.Annotations = map[string]string{common.AnnMissingSince: time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)}
+		test.cache.AddPV(pv)
+	}
+}
+
+func TestDiscoverVolumes_CleanupConcurrency(t *testing.T) {
+	tests := []struct {
+		name                 string
+		maxVolumeConcurrency int
+		expectedMaxDeletes   int
+	}{
+		{
+			name:               "one at a time",
+			expectedMaxDeletes: 1,
+		},
+		{
+			name:                 "concurrent",
+			maxVolumeConcurrency: 4,
+			expectedMaxDeletes:   4,
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		config := &testConfig{
+			dirLayout:            map[string][]*util.FakeDirEntry{"dir1": {}},
+			maxVolumeConcurrency: test.maxVolumeConcurrency,
+		}
+		d := testSetup(t, config)
+		addMissingPVs(config, d, 20)
+		config.apiUtil.SetDeleteDelay(10 * time.Millisecond)
+
+		result := d.DiscoverLocalVolumes(context.Background())
+		if deleted := config.apiUtil.GetAndResetDeletedPVs(); len(deleted) != 20 {
+			t.Errorf("Expected 20 deleted PVs, got %v", len(deleted))
+		}
+		if result.Deleted() != 20 {
+			t.Errorf("Expected 20 deleted PVs in the result, got %v", result.Deleted())
+		}
+		if max := config.apiUtil.GetMaxConcurrentDeletes(); max != test.expectedMaxDeletes {
+			t.Errorf("Expected at most %v concurrent deletes, got %v", test.expectedMaxDeletes, max)
+		}
+	}
+}
+
+// BenchmarkDiscoverVolumes_CleanupConcurrency deletes the PVs of 24 missing volumes, one
+// at a time and with 8 workers
+func BenchmarkDiscoverVolumes_CleanupConcurrency(b *testing.B) {
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				test := &testConfig{
+					dirLayout:            map[string][]*util.FakeDirEntry{"dir1": {}},
+					maxVolumeConcurrency: workers,
+				}
+				d := testSetup(b, test)
+				addMissingPVs(test, d, 24)
+				test.apiUtil.SetDeleteDelay(time.Millisecond)
+				if deleted := d.DiscoverLocalVolumes(context.Background()).Deleted(); deleted != 24 {
+					b.Fatalf("Expected 24 deleted PVs, got %v", deleted)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoverVolumes_AdoptExisting(t *testing.T) {
+	tests := []struct {
+		name  string
+		adopt bool
+		// Storage class of the manual PV of dir1/mount1
+		pvClass string
+		// Add a PV of another class for dir1/mount1, sorting before the manual PV
+		otherClassPV    bool
+		expectedCreated []string
+		expectedAdopted []string
+		expectedReason  SkipReason
+	}{
+		{
+			name:            "disabled",
+			pvClass:         "sc1",
+			expectedCreated: []string{"mount1", "mount2"},
+		},
+		{
+			name:            "adopted",
+			adopt:           true,
+			pvClass:         "sc1",
+			expectedCreated: []string{"mount2"},
+			expectedAdopted: []string{"manual-pv"},
+		},
+		{
+			name:            "adopted next to a PV of another class",
+			adopt:           true,
+			pvClass:         "sc1",
+			otherClassPV:    true,
+			expectedCreated: []string{"mount2"},
+			expectedAdopted: []string{"manual-pv"},
+		},
+		{
+			name:            "other storage class",
+			adopt:           true,
+			pvClass:         "sc2",
+			expectedCreated: []string{"mount2"},
+			expectedReason:  SkipReasonHostPathInUse,
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		config := &testConfig{
+			dirLayout: map[string][]*util.FakeDirEntry{
+				"dir1": {
+					{Name: "mount1", VolumeType: util.FakeEntryFile},
+					{Name: "mount2", VolumeType: util.FakeEntryFile},
+				},
+			},
+		}
+		d := testSetup(t, config)
+		d.AdoptExisting = test.adopt
+		config.cache.AddAdoptablePV(common.CreateLocalPVSpec(&common.LocalPVConfig{
+			Name:         "manual-pv",
+			HostPath:     filepath.Join(testHostDir, "dir1", "mount1") + "/",
+			StorageClass: test.pvClass,
+		}))
+		if test.otherClassPV {
+			config.cache.AddPV(common.CreateLocalPVSpec(&common.LocalPVConfig{
+				Name:         "a-pv",
+				HostPath:     filepath.Join(testHostDir, "dir1", "mount1"),
+				StorageClass: "sc2",
+			}))
+		}
+
+		result := d.DiscoverLocalVolumes(context.Background())
+		created := config.apiUtil.GetAndResetCreatedPVs()
+		if len(created) != len(test.expectedCreated) {
+			t.Errorf("Expected %v created PVs, got %v", len(test.expectedCreated), len(created))
+		}
+		for _, file := range test.expectedCreated {
+			if _, found := created[d.generatePVName(file, "sc1")]; !found {
+				t.Errorf("Expected a PV created for %q", file)
+			}
+		}
+		adopted := result.Classes["sc1"].Adopted
+		if !reflect.DeepEqual(adopted, test.expectedAdopted) {
+			t.Errorf("Expected adopted PVs %v, got %v", test.expectedAdopted, adopted)
+		}
+		if entry := result.Classes["sc1"].Entries["mount1"]; entry == nil || entry.Reason != test.expectedReason {
+			t.Errorf("Expected entry of %q to have reason %q, got %+v", "mount1", test.expectedReason, entry)
+		}
+		updated := config.apiUtil.GetAndResetUpdatedPVs()
+		if len(test.expectedAdopted) == 0 {
+			if len(updated) != 0 {
+				t.Errorf("Expected no updated PVs, got %v", updated)
+			}
+			continue
+		}
+		pv := updated["manual-pv"]
+		if pv == nil {
+			t.Fatalf("Expected PV %q to be updated, got %v", "manual-pv", updated)
+		}
+		if provisioner := pv.Annotations[common.AnnProvisionedBy]; provisioner != testProvisionerName {
+			t.Errorf("Expected the %s annotation %q, got %q", common.AnnProvisionedBy, testProvisionerName, provisioner)
+		}
+		if _, found := pv.Labels[common.LabelProvisionedBy]; !found {
+			t.Errorf("Expected the %s label on the adopted PV", common.LabelProvisionedBy)
+		}
+
+		// The adopted PV is the PV of the volume in the next discoveries
+		result = d.DiscoverLocalVolumes(context.Background())
+		if created := config.apiUtil.GetAndResetCreatedPVs(); len(created) != 0 {
+			t.Errorf("Expected no created PVs after the adoption, got %v", created)
+		}
+		if entry := result.Classes["sc1"].Entries["mount1"]; entry == nil || entry.Decision != "has PV manual-pv" {
+			t.Errorf("Expected entry of %q to have the adopted PV, got %+v", "mount1", entry)
+		}
+	}
+}
+
+func TestDiscoverVolumes_HostPathInUse(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+			{Name: "mount3", VolumeType: util.FakeEntryFile},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile}},
+		},
+	}
+	d := testSetup(t, test)
+	// PVs of a previous provisioner version, with other names
+	stale := []*v1.PersistentVolume{}
+	for _, file := range []string{"mount1", "mount3"} {
+		pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+			Name:         "old-local-pv-" + file,
+			HostPath:     filepath.Join(testHostDir, "dir1", file),
+			StorageClass: "sc2",
+		})
+		test.cache.AddPV(pv)
+		stale = append(stale, pv)
+	}
+
+	result := d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	if entry := result.Classes["sc1"].Entries["mount1"]; entry == nil || entry.Reason != SkipReasonHostPathInUse {
+		t.Errorf("Expected entry of %q to have reason %q, got %+v", "mount1", SkipReasonHostPathInUse, entry)
+	}
+	verifyEvents(t, test, common.EventHostPathInUse, 2)
+
+	// The events are throttled while the PVs have the host paths
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyEvents(t, test, common.EventHostPathInUse, 0)
+
+	// The event of a volume is forgotten once the volume is gone
+	if err := test.volUtil.RemoveDir(filepath.Join(testMountDir, "dir1", "mount3")); err != nil {
+		t.Fatalf("Error removing volume: %v", err)
+	}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyHostPathInUseVolumes(t, d, d.generatePVName("mount1", "sc1"))
+
+	// The PV is created once the stale PV is deleted, and its event is forgotten
+	test.cache.DeletePV(stale[0].Name)
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{
+		"dir1": {{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile}},
+	}
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyHostPathInUseVolumes(t, d)
+}
+
+// verifyHostPathInUseVolumes checks the names of the PVs whose host path in use events
+// are remembered
+func verifyHostPathInUseVolumes(t *testing.T, d *Discoverer, expected ...string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.hostPathInUseEvents) != len(expected) {
+		t.Errorf("Expected host path in use events of %v, got %v", expected, d.hostPathInUseEvents)
+	}
+	for _, pvName := range expected {
+		if _, found := d.hostPathInUseEvents[pvName]; !found {
+			t.Errorf("Expected a host path in use event of PV %q", pvName)
+		}
+	}
+}
+
+func TestDiscoverVolumes_DuplicateHostPaths(t *testing.T) {
+	type dupPV struct {
+		class string
+		phase v1.PersistentVolumePhase
+		age   time.Duration
+		// Bound according to the API server, but not yet in the cache
+		boundOnServer bool
+	}
+	tests := []struct {
+		name    string
+		resolve bool
+		// The PVs of the host path of dir1/mount1, the PV of its volume is named "volume"
+		pvs             map[string]dupPV
+		expectedDeleted []string
+	}{
+		{
+			name: "not resolved",
+			pvs: map[string]dupPV{
+				"volume": {class: "sc1", phase: v1.VolumeBound},
+				"pv-dup": {class: "sc2", phase: v1.VolumeAvailable},
+			},
+		},
+		{
+			name:    "unbound duplicate of bound PV",
+			resolve: true,
+			pvs: map[string]dupPV{
+				"volume": {class: "sc1", phase: v1.VolumeBound},
+				"pv-dup": {class: "sc2", phase: v1.VolumeAvailable, age: time.Hour},
+			},
+			expectedDeleted: []string{"pv-dup"},
+		},
+		{
+			name:    "bound duplicates",
+			resolve: true,
+			pvs: map[string]dupPV{
+				"volume": {class: "sc1", phase: v1.VolumeBound},
+				"pv-dup": {class: "sc2", phase: v1.VolumeBound},
+			},
+		},
+		{
+			name:    "unbound duplicates keep the oldest",
+			resolve: true,
+			pvs: map[string]dupPV{
+				"volume": {class: "sc1", phase: v1.VolumeAvailable, age: time.Minute},
+				"pv-dup": {class: "sc2", phase: v1.VolumeAvailable, age: time.Hour},
+			},
+			expectedDeleted: []string{"volume"},
+		},
+		{
+			name:    "unbound duplicate bound since cached",
+			resolve: true,
+			pvs: map[string]dupPV{
+				"volume": {class: "sc1", phase: v1.VolumeBound},
+				"pv-dup": {class: "sc2", phase: v1.VolumeAvailable, boundOnServer: true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		vols := map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			},
+		}
+		config := &testConfig{
+			dirLayout:       vols,
+			expectedVolumes: map[string][]*util.FakeDirEntry{},
+		}
+		d := testSetup(t, config)
+		d.ResolveDuplicateHostPaths = test.resolve
+		for name, dup := range test.pvs {
+			if name == "volume" {
+				name = d.generatePVName("mount1", "sc1")
+			}
+			pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+				Name:         name,
+				HostPath:     filepath.Join(testHostDir, "dir1", "mount1"),
+				StorageClass: dup.class,
+			})
+			pv.Status.Phase = dup.phase
+			pv.CreationTimestamp = metav1.NewTime(time.Now().Add(-dup.age))
+			config.cache.AddPV(pv)
+			if dup.boundOnServer {
+				bound := *pv
+				bound.Status.Phase = v1.VolumeBound
+				bound.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: "claim"}
+				config.apiUtil.SetServerPV(&bound)
+			}
+		}
+
+		result := d.DiscoverLocalVolumes(context.Background())
+		verifyCreatedPVs(t, config)
+		deleted := config.apiUtil.GetAndResetDeletedPVs()
+		if len(deleted) != len(test.expectedDeleted) {
+			t.Errorf("Expected deleted PVs %v, got %v", test.expectedDeleted, deleted)
+		}
+		for _, name := range test.expectedDeleted {
+			if name == "volume" {
+				name = d.generatePVName("mount1", "sc1")
+			}
+			if _, found := deleted[name]; !found {
+				t.Errorf("Expected PV %q to be deleted, got %v", name, deleted)
+			}
+		}
+		if result.Deleted() != len(test.expectedDeleted) {
+			t.Errorf("Expected %v deleted PVs in the result, got %v", len(test.expectedDeleted), result.Deleted())
+		}
+		verifyEvents(t, config, common.EventDuplicateHostPath, 1)
+	}
+}
+
+func TestDiscoverVolumes_Result(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
 		},
 		"dir2": {
 			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
-			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
 		},
 	}
 	test := &testConfig{
 		dirLayout:       vols,
-		expectedVolumes: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{"dir1": vols["dir1"]},
 	}
 	d := testSetup(t, test)
+	test.volUtil.SetError(util.FakeOpReadDir, filepath.Join(testMountDir, "dir2"), fmt.Errorf("injected error"))
+	pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+		Name:         "pv-bound",
+		HostPath:     filepath.Join(testHostDir, "dir1", "missing"),
+		StorageClass: "sc1",
+	})
+	pv.Status.Phase = v1.VolumeBound
+	test.cache.AddPV(pv)
 
-	d.DiscoverLocalVolumes()
+	result := d.DiscoverLocalVolumes(context.Background())
 	verifyCreatedPVs(t, test)
+	if result.Paused {
+		t.Errorf("Expected discovery not to be paused")
+	}
+	if result.Created() != 2 || result.Deleted() != 0 {
+		t.Errorf("Expected 2 created and 0 deleted PVs, got %v and %v", result.Created(), result.Deleted())
+	}
+	created := append([]string{}, result.Classes["sc1"].Created...)
+	sort.Strings(created)
+	if expected := []string{"local-pv-79412c38", "local-pv-aaaafef5"}; !reflect.DeepEqual(created, expected) {
+		t.Errorf("Expected created PVs %v, got %v", expected, created)
+	}
+	if missing := result.Classes["sc1"].MissingMedia; !reflect.DeepEqual(missing, []string{"pv-bound"}) {
+		t.Errorf("Expected missing media PVs [pv-bound], got %v", missing)
+	}
+	errs := result.Errors()
+	if len(errs) != 1 || errs["sc2"] == nil {
+		t.Errorf("Expected an error for storage class sc2, got %v", errs)
+	}
+
+	// Nothing is created again
+	result = d.DiscoverLocalVolumes(context.Background())
+	if result.Created() != 0 {
+		t.Errorf("Expected no created PVs, got %v", result.Created())
+	}
 }
 
-func TestDiscoverVolumes_BasicTwice(t *testing.T) {
+func TestDiscoverVolumes_SummaryEvents(t *testing.T) {
 	vols := map[string][]*util.FakeDirEntry{
 		"dir1": {
 			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
@@ -106,138 +3850,433 @@ func TestDiscoverVolumes_BasicTwice(t *testing.T) {
 	test := &testConfig{
 		dirLayout:       vols,
 		expectedVolumes: vols,
+		eventMode:       common.EventModeSummary,
 	}
 	d := testSetup(t, test)
 
-	d.DiscoverLocalVolumes()
+	d.DiscoverLocalVolumes(context.Background())
 	verifyCreatedPVs(t, test)
+	events := drainEvents(test)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %v", events)
+	}
+	expected := "Normal " + common.EventDiscoverySummary + " Discovered 4 volumes, created 4 PVs, deleted 0 PVs across storage classes [sc1 sc2]"
+	if events[0] != expected {
+		t.Errorf("Expected event %q, got %q", expected, events[0])
+	}
 
-	// Second time should not create any new volumes
-	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
-	d.DiscoverLocalVolumes()
-	verifyCreatedPVs(t, test)
+	// Nothing happens in the next cycle
+	d.DiscoverLocalVolumes(context.Background())
+	if events := drainEvents(test); len(events) != 0 {
+		t.Errorf("Expected no events, got %v", events)
+	}
 }
 
-func TestDiscoverVolumes_NoDir(t *testing.T) {
-	vols := map[string][]*util.FakeDirEntry{}
+func TestDiscoverVolumes_NoEvents(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+		"dir2": {
+			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+		},
+	}
 	test := &testConfig{
 		dirLayout:       vols,
 		expectedVolumes: vols,
+		eventMode:       common.EventModeNone,
 	}
 	d := testSetup(t, test)
 
-	d.DiscoverLocalVolumes()
+	d.DiscoverLocalVolumes(context.Background())
 	verifyCreatedPVs(t, test)
+	if events := drainEvents(test); len(events) != 0 {
+		t.Errorf("Expected no events, got %v", events)
+	}
 }
 
-func TestDiscoverVolumes_EmptyDir(t *testing.T) {
+func TestNewDiscoverer_InvalidEventMode(t *testing.T) {
+	runConfig := &common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node:         testNode,
+			DiscoveryMap: scMapping,
+			EventMode:    "all",
+		},
+		Name: testProvisionerName,
+	}
+	if _, err := NewDiscoverer(runConfig); err == nil {
+		t.Errorf("Expected error for event mode %q", runConfig.EventMode)
+	}
+}
+
+func TestDiscoverVolumes_PVNameCollision(t *testing.T) {
 	vols := map[string][]*util.FakeDirEntry{
-		"dir1": {},
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
+		},
+	}
+	test := &testConfig{
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {vols["dir1"][1]},
+		},
+	}
+	d := testSetup(t, test)
+	// The PV of another volume has the generated name of mount1
+	pv := common.CreateLocalPVSpec(&common.LocalPVConfig{
+		Name:         expectedPVName(test, vols["dir1"][0]),
+		HostPath:     filepath.Join(testHostDir, "dir1", "other"),
+		StorageClass: "sc1",
+	})
+	test.cache.AddPV(pv)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyEvents(t, test, common.EventPVNameCollision, 1)
+	if cached, _ := test.cache.GetPV(pv.Name); cached.Spec.Local.Path != pv.Spec.Local.Path {
+		t.Errorf("Expected PV %q to keep host path %q, got %q", pv.Name, pv.Spec.Local.Path, cached.Spec.Local.Path)
+	}
+
+	// The event is throttled while the collision lasts
+	d.DiscoverLocalVolumes(context.Background())
+	verifyEvents(t, test, common.EventPVNameCollision, 0)
+}
+
+func TestDiscoverVolumes_CapacityShrink(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock, Capacity: 100 * 1024},
+		},
 	}
 	test := &testConfig{
 		dirLayout:       vols,
 		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.DetectCapacityShrink = true
+			config.CapacityShrinkTolerancePercent = 10
+		}),
 	}
 	d := testSetup(t, test)
 
-	d.DiscoverLocalVolumes()
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+	verifyEvents(t, test, common.EventCapacityShrunk, 0)
+
+	// Only shrinking beyond the tolerance is reported
+	vols["dir1"][0].Capacity = 95 * 1024
+	vols["dir1"][1].Capacity = 80 * 1024
+	d.DiscoverLocalVolumes(context.Background())
+	verifyEvents(t, test, common.EventCapacityShrunk, 1)
+
+	// The event is throttled while the volume stays shrunk
+	d.DiscoverLocalVolumes(context.Background())
+	verifyEvents(t, test, common.EventCapacityShrunk, 0)
+
+	// No new PVs are created for the shrunk volumes
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
 	verifyCreatedPVs(t, test)
 }
 
-func TestDiscoverVolumes_NewVolumesLater(t *testing.T) {
+func TestDiscoverVolumes_UpdateUnboundCapacity(t *testing.T) {
 	vols := map[string][]*util.FakeDirEntry{
 		"dir1": {
-			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
-			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
-		},
-		"dir2": {
-			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
-			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024},
 		},
 	}
 	test := &testConfig{
 		dirLayout:       vols,
 		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.UpdateUnboundCapacity = true
+		}),
 	}
 	d := testSetup(t, test)
 
-	d.DiscoverLocalVolumes()
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
+
+	unbound, _ := test.cache.GetPV(expectedPVName(test, vols["dir1"][0]))
+	unbound.Status.Phase = v1.VolumeAvailable
+	unbound.Annotations[common.AnnLastSeen] = time.Now().Format(time.RFC3339)
+	unbound.Annotations[common.AnnMissingSince] = time.Now().Format(time.RFC3339)
+	bound, _ := test.cache.GetPV(expectedPVName(test, vols["dir1"][1]))
+	bound.Status.Phase = v1.VolumeBound
+	bound.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: "claim"}
+	vols["dir1"][0].Capacity = 200 * 1024
+	vols["dir1"][1].Capacity = 200 * 1024
 
+	// Only the unbound PV is recreated with the new capacity
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{
+		"dir1": {
+			{Name: "mount1", Hash: 0xaaaafef5, Capacity: 200 * 1024},
+		},
+	}
+	d.DiscoverLocalVolumes(context.Background())
 	verifyCreatedPVs(t, test)
+	deleted := test.apiUtil.GetAndResetDeletedPVs()
+	if _, found := deleted[unbound.Name]; !found || len(deleted) != 1 {
+		t.Errorf("Expected only PV %q to be deleted, got %v", unbound.Name, deleted)
+	}
+	pv, _ := test.cache.GetPV(bound.Name)
+	if capacity := pv.Spec.Capacity[v1.ResourceStorage]; capacity.Value() != 100*1024 {
+		t.Errorf("Expected bound PV capacity %d, got %d", 100*1024, capacity.Value())
+	}
+	// The state of the previous syncs isn't carried over to the recreated PV
+	pv, _ = test.cache.GetPV(unbound.Name)
+	for _, key := range []string{common.AnnLastSeen, common.AnnMissingSince} {
+		if value, found := pv.Annotations[key]; found {
+			t.Errorf("Expected recreated PV without annotation %s, got %q", key, value)
+		}
+	}
+}
 
-	// Some new mount points show up
-	newVols := map[string][]*util.FakeDirEntry{
+func TestDiscoverVolumes_UpdateUnboundCapacityBoundSinceCached(t *testing.T) {
+	vols := map[string][]*util.FakeDirEntry{
 		"dir1": {
-			{Name: "mount3", Hash: 0xf34b8003, VolumeType: util.FakeEntryFile},
-			{Name: "mount4", Hash: 0x144e29de, VolumeType: util.FakeEntryBlock},
+			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, Capacity: 100 * 1024},
 		},
 	}
-	test.volUtil.AddNewDirEntries(testMountDir, newVols)
-	test.expectedVolumes = newVols
+	test := &testConfig{
+		dirLayout:       vols,
+		expectedVolumes: vols,
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.UpdateUnboundCapacity = true
+		}),
+	}
+	d := testSetup(t, test)
+
+	d.DiscoverLocalVolumes(context.Background())
+	verifyCreatedPVs(t, test)
 
-	d.DiscoverLocalVolumes()
+	cached, _ := test.cache.GetPV(expectedPVName(test, vols["dir1"][0]))
+	cached.Status.Phase = v1.VolumeAvailable
+	// A claim is bound to the PV, but the informer hasn't delivered the update yet
+	bound := *cached
+	bound.Status.Phase = v1.VolumeBound
+	bound.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: "claim"}
+	test.apiUtil.SetServerPV(&bound)
+	vols["dir1"][0].Capacity = 200 * 1024
 
+	test.expectedVolumes = map[string][]*util.FakeDirEntry{}
+	d.DiscoverLocalVolumes(context.Background())
 	verifyCreatedPVs(t, test)
+	if deleted := test.apiUtil.GetAndResetDeletedPVs(); len(deleted) != 0 {
+		t.Errorf("Expected the PV bound since it was cached to be kept, got deleted %v", deleted)
+	}
 }
 
-func TestDiscoverVolumes_CreatePVFails(t *testing.T) {
+func TestIsCapacityShrunk(t *testing.T) {
+	tests := []struct {
+		advertised int64
+		capacity   int64
+		tolerance  int
+		expected   bool
+	}{
+		{advertised: 1000, capacity: 1000, tolerance: 0, expected: false},
+		{advertised: 1000, capacity: 1200, tolerance: 0, expected: false},
+		{advertised: 1000, capacity: 999, tolerance: 0, expected: true},
+		{advertised: 1000, capacity: 900, tolerance: 10, expected: false},
+		{advertised: 1000, capacity: 899, tolerance: 10, expected: true},
+		{advertised: 1000, capacity: 0, tolerance: 100, expected: false},
+	}
+	for _, test := range tests {
+		shrunk := isCapacityShrunk(test.advertised, test.capacity, test.tolerance)
+		if shrunk != test.expected {
+			t.Errorf("isCapacityShrunk(%d, %d, %d) = %v, expected %v", test.advertised, test.capacity, test.tolerance, shrunk, test.expected)
+		}
+	}
+}
+
+func TestDiscoverVolumes_MaxPVsPerNode(t *testing.T) {
 	vols := map[string][]*util.FakeDirEntry{
 		"dir1": {
 			{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile},
-			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock},
 		},
 		"dir2": {
 			{Name: "mount1", Hash: 0xa7aafa3c, VolumeType: util.FakeEntryFile},
-			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x7c4130f1, VolumeType: util.FakeEntryBlock},
 		},
 	}
 	test := &testConfig{
-		apiShouldFail:   true,
-		dirLayout:       vols,
-		expectedVolumes: map[string][]*util.FakeDirEntry{},
+		maxPVs:    3,
+		dirLayout: vols,
 	}
 	d := testSetup(t, test)
 
-	d.DiscoverLocalVolumes()
+	d.DiscoverLocalVolumes(context.Background())
+	if created := len(test.apiUtil.GetAndResetCreatedPVs()); created != 3 {
+		t.Errorf("Expected 3 created PVs, got %v", created)
+	}
+	verifyEvents(t, test, common.EventMaxPVsReached, 1)
 
-	verifyCreatedPVs(t, test)
-	verifyPVsNotInCache(t, test)
+	// The limit stays in effect in the next cycles
+	d.DiscoverLocalVolumes(context.Background())
+	if created := len(test.apiUtil.GetAndResetCreatedPVs()); created != 0 {
+		t.Errorf("Expected 0 created PVs, got %v", created)
+	}
+	verifyEvents(t, test, common.EventMaxPVsReached, 1)
 }
 
-func TestDiscoverVolumes_BadVolume(t *testing.T) {
+func TestDiscoverVolumes_NestedDepth(t *testing.T) {
 	vols := map[string][]*util.FakeDirEntry{
 		"dir1": {
-			{Name: "mount1", VolumeType: util.FakeEntryUnknown},
+			{Name: "pool1", VolumeType: util.FakeEntryFile},
+			{Name: "pool2", VolumeType: util.FakeEntryFile},
+			{Name: ".hidden", VolumeType: util.FakeEntryFile},
+			// Only directories are descended into
+			{Name: "disk1", VolumeType: util.FakeEntryBlock},
+		},
+		"dir1/pool1": {
+			{Name: "mount1", Hash: 0xb7a52097, VolumeType: util.FakeEntryFile},
+			{Name: "mount2", Hash: 0x197040e6, VolumeType: util.FakeEntryBlock},
+		},
+		"dir1/pool2": {
+			{Name: "mount1", Hash: 0x2fd60160, VolumeType: util.FakeEntryFile},
+		},
+		"dir1/.hidden": {
+			{Name: "mount1", VolumeType: util.FakeEntryFile},
 		},
 	}
 	test := &testConfig{
-		dirLayout:       vols,
-		expectedVolumes: map[string][]*util.FakeDirEntry{},
+		dirLayout: vols,
+		expectedVolumes: map[string][]*util.FakeDirEntry{
+			"dir1": {
+				{Name: "pool1/mount1", Hash: 0xb7a52097},
+				{Name: "pool1/mount2", Hash: 0x197040e6},
+				{Name: "pool2/mount1", Hash: 0x2fd60160},
+			},
+		},
+		discoveryMap: newDiscoveryMap(func(config *common.MountConfig) {
+			config.NestedDepth = 2
+		}),
 	}
 	d := testSetup(t, test)
 
-	d.DiscoverLocalVolumes()
-
+	d.DiscoverLocalVolumes(context.Background())
 	verifyCreatedPVs(t, test)
-	verifyPVsNotInCache(t, test)
 }
 
-func testSetup(t *testing.T, test *testConfig) *Discoverer {
+func TestDiscoverVolumes_BadVolume(t *testing.T) {
+	file := &util.FakeDirEntry{Name: "mount1", Hash: 0xaaaafef5, VolumeType: util.FakeEntryFile, FsType: "ext4"}
+	block := &util.FakeDirEntry{Name: "mount2", Hash: 0x79412c38, VolumeType: util.FakeEntryBlock}
+	filePath := filepath.Join(testMountDir, "dir1", file.Name)
+	blockPath := filepath.Join(testMountDir, "dir1", block.Name)
+	tests := map[string]struct {
+		vols []*util.FakeDirEntry
+		// Key = FakeOp*, value = path of the injected error
+		errors map[string]string
+		// The volumes in vols that are expected to be created as PVs
+		expected []*util.FakeDirEntry
+	}{
+		"unknown volume type": {
+			vols:     []*util.FakeDirEntry{{Name: "mount1", VolumeType: util.FakeEntryUnknown}},
+			expected: []*util.FakeDirEntry{},
+		},
+		"read dir error": {
+			vols:     []*util.FakeDirEntry{file, block},
+			errors:   map[string]string{util.FakeOpReadDir: filepath.Join(testMountDir, "dir1")},
+			expected: []*util.FakeDirEntry{},
+		},
+		"is dir and is block errors": {
+			vols:     []*util.FakeDirEntry{file, block},
+			errors:   map[string]string{util.FakeOpIsDir: filePath, util.FakeOpIsBlock: filePath},
+			expected: []*util.FakeDirEntry{block},
+		},
+		"fs capacity error": {
+			vols:     []*util.FakeDirEntry{file, block},
+			errors:   map[string]string{util.FakeOpGetFsCapacityByte: filePath},
+			expected: []*util.FakeDirEntry{block},
+		},
+		"block capacity error": {
+			vols:     []*util.FakeDirEntry{file, block},
+			errors:   map[string]string{util.FakeOpGetBlockCapacityByte: blockPath},
+			expected: []*util.FakeDirEntry{file},
+		},
+		"fs type error": {
+			vols:     []*util.FakeDirEntry{file},
+			errors:   map[string]string{util.FakeOpGetFsType: filePath},
+			expected: []*util.FakeDirEntry{{Name: "mount1", Hash: 0xaaaafef5}},
+		},
+	}
+	for name, tc := range tests {
+		test := &testConfig{
+			dirLayout:       map[string][]*util.FakeDirEntry{"dir1": tc.vols},
+			expectedVolumes: map[string][]*util.FakeDirEntry{"dir1": tc.expected},
+		}
+		d := testSetup(t, test)
+		for op, path := range tc.errors {
+			test.volUtil.SetError(op, path, fmt.Errorf("injected %s error", op))
+		}
+
+		d.DiscoverLocalVolumes(context.Background())
+
+		t.Logf("Verifying %q", name)
+		verifyCreatedPVs(t, test)
+		if len(tc.expected) == 0 {
+			verifyPVsNotInCache(t, test)
+		}
+	}
+}
+
+// newDiscoveryMap returns a copy of scMapping with modify applied to each class
+func newDiscoveryMap(modify func(config *common.MountConfig)) map[string]common.MountConfig {
+	discoveryMap := map[string]common.MountConfig{}
+	for class, config := range scMapping {
+		modify(&config)
+		discoveryMap[class] = config
+	}
+	return discoveryMap
+}
+
+func testSetup(t testing.TB, test *testConfig) *Discoverer {
 	test.cache = cache.NewVolumeCache()
 	test.volUtil = util.NewFakeVolumeUtil(false)
 	test.volUtil.AddNewDirEntries(testMountDir, test.dirLayout)
 	test.apiUtil = util.NewFakeAPIUtil(test.apiShouldFail, test.cache)
+	test.apiUtil.SetTransientFailures(test.apiTransientFailures)
+	test.apiUtil.SetNode(testNode)
 
+	if test.discoveryMap == nil {
+		test.discoveryMap = scMapping
+	}
+	for class := range test.discoveryMap {
+		if !test.missingClasses[class] {
+			test.apiUtil.SetStorageClass(&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: class}})
+		}
+	}
 	userConfig := &common.UserConfig{
 		Node:         testNode,
-		DiscoveryMap: scMapping,
+		DiscoveryMap: test.discoveryMap,
+
+		MaxDiscoveryConcurrency: test.maxConcurrency,
+		MaxVolumeConcurrency:    test.maxVolumeConcurrency,
+		EventMode:               test.eventMode,
+		PVNamePrefix:            test.pvNamePrefix,
+		APIRetryAttempts:        test.apiRetryAttempts,
+		APIRetryInterval:        time.Millisecond,
+		DryRun:                  test.dryRun,
+		MaxPVsPerNode:           test.maxPVs,
+		SkipZeroCapacity:        test.skipZeroCapacity,
+		SetNodeOwnerRef:         test.setNodeOwnerRef,
+		ExtraAnnotations:        test.extraAnnotations,
+		ExtraLabels:             test.extraLabels,
+		LastSeenInterval:        test.lastSeenInterval,
+		ReconcilePeriod:         test.reconcilePeriod,
 	}
+	test.recorder = record.NewFakeRecorder(100)
 	runConfig := &common.RuntimeConfig{
 		UserConfig: userConfig,
 		Cache:      test.cache,
 		VolUtil:    test.volUtil,
 		APIUtil:    test.apiUtil,
 		Name:       testProvisionerName,
+		Recorder:   common.NewEventModeRecorder(test.recorder, test.eventMode),
 	}
 	d, err := NewDiscoverer(runConfig)
 	if err != nil {
@@ -300,7 +4339,7 @@ func verifyNodeAffinity(t *testing.T, pv *v1.PersistentVolume) {
 	}
 }
 
-func verifyProvisionerName(t *testing.T, pv *v1.PersistentVolume) {
+func verifyProvisionerName(t *testing.T, pv *v1.PersistentVolume, expected string) {
 	if len(pv.Annotations) == 0 {
 		t.Errorf("Annotations not set")
 		return
@@ -310,8 +4349,26 @@ func verifyProvisionerName(t *testing.T, pv *v1.PersistentVolume) {
 		t.Errorf("Provisioned by annotations not set")
 		return
 	}
-	if name != testProvisionerName {
-		t.Errorf("Provisioned name is %q, expected %q", name, testProvisionerName)
+	if name != expected {
+		t.Errorf("Provisioned name is %q, expected %q", name, expected)
+	}
+	if label := pv.Labels[common.LabelProvisionedBy]; label != common.ProvisionerLabelValue(expected) {
+		t.Errorf("Provisioned by label is %q, expected %q", label, common.ProvisionerLabelValue(expected))
+	}
+}
+
+func verifyOwnerReferences(t *testing.T, test *testConfig, pv *v1.PersistentVolume) {
+	var expected []metav1.OwnerReference
+	if test.setNodeOwnerRef {
+		expected = append(expected, metav1.OwnerReference{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Name:       testNodeName,
+			UID:        testNode.UID,
+		})
+	}
+	if !reflect.DeepEqual(pv.OwnerReferences, expected) {
+		t.Errorf("Expected owner references %+v, got %+v", expected, pv.OwnerReferences)
 	}
 }
 
@@ -335,19 +4392,31 @@ type testPVInfo struct {
 	path         string
 	capacity     int64
 	storageClass string
+	fsType       string
+	deviceID     string
+}
+
+func expectedPVName(test *testConfig, file *util.FakeDirEntry) string {
+	prefix := test.pvNamePrefix
+	if prefix == "" {
+		prefix = common.DefaultPVNamePrefix
+	}
+	return fmt.Sprintf("%s%x", prefix, file.Hash)
 }
 
 func verifyCreatedPVs(t *testing.T, test *testConfig) {
 	expectedPVs := map[string]*testPVInfo{}
 	for dir, files := range test.expectedVolumes {
 		for _, file := range files {
-			pvName := fmt.Sprintf("local-pv-%x", file.Hash)
+			pvName := expectedPVName(test, file)
 			path := filepath.Join(testHostDir, dir, file.Name)
 			expectedPVs[pvName] = &testPVInfo{
 				pvName:       pvName,
 				path:         path,
 				capacity:     file.Capacity,
 				storageClass: findSCName(t, dir, test),
+				fsType:       file.FsType,
+				deviceID:     file.DeviceID,
 			}
 		}
 	}
@@ -370,22 +4439,82 @@ func verifyCreatedPVs(t *testing.T, test *testConfig) {
 		if createdPV.Spec.StorageClassName != expectedPV.storageClass {
 			t.Errorf("Expected storage class %q, got %q", expectedPV.storageClass, createdPV.Spec.StorageClassName)
 		}
+		if fsType := createdPV.Labels[common.LabelFsType]; fsType != expectedPV.fsType {
+			t.Errorf("Expected fs type label %q, got %q", expectedPV.fsType, fsType)
+		}
+		if deviceID := createdPV.Annotations[common.AnnDeviceID]; deviceID != expectedPV.deviceID {
+			t.Errorf("Expected device ID annotation %q, got %q", expectedPV.deviceID, deviceID)
+		}
+		if node := createdPV.Labels[common.LabelNode]; node != testNodeName {
+			t.Errorf("Expected node label %q, got %q", testNodeName, node)
+		}
 		_, exists := test.cache.GetPV(pvName)
 		if !exists {
 			t.Errorf("PV %q not in cache", pvName)
 		}
 
-		verifyProvisionerName(t, createdPV)
+		provisionerName := testProvisionerName
+		if name := test.discoveryMap[expectedPV.storageClass].ProvisionerName; name != "" {
+			provisionerName = name
+		}
+		verifyProvisionerName(t, createdPV, provisionerName)
 		verifyNodeAffinity(t, createdPV)
+		verifyOwnerReferences(t, test, createdPV)
 		verifyCapacity(t, createdPV, expectedPV)
 		// TODO: Verify volume type once that is supported in the API.
 	}
 }
 
+// verifyCreatedEvents checks that an event was recorded for each created PV
+func verifyCreatedEvents(t *testing.T, test *testConfig, expected int) {
+	created := 0
+	for len(test.recorder.Events) > 0 {
+		event := <-test.recorder.Events
+		if !strings.Contains(event, " "+common.EventVolumeCreated+" ") {
+			t.Errorf("Unexpected event %q", event)
+			continue
+		}
+		created++
+	}
+	if created != expected {
+		t.Errorf("Expected %v %s events, got %v", expected, common.EventVolumeCreated, created)
+	}
+}
+
+// verifyEvents checks the number of recorded events with the given reason, ignoring
+// other events
+func verifyEvents(t *testing.T, test *testConfig, reason string, expected int) {
+	events := []string{}
+	for _, event := range drainEvents(test) {
+		if strings.Contains(event, " "+reason+" ") {
+			events = append(events, event)
+		}
+	}
+	if len(events) != expected {
+		t.Errorf("Expected %v %s events, got %v", expected, reason, events)
+	}
+}
+
+// verifyLastSeenUpdates checks the number of PVs whose last seen annotation was updated
+func verifyLastSeenUpdates(t *testing.T, test *testConfig, expected int) {
+	updatedPVs := test.apiUtil.GetAndResetUpdatedPVs()
+	if len(updatedPVs) != expected {
+		t.Errorf("Expected %v updated PVs, got %v", expected, len(updatedPVs))
+	}
+	for name, pv := range updatedPVs {
+		lastSeen, err := time.Parse(time.RFC3339, pv.Annotations[common.AnnLastSeen])
+		if err != nil {
+			t.Errorf("PV %q has invalid last seen annotation: %v", name, err)
+		} else if time.Since(lastSeen) > time.Minute {
+			t.Errorf("PV %q last seen annotation %v is not recent", name, lastSeen)
+		}
+	}
+}
+
 func verifyPVsNotInCache(t *testing.T, test *testConfig) {
 	for _, files := range test.dirLayout {
 		for _, file := range files {
-			pvName := fmt.Sprintf("local-pv-%x", file.Hash)
+			pvName := expectedPVName(test, file)
 			_, exists := test.cache.GetPV(pvName)
 			if exists {
 				t.Errorf("Expected PV %q to not be in cache", pvName)
@@ -393,3 +4522,12 @@ func verifyPVsNotInCache(t *testing.T, test *testConfig) {
 		}
 	}
 }
+
+// drainEvents returns the recorded events
+func drainEvents(test *testConfig) []string {
+	events := []string{}
+	for len(test.recorder.Events) > 0 {
+		events = append(events, <-test.recorder.Events)
+	}
+	return events
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics implements the metrics of the provisioner and serves them in the
+// Prometheus text exposition format.
+// TODO: Switch to github.com/prometheus/client_golang once it is vendored.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// DiscoveredVolumes counts the new volumes found by discovery
+	DiscoveredVolumes = NewCounterVec("local_volume_discovered_total", "Number of new local volumes discovered.", "class")
+	// CreatedVolumes counts the PVs created by discovery
+	CreatedVolumes = NewCounterVec("local_volume_created_total", "Number of local PVs created.", "class")
+	// SkippedVolumes counts the entries of the mount dirs skipped by discovery, by reason
+	SkippedVolumes = NewCounterVec("local_volume_skipped_total", "Number of mount dir entries skipped by discovery.", "class", "reason")
+	// DeletedVolumes counts the PVs deleted by the deleter
+	DeletedVolumes = NewCounterVec("local_volume_deleted_total", "Number of local PVs deleted.", "class")
+	// CachedVolumes is the number of PVs in the volume cache
+	CachedVolumes = NewGauge("local_volume_cache_size", "Number of local PVs in the volume cache.")
+	// DiscoveryDuration is the duration of a full discovery pass over all the storage classes
+	DiscoveryDuration = NewHistogramVec("local_volume_discovery_duration_seconds",
+		"Duration of a discovery pass over all storage classes in seconds.", DiscoveryBuckets, "outcome")
+	// ClassDiscoveryDuration is the duration of discovering volumes of a single storage class
+	ClassDiscoveryDuration = NewHistogramVec("local_volume_class_discovery_duration_seconds",
+		"Duration of discovering the volumes of a storage class in seconds.", DiscoveryBuckets, "class", "outcome")
+)
+
+const (
+	// OutcomeSuccess is the outcome label value of an operation that succeeded
+	OutcomeSuccess = "success"
+	// OutcomeError is the outcome label value of an operation that failed
+	OutcomeError = "error"
+)
+
+// DiscoveryBuckets are the histogram buckets of the discovery durations, in seconds
+var DiscoveryBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// collector is a metric that can be written in the text exposition format
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = map[string]collector{}
+)
+
+func register(name string, c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("metric %q is already registered", name))
+	}
+	registry[name] = c
+}
+
+// WriteAll writes all the registered metrics, sorted by name
+func WriteAll(w io.Writer) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		registry[name].write(w)
+	}
+}
+
+// Handler returns an http.Handler that serves all the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteAll(w)
+	})
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a counter with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter for the given label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by v
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	keys := []string{}
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, key, c.values[key])
+	}
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	name string
+	help string
+
+	mutex sync.Mutex
+	value float64
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(name, g)
+	return g
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = v
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %v\n", g.name, g.value)
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	// counts[i] is the number of observations in (buckets[i-1], buckets[i]]
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper bounds of
+// the buckets, in increasing order, and label names
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	register(name, h)
+	return h
+}
+
+// Observe adds the observation v to the histogram for the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, found := h.values[key]
+	if !found {
+		hist = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := []string{}
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		hist := h.values[key]
+		bucketValues := append(append([]string{}, hist.labelValues...), "")
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			bucketValues[len(bucketValues)-1] = strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, bucketValues), cumulative)
+		}
+		bucketValues[len(bucketValues)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, bucketValues), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, key, hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// formatLabels returns the label set in the text exposition format, e.g. {class="sc1"}
+func formatLabels(names, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(names), len(values)))
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelValueEscaper.Replace(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := &CounterVec{name: "test_total", help: "Test counter.", labels: []string{"class"}, values: map[string]float64{}}
+	c.Inc("sc2")
+	c.Inc("sc1")
+	c.Add(2, "sc1")
+	c.Inc(`a"b`)
+
+	buf := &bytes.Buffer{}
+	c.write(buf)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{class="a\"b"} 1
+test_total{class="sc1"} 3
+test_total{class="sc2"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := &Gauge{name: "test_size", help: "Test gauge."}
+	g.Set(5)
+	g.Set(3)
+
+	buf := &bytes.Buffer{}
+	g.write(buf)
+	expected := `# HELP test_size Test gauge.
+# TYPE test_size gauge
+test_size 3
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &HistogramVec{name: "test_seconds", help: "Test histogram.", labels: []string{"outcome"}, buckets: []float64{0.5, 1}, values: map[string]*histogram{}}
+	h.Observe(0.5, OutcomeSuccess)
+	h.Observe(0.75, OutcomeSuccess)
+	h.Observe(2, OutcomeSuccess)
+	h.Observe(0.1, OutcomeError)
+
+	buf := &bytes.Buffer{}
+	h.write(buf)
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{outcome="error",le="0.5"} 1
+test_seconds_bucket{outcome="error",le="1"} 1
+test_seconds_bucket{outcome="error",le="+Inf"} 1
+test_seconds_sum{outcome="error"} 0.1
+test_seconds_count{outcome="error"} 1
+test_seconds_bucket{outcome="success",le="0.5"} 1
+test_seconds_bucket{outcome="success",le="1"} 2
+test_seconds_bucket{outcome="success",le="+Inf"} 3
+test_seconds_sum{outcome="success"} 3.25
+test_seconds_count{outcome="success"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
@@ -17,14 +17,17 @@ limitations under the License.
 package populator
 
 import (
+	"context"
 	"os"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
@@ -38,19 +41,30 @@ type Populator struct {
 
 // NewPopulator returns a Populator object to update the PV cache
 func NewPopulator(config *common.RuntimeConfig) *Populator {
+	if config.RateLimiter == nil {
+		config.RateLimiter = util.NewRateLimiter(0, 0)
+	}
 	return &Populator{RuntimeConfig: config}
 }
 
-// Start launches the PV informer
+// Start launches the PV informer and waits for its initial list of the PVs to be in the
+// cache, so that the Deleter and Discoverer never start with an incomplete cache, in which
+// existing PVs would be missing. The process exits if the initial sync times out.
 func (p *Populator) Start() {
+	selector := p.labelSelector()
+	if selector != "" {
+		p.backfillNodeLabel()
+	}
 	_, controller := kcache.NewInformer(
 		&kcache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = selector
 				pvs, err := p.Client.Core().PersistentVolumes().List(options)
 				return pvs, err
 			},
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
 				// TODO: can we just watch for changes on the phase field?
+				options.LabelSelector = selector
 				w, err := p.Client.Core().PersistentVolumes().Watch(options)
 				return w, err
 			},
@@ -96,28 +110,108 @@ func (p *Populator) Start() {
 	}
 }
 
+// labelSelector returns the label selector of the PVs watched by the informer, empty to
+// watch all PVs
+func (p *Populator) labelSelector() string {
+	if !p.ScopePVInformer {
+		return ""
+	}
+	node := p.GetNode()
+	value := common.NodeLabelValue(node)
+	if value == "" {
+		glog.Warningf("Node name %q is not a valid label value, watching all PVs", node.Name)
+		return ""
+	}
+	glog.Infof("Only watching the PVs with label %s=%s", common.LabelNode, value)
+	return labels.SelectorFromSet(labels.Set{common.LabelNode: value}).String()
+}
+
+// backfillNodeLabel adds the LabelNode label to the PVs of this provisioner that don't
+// have it, e.g. the PVs created by a version without the label, which the scoped informer
+// wouldn't find. It lists all the PVs once, errors are only logged.
+func (p *Populator) backfillNodeLabel() {
+	pvs, err := p.APIUtil.ListPVs()
+	if err != nil {
+		glog.Errorf("Error listing PVs to add the %s label: %v", common.LabelNode, err)
+		return
+	}
+	value := common.NodeLabelValue(p.GetNode())
+	for _, pv := range pvs {
+		if _, found := pv.Labels[common.LabelNode]; found || !p.isOwned(pv) {
+			continue
+		}
+		if p.DryRun {
+			glog.Infof("Dry run: skipping the addition of the %s label to PV %q", common.LabelNode, pv.Name)
+			continue
+		}
+		updated := *pv
+		updated.Labels = map[string]string{common.LabelNode: value}
+		for k, v := range pv.Labels {
+			updated.Labels[k] = v
+		}
+		if err := p.RateLimiter.Wait(context.Background()); err != nil {
+			glog.Errorf("Error waiting to update PV %q: %v", pv.Name, err)
+			return
+		}
+		if _, err := p.APIUtil.UpdatePV(&updated); err != nil {
+			glog.Errorf("Error adding the %s label to PV %q: %v", common.LabelNode, pv.Name, err)
+			continue
+		}
+		glog.Infof("Added the %s label to PV %q", common.LabelNode, pv.Name)
+	}
+}
+
+// isOwned returns true if the PV was created by this provisioner
+func (p *Populator) isOwned(pv *v1.PersistentVolume) bool {
+	provisioner, found := pv.Annotations[common.AnnProvisionedBy]
+	return found && (provisioner == p.Name || p.isClassProvisioner(pv, provisioner))
+}
+
 func (p *Populator) handlePVUpdate(pv *v1.PersistentVolume) {
 	_, exists := p.Cache.GetPV(pv.Name)
 	if exists {
 		p.Cache.UpdatePV(pv)
 	} else {
-		if pv.Annotations != nil {
-			provisioner, found := pv.Annotations[common.AnnProvisionedBy]
-			if !found {
-				return
-			}
-			if provisioner == p.Name {
-				// This PV was created by this provisioner
-				p.Cache.AddPV(pv)
-			}
+		_, found := pv.Annotations[common.AnnProvisionedBy]
+		if p.isOwned(pv) {
+			// This PV was created by this provisioner
+			p.Cache.AddPV(pv)
+		} else if !found && p.isAdoptable(pv) {
+			p.Cache.AddAdoptablePV(pv)
+		} else {
+			p.Cache.DeleteAdoptablePV(pv.Name)
 		}
 	}
 }
 
+// isAdoptable returns true if AdoptExisting is set and the PV, which wasn't created by a
+// provisioner, is a local PV of the node in one of the discovered storage classes
+func (p *Populator) isAdoptable(pv *v1.PersistentVolume) bool {
+	if !p.AdoptExisting || pv.Spec.Local == nil {
+		return false
+	}
+	if _, found := p.DiscoveryMap[pv.Spec.StorageClassName]; !found {
+		return false
+	}
+	return common.IsLocalPVOnNode(pv, p.GetNode())
+}
+
+// isClassProvisioner returns true if the PV is on this node and provisioner is the
+// provisioner name configured for its storage class
+func (p *Populator) isClassProvisioner(pv *v1.PersistentVolume, provisioner string) bool {
+	config, found := p.DiscoveryMap[pv.Spec.StorageClassName]
+	if !found || config.ProvisionerName == "" || config.ProvisionerName != provisioner {
+		return false
+	}
+	// The class provisioner name is shared by all nodes
+	return common.IsLocalPVOnNode(pv, p.GetNode())
+}
+
 func (p *Populator) handlePVDelete(pv *v1.PersistentVolume) {
 	_, exists := p.Cache.GetPV(pv.Name)
 	if exists {
 		// Don't do cleanup, just delete from cache
 		p.Cache.DeletePV(pv.Name)
 	}
+	p.Cache.DeleteAdoptablePV(pv.Name)
 }
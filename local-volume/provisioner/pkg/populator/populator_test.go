@@ -0,0 +1,140 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package populator
+
+import (
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/cache"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/common"
+	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/util"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testProvisionerName = "test-provisioner"
+
+var testNode = &v1.Node{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:   "test-node",
+		Labels: map[string]string{common.NodeLabelKey: "test-node"},
+	},
+}
+
+func newTestPV(name, provisioner string, labels map[string]string) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      labels,
+			Annotations: map[string]string{},
+		},
+	}
+	if provisioner != "" {
+		pv.Annotations[common.AnnProvisionedBy] = provisioner
+	}
+	return pv
+}
+
+func TestBackfillNodeLabel(t *testing.T) {
+	// The PVs on the API server, none of them are in the scoped informer's cache yet
+	serverCache := cache.NewVolumeCache()
+	serverCache.AddPV(newTestPV("pv-unlabeled", testProvisionerName, map[string]string{"foo": "bar"}))
+	serverCache.AddPV(newTestPV("pv-labeled", testProvisionerName, map[string]string{common.LabelNode: "test-node"}))
+	serverCache.AddPV(newTestPV("pv-foreign", "other-provisioner", nil))
+	serverCache.AddPV(newTestPV("pv-unprovisioned", "", nil))
+	apiUtil := util.NewFakeAPIUtil(false, serverCache)
+
+	p := NewPopulator(&common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node:            testNode,
+			ScopePVInformer: true,
+		},
+		Cache:   cache.NewVolumeCache(),
+		APIUtil: apiUtil,
+		Name:    testProvisionerName,
+	})
+	p.backfillNodeLabel()
+
+	updated := apiUtil.GetAndResetUpdatedPVs()
+	if len(updated) != 1 {
+		t.Fatalf("Expected 1 updated PV, got %d: %v", len(updated), updated)
+	}
+	pv, found := updated["pv-unlabeled"]
+	if !found {
+		t.Fatalf("Expected PV %q to be updated, got %v", "pv-unlabeled", updated)
+	}
+	if value := pv.Labels[common.LabelNode]; value != "test-node" {
+		t.Errorf("Expected label %s=%s, got %q", common.LabelNode, "test-node", value)
+	}
+	if value := pv.Labels["foo"]; value != "bar" {
+		t.Errorf("Expected the existing labels to be kept, got %v", pv.Labels)
+	}
+}
+
+func TestBackfillNodeLabel_DryRun(t *testing.T) {
+	serverCache := cache.NewVolumeCache()
+	serverCache.AddPV(newTestPV("pv-unlabeled", testProvisionerName, nil))
+	apiUtil := util.NewFakeAPIUtil(false, serverCache)
+
+	p := NewPopulator(&common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node:            testNode,
+			ScopePVInformer: true,
+			DryRun:          true,
+		},
+		Cache:   cache.NewVolumeCache(),
+		APIUtil: apiUtil,
+		Name:    testProvisionerName,
+	})
+	p.backfillNodeLabel()
+
+	if updated := apiUtil.GetAndResetUpdatedPVs(); len(updated) != 0 {
+		t.Errorf("Expected no updated PVs on dry run, got %v", updated)
+	}
+}
+
+func TestHandlePVUpdate_ConcurrentRefreshNode(t *testing.T) {
+	apiUtil := util.NewFakeAPIUtil(false, cache.NewVolumeCache())
+	apiUtil.SetNode(testNode)
+	p := NewPopulator(&common.RuntimeConfig{
+		UserConfig: &common.UserConfig{
+			Node: testNode,
+			DiscoveryMap: map[string]common.MountConfig{
+				"sc1": {ProvisionerName: "class-provisioner"},
+			},
+		},
+		Cache:   cache.NewVolumeCache(),
+		APIUtil: apiUtil,
+		Name:    testProvisionerName,
+	})
+	pv := newTestPV("pv1", "class-provisioner", nil)
+	pv.Spec.StorageClassName = "sc1"
+
+	// The deleter and discoverer refresh the node while the informer handles PVs
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.RefreshNode()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		p.handlePVUpdate(pv)
+	}
+	<-done
+}
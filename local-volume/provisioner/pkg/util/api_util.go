@@ -18,10 +18,14 @@ package util
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/kubernetes-incubator/external-storage/local-volume/provisioner/pkg/cache"
 
 	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -31,8 +35,23 @@ type APIUtil interface {
 	// Create PersistentVolume object
 	CreatePV(pv *v1.PersistentVolume) (*v1.PersistentVolume, error)
 
+	// Update PersistentVolume object
+	UpdatePV(pv *v1.PersistentVolume) (*v1.PersistentVolume, error)
+
 	// Delete PersistentVolume object
 	DeletePV(pvName string) error
+
+	// Get PersistentVolume object from the API server, bypassing the informer cache
+	GetPV(pvName string) (*v1.PersistentVolume, error)
+
+	// List all the PersistentVolume objects from the API server
+	ListPVs() ([]*v1.PersistentVolume, error)
+
+	// Get Node object
+	GetNode(nodeName string) (*v1.Node, error)
+
+	// Get StorageClass object
+	GetStorageClass(className string) (*storagev1.StorageClass, error)
 }
 
 var _ APIUtil = &apiUtil{}
@@ -51,48 +70,152 @@ func (u *apiUtil) CreatePV(pv *v1.PersistentVolume) (*v1.PersistentVolume, error
 	return u.client.Core().PersistentVolumes().Create(pv)
 }
 
+// UpdatePV will update a PersistentVolume
+func (u *apiUtil) UpdatePV(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	return u.client.Core().PersistentVolumes().Update(pv)
+}
+
 // DeletePV will delete a PersistentVolume
 func (u *apiUtil) DeletePV(pvName string) error {
 	return u.client.Core().PersistentVolumes().Delete(pvName, &metav1.DeleteOptions{})
 }
 
+// GetPV will get a PersistentVolume
+func (u *apiUtil) GetPV(pvName string) (*v1.PersistentVolume, error) {
+	return u.client.Core().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+}
+
+// ListPVs will list all the PersistentVolumes
+func (u *apiUtil) ListPVs() ([]*v1.PersistentVolume, error) {
+	list, err := u.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pvs := []*v1.PersistentVolume{}
+	for i := range list.Items {
+		pvs = append(pvs, &list.Items[i])
+	}
+	return pvs, nil
+}
+
+// GetNode will get a Node
+func (u *apiUtil) GetNode(nodeName string) (*v1.Node, error) {
+	return u.client.Core().Nodes().Get(nodeName, metav1.GetOptions{})
+}
+
+// GetStorageClass will get a StorageClass
+func (u *apiUtil) GetStorageClass(className string) (*storagev1.StorageClass, error) {
+	return u.client.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+}
+
 var _ APIUtil = &FakeAPIUtil{}
 
 // FakeAPIUtil is a fake API wrapper for unit testing
 type FakeAPIUtil struct {
+	mutex      sync.Mutex
 	createdPVs map[string]*v1.PersistentVolume
+	updatedPVs map[string]*v1.PersistentVolume
 	deletedPVs map[string]*v1.PersistentVolume
 	shouldFail bool
-	cache      *cache.VolumeCache
+	// Number of remaining CreatePV calls that fail before succeeding
+	transientFailures int
+	// Number of remaining DeletePV calls that fail before succeeding
+	deleteTransientFailures int
+	// Time each DeletePV call takes, and the number of calls in progress
+	deleteDelay        time.Duration
+	deletesInFlight    int
+	maxDeletesInFlight int
+	cache              *cache.VolumeCache
+	// PVs returned by GetPV instead of the cached ones
+	serverPVs      map[string]*v1.PersistentVolume
+	nodes          map[string]*v1.Node
+	storageClasses map[string]*storagev1.StorageClass
 }
 
 // NewFakeAPIUtil returns an APIUtil object that can be used for unit testing
 func NewFakeAPIUtil(shouldFail bool, cache *cache.VolumeCache) *FakeAPIUtil {
 	return &FakeAPIUtil{
-		createdPVs: map[string]*v1.PersistentVolume{},
-		deletedPVs: map[string]*v1.PersistentVolume{},
-		shouldFail: shouldFail,
-		cache:      cache,
+		createdPVs:     map[string]*v1.PersistentVolume{},
+		updatedPVs:     map[string]*v1.PersistentVolume{},
+		deletedPVs:     map[string]*v1.PersistentVolume{},
+		shouldFail:     shouldFail,
+		cache:          cache,
+		serverPVs:      map[string]*v1.PersistentVolume{},
+		nodes:          map[string]*v1.Node{},
+		storageClasses: map[string]*storagev1.StorageClass{},
 	}
 }
 
-// CreatePV will add the PV to the created list and cache
+// CreatePV will add the PV to the created list and cache, or fail if the cache already has
+// it or it was set with SetServerPV
 func (u *FakeAPIUtil) CreatePV(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
 	if u.shouldFail {
 		return nil, fmt.Errorf("API failed")
 	}
+	if u.transientFailures > 0 {
+		u.transientFailures--
+		return nil, fmt.Errorf("API transiently failed")
+	}
+	_, onServer := u.serverPVs[pv.Name]
+	if _, exists := u.cache.GetPV(pv.Name); exists || onServer {
+		return nil, errors.NewAlreadyExists(v1.Resource("persistentvolumes"), pv.Name)
+	}
 
 	u.createdPVs[pv.Name] = pv
 	u.cache.AddPV(pv)
 	return pv, nil
 }
 
+// UpdatePV will add the PV to the updated list and update it in the cache
+func (u *FakeAPIUtil) UpdatePV(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.shouldFail {
+		return nil, fmt.Errorf("API failed")
+	}
+	if _, exists := u.cache.GetPV(pv.Name); !exists {
+		if _, adoptable := u.cache.GetAdoptablePV(pv.Name); !adoptable {
+			return nil, errors.NewNotFound(v1.Resource("persistentvolumes"), pv.Name)
+		}
+		// Added to the cache like the populator does once the PV is adopted
+		u.updatedPVs[pv.Name] = pv
+		u.cache.AddPV(pv)
+		return pv, nil
+	}
+
+	u.updatedPVs[pv.Name] = pv
+	u.cache.UpdatePV(pv)
+	return pv, nil
+}
+
 // DeletePV will delete the PV from the created list and cache, and also add it to the deleted list
 func (u *FakeAPIUtil) DeletePV(pvName string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.deleteDelay > 0 {
+		u.deletesInFlight++
+		if u.deletesInFlight > u.maxDeletesInFlight {
+			u.maxDeletesInFlight = u.deletesInFlight
+		}
+		u.mutex.Unlock()
+		time.Sleep(u.deleteDelay)
+		u.mutex.Lock()
+		u.deletesInFlight--
+	}
+
 	if u.shouldFail {
 		return fmt.Errorf("API failed")
 	}
+	if u.deleteTransientFailures > 0 {
+		u.deleteTransientFailures--
+		return fmt.Errorf("API transiently failed")
+	}
 
+	delete(u.serverPVs, pvName)
 	pv, exists := u.cache.GetPV(pvName)
 	if exists {
 		u.deletedPVs[pvName] = pv
@@ -102,17 +225,164 @@ func (u *FakeAPIUtil) DeletePV(pvName string) error {
 	return nil
 }
 
+// GetPV returns the PV set with SetServerPV, or else the cached PV
+func (u *FakeAPIUtil) GetPV(pvName string) (*v1.PersistentVolume, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.shouldFail {
+		return nil, fmt.Errorf("API failed")
+	}
+	if pv, found := u.serverPVs[pvName]; found {
+		return pv, nil
+	}
+	if pv, found := u.cache.GetPV(pvName); found {
+		return pv, nil
+	}
+	return nil, errors.NewNotFound(v1.Resource("persistentvolumes"), pvName)
+}
+
+// ListPVs returns the cached PVs, replaced by the ones set with SetServerPV
+func (u *FakeAPIUtil) ListPVs() ([]*v1.PersistentVolume, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.shouldFail {
+		return nil, fmt.Errorf("API failed")
+	}
+	pvs := []*v1.PersistentVolume{}
+	for _, pv := range u.cache.ListPVs() {
+		if serverPV, found := u.serverPVs[pv.Name]; found {
+			pv = serverPV
+		}
+		pvs = append(pvs, pv)
+	}
+	return pvs, nil
+}
+
+// SetServerPV makes GetPV return pv instead of the cached PV, like an update that the
+// informer hasn't delivered yet, e.g. a PVC that was just bound to it
+// This is only for testing
+func (u *FakeAPIUtil) SetServerPV(pv *v1.PersistentVolume) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.serverPVs[pv.Name] = pv
+}
+
+// GetNode returns the node set with SetNode
+func (u *FakeAPIUtil) GetNode(nodeName string) (*v1.Node, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.shouldFail {
+		return nil, fmt.Errorf("API failed")
+	}
+	node, exists := u.nodes[nodeName]
+	if !exists {
+		return nil, errors.NewNotFound(v1.Resource("nodes"), nodeName)
+	}
+	return node, nil
+}
+
+// SetNode adds or replaces the node returned by GetNode
+// This is only for testing
+func (u *FakeAPIUtil) SetNode(node *v1.Node) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.nodes[node.Name] = node
+}
+
+// GetStorageClass returns the storage class set with SetStorageClass
+func (u *FakeAPIUtil) GetStorageClass(className string) (*storagev1.StorageClass, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.shouldFail {
+		return nil, fmt.Errorf("API failed")
+	}
+	class, exists := u.storageClasses[className]
+	if !exists {
+		return nil, errors.NewNotFound(storagev1.Resource("storageclasses"), className)
+	}
+	return class, nil
+}
+
+// SetStorageClass adds or replaces the storage class returned by GetStorageClass
+// This is only for testing
+func (u *FakeAPIUtil) SetStorageClass(class *storagev1.StorageClass) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.storageClasses[class.Name] = class
+}
+
+// SetTransientFailures makes the next count CreatePV calls fail
+// This is only for testing
+func (u *FakeAPIUtil) SetTransientFailures(count int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.transientFailures = count
+}
+
+// SetTransientDeleteFailures makes the next count DeletePV calls fail
+// This is only for testing
+func (u *FakeAPIUtil) SetTransientDeleteFailures(count int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.deleteTransientFailures = count
+}
+
+// SetDeleteDelay makes each DeletePV call take delay, so that concurrent calls overlap
+// This is only for testing
+func (u *FakeAPIUtil) SetDeleteDelay(delay time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.deleteDelay = delay
+}
+
+// GetMaxConcurrentDeletes returns the most DeletePV calls that were in progress at once,
+// with SetDeleteDelay
+// This is only for testing
+func (u *FakeAPIUtil) GetMaxConcurrentDeletes() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.maxDeletesInFlight
+}
+
 // GetAndResetCreatedPVs returns createdPVs and resets the map
 // This is only for testing
 func (u *FakeAPIUtil) GetAndResetCreatedPVs() map[string]*v1.PersistentVolume {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
 	createdPVs := u.createdPVs
 	u.createdPVs = map[string]*v1.PersistentVolume{}
 	return createdPVs
 }
 
+// GetAndResetUpdatedPVs returns updatedPVs and resets the map
+// This is only for testing
+func (u *FakeAPIUtil) GetAndResetUpdatedPVs() map[string]*v1.PersistentVolume {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	updatedPVs := u.updatedPVs
+	u.updatedPVs = map[string]*v1.PersistentVolume{}
+	return updatedPVs
+}
+
 // GetAndResetDeletedPVs returns createdPVs and resets the map
 // This is only for testing
 func (u *FakeAPIUtil) GetAndResetDeletedPVs() map[string]*v1.PersistentVolume {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
 	deletedPVs := u.deletedPVs
 	u.deletedPVs = map[string]*v1.PersistentVolume{}
 	return deletedPVs
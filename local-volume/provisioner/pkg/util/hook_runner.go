@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// HookRunner runs external hook commands
+type HookRunner interface {
+	// Run runs the command with args until it exits or ctx is done. A non-zero exit
+	// status is an error.
+	Run(ctx context.Context, command string, args ...string) error
+}
+
+var _ HookRunner = &execHookRunner{}
+
+type execHookRunner struct{}
+
+// NewHookRunner returns a HookRunner that executes the commands
+func NewHookRunner() HookRunner {
+	return &execHookRunner{}
+}
+
+// Run executes the command, its output is included in the returned error
+func (r *execHookRunner) Run(ctx context.Context, command string, args ...string) error {
+	output, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("%v, output: %q", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+var _ HookRunner = &FakeHookRunner{}
+
+// FakeHookRunner records the hook runs instead of executing the commands
+type FakeHookRunner struct {
+	mutex sync.Mutex
+	runs  [][]string
+	err   error
+}
+
+// NewFakeHookRunner returns a FakeHookRunner whose runs succeed
+func NewFakeHookRunner() *FakeHookRunner {
+	return &FakeHookRunner{}
+}
+
+// SetError makes the following runs fail with err, nil makes them succeed
+func (r *FakeHookRunner) SetError(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.err = err
+}
+
+// Run records the command and args
+func (r *FakeHookRunner) Run(ctx context.Context, command string, args ...string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.runs = append(r.runs, append([]string{command}, args...))
+	return r.err
+}
+
+// GetRuns returns the command and args of every run
+func (r *FakeHookRunner) GetRuns() [][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.runs
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// RateLimiter limits the rate of K8s API calls
+type RateLimiter interface {
+	// Wait blocks until the next API call is allowed, or ctx is done
+	Wait(ctx context.Context) error
+}
+
+var _ RateLimiter = &tokenBucketRateLimiter{}
+
+type tokenBucketRateLimiter struct {
+	bucket *ratelimit.Bucket
+}
+
+// NewRateLimiter returns a token bucket RateLimiter allowing qps calls per second with
+// the given burst. If qps is zero or less, calls are not limited.
+func NewRateLimiter(qps float64, burst int) RateLimiter {
+	if qps <= 0 {
+		return &unlimitedRateLimiter{}
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucketRateLimiter{bucket: ratelimit.NewBucketWithRate(qps, int64(burst))}
+}
+
+// Wait blocks until a token is available, or ctx is done
+func (l *tokenBucketRateLimiter) Wait(ctx context.Context) error {
+	delay := l.bucket.Take(1)
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var _ RateLimiter = &unlimitedRateLimiter{}
+
+type unlimitedRateLimiter struct{}
+
+// Wait returns immediately unless ctx is already done
+func (l *unlimitedRateLimiter) Wait(ctx context.Context) error {
+	return ctx.Err()
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		qps   float64
+		burst int
+		calls int
+		// canceled cancels ctx before the calls, cancelAfter while they wait
+		canceled    bool
+		cancelAfter time.Duration
+		expectErr   bool
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		{
+			name:        "zero qps is unlimited",
+			qps:         0,
+			calls:       1000,
+			maxDuration: time.Second,
+		},
+		{
+			name:        "negative qps is unlimited",
+			qps:         -1,
+			calls:       1000,
+			maxDuration: time.Second,
+		},
+		{
+			name:        "burst is not limited",
+			qps:         1,
+			burst:       5,
+			calls:       5,
+			maxDuration: 500 * time.Millisecond,
+		},
+		{
+			name:        "limited after burst",
+			qps:         20,
+			burst:       1,
+			calls:       4,
+			minDuration: 100 * time.Millisecond,
+			maxDuration: 2 * time.Second,
+		},
+		{
+			name:        "cancel while waiting",
+			qps:         0.1,
+			burst:       1,
+			calls:       2,
+			cancelAfter: 50 * time.Millisecond,
+			expectErr:   true,
+			minDuration: 50 * time.Millisecond,
+			maxDuration: 2 * time.Second,
+		},
+		{
+			name:        "unlimited with done ctx",
+			qps:         0,
+			calls:       1,
+			canceled:    true,
+			expectErr:   true,
+			maxDuration: time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Logf("Test %q", test.name)
+		limiter := NewRateLimiter(test.qps, test.burst)
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.canceled {
+			cancel()
+		}
+		if test.cancelAfter > 0 {
+			time.AfterFunc(test.cancelAfter, cancel)
+		}
+
+		start := time.Now()
+		var err error
+		for i := 0; i < test.calls && err == nil; i++ {
+			err = limiter.Wait(ctx)
+		}
+		elapsed := time.Since(start)
+		cancel()
+
+		if test.expectErr && err == nil {
+			t.Errorf("Expected an error")
+		}
+		if !test.expectErr && err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if elapsed < test.minDuration {
+			t.Errorf("Expected %d calls to take at least %v, took %v", test.calls, test.minDuration, elapsed)
+		}
+		if elapsed > test.maxDuration {
+			t.Errorf("Expected %d calls to take at most %v, took %v", test.calls, test.maxDuration, elapsed)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TimeoutError is the error of a call that timed out, or that failed immediately because
+// a previous call on the same path is still hung
+type TimeoutError struct {
+	Op      string
+	Path    string
+	Timeout time.Duration
+	// True if the call failed immediately
+	Hung bool
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Hung {
+		return fmt.Sprintf("%s of %q is still hung after timing out", e.Op, e.Path)
+	}
+	return fmt.Sprintf("%s of %q timed out after %v", e.Op, e.Path, e.Timeout)
+}
+
+// IsTimeout returns true if err is a TimeoutError
+func IsTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+var _ VolumeUtil = &timeoutVolumeUtil{}
+
+// timeoutVolumeUtil fails the filesystem stat and listing calls of a VolumeUtil that
+// don't return within the timeout, e.g. on a hung mount. Calls that modify volumes,
+// like DeleteContents and WipeBlock, are not abandoned and go to the VolumeUtil as is.
+type timeoutVolumeUtil struct {
+	VolumeUtil
+	timeout time.Duration
+
+	mutex sync.Mutex
+	// Paths with a call that timed out and hasn't returned yet, by method
+	hung map[string]bool
+}
+
+// NewTimeoutVolumeUtil returns a VolumeUtil that runs the filesystem stat and listing
+// calls of volUtil in the background, and returns an error if they take longer than
+// timeout. A call is abandoned when it times out, and until it returns, the following
+// calls of the same method on the same path fail immediately, so that a hung path
+// doesn't pile up goroutines.
+func NewTimeoutVolumeUtil(volUtil VolumeUtil, timeout time.Duration) VolumeUtil {
+	return &timeoutVolumeUtil{
+		VolumeUtil: volUtil,
+		timeout:    timeout,
+		hung:       map[string]bool{},
+	}
+}
+
+// run runs f in the background until it returns or the timeout expires
+func (u *timeoutVolumeUtil) run(op, fullPath string, f func() error) error {
+	key := op + fullPath
+	u.mutex.Lock()
+	if u.hung[key] {
+		u.mutex.Unlock()
+		return &TimeoutError{Op: op, Path: fullPath, Timeout: u.timeout, Hung: true}
+	}
+	u.mutex.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := f()
+		u.mutex.Lock()
+		if u.hung[key] {
+			glog.Infof("%s of %q returned after timing out", op, fullPath)
+			delete(u.hung, key)
+		}
+		u.mutex.Unlock()
+		done <- err
+	}()
+
+	timer := time.NewTimer(u.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	select {
+	case err := <-done:
+		// Returned while the timer fired
+		return err
+	default:
+	}
+	u.hung[key] = true
+	glog.Warningf("%s of %q timed out after %v, skipping it", op, fullPath, u.timeout)
+	return &TimeoutError{Op: op, Path: fullPath, Timeout: u.timeout}
+}
+
+func (u *timeoutVolumeUtil) runBool(op, fullPath string, f func(string) (bool, error)) (bool, error) {
+	var result bool
+	err := u.run(op, fullPath, func() (err error) {
+		result, err = f(fullPath)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+func (u *timeoutVolumeUtil) runInt64(op, fullPath string, f func(string) (int64, error)) (int64, error) {
+	var result int64
+	err := u.run(op, fullPath, func() (err error) {
+		result, err = f(fullPath)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+func (u *timeoutVolumeUtil) runString(op, fullPath string, f func(string) (string, error)) (string, error) {
+	var result string
+	err := u.run(op, fullPath, func() (err error) {
+		result, err = f(fullPath)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// IsDir checks if the given path is a directory
+func (u *timeoutVolumeUtil) IsDir(fullPath string) (bool, error) {
+	return u.runBool("IsDir", fullPath, u.VolumeUtil.IsDir)
+}
+
+// IsBlock checks if the given path is a block device
+func (u *timeoutVolumeUtil) IsBlock(fullPath string) (bool, error) {
+	return u.runBool("IsBlock", fullPath, u.VolumeUtil.IsBlock)
+}
+
+// IsMountPoint checks if the given path is a mount point
+func (u *timeoutVolumeUtil) IsMountPoint(fullPath string) (bool, error) {
+	return u.runBool("IsMountPoint", fullPath, u.VolumeUtil.IsMountPoint)
+}
+
+// ReadDir returns a list of files under the specified directory
+func (u *timeoutVolumeUtil) ReadDir(fullPath string) ([]string, error) {
+	var files []string
+	err := u.run("ReadDir", fullPath, func() (err error) {
+		files, err = u.VolumeUtil.ReadDir(fullPath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// CheckReadable checks that the directory can be listed, and its entries accessed
+func (u *timeoutVolumeUtil) CheckReadable(fullPath string) error {
+	return u.run("CheckReadable", fullPath, func() error {
+		return u.VolumeUtil.CheckReadable(fullPath)
+	})
+}
+
+// Glob returns the sorted directories matching the pattern
+func (u *timeoutVolumeUtil) Glob(pattern string) ([]string, error) {
+	var matches []string
+	err := u.run("Glob", pattern, func() (err error) {
+		matches, err = u.VolumeUtil.Glob(pattern)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// Exists checks if the given path exists
+func (u *timeoutVolumeUtil) Exists(fullPath string) (bool, error) {
+	return u.runBool("Exists", fullPath, u.VolumeUtil.Exists)
+}
+
+// EvalSymlinks returns the path name after resolving any symlinks
+func (u *timeoutVolumeUtil) EvalSymlinks(fullPath string) (string, error) {
+	return u.runString("EvalSymlinks", fullPath, u.VolumeUtil.EvalSymlinks)
+}
+
+// GetFsCapacityByte returns the capacity of the fs on full path
+func (u *timeoutVolumeUtil) GetFsCapacityByte(fullPath string) (int64, error) {
+	return u.runInt64("GetFsCapacityByte", fullPath, u.VolumeUtil.GetFsCapacityByte)
+}
+
+// GetFsInodes returns the total and free inodes of the fs on full path
+func (u *timeoutVolumeUtil) GetFsInodes(fullPath string) (int64, int64, error) {
+	var inodes, free int64
+	err := u.run("GetFsInodes", fullPath, func() (err error) {
+		inodes, free, err = u.VolumeUtil.GetFsInodes(fullPath)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return inodes, free, nil
+}
+
+// GetQuotaCapacityByte returns the project quota limit of the directory
+func (u *timeoutVolumeUtil) GetQuotaCapacityByte(fullPath string) (int64, error) {
+	return u.runInt64("GetQuotaCapacityByte", fullPath, u.VolumeUtil.GetQuotaCapacityByte)
+}
+
+// GetLoopbackBackingFile returns the backing file of the loop device of full path
+func (u *timeoutVolumeUtil) GetLoopbackBackingFile(fullPath string) (string, error) {
+	return u.runString("GetLoopbackBackingFile", fullPath, u.VolumeUtil.GetLoopbackBackingFile)
+}
+
+// GetAllocatedByte returns the bytes allocated on disk for the file
+func (u *timeoutVolumeUtil) GetAllocatedByte(fullPath string) (int64, error) {
+	return u.runInt64("GetAllocatedByte", fullPath, u.VolumeUtil.GetAllocatedByte)
+}
+
+// GetFsType returns the type of the fs that full path is on
+func (u *timeoutVolumeUtil) GetFsType(fullPath string) (string, error) {
+	return u.runString("GetFsType", fullPath, u.VolumeUtil.GetFsType)
+}
+
+// IsReadOnly checks if the fs that full path is on is mounted read-only
+func (u *timeoutVolumeUtil) IsReadOnly(fullPath string) (bool, error) {
+	return u.runBool("IsReadOnly", fullPath, u.VolumeUtil.IsReadOnly)
+}
+
+// IsTmpfs checks if the fs that full path is on is a tmpfs
+func (u *timeoutVolumeUtil) IsTmpfs(fullPath string) (bool, error) {
+	return u.runBool("IsTmpfs", fullPath, u.VolumeUtil.IsTmpfs)
+}
+
+// GetBlockCapacityByte returns the capacity of the block device
+func (u *timeoutVolumeUtil) GetBlockCapacityByte(fullPath string) (int64, error) {
+	return u.runInt64("GetBlockCapacityByte", fullPath, u.VolumeUtil.GetBlockCapacityByte)
+}
+
+// GetDeviceID returns a stable identifier of the block device hardware
+func (u *timeoutVolumeUtil) GetDeviceID(fullPath string) (string, error) {
+	return u.runString("GetDeviceID", fullPath, u.VolumeUtil.GetDeviceID)
+}
+
+// ReadFile returns the contents of a small file
+func (u *timeoutVolumeUtil) ReadFile(fullPath string) ([]byte, error) {
+	var content []byte
+	err := u.run("ReadFile", fullPath, func() (err error) {
+		content, err = u.VolumeUtil.ReadFile(fullPath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// HasPartitions checks if the block device is a whole disk with partitions
+func (u *timeoutVolumeUtil) HasPartitions(fullPath string) (bool, error) {
+	return u.runBool("HasPartitions", fullPath, u.VolumeUtil.HasPartitions)
+}
+
+// GetModTime returns the modification time of the given path
+func (u *timeoutVolumeUtil) GetModTime(fullPath string) (time.Time, error) {
+	var modTime time.Time
+	err := u.run("GetModTime", fullPath, func() (err error) {
+		modTime, err = u.VolumeUtil.GetModTime(fullPath)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return modTime, nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// LogFormatText logs the volume events with glog
+	LogFormatText = "text"
+	// LogFormatJSON logs the volume events as JSON lines
+	LogFormatJSON = "json"
+)
+
+const (
+	// VolumeEventDiscovered is logged when a new volume is found
+	VolumeEventDiscovered = "discovered"
+	// VolumeEventCreated is logged when the PV of a volume is created
+	VolumeEventCreated = "created"
+	// VolumeEventDeleted is logged when the PV of a volume is cleaned up and deleted
+	VolumeEventDeleted = "deleted"
+	// VolumeEventMissingMedia is logged when the volume of a bound PV is missing
+	VolumeEventMissingMedia = "missing-media"
+)
+
+// VolumeEvent describes a lifecycle event of a local volume
+type VolumeEvent struct {
+	Event    string `json:"event"`
+	Class    string `json:"class,omitempty"`
+	PVName   string `json:"pvName,omitempty"`
+	HostPath string `json:"hostPath,omitempty"`
+	Capacity int64  `json:"capacity,omitempty"`
+	Node     string `json:"node,omitempty"`
+}
+
+// VolumeLogger logs the lifecycle events of local volumes
+type VolumeLogger interface {
+	// Info logs an informational event, msg is the message of the text format
+	Info(event *VolumeEvent, msg string)
+	// Warning logs a warning event, msg is the message of the text format
+	Warning(event *VolumeEvent, msg string)
+}
+
+// NewVolumeLogger returns a VolumeLogger for the format. JSON lines are written to out.
+// An empty format means the text format.
+func NewVolumeLogger(format string, out io.Writer) (VolumeLogger, error) {
+	switch format {
+	case "", LogFormatText:
+		return &textVolumeLogger{}, nil
+	case LogFormatJSON:
+		return &jsonVolumeLogger{out: out}, nil
+	}
+	return nil, fmt.Errorf("Unsupported log format %q", format)
+}
+
+var _ VolumeLogger = &textVolumeLogger{}
+
+type textVolumeLogger struct{}
+
+// Info logs msg with glog, attributed to the caller
+func (l *textVolumeLogger) Info(event *VolumeEvent, msg string) {
+	glog.InfoDepth(1, msg)
+}
+
+// Warning logs msg with glog, attributed to the caller
+func (l *textVolumeLogger) Warning(event *VolumeEvent, msg string) {
+	glog.WarningDepth(1, msg)
+}
+
+var _ VolumeLogger = &jsonVolumeLogger{}
+
+type jsonVolumeLogger struct {
+	// Serializes the writes of the lines
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+type jsonLogLine struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	*VolumeEvent
+	Msg string `json:"msg"`
+}
+
+// Info writes the event as a JSON line
+func (l *jsonVolumeLogger) Info(event *VolumeEvent, msg string) {
+	l.write("info", event, msg)
+}
+
+// Warning writes the event as a JSON line
+func (l *jsonVolumeLogger) Warning(event *VolumeEvent, msg string) {
+	l.write("warning", event, msg)
+}
+
+func (l *jsonVolumeLogger) write(level string, event *VolumeEvent, msg string) {
+	line, err := json.Marshal(&jsonLogLine{
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       level,
+		VolumeEvent: event,
+		Msg:         msg,
+	})
+	if err != nil {
+		glog.Errorf("Error encoding volume event %+v: %v", event, err)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		glog.Errorf("Error writing volume event: %v", err)
+	}
+}
@@ -17,13 +17,21 @@ limitations under the License.
 package util
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
+	"k8s.io/kubernetes/pkg/util/mount"
 	"k8s.io/kubernetes/pkg/volume/util"
 	"unsafe"
 )
@@ -33,20 +41,83 @@ type VolumeUtil interface {
 	// IsDir checks if the given path is a directory
 	IsDir(fullPath string) (bool, error)
 
-	// IsBlock checks if the given path is a directory
+	// IsBlock checks if the given path is a block device
 	IsBlock(fullPath string) (bool, error)
 
+	// IsMountPoint checks if the given path is a mount point
+	IsMountPoint(fullPath string) (bool, error)
+
 	// ReadDir returns a list of files under the specified directory
 	ReadDir(fullPath string) ([]string, error)
 
+	// CheckReadable checks that the directory can be listed, and its entries accessed
+	CheckReadable(fullPath string) error
+
+	// Glob returns the sorted directories matching the pattern, as used by filepath.Match
+	Glob(pattern string) ([]string, error)
+
+	// Exists checks if the given path exists
+	Exists(fullPath string) (bool, error)
+
+	// EvalSymlinks returns the path name after resolving any symlinks
+	EvalSymlinks(fullPath string) (string, error)
+
 	// Delete all the contents under the given path, but not the path itself
 	DeleteContents(fullPath string) error
 
+	// Remove the given directory if it is empty, non-empty directories and other files
+	// are never removed
+	RemoveDir(fullPath string) error
+
 	// Get capacity for fs on full path
 	GetFsCapacityByte(fullPath string) (int64, error)
 
+	// Get the total and free inodes of the fs on full path
+	GetFsInodes(fullPath string) (inodes, free int64, err error)
+
+	// Get the project quota limit of the directory
+	GetQuotaCapacityByte(fullPath string) (int64, error)
+
+	// Get the backing file of the loop device that full path is mounted from, empty if
+	// it is not on a loop device
+	GetLoopbackBackingFile(fullPath string) (string, error)
+
+	// Get the bytes allocated on disk for the file, less than its size if it is sparse
+	GetAllocatedByte(fullPath string) (int64, error)
+
+	// Get type of the fs that full path is on
+	GetFsType(fullPath string) (string, error)
+
+	// IsReadOnly checks if the fs that full path is on is mounted read-only
+	IsReadOnly(fullPath string) (bool, error)
+
+	// IsTmpfs checks if the fs that full path is on is a tmpfs
+	IsTmpfs(fullPath string) (bool, error)
+
 	// Get capacity of the block device
 	GetBlockCapacityByte(fullPath string) (int64, error)
+
+	// Overwrite the whole block device with zeros
+	WipeBlock(ctx context.Context, fullPath string) error
+
+	// Get a stable identifier of the block device hardware, empty if it has none
+	GetDeviceID(fullPath string) (string, error)
+
+	// HasPartitions checks if the block device is a whole disk with partitions
+	HasPartitions(fullPath string) (bool, error)
+
+	// ProbeHealth checks that the volume can be read, until it's done or ctx is done
+	ProbeHealth(ctx context.Context, fullPath string) error
+
+	// GetModTime returns the modification time of the given path, following symlinks
+	GetModTime(fullPath string) (time.Time, error)
+
+	// ReadFile returns the contents of a small file, up to maxReadFileSize bytes
+	ReadFile(fullPath string) ([]byte, error)
+	// WriteFile creates the file with the contents, it fails if the file exists
+	WriteFile(fullPath string, data []byte) error
+	// RemoveFile removes the file, directories are never removed
+	RemoveFile(fullPath string) error
 }
 
 var _ VolumeUtil = &volumeUtil{}
@@ -74,10 +145,11 @@ func (u *volumeUtil) IsDir(fullPath string) (bool, error) {
 	return stat.IsDir(), nil
 }
 
-// IsBlock checks if the given path is a block device
+// IsBlock checks if the given path is a block device. Symlinks are followed, including
+// the dangling links of device-mapper devices, see devicePath.
 func (u *volumeUtil) IsBlock(fullPath string) (bool, error) {
 	var st unix.Stat_t
-	err := unix.Stat(fullPath, &st)
+	err := unix.Stat(devicePath(fullPath), &st)
 	if err != nil {
 		return false, err
 	}
@@ -85,6 +157,48 @@ func (u *volumeUtil) IsBlock(fullPath string) (bool, error) {
 	return (st.Mode & unix.S_IFMT) == unix.S_IFBLK, nil
 }
 
+// maxSymlinks is the maximum number of symlinks followed by devicePath
+const maxSymlinks = 40
+
+// dmDeviceName matches the names of device-mapper devices in /dev
+var dmDeviceName = regexp.MustCompile(`^dm-[0-9]+$`)
+
+// devicePath returns the path of the block device at fullPath. The /dev/mapper/<vg>-<lv>
+// and /dev/<vg>/<lv> links of device-mapper and LVM volumes are relative links to
+// ../dm-<N>, which dangle if only the directory of the links is mounted in the container.
+// If following the links of fullPath ends at such a missing dm-<N> device, /dev/dm-<N>
+// is returned instead, otherwise fullPath.
+func devicePath(fullPath string) string {
+	path := fullPath
+	for i := 0; i < maxSymlinks; i++ {
+		target, err := os.Readlink(path)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	if path == fullPath || !dmDeviceName.MatchString(filepath.Base(path)) {
+		return fullPath
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return fullPath
+	}
+	return filepath.Join("/dev", filepath.Base(path))
+}
+
+// IsMountPoint checks if the given path is a mount point. Bind mounts on the same
+// filesystem are not detected.
+func (u *volumeUtil) IsMountPoint(fullPath string) (bool, error) {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(fullPath)
+	if err != nil {
+		return false, err
+	}
+	return !notMnt, nil
+}
+
 // ReadDir returns a list all the files under the given directory
 func (u *volumeUtil) ReadDir(fullPath string) ([]string, error) {
 	dir, err := os.Open(fullPath)
@@ -100,6 +214,128 @@ func (u *volumeUtil) ReadDir(fullPath string) ([]string, error) {
 	return files, nil
 }
 
+// CheckReadable checks that the directory can be opened and listed, and that the first
+// entry, if any, can be stat'ed, which needs the search permission of the directory
+func (u *volumeUtil) CheckReadable(fullPath string) error {
+	dir, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(names) > 0 {
+		if _, err := os.Lstat(filepath.Join(fullPath, names[0])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetModTime returns the modification time of the given path, following symlinks
+func (u *volumeUtil) GetModTime(fullPath string) (time.Time, error) {
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
+
+// maxReadFileSize is the maximum number of bytes returned by ReadFile, so that a large
+// file in place of a small config file isn't read in whole
+const maxReadFileSize = 4096
+
+// ReadFile returns the first maxReadFileSize bytes of the file
+func (u *volumeUtil) ReadFile(fullPath string) ([]byte, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(io.LimitReader(file, maxReadFileSize))
+}
+
+// healthProbeSize is the number of bytes read from the start of a block device by ProbeHealth
+const healthProbeSize = 4096
+
+// ProbeHealth reads the start of a block device, or lists a directory and stats its fs.
+// A read that hangs on a failing disk can't be interrupted, so it's left running in the
+// background once ctx is done.
+func (u *volumeUtil) ProbeHealth(ctx context.Context, fullPath string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- probeHealth(fullPath)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("health probe of %q: %v", fullPath, ctx.Err())
+	}
+}
+
+func probeHealth(fullPath string) error {
+	file, err := os.Open(devicePath(fullPath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		if _, err := file.Readdirnames(1); err != nil && err != io.EOF {
+			return err
+		}
+		var statfs unix.Statfs_t
+		if err := unix.Fstatfs(int(file.Fd()), &statfs); err != nil {
+			return &os.PathError{Op: "statfs", Path: fullPath, Err: err}
+		}
+		return nil
+	}
+	if _, err := file.ReadAt(make([]byte, healthProbeSize), 0); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Glob returns the directories matching the pattern, following symlinks
+func (u *volumeUtil) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{}
+	for _, match := range matches {
+		if stat, err := os.Stat(match); err == nil && stat.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+	return dirs, nil
+}
+
+// Exists checks if the given path exists
+func (u *volumeUtil) Exists(fullPath string) (bool, error) {
+	_, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// EvalSymlinks returns the path name after resolving any symlinks
+func (u *volumeUtil) EvalSymlinks(fullPath string) (string, error) {
+	return filepath.EvalSymlinks(fullPath)
+}
+
 // DeleteContents deletes all the contents under the given directory
 func (u *volumeUtil) DeleteContents(fullPath string) error {
 	dir, err := os.Open(fullPath)
@@ -123,6 +359,36 @@ func (u *volumeUtil) DeleteContents(fullPath string) error {
 	return nil
 }
 
+// WriteFile creates the file with the contents, it fails if the file exists
+func (u *volumeUtil) WriteFile(fullPath string, data []byte) error {
+	f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RemoveFile removes the file with unlink, which fails for directories
+func (u *volumeUtil) RemoveFile(fullPath string) error {
+	if err := unix.Unlink(fullPath); err != nil {
+		return &os.PathError{Op: "unlink", Path: fullPath, Err: err}
+	}
+	return nil
+}
+
+// RemoveDir removes the given directory with rmdir, which fails for non-empty
+// directories, other files and mount points
+func (u *volumeUtil) RemoveDir(fullPath string) error {
+	if err := unix.Rmdir(fullPath); err != nil {
+		return &os.PathError{Op: "rmdir", Path: fullPath, Err: err}
+	}
+	return nil
+}
+
 // GetFsCapacityByte returns capacity in bytes about a mounted filesystem.
 // fullPath is the pathname of any file within the mounted filesystem. Capacity
 // returned here is total capacity.
@@ -131,10 +397,180 @@ func (u *volumeUtil) GetFsCapacityByte(fullPath string) (int64, error) {
 	return capacity, err
 }
 
+// GetFsInodes returns the total and free inodes of the fs on full path. Filesystems that
+// allocate inodes dynamically, like btrfs, report zero.
+func (u *volumeUtil) GetFsInodes(fullPath string) (int64, int64, error) {
+	_, _, _, inodes, free, _, err := util.FsInfo(fullPath)
+	return inodes, free, err
+}
+
+// stRdonly is the ST_RDONLY statfs flag of read-only mounts
+const stRdonly = 0x1
+
+// IsReadOnly checks if the fs that full path is on is mounted read-only
+func (u *volumeUtil) IsReadOnly(fullPath string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(fullPath, &st); err != nil {
+		return false, err
+	}
+	return st.Flags&stRdonly != 0, nil
+}
+
+// tmpfsMagic is the statfs f_type of tmpfs, missing from the vendored x/sys/unix
+const tmpfsMagic = 0x01021994
+
+// IsTmpfs checks the fs magic number of the fs that full path is on, which unlike the
+// mount table also works for volumes that are bind mounted into the container
+func (u *volumeUtil) IsTmpfs(fullPath string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(fullPath, &st); err != nil {
+		return false, err
+	}
+	return st.Type == tmpfsMagic, nil
+}
+
+// GetFsType returns the type of the filesystem mounted at the closest mount point
+// containing fullPath, as listed in the mount table.
+func (u *volumeUtil) GetFsType(fullPath string) (string, error) {
+	mountPoint, err := findMountPoint(fullPath)
+	if err != nil {
+		return "", err
+	}
+	return mountPoint.Type, nil
+}
+
+// findMountPoint returns the closest mount point containing fullPath in the mount table
+func findMountPoint(fullPath string) (*mount.MountPoint, error) {
+	mountPoints, err := mount.New("").List()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *mount.MountPoint
+	for i, mp := range mountPoints {
+		rel, err := filepath.Rel(mp.Path, fullPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if found == nil || len(mp.Path) > len(found.Path) {
+			found = &mountPoints[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("No mount point found for %q", fullPath)
+	}
+	return found, nil
+}
+
+const (
+	// fsIocFsGetXattr is the FS_IOC_FSGETXATTR ioctl, which gets the project ID of a file
+	fsIocFsGetXattr = 0x801c581f
+	// qXGetQuota is the Q_XGETQUOTA quotactl command, supported by XFS and ext4
+	qXGetQuota = 0x5803
+	// prjQuota is the PRJQUOTA quota type
+	prjQuota = 2
+	// quotaBlockSize is the size of the units of the limits in fsDiskQuota
+	quotaBlockSize = 512
+)
+
+// fsxattr is struct fsxattr of linux/fs.h
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// fsDiskQuota is the beginning of struct fs_disk_quota of linux/dqblk_xfs.h, padded
+// to its full size
+type fsDiskQuota struct {
+	version      int8
+	flags        int8
+	fieldmask    uint16
+	id           uint32
+	blkHardlimit uint64
+	blkSoftlimit uint64
+	pad          [88]byte
+}
+
+// GetQuotaCapacityByte returns the block limit of the project quota of the directory in
+// bytes, i.e. the hard limit, or the soft limit if there is no hard limit. It fails if
+// the directory is not in a project, or the project has no block limit.
+func (u *volumeUtil) GetQuotaCapacityByte(fullPath string) (int64, error) {
+	dir, err := os.Open(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+
+	var attr fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return 0, fmt.Errorf("error getting the project of %q: %v", fullPath, errno)
+	}
+	if attr.projid == 0 {
+		return 0, fmt.Errorf("%q is not in a project", fullPath)
+	}
+
+	mountPoint, err := findMountPoint(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	device, err := unix.BytePtrFromString(mountPoint.Device)
+	if err != nil {
+		return 0, err
+	}
+	var quota fsDiskQuota
+	if _, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, uintptr(qXGetQuota<<8|prjQuota), uintptr(unsafe.Pointer(device)),
+		uintptr(attr.projid), uintptr(unsafe.Pointer(&quota)), 0, 0); errno != 0 {
+		return 0, fmt.Errorf("error getting the quota of project %d of %q on %q: %v", attr.projid, fullPath, mountPoint.Device, errno)
+	}
+	limit := quota.blkHardlimit
+	if limit == 0 {
+		limit = quota.blkSoftlimit
+	}
+	if limit == 0 {
+		return 0, fmt.Errorf("project %d of %q has no block limit", attr.projid, fullPath)
+	}
+	return int64(limit * quotaBlockSize), nil
+}
+
+// loopDeviceName matches the names of loop devices
+var loopDeviceName = regexp.MustCompile(`^loop[0-9]+$`)
+
+// GetLoopbackBackingFile returns the backing file of the loop device of the mount that
+// fullPath is on, as found in sysfs. The path is in the mount namespace of the host.
+func (u *volumeUtil) GetLoopbackBackingFile(fullPath string) (string, error) {
+	mountPoint, err := findMountPoint(fullPath)
+	if err != nil {
+		return "", err
+	}
+	device := filepath.Base(mountPoint.Device)
+	if filepath.Dir(mountPoint.Device) != "/dev" || !loopDeviceName.MatchString(device) {
+		return "", nil
+	}
+	backingFile, err := ioutil.ReadFile(filepath.Join("/sys/block", device, "loop", "backing_file"))
+	if err != nil {
+		return "", fmt.Errorf("error reading the backing file of %q: %v", mountPoint.Device, err)
+	}
+	return strings.TrimSpace(string(backingFile)), nil
+}
+
+// GetAllocatedByte returns the bytes of the blocks allocated for the file
+func (u *volumeUtil) GetAllocatedByte(fullPath string) (int64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(fullPath, &stat); err != nil {
+		return 0, err
+	}
+	// st_blocks is always in 512 byte units
+	return stat.Blocks * 512, nil
+}
+
 // GetBlockCapacityByte returns  capacity in bytes of a block device.
 // fullPath is the pathname of block device.
 func (u *volumeUtil) GetBlockCapacityByte(fullPath string) (int64, error) {
-	file, err := os.OpenFile(fullPath, os.O_RDONLY, 0)
+	file, err := os.OpenFile(devicePath(fullPath), os.O_RDONLY, 0)
 	if err != nil {
 		return 0, err
 	}
@@ -150,6 +586,118 @@ func (u *volumeUtil) GetBlockCapacityByte(fullPath string) (int64, error) {
 	return size, err
 }
 
+// wipeChunkSize is the size of the writes used to wipe a block device
+const wipeChunkSize = 1024 * 1024
+
+// WipeBlock overwrites the whole block device with zeros.
+// The wipe is aborted if ctx is done before it finishes.
+func (u *volumeUtil) WipeBlock(ctx context.Context, fullPath string) error {
+	size, err := u.GetBlockCapacityByte(fullPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(devicePath(fullPath), os.O_WRONLY|os.O_SYNC, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zeros := make([]byte, wipeChunkSize)
+	for written := int64(0); written < size; {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wiping %q aborted after %d of %d bytes: %v", fullPath, written, size, ctx.Err())
+		default:
+		}
+
+		chunk := zeros
+		if size-written < int64(len(chunk)) {
+			chunk = chunk[:size-written]
+		}
+		n, err := file.Write(chunk)
+		if err != nil {
+			return err
+		}
+		written += int64(n)
+	}
+	return file.Sync()
+}
+
+// deviceIDFiles are the sysfs attributes of a block device that can hold a stable
+// identifier of the hardware, relative to /sys/dev/block/<major>:<minor>, in order of preference
+var deviceIDFiles = []string{"wwid", "device/wwid", "device/serial", "serial"}
+
+// GetDeviceID returns the WWN or serial number of the block device, as reported by sysfs.
+// Partitions are identified by the device they are on. It returns an empty ID if the
+// device doesn't report any.
+func (u *volumeUtil) GetDeviceID(fullPath string) (string, error) {
+	sysPath, err := blockSysPath(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if isPartition(sysPath) {
+		sysPath = filepath.Dir(sysPath)
+	}
+
+	for _, file := range deviceIDFiles {
+		id, err := ioutil.ReadFile(filepath.Join(sysPath, file))
+		if err != nil {
+			continue
+		}
+		if trimmed := strings.TrimSpace(string(id)); trimmed != "" {
+			return trimmed, nil
+		}
+	}
+	return "", nil
+}
+
+// HasPartitions checks if the block device is a whole disk with partitions, i.e. its
+// directory under /sys/block has subdirectories of partitions. Partitions never have
+// partitions themselves.
+func (u *volumeUtil) HasPartitions(fullPath string) (bool, error) {
+	sysPath, err := blockSysPath(fullPath)
+	if err != nil {
+		return false, err
+	}
+	if isPartition(sysPath) {
+		return false, nil
+	}
+	entries, err := ioutil.ReadDir(sysPath)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && isPartition(filepath.Join(sysPath, entry.Name())) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// blockSysPath returns the sysfs directory of the block device, with symlinks resolved
+func blockSysPath(fullPath string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(devicePath(fullPath), &st); err != nil {
+		return "", err
+	}
+	if (st.Mode & unix.S_IFMT) != unix.S_IFBLK {
+		return "", fmt.Errorf("%q is not a block device", fullPath)
+	}
+
+	// Decode the device number the same way as glibc's gnu_dev_major and gnu_dev_minor
+	dev := uint64(st.Rdev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+	return filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+}
+
+// isPartition checks if the sysfs directory of a block device is the one of a partition
+func isPartition(sysPath string) bool {
+	_, err := os.Stat(filepath.Join(sysPath, "partition"))
+	return err == nil
+}
+
 var _ VolumeUtil = &FakeVolumeUtil{}
 
 // FakeVolumeUtil is a stub interface for unit testing
@@ -158,6 +706,12 @@ type FakeVolumeUtil struct {
 	directoryFiles map[string][]*FakeDirEntry
 	// True if DeleteContents should fail
 	deleteShouldFail bool
+	// Errors returned by the methods for the given paths, key = method + path
+	errors map[string]error
+	// Duration of the capacity probes, to simulate slow disks
+	capacityDelay time.Duration
+	// Targets of the fake bind mounts, key = source path
+	bindMounts map[string]string
 }
 
 const (
@@ -169,6 +723,43 @@ const (
 	FakeEntryUnknown = "unknown"
 )
 
+const (
+	// FakeOpReadDir is the ReadDir method, for SetError
+	FakeOpReadDir = "ReadDir"
+	// FakeOpIsDir is the IsDir method, for SetError
+	FakeOpIsDir = "IsDir"
+	// FakeOpIsBlock is the IsBlock method, for SetError
+	FakeOpIsBlock = "IsBlock"
+	// FakeOpGetFsCapacityByte is the GetFsCapacityByte method, for SetError
+	FakeOpGetFsCapacityByte = "GetFsCapacityByte"
+	// FakeOpGetBlockCapacityByte is the GetBlockCapacityByte method, for SetError
+	FakeOpGetBlockCapacityByte = "GetBlockCapacityByte"
+	// FakeOpGetFsType is the GetFsType method, for SetError
+	FakeOpGetFsType = "GetFsType"
+	// FakeOpGetQuotaCapacityByte is the GetQuotaCapacityByte method, for SetError
+	FakeOpGetQuotaCapacityByte = "GetQuotaCapacityByte"
+	// FakeOpGetAllocatedByte is the GetAllocatedByte method, for SetError
+	FakeOpGetAllocatedByte = "GetAllocatedByte"
+	// FakeOpRemoveDir is the RemoveDir method, for SetError
+	FakeOpRemoveDir = "RemoveDir"
+	// FakeOpCheckReadable is the CheckReadable method, for SetError
+	FakeOpCheckReadable = "CheckReadable"
+	// FakeOpProbeHealth is the ProbeHealth method, for SetError
+	FakeOpProbeHealth = "ProbeHealth"
+	// FakeOpGetModTime is the GetModTime method, for SetError
+	FakeOpGetModTime = "GetModTime"
+	// FakeOpHasPartitions is the HasPartitions method, for SetError
+	FakeOpHasPartitions = "HasPartitions"
+	// FakeOpReadFile is the ReadFile method, for SetError
+	FakeOpReadFile = "ReadFile"
+	// FakeOpGetFsInodes is the GetFsInodes method, for SetError
+	FakeOpGetFsInodes = "GetFsInodes"
+	// FakeOpWriteFile is the WriteFile method, for SetError
+	FakeOpWriteFile = "WriteFile"
+	// FakeOpRemoveFile is the RemoveFile method, for SetError
+	FakeOpRemoveFile = "RemoveFile"
+)
+
 // FakeDirEntry contains a representation of a file under a directory
 type FakeDirEntry struct {
 	Name       string
@@ -176,6 +767,33 @@ type FakeDirEntry struct {
 	// Expected hash value of the PV name
 	Hash     uint32
 	Capacity int64
+	// Path that the entry is a symlink to, empty if not a symlink
+	SymlinkTarget string
+	// Filesystem type of file entries
+	FsType string
+	// Hardware identifier of block entries
+	DeviceID string
+	// True if the entry is a mount point
+	MountPoint bool
+	// True if the entry is on a read-only mount
+	ReadOnly bool
+	// Project quota limit of file entries, zero if they are not in a project
+	QuotaCapacity int64
+	// Backing file of file entries on a loop device, empty if they are not
+	LoopbackFile string
+	// Allocated bytes of the backing file of file entries on a loop device
+	LoopbackAllocated int64
+	// Modification time of the entry, zero is older than any minimum age
+	ModTime time.Time
+	// True if the entry is on a tmpfs
+	Tmpfs bool
+	// True if the block device entry is a whole disk with partitions
+	HasPartitions bool
+	// Contents of the file entry, for ReadFile
+	Content string
+	// Total and free inodes of the fs of the entry
+	Inodes     int64
+	FreeInodes int64
 }
 
 // NewFakeVolumeUtil returns a VolumeUtil object for use in unit testing
@@ -183,11 +801,37 @@ func NewFakeVolumeUtil(deleteShouldFail bool) *FakeVolumeUtil {
 	return &FakeVolumeUtil{
 		directoryFiles:   map[string][]*FakeDirEntry{},
 		deleteShouldFail: deleteShouldFail,
+		errors:           map[string]error{},
+		bindMounts:       map[string]string{},
+	}
+}
+
+// SetCapacityDelay makes GetFsCapacityByte and GetBlockCapacityByte take delay
+// This is only for testing
+func (u *FakeVolumeUtil) SetCapacityDelay(delay time.Duration) {
+	u.capacityDelay = delay
+}
+
+// SetError makes the method op fail with err for the given path, a nil err removes the error
+// This is only for testing
+func (u *FakeVolumeUtil) SetError(op, fullPath string, err error) {
+	if err == nil {
+		delete(u.errors, op+fullPath)
+		return
 	}
+	u.errors[op+fullPath] = err
+}
+
+// getError returns the error set with SetError for the method and path
+func (u *FakeVolumeUtil) getError(op, fullPath string) error {
+	return u.errors[op+fullPath]
 }
 
 // IsDir checks if the given path is a directory
 func (u *FakeVolumeUtil) IsDir(fullPath string) (bool, error) {
+	if err := u.getError(FakeOpIsDir, fullPath); err != nil {
+		return false, err
+	}
 	dir, file := filepath.Split(fullPath)
 	dir = filepath.Clean(dir)
 	files, found := u.directoryFiles[dir]
@@ -209,6 +853,9 @@ func (u *FakeVolumeUtil) IsDir(fullPath string) (bool, error) {
 
 // IsBlock checks if the given path is a block device
 func (u *FakeVolumeUtil) IsBlock(fullPath string) (bool, error) {
+	if err := u.getError(FakeOpIsBlock, fullPath); err != nil {
+		return false, err
+	}
 	dir, file := filepath.Split(fullPath)
 	dir = filepath.Clean(dir)
 	files, found := u.directoryFiles[dir]
@@ -218,18 +865,42 @@ func (u *FakeVolumeUtil) IsBlock(fullPath string) (bool, error) {
 
 	for _, f := range files {
 		if file == f.Name {
+			if f.SymlinkTarget != "" {
+				// Like stat, follow the symlink
+				return u.IsBlock(f.SymlinkTarget)
+			}
 			return f.VolumeType == FakeEntryBlock, nil
 		}
 	}
 	return false, fmt.Errorf("Directory entry %q not found", fullPath)
 }
 
+// IsMountPoint checks if the given entry is a mount point
+func (u *FakeVolumeUtil) IsMountPoint(fullPath string) (bool, error) {
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return false, fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			return f.MountPoint, nil
+		}
+	}
+	return false, fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
 // ReadDir returns the list of all files under the given directory
 func (u *FakeVolumeUtil) ReadDir(fullPath string) ([]string, error) {
+	if err := u.getError(FakeOpReadDir, fullPath); err != nil {
+		return nil, err
+	}
 	fileNames := []string{}
 	files, found := u.directoryFiles[fullPath]
 	if !found {
-		return nil, fmt.Errorf("Directory %q not found", fullPath)
+		return nil, &os.PathError{Op: "open", Path: fullPath, Err: os.ErrNotExist}
 	}
 	for _, file := range files {
 		fileNames = append(fileNames, file.Name)
@@ -237,6 +908,67 @@ func (u *FakeVolumeUtil) ReadDir(fullPath string) ([]string, error) {
 	return fileNames, nil
 }
 
+// CheckReadable checks that the given directory has a listing
+func (u *FakeVolumeUtil) CheckReadable(fullPath string) error {
+	if err := u.getError(FakeOpCheckReadable, fullPath); err != nil {
+		return err
+	}
+	if _, found := u.directoryFiles[fullPath]; !found {
+		return &os.PathError{Op: "open", Path: fullPath, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// Glob returns the sorted directories with listings that match the pattern
+func (u *FakeVolumeUtil) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	dirs := []string{}
+	for dir := range u.directoryFiles {
+		if matched, _ := filepath.Match(pattern, dir); matched {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// Exists checks if the given path is a directory or a directory entry
+func (u *FakeVolumeUtil) Exists(fullPath string) (bool, error) {
+	fullPath = u.resolveBindMount(fullPath)
+	if _, found := u.directoryFiles[fullPath]; found {
+		return true, nil
+	}
+	dir, file := filepath.Split(fullPath)
+	for _, f := range u.directoryFiles[filepath.Clean(dir)] {
+		if file == f.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// EvalSymlinks returns the symlink target of the given entry, or the path itself if it is not a symlink
+func (u *FakeVolumeUtil) EvalSymlinks(fullPath string) (string, error) {
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return "", fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			if f.SymlinkTarget == "" {
+				return fullPath, nil
+			}
+			return u.EvalSymlinks(f.SymlinkTarget)
+		}
+	}
+	return "", fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
 // DeleteContents removes all the contents under the given directory
 func (u *FakeVolumeUtil) DeleteContents(fullPath string) error {
 	if u.deleteShouldFail {
@@ -245,13 +977,290 @@ func (u *FakeVolumeUtil) DeleteContents(fullPath string) error {
 	return nil
 }
 
+// RemoveDir removes the given file entry from its directory, unless it has a listing
+// with entries
+func (u *FakeVolumeUtil) RemoveDir(fullPath string) error {
+	if err := u.getError(FakeOpRemoveDir, fullPath); err != nil {
+		return err
+	}
+	if len(u.directoryFiles[fullPath]) > 0 {
+		return &os.PathError{Op: "rmdir", Path: fullPath, Err: unix.ENOTEMPTY}
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files := u.directoryFiles[dir]
+	for i, f := range files {
+		if file != f.Name {
+			continue
+		}
+		if f.VolumeType != FakeEntryFile {
+			return &os.PathError{Op: "rmdir", Path: fullPath, Err: unix.ENOTDIR}
+		}
+		u.directoryFiles[dir] = append(files[:i:i], files[i+1:]...)
+		delete(u.directoryFiles, fullPath)
+		return nil
+	}
+	return &os.PathError{Op: "rmdir", Path: fullPath, Err: os.ErrNotExist}
+}
+
 // GetFsCapacityByte returns capacity in byte about a mounted filesystem.
 func (u *FakeVolumeUtil) GetFsCapacityByte(fullPath string) (int64, error) {
+	if err := u.getError(FakeOpGetFsCapacityByte, fullPath); err != nil {
+		return 0, err
+	}
+	time.Sleep(u.capacityDelay)
 	return u.getDirEntryCapacity(fullPath, FakeEntryFile)
 }
 
+// GetFsInodes returns the total and free inodes of the given file entry
+func (u *FakeVolumeUtil) GetFsInodes(fullPath string) (int64, int64, error) {
+	if err := u.getError(FakeOpGetFsInodes, fullPath); err != nil {
+		return 0, 0, err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return 0, 0, fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			return f.Inodes, f.FreeInodes, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// GetQuotaCapacityByte returns the project quota limit of the given file entry
+func (u *FakeVolumeUtil) GetQuotaCapacityByte(fullPath string) (int64, error) {
+	if err := u.getError(FakeOpGetQuotaCapacityByte, fullPath); err != nil {
+		return 0, err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return 0, fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			if f.VolumeType != FakeEntryFile {
+				return 0, fmt.Errorf("Directory entry %q is not a %q", f.Name, FakeEntryFile)
+			}
+			if f.QuotaCapacity == 0 {
+				return 0, fmt.Errorf("Directory entry %q is not in a project", f.Name)
+			}
+			return f.QuotaCapacity, nil
+		}
+	}
+	return 0, fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// GetLoopbackBackingFile returns the loopback file of the given file entry
+func (u *FakeVolumeUtil) GetLoopbackBackingFile(fullPath string) (string, error) {
+	dir, file := filepath.Split(fullPath)
+	for _, f := range u.directoryFiles[filepath.Clean(dir)] {
+		if file == f.Name {
+			return f.LoopbackFile, nil
+		}
+	}
+	return "", fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// GetAllocatedByte returns the allocated bytes of the entry with the given loopback file
+func (u *FakeVolumeUtil) GetAllocatedByte(fullPath string) (int64, error) {
+	if err := u.getError(FakeOpGetAllocatedByte, fullPath); err != nil {
+		return 0, err
+	}
+	for _, files := range u.directoryFiles {
+		for _, f := range files {
+			if f.LoopbackFile == fullPath {
+				return f.LoopbackAllocated, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Loopback file %q not found", fullPath)
+}
+
+// GetFsType returns the filesystem type of the given file entry
+func (u *FakeVolumeUtil) GetFsType(fullPath string) (string, error) {
+	if err := u.getError(FakeOpGetFsType, fullPath); err != nil {
+		return "", err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return "", fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			if f.VolumeType != FakeEntryFile {
+				return "", fmt.Errorf("Directory entry %q is not a %q", f.Name, FakeEntryFile)
+			}
+			return f.FsType, nil
+		}
+	}
+	return "", fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// GetModTime returns the modification time of the given entry
+func (u *FakeVolumeUtil) GetModTime(fullPath string) (time.Time, error) {
+	if err := u.getError(FakeOpGetModTime, fullPath); err != nil {
+		return time.Time{}, err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return time.Time{}, fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			return f.ModTime, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// ReadFile returns the content of the given file entry, a missing entry is an
+// os.ErrNotExist error like for real files
+func (u *FakeVolumeUtil) ReadFile(fullPath string) ([]byte, error) {
+	if err := u.getError(FakeOpReadFile, fullPath); err != nil {
+		return nil, err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	for _, f := range u.directoryFiles[dir] {
+		if file == f.Name {
+			return []byte(f.Content), nil
+		}
+	}
+	return nil, &os.PathError{Op: "open", Path: fullPath, Err: os.ErrNotExist}
+}
+
+// WriteFile adds a file entry with the contents, the directory must exist
+func (u *FakeVolumeUtil) WriteFile(fullPath string, data []byte) error {
+	if err := u.getError(FakeOpWriteFile, fullPath); err != nil {
+		return err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return &os.PathError{Op: "open", Path: fullPath, Err: os.ErrNotExist}
+	}
+	for _, f := range files {
+		if file == f.Name {
+			return &os.PathError{Op: "open", Path: fullPath, Err: os.ErrExist}
+		}
+	}
+	u.directoryFiles[dir] = append(files, &FakeDirEntry{Name: file, VolumeType: FakeEntryUnknown, Content: string(data)})
+	return nil
+}
+
+// RemoveFile removes the given entry, unless it is a directory
+func (u *FakeVolumeUtil) RemoveFile(fullPath string) error {
+	if err := u.getError(FakeOpRemoveFile, fullPath); err != nil {
+		return err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files := u.directoryFiles[dir]
+	for i, f := range files {
+		if file != f.Name {
+			continue
+		}
+		if f.VolumeType == FakeEntryFile {
+			return &os.PathError{Op: "unlink", Path: fullPath, Err: unix.EISDIR}
+		}
+		u.directoryFiles[dir] = append(files[:i:i], files[i+1:]...)
+		return nil
+	}
+	return &os.PathError{Op: "unlink", Path: fullPath, Err: os.ErrNotExist}
+}
+
+// AddBindMount makes the paths under source show the entries of the paths under target,
+// for Exists, e.g. to fake the host fs mounted in the container
+func (u *FakeVolumeUtil) AddBindMount(source, target string) {
+	u.bindMounts[filepath.Clean(source)] = filepath.Clean(target)
+}
+
+// resolveBindMount returns the path of the target of the bind mount that fullPath is
+// under, or fullPath itself
+func (u *FakeVolumeUtil) resolveBindMount(fullPath string) string {
+	for source, target := range u.bindMounts {
+		if fullPath == source || strings.HasPrefix(fullPath, source+string(filepath.Separator)) {
+			return target + strings.TrimPrefix(fullPath, source)
+		}
+	}
+	return fullPath
+}
+
+// IsReadOnly checks if the given file entry is on a read-only mount
+func (u *FakeVolumeUtil) IsReadOnly(fullPath string) (bool, error) {
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return false, fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			return f.ReadOnly, nil
+		}
+	}
+	return false, fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// HasPartitions checks if the given block device entry is a whole disk with partitions
+func (u *FakeVolumeUtil) HasPartitions(fullPath string) (bool, error) {
+	if err := u.getError(FakeOpHasPartitions, fullPath); err != nil {
+		return false, err
+	}
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return false, fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			return f.HasPartitions, nil
+		}
+	}
+	return false, fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// IsTmpfs checks if the given file entry is on a tmpfs
+func (u *FakeVolumeUtil) IsTmpfs(fullPath string) (bool, error) {
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return false, fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			return f.Tmpfs, nil
+		}
+	}
+	return false, fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
 // GetBlockCapacityByte returns the space in the specified block device.
 func (u *FakeVolumeUtil) GetBlockCapacityByte(fullPath string) (int64, error) {
+	if err := u.getError(FakeOpGetBlockCapacityByte, fullPath); err != nil {
+		return 0, err
+	}
+	time.Sleep(u.capacityDelay)
 	return u.getDirEntryCapacity(fullPath, FakeEntryBlock)
 }
 
@@ -265,8 +1274,11 @@ func (u *FakeVolumeUtil) getDirEntryCapacity(fullPath string, entryType string)
 
 	for _, f := range files {
 		if file == f.Name {
+			if f.SymlinkTarget != "" {
+				return u.getDirEntryCapacity(f.SymlinkTarget, entryType)
+			}
 			if f.VolumeType != entryType {
-				return 0, fmt.Errorf("Directory entry %q is not a %q", f, entryType)
+				return 0, fmt.Errorf("Directory entry %q is not a %q", f.Name, entryType)
 			}
 			return f.Capacity, nil
 		}
@@ -274,6 +1286,60 @@ func (u *FakeVolumeUtil) getDirEntryCapacity(fullPath string, entryType string)
 	return 0, fmt.Errorf("Directory entry %q not found", fullPath)
 }
 
+// WipeBlock wipes the given block entry
+func (u *FakeVolumeUtil) WipeBlock(ctx context.Context, fullPath string) error {
+	if u.deleteShouldFail {
+		return fmt.Errorf("Fake wipe block failed")
+	}
+	_, err := u.getDirEntryCapacity(fullPath, FakeEntryBlock)
+	return err
+}
+
+// ProbeHealth returns the error set for the given path, probes succeed by default
+func (u *FakeVolumeUtil) ProbeHealth(ctx context.Context, fullPath string) error {
+	return u.getError(FakeOpProbeHealth, fullPath)
+}
+
+// GetDeviceID returns the device ID of the given block entry
+func (u *FakeVolumeUtil) GetDeviceID(fullPath string) (string, error) {
+	dir, file := filepath.Split(fullPath)
+	dir = filepath.Clean(dir)
+	files, found := u.directoryFiles[dir]
+	if !found {
+		return "", fmt.Errorf("Directory %q not found", dir)
+	}
+
+	for _, f := range files {
+		if file == f.Name {
+			if f.SymlinkTarget != "" {
+				return u.GetDeviceID(f.SymlinkTarget)
+			}
+			if f.VolumeType != FakeEntryBlock {
+				return "", fmt.Errorf("Directory entry %q is not a %q", f.Name, FakeEntryBlock)
+			}
+			return f.DeviceID, nil
+		}
+	}
+	return "", fmt.Errorf("Directory entry %q not found", fullPath)
+}
+
+// SetDeviceID changes the device ID of the given block entry, e.g. to simulate a replaced disk
+// This is only for testing
+func (u *FakeVolumeUtil) SetDeviceID(fullPath, deviceID string) {
+	dir, file := filepath.Split(fullPath)
+	for _, f := range u.directoryFiles[filepath.Clean(dir)] {
+		if file == f.Name {
+			f.DeviceID = deviceID
+		}
+	}
+}
+
+// RemoveDirListing removes the listing of the given directory, e.g. to simulate an unmounted disk
+// This is only for testing
+func (u *FakeVolumeUtil) RemoveDirListing(fullPath string) {
+	delete(u.directoryFiles, fullPath)
+}
+
 // AddNewDirEntries adds the given files to the current directory listing
 // This is only for testing
 func (u *FakeVolumeUtil) AddNewDirEntries(mountDir string, dirFiles map[string][]*FakeDirEntry) {